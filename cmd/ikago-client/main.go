@@ -1,41 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
-	"ikago/internal/addr"
-	"ikago/internal/config"
-	"ikago/internal/crypto"
-	"ikago/internal/exec"
 	"ikago/internal/log"
-	"ikago/internal/pcap"
-	"ikago/internal/stat"
+	"ikago/pkg/client"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/stat"
 	"io"
-	"math"
-	"math/rand"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
-type natIndicator struct {
-	srcHardwareAddr net.HardwareAddr
-	conn            *pcap.RawConn
-}
-
 const name string = "IkaGo-client"
 
+// selfTestCount is the count of packets of each size echoed in self-tests.
+const selfTestCount = 10
+
+const (
+	// benchSize is the size of payloads in benchmarks.
+	benchSize = 1400
+	// benchDuration is the duration of each benchmark.
+	benchDuration = 500 * time.Millisecond
+)
+
 var (
 	version     = ""
 	build       = ""
@@ -46,18 +46,85 @@ type natIndicator struct {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argBench          = flag.Bool("bench", false, "Benchmark ciphers and serialization.")
+	argPing           = flag.Bool("ping", false, "Measure latency of the tunnel.")
+	argPingInterval   = flag.Int("ping-interval", 1000, "Interval of ping in milliseconds.")
+	argPingCount      = flag.Int("ping-count", 0, "Count of ping.")
+	argTest           = flag.Bool("test", false, "Test throughput of the tunnel.")
+	argTestSizes      = flag.String("test-sizes", "64,512,1400", "Sizes of packets in throughput test.")
+	argTestDuration   = flag.Int("test-duration", 5, "Duration of throughput test of each size in seconds.")
+	argDiagnose       = flag.Bool("diagnose", false, "Diagnose middleboxes on the path.")
+	argDoctor         = flag.Bool("doctor", false, "Check the environment.")
+	argSelfTest       = flag.Bool("self-test", false, "Test the build by a client and a server in memory.")
 	argConfig         = flag.String("c", "", "Configuration file.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
+	argGatewayMAC     = flag.String("gateway-mac", "", "Gateway hardware address.")
+	argMAC            = flag.String("mac", "", "Hardware address of upstream device.")
 	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
+	argTransforms     = flag.String("transforms", "encrypt", "Transforms in order.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
+	argLowMemory      = flag.Bool("low-memory", false, "Minimize memory usage.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argTrace          = flag.String("trace", "", "Filter of packets traced.")
+	argTraceHex       = flag.Bool("trace-hex", false, "Dump packets traced in hex.")
+	argErrorWindow    = flag.Int("error-window", 0, "Window of errors aggregated in seconds.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argHook           = flag.String("hook", "", "Webhook of events.")
+	argHookScript     = flag.String("hook-script", "", "Script of events.")
+	argHookEvents     = flag.String("hook-events", "", "Events notified by hooks.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argFragmentSize   = flag.Int("fragment-size", 0, "Size of fragments.")
+	argNoFragment     = flag.Bool("no-fragment", false, "Never fragment packets.")
+	argDefrag         = flag.String("defrag", "easy", "Mode of defragmentation.")
+	argDefragDeadline = flag.Int("defrag-deadline", 30, "Deadline of fragments in seconds.")
+	argDefragLimit    = flag.Int("defrag-limit", 4096, "Max count of flows of fragments in progress.")
+	argJitter         = flag.Int("jitter", 0, "Latency budget of timing obfuscation in milliseconds.")
+	argProfile        = flag.String("profile", "", "Traffic profile.")
+	argPriority       = flag.Int("priority", 0, "Max size of packets prioritized in bytes.")
+	argQoSRealtime    = flag.String("qos-realtime", "", "Rules of realtime traffic.")
+	argQoSRealtimeW   = flag.Int("qos-realtime-weight", 8, "Weight of realtime traffic.")
+	argQoSRealtimeR   = flag.Int("qos-realtime-rate", 0, "Max bandwidth of realtime traffic in bytes per second.")
+	argQoSNormal      = flag.String("qos-normal", "", "Rules of normal traffic.")
+	argQoSNormalW     = flag.Int("qos-normal-weight", 4, "Weight of normal traffic.")
+	argQoSNormalR     = flag.Int("qos-normal-rate", 0, "Max bandwidth of normal traffic in bytes per second.")
+	argQoSBulk        = flag.String("qos-bulk", "", "Rules of bulk traffic.")
+	argQoSBulkW       = flag.Int("qos-bulk-weight", 1, "Weight of bulk traffic.")
+	argQoSBulkR       = flag.Int("qos-bulk-rate", 0, "Max bandwidth of bulk traffic in bytes per second.")
+	argDSCP           = flag.String("dscp", "", "DSCP value of packets.")
+	argCopyTOS        = flag.Bool("copy-tos", false, "Copy DSCP and ECN of packets tunneled.")
+	argTTL            = flag.String("ttl", "", "TTL of packets.")
+	argProbe          = flag.Int("probe", 0, "Interval of latency probes in milliseconds.")
+	argFeedback       = flag.Int("feedback", 0, "Interval of delivery reports in milliseconds.")
+	argRekey          = flag.Int("rekey", 0, "Interval of rekeys in seconds.")
+	argCongestion     = flag.String("congestion", "", "Congestion control pacing writes.")
+	argAdaptive       = flag.String("adaptive", "", "Thresholds of loss in percent of adaptive duplication.")
+	argBlackhole      = flag.Bool("blackhole", false, "Detect MTU blackholes and fall back to smaller fragments.")
+	argChaff          = flag.Int("chaff", 0, "Max bandwidth of cover traffic in bytes per second.")
+	argCookie         = flag.String("cookie", "", "Secret of cookies in TCP SYN.")
+	argPreamble       = flag.String("preamble", "tagged", "Preamble of handshakes.")
+	argWireVersion    = flag.Int("wire-version", 0, "Version of the wire format.")
+	argTLS            = flag.Bool("tls", false, "Mimic TLS.")
+	argTLSSNI         = flag.String("tls-sni", "", "SNI in TLS ClientHello.")
+	argTLSALPN        = flag.String("tls-alpn", "h2,http/1.1", "ALPN in TLS ClientHello.")
+	argTyped          = flag.Bool("typed", false, "Frame packets with types.")
+	argLengthPrefix   = flag.Bool("length-prefix", false, "Prefix datagrams with lengths.")
+	argValidation     = flag.String("validation", "normal", "Validation of packets.")
+	argChecksum       = flag.Bool("checksum", false, "Verify checksums of packets in the tunnel.")
+	argTolerance      = flag.Int("tolerance", 0, "Count of packets failed to parse or decrypt in a row skipped in reads.")
+	argFilter         = flag.String("filter", "", "Extra BPF filter.")
+	argTunnel         = flag.String("tunnel", "", "Rules of traffic tunneled.")
+	argSFlow          = flag.String("sflow", "", "sFlow collector.")
+	argSFlowRate      = flag.Int("sflow-rate", 1000, "Sample 1 in every count of packets in sFlow.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of pcap handles in KB.")
+	argPcapSnapLen    = flag.Int("pcap-snaplen", 0, "Snap length of pcap handles.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Capture in immediate mode.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Read timeout of pcap handles in milliseconds.")
+	argBackend        = flag.String("backend", "pcap", "Backend of capturing.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -69,38 +136,22 @@ type natIndicator struct {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argImpairLoss     = flag.Float64("impair-loss", 0, "Percent of packets lost in impairment simulation.")
+	argImpairDelay    = flag.Int("impair-delay", 0, "Delay of packets in impairment simulation in milliseconds.")
+	argImpairJitter   = flag.Int("impair-jitter", 0, "Jitter of delay in impairment simulation in milliseconds.")
+	argImpairDup      = flag.Float64("impair-duplicate", 0, "Percent of packets duplicated in impairment simulation.")
+	argImpairReorder  = flag.Float64("impair-reorder", 0, "Percent of packets reordered in impairment simulation.")
 	argPublish        = flag.String("publish", "", "ARP publishing address.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
+	argPorts          = flag.Int("ports", 1, "Count of ports for routing upstream.")
+	argStripe         = flag.Bool("stripe", false, "Stripe packets among ports.")
+	argRotate         = flag.Int("rotate", 0, "Interval of rotating ports in seconds.")
+	argHop            = flag.Int("hop", 0, "Interval of port hopping in seconds.")
+	argHopPorts       = flag.String("hop-ports", "20000-40000", "Range of ports hopped.")
+	argState          = flag.String("state", "", "File the session is persisted in.")
 	argSources        = flag.String("r", "", "Sources.")
 	argServer         = flag.String("s", "", "Server.")
-)
-
-var (
-	publishIP  *net.IPAddr
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
-)
-
-var (
-	isClosed    bool
-	listenConns []*pcap.RawConn
-	upConn      net.Conn
-	c           chan pcap.ConnPacket
-	natLock     sync.RWMutex
-	nat         map[string]*natIndicator
-	monitor     *stat.TrafficMonitor
-	dnsLock     sync.RWMutex
-	dns         map[string]string
+	argApp            = flag.String("app", "", "Application profile.")
 )
 
 func init() {
@@ -134,21 +185,12 @@ func init() {
 			*argConfig = "config.json"
 		}
 	}
-
-	sources = make([]*net.IPAddr, 0)
-	listenDevs = make([]*pcap.Device, 0)
-
-	listenConns = make([]*pcap.RawConn, 0)
-	c = make(chan pcap.ConnPacket, 1000)
-	nat = make(map[string]*natIndicator)
-	dns = make(map[string]string)
 }
 
 func main() {
 	var (
-		err     error
-		cfg     *config.Config
-		gateway net.IP
+		err error
+		cfg *config.Config
 	)
 
 	// Configuration
@@ -163,14 +205,79 @@ func main() {
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
 		cfg.Gateway = *argGateway
+		cfg.GatewayMAC = *argGatewayMAC
+		cfg.MAC = *argMAC
 		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.Transforms = splitArg(*argTransforms)
 		cfg.Rule = *argRule
+		cfg.LowMemory = *argLowMemory
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.Trace = *argTrace
+		cfg.TraceHex = *argTraceHex
+		cfg.ErrorWindow = *argErrorWindow
 		cfg.Monitor = *argMonitor
+		cfg.HookConfig = *config.NewHookConfig()
+		cfg.HookConfig.URL = *argHook
+		cfg.HookConfig.Script = *argHookScript
+		cfg.HookConfig.Events = splitArg(*argHookEvents)
 		cfg.MTU = *argMTU
+		cfg.FragmentSize = *argFragmentSize
+		cfg.NoFragment = *argNoFragment
+		cfg.DefragConfig = *config.NewDefragConfig()
+		cfg.DefragConfig.Mode = *argDefrag
+		cfg.DefragConfig.Deadline = *argDefragDeadline
+		cfg.DefragConfig.Limit = *argDefragLimit
+		cfg.Jitter = *argJitter
+		cfg.Profile = *argProfile
+		cfg.Priority = *argPriority
+		cfg.QoSConfig = *config.NewQoSConfig()
+		cfg.QoSConfig.Realtime.Match = splitArg(*argQoSRealtime)
+		cfg.QoSConfig.Realtime.Weight = *argQoSRealtimeW
+		cfg.QoSConfig.Realtime.Rate = *argQoSRealtimeR
+		cfg.QoSConfig.Normal.Match = splitArg(*argQoSNormal)
+		cfg.QoSConfig.Normal.Weight = *argQoSNormalW
+		cfg.QoSConfig.Normal.Rate = *argQoSNormalR
+		cfg.QoSConfig.Bulk.Match = splitArg(*argQoSBulk)
+		cfg.QoSConfig.Bulk.Weight = *argQoSBulkW
+		cfg.QoSConfig.Bulk.Rate = *argQoSBulkR
+		cfg.DSCP = *argDSCP
+		cfg.CopyTOS = *argCopyTOS
+		cfg.TTL = *argTTL
+		cfg.Probe = *argProbe
+		cfg.Feedback = *argFeedback
+		cfg.Rekey = *argRekey
+		cfg.Congestion = *argCongestion
+		cfg.Adaptive, err = splitFloatArg(*argAdaptive)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse adaptive %s: %w", *argAdaptive, err))
+		}
+		cfg.Blackhole = *argBlackhole
+		cfg.Chaff = *argChaff
+		cfg.Cookie = *argCookie
+		cfg.Preamble = *argPreamble
+		cfg.WireVersion = *argWireVersion
+		cfg.TLSConfig = *config.NewTLSConfig()
+		cfg.TLSConfig.Enabled = *argTLS
+		cfg.TLSConfig.SNI = *argTLSSNI
+		cfg.TLSConfig.ALPN = splitArg(*argTLSALPN)
+		cfg.Typed = *argTyped
+		cfg.LengthPrefix = *argLengthPrefix
+		cfg.Validation = *argValidation
+		cfg.Checksum = *argChecksum
+		cfg.Tolerance = *argTolerance
+		cfg.Filter = *argFilter
+		cfg.Tunnel = splitArg(*argTunnel)
+		cfg.SFlowConfig = *config.NewSFlowConfig()
+		cfg.SFlowConfig.Collector = *argSFlow
+		cfg.SFlowConfig.Rate = *argSFlowRate
+		cfg.PcapConfig.Buffer = *argPcapBuffer
+		cfg.PcapConfig.SnapLen = *argPcapSnapLen
+		cfg.PcapConfig.Immediate = *argPcapImmediate
+		cfg.PcapConfig.Timeout = *argPcapTimeout
+		cfg.Backend = *argBackend
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -183,14 +290,28 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.ImpairmentConfig = *config.NewImpairmentConfig()
+		cfg.ImpairmentConfig.Loss = *argImpairLoss
+		cfg.ImpairmentConfig.Delay = *argImpairDelay
+		cfg.ImpairmentConfig.Jitter = *argImpairJitter
+		cfg.ImpairmentConfig.Duplicate = *argImpairDup
+		cfg.ImpairmentConfig.Reorder = *argImpairReorder
 		cfg.Publish = *argPublish
 		cfg.Port = *argUpPort
+		cfg.Ports = *argPorts
+		cfg.Stripe = *argStripe
+		cfg.Rotate = *argRotate
+		cfg.Hop = *argHop
+		cfg.HopPorts = *argHopPorts
+		cfg.State = *argState
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
+		cfg.App = *argApp
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	log.SetTrace(cfg.Trace != "")
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
@@ -198,6 +319,13 @@ func main() {
 	if cfg.Log != "" {
 		log.Infof("Save log to file %s\n", cfg.Log)
 	}
+	if cfg.ErrorWindow < 0 {
+		log.Fatalln(fmt.Errorf("error window %d out of range", cfg.ErrorWindow))
+	}
+	log.SetAggregation(time.Duration(cfg.ErrorWindow) * time.Second)
+	if cfg.ErrorWindow > 0 {
+		log.Infof("Aggregate errors every %d s\n", cfg.ErrorWindow)
+	}
 
 	// Check permission
 	switch runtime.GOOS {
@@ -233,162 +361,111 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Verify parameters
-	if len(cfg.Sources) <= 0 {
-		log.Fatalln("Please provide sources by -r addresses.")
-	}
-	if cfg.Server == "" {
-		log.Fatalln("Please provide server by -s address.")
-	}
-	if cfg.Gateway != "" {
-		gateway = net.ParseIP(cfg.Gateway)
-		if gateway == nil {
-			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
+	if *argBench {
+		err := bench()
+		if err != nil {
+			log.Fatalln(err)
 		}
+		os.Exit(0)
 	}
-	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
-		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
-	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		if cfg.MTU == 0 {
-			cfg.MTU = pcap.MaxMTU
-		} else {
-			log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+
+	if *argPing {
+		if cfg.Server == "" {
+			log.Fatalln("Please provide server by -s address.")
 		}
-	}
-	if cfg.KCPConfig.MTU > 1500 {
-		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
-	}
-	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
-	}
-	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow))
-	}
-	if cfg.KCPConfig.DataShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard))
-	}
-	if cfg.KCPConfig.ParityShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard))
-	}
-	if cfg.KCPConfig.Interval < 0 {
-		log.Fatalln(fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval))
-	}
-	if cfg.KCPConfig.Resend < 0 {
-		log.Fatalln(fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend))
-	}
-	if cfg.KCPConfig.NC < 0 {
-		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
-	}
-	if cfg.Port < 0 || cfg.Port > 65535 {
-		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
-	}
 
-	// Randomize upstream port
-	if cfg.Port == 0 {
-		s := rand.NewSource(time.Now().UnixNano())
-		for cfg.Port == 0 || cfg.Port == cfg.Monitor {
-			r := rand.New(s)
-			cfg.Port = 49152 + r.Intn(16384)
+		err := ping(cfg)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		os.Exit(0)
 	}
-	upPort = uint16(cfg.Port)
 
-	// Sources
-	for _, source := range cfg.Sources {
-		ip := net.ParseIP(source)
-		if ip == nil {
-			log.Fatalln(fmt.Errorf("invalid source %s", source))
+	if *argTest {
+		if cfg.Server == "" {
+			log.Fatalln("Please provide server by -s address.")
 		}
-		sources = append(sources, &net.IPAddr{IP: ip})
-	}
 
-	// Server
-	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
+		err := test(cfg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
 	}
-	serverIP = serverAddr.IP
-	serverPort = uint16(serverAddr.Port)
 
-	// Publish
-	if cfg.Publish != "" {
-		ip := net.ParseIP(cfg.Publish)
-		if ip == nil {
-			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
+	if *argDiagnose {
+		if cfg.Server == "" {
+			log.Fatalln("Please provide server by -s address.")
 		}
-		publishIP = &net.IPAddr{IP: ip}
-	}
-	if publishIP != nil {
-		log.Infof("Publish %s\n", publishIP.IP)
-	}
 
-	// Mode
-	switch cfg.Mode {
-	case "faketcp":
-		mode = "faketcp"
-		log.Infoln("Use FakeTCP")
-	case "tcp":
-		mode = "tcp"
-		log.Infoln("Use standard TCP")
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
+		err := diagnose(cfg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
 	}
 
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
-	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
-	}
+	if *argDoctor {
+		if cfg.Server == "" {
+			log.Fatalln("Please provide server by -s address.")
+		}
 
-	// Add firewall rule
-	if cfg.Rule {
-		err := exec.DisableIPForwarding()
+		err := doctor(cfg)
 		if err != nil {
-			log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
-		} else {
-			log.Infoln("Disable IP forwarding")
+			log.Fatalln(err)
 		}
+		os.Exit(0)
+	}
 
-		switch mode {
-		case "faketcp":
-			err = exec.AddSpecificFirewallRule(serverIP, serverPort)
-			if err != nil {
-				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
-			} else {
-				log.Infoln("Add firewall rule")
-			}
-		case "tcp":
-			break
-		default:
-			log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
+	if *argSelfTest {
+		err := selfTest(cfg)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		os.Exit(0)
 	}
 
-	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(upPort) {
-			log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
-		}
+	// Verify parameters
+	if len(cfg.Sources) <= 0 {
+		log.Fatalln("Please provide sources by -r addresses.")
+	}
+	if cfg.Server == "" {
+		log.Fatalln("Please provide server by -s address.")
+	}
 
-		monitor = stat.NewTrafficMonitor()
+	c, err := client.New(cfg)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("create client: %w", err))
+	}
 
+	// Monitor
+	if cfg.Monitor != 0 {
 		go func() {
 			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				stats := c.Stats()
+
 				b, err := json.Marshal(&struct {
-					Name    string               `json:"name"`
-					Version string               `json:"version"`
-					Time    int                  `json:"time"`
-					Monitor *stat.TrafficMonitor `json:"monitor"`
+					Name       string                 `json:"name"`
+					Version    string                 `json:"version"`
+					Time       int                    `json:"time"`
+					Monitor    *stat.TrafficMonitor   `json:"monitor"`
+					Fragments  *stat.FragmentMonitor  `json:"fragments"`
+					Rejections *stat.RejectionMonitor `json:"rejections"`
+					Malformed  *stat.MalformedMonitor `json:"malformed"`
+					Latency    *stat.LatencyMonitor   `json:"latency"`
+					Delivery   *stat.DeliveryMonitor  `json:"delivery"`
+					Errors     *log.ErrorAggregator   `json:"errors"`
 				}{
-					Name:    name,
-					Version: versionInfo,
-					Time:    int(time.Now().Sub(startTime).Seconds()),
-					Monitor: monitor,
+					Name:       name,
+					Version:    versionInfo,
+					Time:       int(time.Now().Sub(startTime).Seconds()),
+					Monitor:    stats.Monitor,
+					Fragments:  stats.Fragments,
+					Rejections: stats.Rejections,
+					Malformed:  stats.Malformed,
+					Latency:    stats.Latency,
+					Delivery:   stats.Delivery,
+					Errors:     stats.Errors,
 				})
 				if err != nil {
 					log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -411,14 +488,12 @@ type IPName struct {
 				}
 
 				ipNames := make([]IPName, 0)
-				dnsLock.RLock()
-				for ip, name := range dns {
+				for ip, name := range c.Names() {
 					ipNames = append(ipNames, IPName{
 						IP:   ip,
 						Name: name,
 					})
 				}
-				dnsLock.RUnlock()
 
 				b, err := json.Marshal(ipNames)
 				if err != nil {
@@ -445,452 +520,252 @@ type IPName struct {
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
-	// Mode-related options
-	switch mode {
-	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
-		if mtu != pcap.MaxMTU {
-			log.Infof("Set MTU to %d Bytes\n", mtu)
-		}
-
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
-		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
-	}
-
-	if len(sources) == 1 {
-		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
-	} else {
-		log.Infoln("Proxy:")
-		for i, f := range sources {
-			if i != len(sources)-1 {
-				log.Infof("  %s\n", f)
-			} else {
-				log.Infof("  %s through :%d to %s\n", f, upPort, serverAddr)
-			}
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		err := c.Stop()
+		if err != nil {
+			log.Errorln(fmt.Errorf("stop client: %w", err))
 		}
-	}
+	}()
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	// Open pcap
+	err = c.Start()
 	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
-	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
-
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
-		}
-
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
+		log.Fatalln(fmt.Errorf("open pcap: %w", err))
 	}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	err = c.Wait()
 	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
-	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
-	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
-	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
+		log.Fatalln(err)
 	}
+}
+
+func ping(cfg *config.Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Wait signals
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
-		closeAll()
-		os.Exit(0)
+		cancel()
 	}()
 
-	// Open pcap
-	err = open()
-	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
-	}
-}
-
-func open() error {
-	var err error
+	log.Infof("Ping server %s\n", cfg.Server)
 
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
+	stats, err := client.Ping(ctx, cfg, time.Duration(*argPingInterval)*time.Millisecond, *argPingCount, func(result *pcap.PingResult) {
+		if result.IsLost {
+			log.Infof("seq=%d lost  loss %.1f%%\n", result.Seq, result.Stats.Loss()*100)
+		} else {
+			log.Infof("seq=%d %.3f ms  loss %.1f%%  avg %.3f ms  best %.3f ms  worst %.3f ms  jitter %.3f ms\n",
+				result.Seq, toMillis(result.RTT), result.Stats.Loss()*100, toMillis(result.Stats.Average),
+				toMillis(result.Stats.Best), toMillis(result.Stats.Worst), toMillis(result.Stats.Jitter))
 		}
+	})
+	if stats != nil {
+		log.Infof("%d sent, %d received, %.1f%% loss, avg %.3f ms, best %.3f ms, worst %.3f ms, jitter %.3f ms\n",
+			stats.Sent, stats.Received, stats.Loss()*100, toMillis(stats.Average), toMillis(stats.Best),
+			toMillis(stats.Worst), toMillis(stats.Jitter))
 	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
+	if err != nil {
+		return fmt.Errorf("ping: %w", err)
 	}
 
-	// Filters for listening
-	fs := make([]string, 0)
-	for _, f := range sources {
-		s, err := addr.SrcBPFFilter(f)
-		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
-		}
+	return nil
+}
 
-		fs = append(fs, s)
-	}
-	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
-	if publishIP != nil {
-		s, err := addr.DstBPFFilter(publishIP)
+func test(cfg *config.Config) error {
+	sizes := make([]int, 0)
+	for _, s := range splitArg(*argTestSizes) {
+		size, err := strconv.Atoi(s)
 		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
+			return fmt.Errorf("parse size %s: %w", s, err)
 		}
-		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
+		sizes = append(sizes, size)
 	}
 
-	// Handles for listening
-	for _, dev := range listenDevs {
-		var (
-			err  error
-			conn *pcap.RawConn
-		)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		if dev.IsLoop() {
-			conn, err = pcap.CreateRawConn(dev, dev, filter)
-		} else {
-			conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
-		}
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-		listenConns = append(listenConns, conn)
-	}
+	log.Infof("Test throughput to server %s\n", cfg.Server)
 
-	// Handle for routing upstream
-	switch mode {
-	case "faketcp":
-		if isKCP {
-			upConn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, kcpConfig)
-		} else {
-			upConn, err = pcap.DialFakeTCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu)
-		}
-	case "tcp":
-		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
-	default:
-		err = fmt.Errorf("mode %s not support", mode)
-	}
+	err := client.Test(ctx, cfg, sizes, time.Duration(*argTestDuration)*time.Second, func(result *client.TestResult) {
+		log.Infof("%5d Bytes  %.2f Mbps  %d/%d packets  loss %.1f%%  CPU %.1f%%\n", result.Size,
+			result.Throughput()*8/1000000, result.Received, result.Sent, result.Loss()*100, result.CPUUsage()*100)
+	})
 	if err != nil {
-		return fmt.Errorf("open upstream: %w", err)
+		return fmt.Errorf("test: %w", err)
 	}
 
-	// Start handling
-	for i := 0; i < len(listenConns); i++ {
-		conn := listenConns[i]
-
-		go func() {
-			for {
-				packet, err := conn.ReadPacket()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
-					continue
-				}
+	return nil
+}
 
-				c <- pcap.ConnPacket{Packet: packet, Conn: conn}
-			}
-		}()
-	}
+func diagnose(cfg *config.Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		for cp := range c {
-			err := handleListen(cp.Packet, cp.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
-				log.Verboseln(cp.Packet)
-				continue
-			}
-		}
+		<-sig
+		cancel()
 	}()
 
-	b := make([]byte, pcap.IPv4MaxSize)
-	for {
-		n, err := upConn.Read(b)
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			if errors.Is(err, io.EOF) {
-				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", upConn.RemoteAddr())
-			}
-			log.Errorln(fmt.Errorf("read upstream: %w", err))
-			continue
-		}
-
-		err = handleUpstream(b[:n])
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
-			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
-			continue
-		}
-	}
-}
+	log.Infof("Diagnose path to server %s\n", cfg.Server)
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listenConns {
-		if handle != nil {
-			handle.Close()
+	failed := 0
+	err := client.Diagnose(ctx, cfg, func(finding *pcap.Finding) {
+		if finding.Passed {
+			log.Infof("PASS  %-20s %s\n", finding.Probe, finding.Detail)
+		} else {
+			failed++
+			log.Infof("FAIL  %-20s %s, %s\n", finding.Probe, finding.Detail, finding.Hint)
 		}
-	}
-	if upConn != nil {
-		upConn.Close()
-	}
-}
-
-func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
-	var (
-		indicator    *pcap.PacketIndicator
-		arpLayer     *layers.ARP
-		newARPLayer  *layers.ARP
-		linkLayer    gopacket.Layer
-		newLinkLayer *layers.Ethernet
-	)
-
-	// Parse packet
-	indicator, err := pcap.ParsePacket(packet)
+	})
 	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
-		return fmt.Errorf("network layer type %s not support", t)
+		return fmt.Errorf("diagnose: %w", err)
 	}
-
-	// Create new ARP layer
-	arpLayer = indicator.ARPLayer()
-	newARPLayer = &layers.ARP{
-		AddrType:          arpLayer.AddrType,
-		Protocol:          arpLayer.Protocol,
-		HwAddressSize:     arpLayer.HwAddressSize,
-		ProtAddressSize:   arpLayer.ProtAddressSize,
-		Operation:         layers.ARPReply,
-		SourceHwAddress:   conn.LocalDev().HardwareAddr(),
-		SourceProtAddress: arpLayer.DstProtAddress,
-		DstHwAddress:      arpLayer.SourceHwAddress,
-		DstProtAddress:    arpLayer.SourceProtAddress,
+	if failed > 0 {
+		log.Infof("%d findings of middleboxes\n", failed)
+	} else {
+		log.Infoln("No middlebox interference found")
 	}
 
-	// Create new link layer
-	linkLayer = packet.LinkLayer()
-
-	switch t := linkLayer.LayerType(); t {
-	case layers.LayerTypeEthernet:
-		newLinkLayer = &layers.Ethernet{
-			SrcMAC:       conn.LocalDev().HardwareAddr(),
-			DstMAC:       linkLayer.(*layers.Ethernet).SrcMAC,
-			EthernetType: linkLayer.(*layers.Ethernet).EthernetType,
-		}
-	default:
-		return fmt.Errorf("link layer type %s not support", t)
-	}
+	return nil
+}
 
-	// Serialize layers
-	data, err := pcap.Serialize(newLinkLayer, newARPLayer)
-	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
-	}
+func doctor(cfg *config.Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Write packet data
-	_, err = conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
-	}
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-	// Reconnect
-	if upConn != nil {
-		switch upConn.(type) {
-		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
-		default:
-			break
+	failed := 0
+	err := client.Doctor(ctx, cfg, func(check *client.Check) {
+		if check.Passed {
+			log.Infof("PASS  %-14s %s\n", check.Name, check.Detail)
+		} else {
+			failed++
+			log.Infof("FAIL  %-14s %s, %s\n", check.Name, check.Detail, check.Hint)
 		}
-	}
+	})
 	if err != nil {
-		return fmt.Errorf("reconnect: %w", err)
+		return fmt.Errorf("doctor: %w", err)
 	}
-
-	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
-	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	log.Infoln("All checks passed")
 
 	return nil
 }
 
-func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
-	var (
-		hardwareAddr net.HardwareAddr
-		data         []byte
-	)
-
-	// Parse packet
-	indicator, err := pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	// ARP
-	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
-		err := publish(packet, conn)
+func selfTest(cfg *config.Config) error {
+	sizes := make([]int, 0)
+	for _, s := range splitArg(*argTestSizes) {
+		size, err := strconv.Atoi(s)
 		if err != nil {
-			return fmt.Errorf("publish: %w", err)
+			return fmt.Errorf("parse size %s: %w", s, err)
 		}
-		return nil
+		sizes = append(sizes, size)
 	}
 
-	// Record source hardware address
-	hardwareAddr = indicator.SrcHardwareAddr()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	data = make([]byte, 0)
-	data = append(data, packet.NetworkLayer().LayerContents()...)
-	data = append(data, packet.NetworkLayer().LayerPayload()...)
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-	// Write packet data
-	_, err = upConn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
-	}
+	log.Infoln("Self-test in memory")
 
-	// Record the connection of the packet
-	ni, ok := nat[indicator.SrcIP().String()]
-	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
-		natLock.Lock()
-		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
-		natLock.Unlock()
+	result, err := client.SelfTest(ctx, cfg, sizes, selfTestCount)
+	if err != nil {
+		return err
 	}
-
-	// Statistics
-	size := indicator.MTU()
-	if monitor != nil {
-		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	log.Infof("%d sent, %d received, %d corrupted in %.3f ms\n", result.Sent, result.Received, result.Corrupted,
+		toMillis(result.Duration))
+	if !result.IsPassed() {
+		return errors.New("self-test failed")
 	}
-
-	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
-		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+	log.Infoln("Self-test passed")
 
 	return nil
 }
 
-func handleUpstream(contents []byte) error {
-	var (
-		embIndicator     *pcap.PacketIndicator
-		newLinkLayer     gopacket.Layer
-		newLinkLayerType gopacket.LayerType
-		data             []byte
-	)
-
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
-	}
-
-	// Parse embedded packet
-	embIndicator, err := pcap.ParseEmbPacket(contents)
-	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
-	}
+func toMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
 
-	// Check map
-	natLock.RLock()
-	ni, ok := nat[embIndicator.DstIP().String()]
-	natLock.RUnlock()
-	if !ok {
-		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
-	}
+func bench() error {
+	log.Infof("Benchmark in %d Bytes on %s/%s with %d CPUs\n", benchSize, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
 
-	// Decide Loopback or Ethernet
-	if ni.conn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
-	}
+	results := make([]*crypto.BenchResult, 0)
+	for _, method := range crypto.Methods() {
+		result, err := crypto.Bench(method, benchSize, benchDuration)
+		if err != nil {
+			return fmt.Errorf("bench %s: %w", method, err)
+		}
+		results = append(results, result)
 
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer = pcap.CreateLoopbackLayer()
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
+		log.Infof("  %-20s encrypt %9.1f Mbps, decrypt %9.1f Mbps\n", result.Method, toMbps(result.Encrypt),
+			toMbps(result.Decrypt))
 	}
 
-	// Serialize layers
-	data, err = pcap.SerializeRaw(newLinkLayer.(gopacket.SerializableLayer),
-		gopacket.Payload(embIndicator.NetworkLayer().LayerContents()),
-		gopacket.Payload(embIndicator.NetworkPayload()))
+	result, err := pcap.Bench(benchSize, pcap.MaxMTU, benchDuration)
 	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
+		return fmt.Errorf("bench serialization: %w", err)
 	}
+	log.Infof("  %-20s serialize %7.1f Mbps, parse %11.1f Mbps\n", "faketcp", toMbps(result.Serialize),
+		toMbps(result.Parse))
 
-	// Write packet data
-	_, err = ni.conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	// Recommend
+	best := crypto.Recommend(results)
+	if best == nil {
+		return nil
 	}
+	log.Infof("Prefer -method %s on this computer, which is the fastest authenticated encryption\n", best.Method)
 
-	// Statistics
-	if monitor != nil {
-		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
+	serialization := result.Serialize
+	if result.Parse < serialization {
+		serialization = result.Parse
 	}
-
-	// Record DNS
-	if embIndicator.DNSIndicator() != nil {
-		if embIndicator.DNSIndicator().IsResponse() {
-			name, ips := embIndicator.DNSIndicator().Answers()
-			if name != "" && len(ips) > 0 {
-				dnsLock.Lock()
-				for _, ip := range ips {
-					dns[ip.String()] = name
-					log.Verbosef("Record DNS record %s = %s\n", name, ip)
-				}
-				dnsLock.Unlock()
-			}
-		}
+	if best.Throughput() < serialization {
+		log.Infof("Encryption bounds the tunnel to about %.1f Mbps per core\n", toMbps(best.Throughput()))
+	} else {
+		log.Infof("Serialization bounds the tunnel to about %.1f Mbps per core\n", toMbps(serialization))
 	}
 
-	log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
-		embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
-
 	return nil
 }
 
+func toMbps(bps float64) float64 {
+	return bps * 8 / 1000000
+}
+
 func splitArg(s string) []string {
 	if s == "" {
 		return nil
@@ -906,3 +781,17 @@ func splitArg(s string) []string {
 
 	return result
 }
+
+func splitFloatArg(s string) ([]float64, error) {
+	result := make([]float64, 0)
+
+	for _, str := range splitArg(s) {
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+
+	return result, nil
+}
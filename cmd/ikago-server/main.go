@@ -1,64 +1,38 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
-	"ikago/internal/addr"
-	"ikago/internal/config"
-	"ikago/internal/crypto"
-	"ikago/internal/exec"
 	"ikago/internal/log"
-	"ikago/internal/pcap"
-	"ikago/internal/stat"
+	"ikago/internal/quota"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/server"
+	"ikago/pkg/stat"
 	"io"
-	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
-type quintuple struct {
-	src      string
-	dst      string
-	protocol gopacket.LayerType
-}
-
-type natIndicator struct {
-	src    net.Addr
-	embSrc net.Addr
-	conn   net.Conn
-}
-
-func (indicator *natIndicator) embSrcIP() net.IP {
-	switch t := indicator.embSrc.(type) {
-	case *net.IPAddr:
-		return indicator.embSrc.(*net.IPAddr).IP
-	case *net.TCPAddr:
-		return indicator.embSrc.(*net.TCPAddr).IP
-	case *net.UDPAddr:
-		return indicator.embSrc.(*net.UDPAddr).IP
-	case *addr.ICMPQueryAddr:
-		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
-	default:
-		panic(fmt.Errorf("type %T not support", t))
-	}
-}
-
 const name string = "IkaGo-server"
 
-const keepAlive = 30 * time.Second
-const keepFragments = 30 * time.Second
+const (
+	// benchSize is the size of payloads in benchmarks.
+	benchSize = 1400
+	// benchDuration is the duration of each benchmark.
+	benchDuration = 500 * time.Millisecond
+)
 
 var (
 	version     = ""
@@ -70,18 +44,91 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argBench          = flag.Bool("bench", false, "Benchmark ciphers and serialization.")
 	argConfig         = flag.String("c", "", "Configuration file.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
+	argGatewayMAC     = flag.String("gateway-mac", "", "Gateway hardware address.")
+	argMAC            = flag.String("mac", "", "Hardware address of upstream device.")
 	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
+	argOldPassword    = flag.String("old-password", "", "Old password still accepted in rotation.")
+	argGrace          = flag.Int("grace", 0, "Seconds the old password is retired after.")
+	argTransforms     = flag.String("transforms", "encrypt", "Transforms in order.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
+	argLowMemory      = flag.Bool("low-memory", false, "Minimize memory usage.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argTrace          = flag.String("trace", "", "Filter of packets traced.")
+	argTraceHex       = flag.Bool("trace-hex", false, "Dump packets traced in hex.")
+	argErrorWindow    = flag.Int("error-window", 0, "Window of errors aggregated in seconds.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argHook           = flag.String("hook", "", "Webhook of events.")
+	argHookScript     = flag.String("hook-script", "", "Script of events.")
+	argHookEvents     = flag.String("hook-events", "", "Events notified by hooks.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argFragmentSize   = flag.Int("fragment-size", 0, "Size of fragments.")
+	argNoFragment     = flag.Bool("no-fragment", false, "Never fragment packets.")
+	argDefrag         = flag.String("defrag", "easy", "Mode of defragmentation.")
+	argDefragDeadline = flag.Int("defrag-deadline", 30, "Deadline of fragments in seconds.")
+	argDefragLimit    = flag.Int("defrag-limit", 4096, "Max count of flows of fragments in progress.")
+	argJitter         = flag.Int("jitter", 0, "Latency budget of timing obfuscation in milliseconds.")
+	argProfile        = flag.String("profile", "", "Traffic profile.")
+	argPriority       = flag.Int("priority", 0, "Max size of packets prioritized in bytes.")
+	argQoSRealtime    = flag.String("qos-realtime", "", "Rules of realtime traffic.")
+	argQoSRealtimeW   = flag.Int("qos-realtime-weight", 8, "Weight of realtime traffic.")
+	argQoSRealtimeR   = flag.Int("qos-realtime-rate", 0, "Max bandwidth of realtime traffic in bytes per second.")
+	argQoSNormal      = flag.String("qos-normal", "", "Rules of normal traffic.")
+	argQoSNormalW     = flag.Int("qos-normal-weight", 4, "Weight of normal traffic.")
+	argQoSNormalR     = flag.Int("qos-normal-rate", 0, "Max bandwidth of normal traffic in bytes per second.")
+	argQoSBulk        = flag.String("qos-bulk", "", "Rules of bulk traffic.")
+	argQoSBulkW       = flag.Int("qos-bulk-weight", 1, "Weight of bulk traffic.")
+	argQoSBulkR       = flag.Int("qos-bulk-rate", 0, "Max bandwidth of bulk traffic in bytes per second.")
+	argDSCP           = flag.String("dscp", "", "DSCP value of packets.")
+	argCopyTOS        = flag.Bool("copy-tos", false, "Copy DSCP and ECN of packets tunneled.")
+	argTTL            = flag.String("ttl", "", "TTL of packets.")
+	argDecrementTTL   = flag.Bool("decrement-ttl", false, "Decrement TTL of packets tunneled.")
+	argProbe          = flag.Int("probe", 0, "Interval of latency probes in milliseconds.")
+	argFeedback       = flag.Int("feedback", 0, "Interval of delivery reports in milliseconds.")
+	argCongestion     = flag.String("congestion", "", "Congestion control pacing writes.")
+	argAdaptive       = flag.String("adaptive", "", "Thresholds of loss in percent of adaptive duplication.")
+	argBlackhole      = flag.Bool("blackhole", false, "Detect MTU blackholes and fall back to smaller fragments.")
+	argChaff          = flag.Int("chaff", 0, "Max bandwidth of cover traffic in bytes per second.")
+	argCookie         = flag.String("cookie", "", "Secret of cookies in TCP SYN.")
+	argPreamble       = flag.String("preamble", "tagged", "Preamble of handshakes.")
+	argWireVersion    = flag.Int("wire-version", 0, "Version of the wire format.")
+	argTLS            = flag.Bool("tls", false, "Mimic TLS.")
+	argTyped          = flag.Bool("typed", false, "Frame packets with types.")
+	argLengthPrefix   = flag.Bool("length-prefix", false, "Prefix datagrams with lengths.")
+	argValidation     = flag.String("validation", "normal", "Validation of packets.")
+	argChecksum       = flag.Bool("checksum", false, "Verify checksums of packets in the tunnel.")
+	argTolerance      = flag.Int("tolerance", 0, "Count of packets failed to parse or decrypt in a row skipped in reads.")
+	argFilter         = flag.String("filter", "", "Extra BPF filter.")
+	argTunnel         = flag.String("tunnel", "", "Rules of traffic tunneled.")
+	argSFlow          = flag.String("sflow", "", "sFlow collector.")
+	argSFlowRate      = flag.Int("sflow-rate", 1000, "Sample 1 in every count of packets in sFlow.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of pcap handles in KB.")
+	argPcapSnapLen    = flag.Int("pcap-snaplen", 0, "Snap length of pcap handles.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Capture in immediate mode.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Read timeout of pcap handles in milliseconds.")
+	argBackend        = flag.String("backend", "pcap", "Backend of capturing.")
+	argStealth        = flag.Bool("stealth", false, "Never respond to clients without proof.")
+	argQuotaDaily     = flag.Int("quota-daily", 0, "Daily quota of each client in MB.")
+	argQuotaMonthly   = flag.Int("quota-monthly", 0, "Monthly quota of each client in MB.")
+	argQuotaAction    = flag.String("quota-action", "throttle", "Action on clients exceeding quota.")
+	argQuotaThrottle  = flag.Int("quota-throttle", 16384, "Throttle of clients exceeding quota in bytes per second.")
+	argQuotaFile      = flag.String("quota-file", "", "File persisting usages of quota.")
+	argMaxClients     = flag.Int("max-clients", 0, "Max count of clients connected simultaneously.")
+	argRefuse         = flag.String("refuse", "ignore", "Action on clients over the max.")
+	argBanFile        = flag.String("ban-file", "", "File persisting bans.")
+	argScheduleAllow  = flag.String("schedule-allow", "", "Time windows clients are allowed in.")
+	argScheduleDeny   = flag.String("schedule-deny", "", "Time windows clients are refused in.")
+	argAdminToken     = flag.String("admin-token", "", "Token of admin interface.")
+	argHandover       = flag.String("handover", "", "Unix socket handing over clients to new processes.")
+	argMirror         = flag.String("mirror", "", "Device or pcap file mirroring packets tunneled.")
+	argMirrorSample   = flag.Int("mirror-sample", 1, "Mirror 1 in every count of packets.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -93,39 +140,15 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argImpairLoss     = flag.Float64("impair-loss", 0, "Percent of packets lost in impairment simulation.")
+	argImpairDelay    = flag.Int("impair-delay", 0, "Delay of packets in impairment simulation in milliseconds.")
+	argImpairJitter   = flag.Int("impair-jitter", 0, "Jitter of delay in impairment simulation in milliseconds.")
+	argImpairDup      = flag.Float64("impair-duplicate", 0, "Percent of packets duplicated in impairment simulation.")
+	argImpairReorder  = flag.Float64("impair-reorder", 0, "Percent of packets reordered in impairment simulation.")
 	argPort           = flag.Int("p", 0, "Port for listening.")
-)
-
-var (
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
-)
-
-var (
-	isClosed     bool
-	listeners    []net.Listener
-	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
-	defrag       *pcap.EasyDefragmenter
-	nextTCPPort  uint16
-	tcpPortPool  []time.Time
-	nextUDPPort  uint16
-	udpPortPool  []time.Time
-	nextICMPv4Id uint16
-	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
-	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
-	monitor      *stat.TrafficMonitor
-	dnsLock      sync.RWMutex
-	dns          map[string]string
+	argListenPorts    = flag.String("listen-ports", "", "Extra ports for listening.")
+	argHop            = flag.Int("hop", 0, "Interval of port hopping in seconds.")
+	argHopPorts       = flag.String("hop-ports", "20000-40000", "Range of ports hopped.")
 )
 
 func init() {
@@ -160,25 +183,12 @@ func init() {
 		}
 	}
 
-	listenDevs = make([]*pcap.Device, 0)
-
-	listeners = make([]net.Listener, 0)
-	c = make(chan pcap.ConnBytes, 1000)
-	defrag = pcap.NewEasyDefragmenter()
-	defrag.SetDeadline(keepFragments)
-	tcpPortPool = make([]time.Time, 16384)
-	udpPortPool = make([]time.Time, 16384)
-	icmpv4IdPool = make([]time.Time, 65536)
-	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
-	dns = make(map[string]string)
 }
 
 func main() {
 	var (
-		err     error
-		cfg     *config.Config
-		gateway net.IP
+		err error
+		cfg *config.Config
 	)
 
 	// Configuration file
@@ -193,14 +203,98 @@ func main() {
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
 		cfg.Gateway = *argGateway
+		cfg.GatewayMAC = *argGatewayMAC
+		cfg.MAC = *argMAC
 		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.RotationConfig = *config.NewRotationConfig()
+		cfg.RotationConfig.Password = *argOldPassword
+		cfg.RotationConfig.Grace = *argGrace
+		cfg.Transforms = splitArg(*argTransforms)
 		cfg.Rule = *argRule
+		cfg.LowMemory = *argLowMemory
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.Trace = *argTrace
+		cfg.TraceHex = *argTraceHex
+		cfg.ErrorWindow = *argErrorWindow
 		cfg.Monitor = *argMonitor
+		cfg.HookConfig = *config.NewHookConfig()
+		cfg.HookConfig.URL = *argHook
+		cfg.HookConfig.Script = *argHookScript
+		cfg.HookConfig.Events = splitArg(*argHookEvents)
 		cfg.MTU = *argMTU
+		cfg.FragmentSize = *argFragmentSize
+		cfg.NoFragment = *argNoFragment
+		cfg.DefragConfig = *config.NewDefragConfig()
+		cfg.DefragConfig.Mode = *argDefrag
+		cfg.DefragConfig.Deadline = *argDefragDeadline
+		cfg.DefragConfig.Limit = *argDefragLimit
+		cfg.Jitter = *argJitter
+		cfg.Profile = *argProfile
+		cfg.Priority = *argPriority
+		cfg.QoSConfig = *config.NewQoSConfig()
+		cfg.QoSConfig.Realtime.Match = splitArg(*argQoSRealtime)
+		cfg.QoSConfig.Realtime.Weight = *argQoSRealtimeW
+		cfg.QoSConfig.Realtime.Rate = *argQoSRealtimeR
+		cfg.QoSConfig.Normal.Match = splitArg(*argQoSNormal)
+		cfg.QoSConfig.Normal.Weight = *argQoSNormalW
+		cfg.QoSConfig.Normal.Rate = *argQoSNormalR
+		cfg.QoSConfig.Bulk.Match = splitArg(*argQoSBulk)
+		cfg.QoSConfig.Bulk.Weight = *argQoSBulkW
+		cfg.QoSConfig.Bulk.Rate = *argQoSBulkR
+		cfg.DSCP = *argDSCP
+		cfg.CopyTOS = *argCopyTOS
+		cfg.TTL = *argTTL
+		cfg.DecrementTTL = *argDecrementTTL
+		cfg.Probe = *argProbe
+		cfg.Feedback = *argFeedback
+		cfg.Congestion = *argCongestion
+		cfg.Adaptive, err = splitFloatArg(*argAdaptive)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse adaptive %s: %w", *argAdaptive, err))
+		}
+		cfg.Blackhole = *argBlackhole
+		cfg.Chaff = *argChaff
+		cfg.Cookie = *argCookie
+		cfg.Preamble = *argPreamble
+		cfg.WireVersion = *argWireVersion
+		cfg.TLSConfig = *config.NewTLSConfig()
+		cfg.TLSConfig.Enabled = *argTLS
+		cfg.Typed = *argTyped
+		cfg.LengthPrefix = *argLengthPrefix
+		cfg.Validation = *argValidation
+		cfg.Checksum = *argChecksum
+		cfg.Tolerance = *argTolerance
+		cfg.Filter = *argFilter
+		cfg.Tunnel = splitArg(*argTunnel)
+		cfg.SFlowConfig = *config.NewSFlowConfig()
+		cfg.SFlowConfig.Collector = *argSFlow
+		cfg.SFlowConfig.Rate = *argSFlowRate
+		cfg.PcapConfig.Buffer = *argPcapBuffer
+		cfg.PcapConfig.SnapLen = *argPcapSnapLen
+		cfg.PcapConfig.Immediate = *argPcapImmediate
+		cfg.PcapConfig.Timeout = *argPcapTimeout
+		cfg.Backend = *argBackend
+		cfg.Stealth = *argStealth
+		cfg.QuotaConfig = *config.NewQuotaConfig()
+		cfg.QuotaConfig.Daily = *argQuotaDaily
+		cfg.QuotaConfig.Monthly = *argQuotaMonthly
+		cfg.QuotaConfig.Action = *argQuotaAction
+		cfg.QuotaConfig.Throttle = *argQuotaThrottle
+		cfg.QuotaConfig.File = *argQuotaFile
+		cfg.MaxClients = *argMaxClients
+		cfg.Refuse = *argRefuse
+		cfg.BanFile = *argBanFile
+		cfg.ScheduleConfig = *config.NewScheduleConfig()
+		cfg.ScheduleConfig.Allow = splitArg(*argScheduleAllow)
+		cfg.ScheduleConfig.Deny = splitArg(*argScheduleDeny)
+		cfg.AdminToken = *argAdminToken
+		cfg.Handover = *argHandover
+		cfg.MirrorConfig = *config.NewMirrorConfig()
+		cfg.MirrorConfig.Target = *argMirror
+		cfg.MirrorConfig.Sample = *argMirrorSample
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -213,11 +307,24 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.ImpairmentConfig = *config.NewImpairmentConfig()
+		cfg.ImpairmentConfig.Loss = *argImpairLoss
+		cfg.ImpairmentConfig.Delay = *argImpairDelay
+		cfg.ImpairmentConfig.Jitter = *argImpairJitter
+		cfg.ImpairmentConfig.Duplicate = *argImpairDup
+		cfg.ImpairmentConfig.Reorder = *argImpairReorder
 		cfg.Port = *argPort
+		cfg.ListenPorts, err = splitIntArg(*argListenPorts)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse listen ports %s: %w", *argListenPorts, err))
+		}
+		cfg.Hop = *argHop
+		cfg.HopPorts = *argHopPorts
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	log.SetTrace(cfg.Trace != "")
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
@@ -225,6 +332,13 @@ func main() {
 	if cfg.Log != "" {
 		log.Infof("Save log to file %s\n", cfg.Log)
 	}
+	if cfg.ErrorWindow < 0 {
+		log.Fatalln(fmt.Errorf("error window %d out of range", cfg.ErrorWindow))
+	}
+	log.SetAggregation(time.Duration(cfg.ErrorWindow) * time.Second)
+	if cfg.ErrorWindow > 0 {
+		log.Infof("Aggregate errors every %d s\n", cfg.ErrorWindow)
+	}
 
 	// Check permission
 	switch runtime.GOOS {
@@ -260,116 +374,56 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Verify parameters
-	if cfg.Port == 0 {
-		log.Fatalln("Please provide listen port by -p port.")
-	}
-	if cfg.Gateway != "" {
-		gateway = net.ParseIP(cfg.Gateway)
-		if gateway == nil {
-			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
-		}
-	}
-	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
-		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
-	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		if cfg.MTU == 0 {
-			cfg.MTU = pcap.MaxMTU
-		} else {
-			log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+	if *argBench {
+		err := bench()
+		if err != nil {
+			log.Fatalln(err)
 		}
-	}
-	if cfg.KCPConfig.MTU > 1500 {
-		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
-	}
-	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
-	}
-	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow))
-	}
-	if cfg.KCPConfig.DataShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard))
-	}
-	if cfg.KCPConfig.ParityShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard))
-	}
-	if cfg.KCPConfig.Interval < 0 {
-		log.Fatalln(fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval))
-	}
-	if cfg.KCPConfig.Resend < 0 {
-		log.Fatalln(fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend))
-	}
-	if cfg.KCPConfig.NC < 0 {
-		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
-	}
-	if cfg.Port <= 0 || cfg.Port > 65535 {
-		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
+		os.Exit(0)
 	}
 
-	// Port
-	port = uint16(cfg.Port)
-
-	// Mode
-	switch cfg.Mode {
-	case "faketcp":
-		mode = "faketcp"
-		log.Infoln("Use FakeTCP")
-	case "tcp":
-		mode = "tcp"
-		log.Infoln("Use standard TCP")
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
+	// Verify parameters
+	if cfg.Port == 0 {
+		log.Fatalln("Please provide listen port by -p port.")
 	}
 
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	s, err := server.New(cfg)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
-	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
-	}
-
-	// Add firewall rule
-	if cfg.Rule {
-		err := exec.DisableIPForwarding()
-		if err != nil {
-			log.Fatalln(fmt.Errorf("disable ip forwarding: %w", err))
-		}
-
-		log.Infoln("Disable IP forwarding")
-
-		err = exec.AddGlobalFirewallRule()
-		if err != nil {
-			log.Fatalln(fmt.Errorf("add firewall rule: %w", err))
-		}
-
-		log.Infoln("Add firewall rule")
+		log.Fatalln(fmt.Errorf("create server: %w", err))
 	}
 
 	// Monitor
 	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
-			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
-		}
-
-		monitor = stat.NewTrafficMonitor()
-
 		go func() {
 			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				stats := s.Stats()
+
 				b, err := json.Marshal(&struct {
-					Name    string               `json:"name"`
-					Version string               `json:"version"`
-					Time    int                  `json:"time"`
-					Monitor *stat.TrafficMonitor `json:"monitor"`
+					Name       string                 `json:"name"`
+					Version    string                 `json:"version"`
+					Time       int                    `json:"time"`
+					Monitor    *stat.TrafficMonitor   `json:"monitor"`
+					Fragments  *stat.FragmentMonitor  `json:"fragments"`
+					Rejections *stat.RejectionMonitor `json:"rejections"`
+					Malformed  *stat.MalformedMonitor `json:"malformed"`
+					Latency    *stat.LatencyMonitor   `json:"latency"`
+					Delivery   *stat.DeliveryMonitor  `json:"delivery"`
+					Queues     *stat.QueueMonitor     `json:"queues"`
+					Errors     *log.ErrorAggregator   `json:"errors"`
+					Quota      *quota.Quota           `json:"quota"`
 				}{
-					Name:    name,
-					Version: versionInfo,
-					Time:    int(time.Now().Sub(startTime).Seconds()),
-					Monitor: monitor,
+					Name:       name,
+					Version:    versionInfo,
+					Time:       int(time.Now().Sub(startTime).Seconds()),
+					Monitor:    stats.Monitor,
+					Fragments:  stats.Fragments,
+					Rejections: stats.Rejections,
+					Malformed:  stats.Malformed,
+					Latency:    stats.Latency,
+					Delivery:   stats.Delivery,
+					Queues:     stats.Queues,
+					Errors:     stats.Errors,
+					Quota:      stats.Quota,
 				})
 				if err != nil {
 					log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -392,14 +446,12 @@ type IPName struct {
 				}
 
 				ipNames := make([]IPName, 0)
-				dnsLock.RLock()
-				for ip, name := range dns {
+				for ip, name := range s.Names() {
 					ipNames = append(ipNames, IPName{
 						IP:   ip,
 						Name: name,
 					})
 				}
-				dnsLock.RUnlock()
 
 				b, err := json.Marshal(ipNames)
 				if err != nil {
@@ -416,858 +468,257 @@ type IPName struct {
 				}
 			})
 
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		}()
+			// Admin interface, which is only enabled with a token
+			if cfg.AdminToken != "" {
+				http.HandleFunc("/bans", func(w http.ResponseWriter, req *http.Request) {
+					if !authorize(w, req, cfg.AdminToken) {
+						return
+					}
 
-		log.Infof("Monitor on :%d\n", cfg.Monitor)
-		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
-	}
+					var err error
+					ip, user := req.URL.Query().Get("ip"), req.URL.Query().Get("user")
+					switch req.Method {
+					case http.MethodGet:
+						break
+					case http.MethodPost, http.MethodDelete:
+						isBan := req.Method == http.MethodPost
+						switch {
+						case ip != "":
+							parsedIP := net.ParseIP(ip)
+							if parsedIP == nil {
+								http.Error(w, fmt.Sprintf("invalid ip %s", ip), http.StatusBadRequest)
+								return
+							}
+							if isBan {
+								err = s.BanIP(parsedIP)
+							} else {
+								err = s.UnbanIP(parsedIP)
+							}
+						case user != "":
+							if isBan {
+								err = s.BanUser(user)
+							} else {
+								err = s.UnbanUser(user)
+							}
+						default:
+							http.Error(w, "missing ip or user", http.StatusBadRequest)
+							return
+						}
+					default:
+						http.Error(w, fmt.Sprintf("method %s not support", req.Method), http.StatusMethodNotAllowed)
+						return
+					}
+					if err != nil {
+						log.Errorln(fmt.Errorf("admin: %w", err))
+						http.Error(w, err.Error(), http.StatusConflict)
+						return
+					}
 
-	// Mode-related options
-	switch mode {
-	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
-		if mtu != pcap.MaxMTU {
-			log.Infof("Set MTU to %d Bytes\n", mtu)
-		}
+					ips, users := s.Bans()
+					b, err := json.Marshal(&struct {
+						IPs   []string `json:"ips"`
+						Users []string `json:"users"`
+					}{
+						IPs:   ips,
+						Users: users,
+					})
+					if err != nil {
+						log.Errorln(fmt.Errorf("admin: %w", err))
+						return
+					}
 
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
-		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
-	}
+					_, err = io.WriteString(w, string(b))
+					if err != nil {
+						log.Errorln(fmt.Errorf("admin: %w", err))
+					}
+				})
+			}
 
-	log.Infof("Proxy from :%d\n", cfg.Port)
+			if cfg.AdminToken != "" {
+				http.HandleFunc("/drain", func(w http.ResponseWriter, req *http.Request) {
+					if !authorize(w, req, cfg.AdminToken) {
+						return
+					}
+					if req.Method != http.MethodPost {
+						http.Error(w, fmt.Sprintf("method %s not support", req.Method), http.StatusMethodNotAllowed)
+						return
+					}
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
-	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
+					after := 0
+					if str := req.URL.Query().Get("after"); str != "" {
+						var err error
+						after, err = strconv.Atoi(str)
+						if err != nil || after < 0 {
+							http.Error(w, fmt.Sprintf("invalid after %s", str), http.StatusBadRequest)
+							return
+						}
+					}
 
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
+					err := s.Drain(time.Duration(after) * time.Second)
+					if err != nil {
+						log.Errorln(fmt.Errorf("admin: %w", err))
+						http.Error(w, err.Error(), http.StatusConflict)
+						return
+					}
+				})
 			}
-			result = append(result, dev)
-		}
 
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
-	}
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		}()
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
-	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
-	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
-	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
+		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+		if cfg.AdminToken != "" {
+			log.Infof("Admin on :%d/bans and :%d/drain\n", cfg.Monitor, cfg.Monitor)
+		}
+	} else if cfg.AdminToken != "" {
+		log.Infoln("Admin interface is disabled because monitor is not set, please provide monitor port by -monitor port")
 	}
 
 	// Wait signals
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
-
-	// Open pcap
-	err = open()
-	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
-	}
-}
-
-func open() error {
-	var err error
-
-	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
-	}
-	if len(listenDevs) <= 0 {
-		return errors.New("missing listen device")
-	}
-	if upDev == nil {
-		return errors.New("missing upstream device")
-	}
-	if gatewayDev == nil {
-		return errors.New("missing gateway")
-	}
-
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
-		}
-	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
-	}
-
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
-
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
-				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
-				}
-			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
-		}
+		err := s.Stop()
 		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+			log.Errorln(fmt.Errorf("stop server: %w", err))
 		}
+	}()
 
-		listeners = append(listeners, listener)
-	}
-
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
-	if err != nil {
-		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
-	}
-
-	// Start handling
-	for i := 0; i < len(listeners); i++ {
-		listener := listeners[i]
+	// Reload configuration file on SIGHUP, changes of passwords only are applied without dropping sessions
+	if *argConfig != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		go func() {
-			for {
-				conn, err := listener.Accept()
+			for range hup {
+				cfg, err := config.ParseFile(*argConfig)
 				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("accept: %w", err))
+					log.Errorln(fmt.Errorf("parse config file %s: %w", *argConfig, err))
 					continue
 				}
-				if conn == nil {
+				err = s.Reload(cfg)
+				if err != nil {
+					log.Errorln(fmt.Errorf("reload: %w", err))
 					continue
 				}
-
-				// Tune
-				switch conn.(type) {
-				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
-					if err != nil {
-						conn.Close()
-						log.Errorln(fmt.Errorf("tune: %w", err))
-						continue
-					}
-				default:
-					break
-				}
-
-				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
-
-				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							if errors.Is(err, io.EOF) {
-								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
-
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
-						}
-					}
-				}()
+				log.Infof("Reload configuration from %s\n", *argConfig)
 			}
 		}()
 	}
 
-	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
-		}
-	}()
-
-	for {
-		packet, err := upConn.ReadPacket()
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			continue
-		}
-
-		err = handleUpstream(packet)
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			log.Verboseln(packet)
-			continue
-		}
-	}
-}
-
-func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
-		}
-	}
-	if upConn != nil {
-		upConn.Close()
-	}
-}
-
-func handleListen(contents []byte, conn net.Conn) error {
-	var (
-		err               error
-		embIndicator      *pcap.PacketIndicator
-		upValue           uint16
-		newTransportLayer gopacket.Layer
-		newNetworkLayer   gopacket.NetworkLayer
-		upIP              net.IP
-		newLinkLayerType  gopacket.LayerType
-		newLinkLayer      gopacket.Layer
-		data              []byte
-		guide             pcap.NATGuide
-		ni                *natIndicator
-	)
-
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
-	}
-
-	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
+	// Open pcap
+	err = s.Start()
 	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
-	}
-
-	// Distribute port/Id by source and client address and protocol
-	if !embIndicator.IsFrag() {
-		var ok bool
-
-		q := quintuple{
-			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
-			protocol: embIndicator.NATProtocol(),
-		}
-		upValue, ok = patMap[q]
-		if !ok {
-			var err error
-
-			// if ICMPv4 error is not in NAT, drop it
-			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-				return errors.New("missing nat")
-			}
-
-			upValue, err = dist(embIndicator.TransportLayer().LayerType())
-			if err != nil {
-				return fmt.Errorf("distribute: %w", err)
-			}
-
-			patMap[q] = upValue
-		}
+		log.Fatalln(fmt.Errorf("open pcap: %w", err))
 	}
 
-	// Create new transport layer
-	if embIndicator.TransportLayer() != nil {
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := embIndicator.TCPLayer()
-			temp := *tcpLayer
-			newTransportLayer = &temp
-
-			newTCPLayer := newTransportLayer.(*layers.TCP)
-
-			newTCPLayer.SrcPort = layers.TCPPort(upValue)
-		case layers.LayerTypeUDP:
-			udpLayer := embIndicator.UDPLayer()
-			temp := *udpLayer
-			newTransportLayer = &temp
-
-			newUDPLayer := newTransportLayer.(*layers.UDP)
-
-			newUDPLayer.SrcPort = layers.UDPPort(upValue)
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
-				newTransportLayer = &temp
-
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
-
-				newICMPv4Layer.Id = upValue
-			} else {
-				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
-
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
-
-				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
-				newEmbIPv4Layer := &temp
-
-				newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
-
-				var (
-					err                  error
-					newEmbTransportLayer gopacket.Layer
-				)
-
-				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
-				switch embTransportLayerType {
-				case layers.LayerTypeTCP:
-					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
-					newEmbTransportLayer = &temp
-
-					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
-
-					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
-
-					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeUDP:
-					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
-					newEmbTransportLayer = &temp
-
-					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
-
-					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
-
-					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeICMPv4:
-					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
-					newEmbTransportLayer = &temp
-
-					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
-						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
-
-						newEmbICMPv4Layer.Id = upValue
-					}
-				default:
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
-				}
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-				}
-
-				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
-				}
-
-				newICMPv4Layer.Payload = payload
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
+	err = s.Wait()
+	if err != nil {
+		log.Fatalln(err)
 	}
+}
 
-	// Create new network layer
-	switch t := embIndicator.NetworkLayer().LayerType(); t {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
-		temp := *ipv4Layer
-		newNetworkLayer = &temp
-
-		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
-
-		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
-		upIP = newIPv4Layer.SrcIP
-	default:
-		return fmt.Errorf("network layer type %s not support", t)
+// authorize returns if the request carries the token of the admin interface, and responds it otherwise.
+func authorize(w http.ResponseWriter, req *http.Request, token string) bool {
+	t := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
 	}
 
-	// Set network layer for transport layer
-	if newTransportLayer != nil {
-		switch t := newTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := newTransportLayer.(*layers.TCP)
+	return true
+}
 
-			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeUDP:
-			udpLayer := newTransportLayer.(*layers.UDP)
+func bench() error {
+	log.Infof("Benchmark in %d Bytes on %s/%s with %d CPUs\n", benchSize, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
 
-			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeICMPv4:
-			break
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
+	results := make([]*crypto.BenchResult, 0)
+	for _, method := range crypto.Methods() {
+		result, err := crypto.Bench(method, benchSize, benchDuration)
 		if err != nil {
-			return fmt.Errorf("set network layer for checksum: %w", err)
+			return fmt.Errorf("bench %s: %w", method, err)
 		}
-	}
+		results = append(results, result)
 
-	// Decide Loopback or Ethernet
-	if upConn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
+		log.Infof("  %-20s encrypt %9.1f Mbps, decrypt %9.1f Mbps\n", result.Method, toMbps(result.Encrypt),
+			toMbps(result.Decrypt))
 	}
 
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer = pcap.CreateLoopbackLayer()
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
+	result, err := pcap.Bench(benchSize, pcap.MaxMTU, benchDuration)
 	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
+		return fmt.Errorf("bench serialization: %w", err)
 	}
+	log.Infof("  %-20s serialize %7.1f Mbps, parse %11.1f Mbps\n", "faketcp", toMbps(result.Serialize),
+		toMbps(result.Parse))
 
-	// Serialize layers
-	if newTransportLayer == nil {
-		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-			newNetworkLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
-	} else {
-		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-			newNetworkLayer.(gopacket.SerializableLayer),
-			newTransportLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
-	}
-	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
+	// Recommend
+	best := crypto.Recommend(results)
+	if best == nil {
+		return nil
 	}
+	log.Infof("Prefer -method %s on this computer, which is the fastest authenticated encryption\n", best.Method)
 
-	// Write packet data
-	_, err = upConn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	serialization := result.Serialize
+	if result.Parse < serialization {
+		serialization = result.Parse
 	}
-
-	// NAT
-	if embIndicator.TransportLayer() != nil {
-		// Record the source and the source device of the packet
-		var addNAT bool
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			a := net.TCPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeUDP:
-			a := net.UDPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				guide = pcap.NATGuide{
-					Src: addr.ICMPQueryAddr{
-						IP: upIP,
-						Id: upValue,
-					}.String(),
-					Protocol: t,
-				}
-				addNAT = true
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if addNAT {
-			ni = &natIndicator{
-				src:    conn.RemoteAddr(),
-				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
-			}
-			natLock.Lock()
-			nat[guide] = ni
-			natLock.Unlock()
-		}
-
-		// Keep alive
-		protocol := embIndicator.NATProtocol()
-		switch protocol {
-		case layers.LayerTypeTCP:
-			tcpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeUDP:
-			udpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeICMPv4:
-			icmpv4IdPool[upValue] = time.Now()
-		default:
-			return fmt.Errorf("transport layer type %s not support", protocol)
-		}
-	}
-
-	// Statistics
-	if monitor != nil {
-		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	if best.Throughput() < serialization {
+		log.Infof("Encryption bounds the tunnel to about %.1f Mbps per core\n", toMbps(best.Throughput()))
+	} else {
+		log.Infof("Serialization bounds the tunnel to about %.1f Mbps per core\n", toMbps(serialization))
 	}
 
-	log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
-
 	return nil
 }
 
-func handleUpstream(packet gopacket.Packet) error {
-	var (
-		err               error
-		indicator         *pcap.PacketIndicator
-		frags             []*pcap.PacketIndicator
-		ni                *natIndicator
-		embTransportLayer gopacket.Layer
-		embNetworkLayer   gopacket.NetworkLayer
-		data              []byte
-	)
-
-	// Parse packet
-	indicator, err = pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	// Handle fragments
-	indicator, frags, err = defrag.AppendOriginal(indicator)
-	if err != nil {
-		return fmt.Errorf("defrag: %w", err)
-	}
-	if indicator == nil {
-		return nil
-	}
+func toMbps(bps float64) float64 {
+	return bps * 8 / 1000000
+}
 
-	// NAT
-	guide := pcap.NATGuide{
-		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
-	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
-	if !ok {
+func splitArg(s string) []string {
+	if s == "" {
 		return nil
 	}
 
-	// Keep alive
-	protocol := indicator.NATProtocol()
-	switch protocol {
-	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
-	default:
-		return fmt.Errorf("transport layer type %s not support", protocol)
-	}
-
-	for _, frag := range frags {
-		// Create embedded transport layer
-		if frag.TransportLayer() != nil {
-			switch t := frag.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := frag.TCPLayer()
-				temp := *embTCPLayer
-				embTransportLayer = &temp
-
-				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
-
-				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-			case layers.LayerTypeUDP:
-				embUDPLayer := frag.UDPLayer()
-				temp := *embUDPLayer
-				embTransportLayer = &temp
-
-				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
-
-				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-			case layers.LayerTypeICMPv4:
-				if frag.ICMPv4Indicator().IsQuery() {
-					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
-					temp := *embICMPv4Layer
-					embTransportLayer = &temp
-
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
-
-					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-				} else {
-					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
-
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
-
-					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
-					newEmbEmbIPv4Layer := &temp
-
-					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
-
-					var (
-						err                     error
-						newEmbEmbTransportLayer gopacket.Layer
-					)
-
-					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
-					case layers.LayerTypeTCP:
-						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
-						newEmbEmbTransportLayer = &temp
-
-						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
-
-						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-
-						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeUDP:
-						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
-						newEmbEmbTransportLayer = &temp
-
-						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
-
-						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-
-						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeICMPv4:
-						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
-						newEmbEmbTransportLayer = &temp
-
-						if frag.ICMPv4Indicator().IsEmbQuery() {
-							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
-
-							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-						}
-					default:
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
-					}
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-					}
-
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
-					}
-
-					newEmbICMPv4Layer.Payload = payload
-				}
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-		}
-
-		// Create embedded network layer
-		switch t := frag.NetworkLayer().LayerType(); t {
-		case layers.LayerTypeIPv4:
-			embIPv4Layer := frag.IPv4Layer()
-			temp := *embIPv4Layer
-			embNetworkLayer = &temp
-
-			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
-
-			newEmbIPv4Layer.DstIP = ni.embSrcIP()
-		default:
-			return fmt.Errorf("embedded network layer type %s not support", t)
-		}
-
-		// Set network layer for transport layer
-		if embTransportLayer != nil {
-			switch t := embTransportLayer.LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := embTransportLayer.(*layers.TCP)
-
-				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeUDP:
-				embUDPLayer := embTransportLayer.(*layers.UDP)
-
-				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeICMPv4:
-				break
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-			if err != nil {
-				return fmt.Errorf("set embedded network layer for checksum: %w", err)
-			}
-		}
-
-		// Serialize layers
-		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
-		}
-
-		// Write packet data
-		_, err = ni.conn.Write(data)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
-		}
-
-		// Statistics
-		size := frag.MTU()
-		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
-		}
+	result := make([]string, 0)
 
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
-	}
+	strs := strings.Split(s, ",")
 
-	// Record DNS
-	if indicator.DNSIndicator() != nil {
-		if indicator.DNSIndicator().IsResponse() {
-			name, ips := indicator.DNSIndicator().Answers()
-			if name != "" && len(ips) > 0 {
-				dnsLock.Lock()
-				for _, ip := range ips {
-					dns[ip.String()] = name
-					log.Verbosef("Record DNS record %s = %s\n", name, ip)
-				}
-				dnsLock.Unlock()
-			}
-		}
+	for _, str := range strs {
+		result = append(result, strings.Trim(str, " "))
 	}
 
-	return nil
+	return result
 }
 
-func dist(t gopacket.LayerType) (uint16, error) {
-	now := time.Now()
-
-	switch t {
-	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
-
-			// Point to next port
-			nextTCPPort++
+func splitIntArg(s string) ([]int, error) {
+	result := make([]int, 0)
 
-			// Check if the port is alive
-			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
-			}
-		}
-	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
-
-			// Point to next port
-			nextUDPPort++
-
-			// Check if the port is alive
-			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
-			}
-		}
-	case layers.LayerTypeICMPv4:
-		for i := 0; i < 65536; i++ {
-			s := nextICMPv4Id
-
-			// Point to next Id
-			nextICMPv4Id++
-
-			// Check if the Id is alive
-			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s ID %d\n", t, s)
-				}
-				return s, nil
-			}
+	for _, str := range splitArg(s) {
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, err
 		}
-	default:
-		return 0, fmt.Errorf("transport layer type %s not support", t)
+		result = append(result, i)
 	}
 
-	return 0, fmt.Errorf("%s pool empty", t)
+	return result, nil
 }
 
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
-}
+func splitFloatArg(s string) ([]float64, error) {
+	result := make([]float64, 0)
 
-func splitArg(s string) []string {
-	if s == "" {
-		return nil
-	}
-
-	result := make([]string, 0)
-
-	strs := strings.Split(s, ",")
-
-	for _, str := range strs {
-		result = append(result, strings.Trim(str, " "))
+	for _, str := range splitArg(s) {
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
 	}
 
-	return result
+	return result, nil
 }
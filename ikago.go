@@ -0,0 +1,39 @@
+// Package ikago runs clients and servers of IkaGo in process, so applications like launchers and router firmwares can
+// embed IkaGo without spawning its executables.
+//
+//	cfg := config.NewConfig()
+//	cfg.Sources = []string{"192.168.1.100"}
+//	cfg.Server = "1.2.3.4:10000"
+//
+//	client, err := ikago.NewClient(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	err = client.Start()
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Stop()
+package ikago
+
+import (
+	"ikago/pkg/client"
+	"ikago/pkg/config"
+	"ikago/pkg/server"
+)
+
+// Client is a client of IkaGo.
+type Client = client.Client
+
+// Server is a server of IkaGo.
+type Server = server.Server
+
+// NewClient returns a client with the given configuration.
+func NewClient(cfg *config.Config) (*Client, error) {
+	return client.New(cfg)
+}
+
+// NewServer returns a server with the given configuration.
+func NewServer(cfg *config.Config) (*Server, error) {
+	return server.New(cfg)
+}
@@ -41,3 +41,14 @@ func AddSpecificFirewallRule(ip net.IP, port uint16) error {
 
 	return nil
 }
+
+// HasSpecificFirewallRule returns if the rule for firewall blocking certain traffic in packets transmission with
+// specific host exists.
+func HasSpecificFirewallRule(ip net.IP, port uint16) (bool, error) {
+	switch t := runtime.GOOS; t {
+	case "darwin", "freebsd", "linux":
+		return hasSpecificFirewallRule(ip, port)
+	default:
+		return false, fmt.Errorf("os %s not support", t)
+	}
+}
@@ -7,6 +7,7 @@
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 func addGlobalFirewallRule() error {
@@ -46,3 +47,21 @@ func addSpecificFirewallRule(ip net.IP, port uint16) error {
 
 	return nil
 }
+
+func hasSpecificFirewallRule(ip net.IP, port uint16) (bool, error) {
+	routeCmd := exec.Command("pfctl", "-s", "rules")
+	out, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("exec pfctl: %w", err)
+	}
+
+	// Rules are shown as "block drop proto tcp from any to 192.168.1.1 port = 80"
+	rule := fmt.Sprintf("to %s port = %d", ip, port)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "block drop") && strings.HasSuffix(strings.TrimSpace(line), rule) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -1,6 +1,7 @@
 package exec
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
@@ -26,3 +27,18 @@ func addSpecificFirewallRule(ip net.IP, port uint16) error {
 
 	return nil
 }
+
+func hasSpecificFirewallRule(ip net.IP, port uint16) (bool, error) {
+	routeCmd := exec.Command("iptables", "-C", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		// iptables exits with 1 if the rule does not exist
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("exec iptables: %w", err)
+	}
+
+	return true, nil
+}
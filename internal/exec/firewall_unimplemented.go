@@ -11,3 +11,7 @@ func addGlobalFirewallRule() error {
 func addSpecificFirewallRule(ip net.IP, port uint16) error {
 	return nil
 }
+
+func hasSpecificFirewallRule(ip net.IP, port uint16) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,69 @@
+// +build linux,integration
+
+package harness
+
+import (
+	"fmt"
+	"ikago/pkg/pcap"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// createDevs returns a veth pair with the IP addresses. Addresses are in the same host, so the kernel never routes
+// packets between them through the pair, and only packets forged in pcap travel in it.
+func createDevs(ip1, ip2 net.IP) (*pcap.Device, *pcap.Device, func() error, error) {
+	name1 := fmt.Sprintf("ikago%da", os.Getpid()%10000)
+	name2 := fmt.Sprintf("ikago%db", os.Getpid()%10000)
+
+	remove := func() error {
+		// Removing one of a veth pair removes both
+		return ip("link", "del", name1)
+	}
+
+	err := ip("link", "add", name1, "type", "veth", "peer", "name", name2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, args := range [][]string{
+		{"addr", "add", ip1.String() + "/30", "dev", name1},
+		{"addr", "add", ip2.String() + "/30", "dev", name2},
+		{"link", "set", name1, "up"},
+		{"link", "set", name2, "up"},
+	} {
+		err := ip(args...)
+		if err != nil {
+			_ = remove()
+			return nil, nil, nil, err
+		}
+	}
+
+	// Addresses may take a while to be assigned
+	var devs []*pcap.Device
+	for i := 0; i < 10; i++ {
+		devs, err = pcap.FindListenDevs([]string{name1, name2})
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		_ = remove()
+		return nil, nil, nil, fmt.Errorf("find devices: %w", err)
+	}
+
+	return devs[0], devs[1], remove, nil
+}
+
+func ip(args ...string) error {
+	cmd := exec.Command("ip", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build !linux !integration
+
+package harness
+
+import (
+	"ikago/pkg/pcap"
+	"net"
+)
+
+// createDevs returns a pair of devices in memory with the IP addresses.
+func createDevs(ip1, ip2 net.IP) (*pcap.Device, *pcap.Device, func() error, error) {
+	dev1, dev2, err := pcap.NewMemoryDevs(ip1, ip2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return dev1, dev2, func() error { return nil }, nil
+}
@@ -0,0 +1,376 @@
+// Package harness implements an integration harness which runs a FakeTCP client and a server of IkaGo against each
+// other over a pair of devices, and asserts end-to-end delivery, compatibility, reconnection and fragmentation.
+//
+// Devices are a veth pair in Linux if built with the integration tag, which requires root and pcap, or a pair of devices
+// in memory otherwise, so the same scenarios run anywhere. Scenarios are run under go test with the integration tag:
+//
+//  go test -tags integration ./internal/harness
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/pkg/pcap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// serverPort is the port of the server.
+	serverPort = 443
+	// fragmentSize is the size of fragments, so large packets are always fragmented.
+	fragmentSize = 576
+	// exchangeTimeout is the time waiting for each packet echoed.
+	exchangeTimeout = 3 * time.Second
+	// reconnectTimeout is the time waiting for the client to recover after the server restarts.
+	reconnectTimeout = 10 * time.Second
+	// maxSize is the max size of packets, so packets too large to be carried by IP fragmentation are written in
+	// segments.
+	maxSize = 1 << 20
+	// headerSize is the size of headers of packets, which is 4 bytes of sequence.
+	headerSize = 4
+	// initialSeq is the sequence packets start from, whose leading byte is of no frame type, so packets are never
+	// read as data in framing other than they are written in.
+	initialSeq = 0xff000000
+)
+
+var (
+	clientIP = net.IPv4(10, 255, 1, 1).To4()
+	serverIP = net.IPv4(10, 255, 1, 2).To4()
+)
+
+// Harness describes a pair of devices a client and a server run in.
+type Harness struct {
+	clientDev *pcap.Device
+	serverDev *pcap.Device
+	close     func() error
+	seq       uint32
+}
+
+// New returns a harness with a new pair of devices. Harnesses must be closed to remove their devices.
+func New() (*Harness, error) {
+	clientDev, serverDev, close, err := createDevs(clientIP, serverIP)
+	if err != nil {
+		return nil, fmt.Errorf("create devices: %w", err)
+	}
+
+	return &Harness{clientDev: clientDev, serverDev: serverDev, close: close, seq: initialSeq}, nil
+}
+
+// Close removes devices of the harness.
+func (h *Harness) Close() error {
+	return h.close()
+}
+
+// Delivery runs a client and a server with options, and asserts count packets of each size are echoed intact.
+func (h *Harness) Delivery(ctx context.Context, sizes []int, count int, opts ...pcap.Option) error {
+	return h.Compatibility(ctx, sizes, count, opts, opts)
+}
+
+// Compatibility runs a client and a server with options of their own, like in different versions of the wire format,
+// and asserts count packets of each size are echoed intact.
+func (h *Harness) Compatibility(ctx context.Context, sizes []int, count int,
+	clientOpts, serverOpts []pcap.Option) error {
+	s, err := h.listen(ctx, serverOpts...)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer s.close()
+
+	c, err := h.dial(ctx, clientOpts...)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.close()
+
+	for _, size := range sizes {
+		for i := 0; i < count; i++ {
+			err := h.exchange(ctx, c, size, exchangeTimeout)
+			if err != nil {
+				return fmt.Errorf("exchange packet %d of size %d: %w", i, size, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reconnection runs a client and a server with options, restarts the server, and asserts the client recovers by
+// reconnecting.
+func (h *Harness) Reconnection(ctx context.Context, opts ...pcap.Option) error {
+	s, err := h.listen(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	c, err := h.dial(ctx, opts...)
+	if err != nil {
+		s.close()
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.close()
+
+	err = h.exchange(ctx, c, 64, exchangeTimeout)
+	if err != nil {
+		s.close()
+		return fmt.Errorf("exchange before restart: %w", err)
+	}
+
+	// Restart
+	s.close()
+	s, err = h.listen(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("listen again: %w", err)
+	}
+	defer s.close()
+
+	err = c.conn.Reconnect()
+	if err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+
+	// Packets may be lost before the handshake completes
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		err = h.exchange(ctx, c, 64, exchangeTimeout)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return fmt.Errorf("exchange after restart: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Fragmentation runs a client and a server with options in fragments of 576 Bytes, and asserts packets carried by IP
+// fragmentation and packets written in segments are echoed intact, and packets larger than fragments are rejected
+// with pcap.ErrMTUExceeded in no fragment mode.
+func (h *Harness) Fragmentation(ctx context.Context, opts ...pcap.Option) error {
+	opts = append(append(make([]pcap.Option, 0), opts...), pcap.WithFragment(fragmentSize))
+
+	err := h.Delivery(ctx, []int{fragmentSize, 1400, 4000, pcap.IPv4MaxSize - 40, 200000}, 1, opts...)
+	if err != nil {
+		return err
+	}
+
+	s, err := h.listen(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer s.close()
+
+	c, err := h.dial(ctx, append(opts, pcap.WithNoFragment(true))...)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.close()
+
+	err = h.exchange(ctx, c, 64, exchangeTimeout)
+	if err != nil {
+		return fmt.Errorf("exchange in no fragment: %w", err)
+	}
+
+	_, err = c.conn.Write(h.packet(1400))
+	if !errors.Is(err, pcap.ErrMTUExceeded) {
+		return fmt.Errorf("write in no fragment: expect %v, got %v", pcap.ErrMTUExceeded, err)
+	}
+
+	return nil
+}
+
+// server describes a server echoing packets.
+type server struct {
+	lock     sync.Mutex
+	listener *pcap.FakeTCPListener
+	conns    []net.Conn
+	isClosed bool
+}
+
+func (h *Harness) listen(ctx context.Context, opts ...pcap.Option) (*server, error) {
+	opts = append(append(make([]pcap.Option, 0), opts...), pcap.WithDevices(h.serverDev, h.clientDev),
+		pcap.WithContext(ctx))
+	listener, err := pcap.ListenFakeTCP(serverPort, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if s.closed() {
+					return
+				}
+				continue
+			}
+			if conn == nil {
+				continue
+			}
+
+			s.lock.Lock()
+			if s.isClosed {
+				s.lock.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+
+			go s.echo(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *server) echo(conn net.Conn) {
+	b := make([]byte, maxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			if s.closed() || errors.Is(err, pcap.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n <= 0 {
+			continue
+		}
+
+		_, _ = conn.Write(b[:n])
+	}
+}
+
+func (s *server) closed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.isClosed
+}
+
+func (s *server) close() {
+	s.lock.Lock()
+	s.isClosed = true
+	conns := s.conns
+	s.conns = nil
+	s.lock.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	_ = s.listener.Close()
+}
+
+// client describes a client whose replies are read in background.
+type client struct {
+	conn    *pcap.FakeTCPConn
+	replies chan []byte
+	cancel  context.CancelFunc
+}
+
+func (h *Harness) dial(ctx context.Context, opts ...pcap.Option) (*client, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	opts = append(append(make([]pcap.Option, 0), opts...), pcap.WithDevices(h.clientDev, h.serverDev),
+		pcap.WithContext(ctx))
+	conn, err := pcap.DialFakeTCP(&net.TCPAddr{IP: serverIP, Port: serverPort}, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c := &client{conn: conn, replies: make(chan []byte, 64), cancel: cancel}
+
+	// Handshakes are handled in reads
+	go func() {
+		b := make([]byte, maxSize)
+		for {
+			n, _, err := conn.ReadFrom(b)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if n <= 0 {
+				continue
+			}
+
+			reply := make([]byte, n)
+			copy(reply, b[:n])
+			select {
+			case c.replies <- reply:
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		c.close()
+		return nil, ctx.Err()
+	case <-conn.Established():
+	case <-time.After(exchangeTimeout):
+		c.close()
+		return nil, errors.New("handshake timeout")
+	}
+
+	return c, nil
+}
+
+func (c *client) close() {
+	_ = c.conn.Close()
+	c.cancel()
+}
+
+// packet returns a packet of the size with a new sequence.
+func (h *Harness) packet(size int) []byte {
+	b := make([]byte, size)
+	rand.Read(b)
+	binary.BigEndian.PutUint32(b[:headerSize], h.seq)
+	h.seq++
+
+	return b
+}
+
+// exchange writes a packet of the size and waits until it is echoed.
+func (h *Harness) exchange(ctx context.Context, c *client, size int, timeout time.Duration) error {
+	if size < headerSize || size > maxSize {
+		return fmt.Errorf("size %d out of range", size)
+	}
+
+	data := h.packet(size)
+	_, err := c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case reply := <-c.replies:
+			if len(reply) < headerSize || !bytes.Equal(reply[:headerSize], data[:headerSize]) {
+				continue
+			}
+			if !bytes.Equal(reply, data) {
+				return errors.New("corrupted")
+			}
+			return nil
+		case <-timer.C:
+			return errors.New("lost")
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// +build integration
+
+package harness
+
+import (
+	"context"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"testing"
+	"time"
+)
+
+// scenarioTimeout is the max time of each scenario.
+const scenarioTimeout = time.Minute
+
+// variants are options scenarios run in, which are the default wire format, the baseline wire format without types,
+// and a crypt in AEAD rekeyed frequently.
+func variants(t *testing.T) map[string][]pcap.Option {
+	crypt, err := crypto.ParseCrypt("aes-256-gcm", "harness")
+	if err != nil {
+		t.Fatalf("parse crypt: %v", err)
+	}
+
+	return map[string][]pcap.Option{
+		"default": nil,
+		"untyped": {pcap.WithWireVersion(pcap.WireVersion2)},
+		"rekey":   {pcap.WithCrypt(crypt), pcap.WithRekey(100 * time.Millisecond)},
+	}
+}
+
+// scenario is a scenario of the harness run in options.
+type scenario func(h *Harness, ctx context.Context, opts ...pcap.Option) error
+
+// run runs the scenario in each variant in a harness of its own.
+func run(t *testing.T, variants map[string][]pcap.Option, s scenario) {
+	for name, opts := range variants {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			h, err := New()
+			if err != nil {
+				t.Fatalf("create harness: %v", err)
+			}
+			defer h.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), scenarioTimeout)
+			defer cancel()
+
+			err = s(h, ctx, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	run(t, variants(t), func(h *Harness, ctx context.Context, opts ...pcap.Option) error {
+		return h.Delivery(ctx, []int{headerSize, 64, 1400}, 20, opts...)
+	})
+}
+
+// TestCompatibility runs clients in every version of the wire format against servers of the latest version, and
+// clients without a preamble against servers without a preamble in the version they agree on.
+func TestCompatibility(t *testing.T) {
+	cases := map[string]struct {
+		client []pcap.Option
+		server []pcap.Option
+	}{
+		// Clients of the baseline carry nothing in TCP SYN and write data only, like clients of the first version
+		// without a preamble
+		"baseline": {
+			client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion1), pcap.WithPreamble(pcap.PreambleNone)},
+		},
+		"version 1": {client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion1)}},
+		"version 1 typed": {
+			client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion1), pcap.WithTyped(true)},
+			server: []pcap.Option{pcap.WithTyped(true)},
+		},
+		"version 2": {client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion2)}},
+		"version 3": {client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion3)}},
+		"no preamble": {
+			client: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion2), pcap.WithPreamble(pcap.PreambleNone)},
+			server: []pcap.Option{pcap.WithWireVersion(pcap.WireVersion2), pcap.WithPreamble(pcap.PreambleNone)},
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			h, err := New()
+			if err != nil {
+				t.Fatalf("create harness: %v", err)
+			}
+			defer h.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), scenarioTimeout)
+			defer cancel()
+
+			err = h.Compatibility(ctx, []int{headerSize, 64, 1400}, 10, c.client, c.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReconnection(t *testing.T) {
+	run(t, variants(t), func(h *Harness, ctx context.Context, opts ...pcap.Option) error {
+		return h.Reconnection(ctx, opts...)
+	})
+}
+
+func TestFragmentation(t *testing.T) {
+	// Packets too large for IP fragmentation are written in segments, which are in typed framing only
+	vs := variants(t)
+	delete(vs, "untyped")
+
+	run(t, vs, func(h *Harness, ctx context.Context, opts ...pcap.Option) error {
+		return h.Fragmentation(ctx, opts...)
+	})
+}
@@ -0,0 +1,223 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event describes an event of the tunnel which needs attention.
+type Event int
+
+const (
+	// EventUnreachable describes the server does not respond to the client.
+	EventUnreachable Event = iota
+	// EventReconnected describes the client reconnects to the server.
+	EventReconnected
+	// EventBanned describes a client is banned by the server.
+	EventBanned
+	// EventQuotaExceeded describes a client exceeds its quota.
+	EventQuotaExceeded
+)
+
+func (event Event) String() string {
+	switch event {
+	case EventUnreachable:
+		return "unreachable"
+	case EventReconnected:
+		return "reconnected"
+	case EventBanned:
+		return "banned"
+	case EventQuotaExceeded:
+		return "quota-exceeded"
+	default:
+		return fmt.Sprintf("%d", event)
+	}
+}
+
+// ParseEvent returns the event by its name.
+func ParseEvent(s string) (Event, error) {
+	switch strings.ToLower(s) {
+	case "unreachable":
+		return EventUnreachable, nil
+	case "reconnected":
+		return EventReconnected, nil
+	case "banned":
+		return EventBanned, nil
+	case "quota-exceeded":
+		return EventQuotaExceeded, nil
+	default:
+		return 0, fmt.Errorf("event %s not support", s)
+	}
+}
+
+const (
+	// hookTimeout is the timeout of a webhook request or a script.
+	hookTimeout = 10 * time.Second
+	// hookWindow is the min interval between notifications of the same event and message, so events recurring do not
+	// flood the receiver.
+	hookWindow = 1 * time.Minute
+)
+
+// Hook notifies events by a webhook, a script or both, so users get a notification once the tunnel needs attention.
+//
+// The webhook receives a POST of JSON, whose content and text are the message in the form of Discord and Slack, and
+// Telegram as well if the chat is in the query of the URL. The script is run with the event and the message as
+// arguments, and also in environment variables IKAGO_EVENT and IKAGO_MESSAGE.
+type Hook struct {
+	url    string
+	script string
+	events map[Event]bool
+	client *http.Client
+	lock   sync.Mutex
+	last   map[string]time.Time
+}
+
+// New returns a new hook notifying the events by the webhook of the URL and the script, either of which may be empty.
+// All events are notified if events are empty.
+func New(rawURL, script string, events []string) (*Hook, error) {
+	if rawURL == "" && script == "" {
+		return nil, errors.New("missing url or script")
+	}
+
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse url %s: %w", rawURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("url scheme %s not support", u.Scheme)
+		}
+	}
+
+	hook := &Hook{
+		url:    rawURL,
+		script: script,
+		events: make(map[Event]bool),
+		client: &http.Client{Timeout: hookTimeout},
+		last:   make(map[string]time.Time),
+	}
+
+	if len(events) <= 0 {
+		for _, event := range []Event{EventUnreachable, EventReconnected, EventBanned, EventQuotaExceeded} {
+			hook.events[event] = true
+		}
+	}
+	for _, s := range events {
+		event, err := ParseEvent(s)
+		if err != nil {
+			return nil, err
+		}
+		hook.events[event] = true
+	}
+
+	return hook, nil
+}
+
+// Notify notifies the event with the message in background. Events not subscribed, and events notified with the same
+// message in the last minute are skipped.
+func (hook *Hook) Notify(event Event, message string) {
+	if hook == nil || !hook.events[event] {
+		return
+	}
+
+	now := time.Now()
+	key := event.String() + " " + message
+
+	hook.lock.Lock()
+	if now.Sub(hook.last[key]) < hookWindow {
+		hook.lock.Unlock()
+		return
+	}
+	for k, t := range hook.last {
+		if now.Sub(t) >= hookWindow {
+			delete(hook.last, k)
+		}
+	}
+	hook.last[key] = now
+	hook.lock.Unlock()
+
+	go func() {
+		if hook.url != "" {
+			err := hook.post(event, message, now)
+			if err != nil {
+				log.Errorln(fmt.Errorf("notify %s by webhook: %w", event, err))
+			}
+		}
+		if hook.script != "" {
+			err := hook.run(event, message)
+			if err != nil {
+				log.Errorln(fmt.Errorf("notify %s by script %s: %w", event, hook.script, err))
+			}
+		}
+	}()
+}
+
+// post posts the event to the webhook.
+func (hook *Hook) post(event Event, message string, t time.Time) error {
+	text := fmt.Sprintf("IkaGo: %s", message)
+
+	b, err := json.Marshal(&struct {
+		Event   string `json:"event"`
+		Message string `json:"message"`
+		Time    string `json:"time"`
+		Content string `json:"content"`
+		Text    string `json:"text"`
+	}{
+		Event:   event.String(),
+		Message: message,
+		Time:    t.Format(time.RFC3339),
+		Content: text,
+		Text:    text,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	resp, err := hook.client.Post(hook.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// run runs the script of the event.
+func (hook *Hook) run(event Event, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.script, event.String(), message)
+	cmd.Env = append(os.Environ(), "IKAGO_EVENT="+event.String(), "IKAGO_MESSAGE="+message)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("run: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Notifyf notifies the event with the message formatted in the same way as Notify.
+func (hook *Hook) Notifyf(event Event, format string, v ...interface{}) {
+	if hook == nil {
+		return
+	}
+
+	hook.Notify(event, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,225 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// aggregateTop is the count of top recurring errors printed at the end of windows.
+	aggregateTop = 5
+	// aggregateMaxCategories is the max count of categories in a window, errors in new categories are counted as
+	// others if it is exceeded.
+	aggregateMaxCategories = 1024
+	// aggregateMaxCategoryLength is the max length of categories.
+	aggregateMaxCategoryLength = 160
+)
+
+// aggregateOthers is the category of errors if there are too many categories in a window.
+const aggregateOthers = "others"
+
+// ErrorCount describes the count of errors in a category.
+type ErrorCount struct {
+	Category string `json:"category"`
+	Count    uint64 `json:"count"`
+	Last     string `json:"last"`
+}
+
+// ErrorAggregator describes errors aggregated in categories in windows, so recurring errors can be told from noise.
+type ErrorAggregator struct {
+	lock    sync.RWMutex
+	window  time.Duration
+	start   time.Time
+	current map[string]*ErrorCount
+	last    []*ErrorCount
+	total   uint64
+	done    chan struct{}
+}
+
+var aggregator *ErrorAggregator
+
+// SetAggregation sets the window errors are aggregated in. Top recurring errors in a window are printed at its end.
+// Errors are not aggregated if the window is 0.
+func SetAggregation(window time.Duration) {
+	if aggregator != nil {
+		close(aggregator.done)
+		aggregator = nil
+	}
+	if window <= 0 {
+		return
+	}
+
+	a := &ErrorAggregator{
+		window:  window,
+		start:   time.Now(),
+		current: make(map[string]*ErrorCount),
+		done:    make(chan struct{}),
+	}
+	aggregator = a
+
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+				a.rotate()
+			}
+		}
+	}()
+}
+
+// Aggregation returns the aggregator of errors, or nil if errors are not aggregated.
+func Aggregation() *ErrorAggregator {
+	return aggregator
+}
+
+// categorize returns the category of the error message, where numbers, like addresses, ports and sizes, are masked.
+func categorize(s string) string {
+	s = strings.TrimSpace(s)
+
+	sb := strings.Builder{}
+	isNumber := false
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			if !isNumber {
+				sb.WriteByte('#')
+			}
+			isNumber = true
+			continue
+		}
+		isNumber = false
+		sb.WriteRune(r)
+		if sb.Len() >= aggregateMaxCategoryLength {
+			break
+		}
+	}
+
+	return sb.String()
+}
+
+// add adds an error message.
+func (a *ErrorAggregator) add(s string) {
+	category := categorize(s)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	count, ok := a.current[category]
+	if !ok {
+		if len(a.current) >= aggregateMaxCategories {
+			category = aggregateOthers
+			count, ok = a.current[category]
+		}
+		if !ok {
+			count = &ErrorCount{Category: category}
+			a.current[category] = count
+		}
+	}
+	count.Count++
+	count.Last = strings.TrimSpace(s)
+	a.total++
+}
+
+// rotate ends the current window, and prints its top recurring errors.
+func (a *ErrorAggregator) rotate() {
+	a.lock.Lock()
+	last := sortErrorCounts(a.current)
+	start := a.start
+	a.last = last
+	a.current = make(map[string]*ErrorCount)
+	a.start = time.Now()
+	a.lock.Unlock()
+
+	if len(last) <= 0 {
+		return
+	}
+
+	sum := uint64(0)
+	for _, count := range last {
+		sum = sum + count.Count
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%d errors in %d categories since %s, top recurring:\n", sum, len(last),
+		start.Format(time.Stamp)))
+	for i, count := range last {
+		if i >= aggregateTop {
+			break
+		}
+		sb.WriteString(fmt.Sprintf("  %d x %s\n", count.Count, count.Last))
+	}
+	Info(sb.String())
+}
+
+// Top returns at most n categories of errors which recur the most in the last window ended.
+func (a *ErrorAggregator) Top(n int) []ErrorCount {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return copyErrorCounts(a.last, n)
+}
+
+// Total returns the count of errors aggregated.
+func (a *ErrorAggregator) Total() uint64 {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.total
+}
+
+func (a *ErrorAggregator) MarshalJSON() ([]byte, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return json.Marshal(&struct {
+		Window  int          `json:"window"`
+		Total   uint64       `json:"total"`
+		Current []ErrorCount `json:"current"`
+		Last    []ErrorCount `json:"last"`
+	}{
+		Window:  int(a.window.Seconds()),
+		Total:   a.total,
+		Current: copyErrorCounts(sortErrorCounts(a.current), aggregateTop),
+		Last:    copyErrorCounts(a.last, aggregateTop),
+	})
+}
+
+func sortErrorCounts(m map[string]*ErrorCount) []*ErrorCount {
+	counts := make([]*ErrorCount, 0, len(m))
+	for _, count := range m {
+		counts = append(counts, count)
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Category < counts[j].Category
+	})
+
+	return counts
+}
+
+func copyErrorCounts(counts []*ErrorCount, n int) []ErrorCount {
+	if n > len(counts) {
+		n = len(counts)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	result := make([]ErrorCount, 0, n)
+	for _, count := range counts[:n] {
+		result = append(result, *count)
+	}
+
+	return result
+}
@@ -12,6 +12,7 @@
 
 var (
 	allowVerbose bool
+	allowTrace   bool
 )
 
 var (
@@ -48,6 +49,16 @@ func SetVerbose(allow bool) {
 	allowVerbose = allow
 }
 
+// SetTrace sets the state if trace message is allowed to print.
+func SetTrace(allow bool) {
+	allowTrace = allow
+}
+
+// IsTrace returns if trace message is allowed to print.
+func IsTrace() bool {
+	return allowTrace
+}
+
 // SetLog sets the path of log file.
 func SetLog(path string) error {
 	if path != "" {
@@ -107,6 +118,20 @@ func Verboseln(v ...interface{}) {
 	}
 }
 
+// Tracef prints message to the stdout if trace message is allowed to print. Arguments are handled in the manner of fmt.Printf.
+func Tracef(format string, v ...interface{}) {
+	if allowTrace {
+		outLogger.output(fmt.Sprintf(format, v...))
+	}
+}
+
+// Trace prints message to the stdout if trace message is allowed to print. Arguments are handled in the manner of fmt.Print.
+func Trace(v ...interface{}) {
+	if allowTrace {
+		outLogger.output(fmt.Sprint(v...))
+	}
+}
+
 // Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
 func Infof(format string, v ...interface{}) {
 	outLogger.output(fmt.Sprintf(format, v...))
@@ -124,17 +149,25 @@ func Infoln(v ...interface{}) {
 
 // Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorf(format string, v ...interface{}) {
-	errLogger.output(fmt.Sprintf(format, v...))
+	outputError(fmt.Sprintf(format, v...))
 }
 
 // Error prints message to the stderr. Arguments are handled in the manner of fmt.Print.
 func Error(v ...interface{}) {
-	errLogger.output(fmt.Sprint(v...))
+	outputError(fmt.Sprint(v...))
 }
 
 // Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorln(v ...interface{}) {
-	errLogger.output(fmt.Sprintln(v...))
+	outputError(fmt.Sprintln(v...))
+}
+
+func outputError(s string) {
+	errLogger.output(s)
+
+	if aggregator != nil {
+		aggregator.add(s)
+	}
 }
 
 // Fatalf prints message to the stderr, and ends with os.Exit(1). Arguments are handled in the manner of fmt.Printf.
@@ -0,0 +1,386 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/hook"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action describes the action taken on clients exceeding their quotas.
+type Action int
+
+const (
+	// ActionThrottle describes the traffic of clients exceeding their quotas is limited to the throttle rate.
+	ActionThrottle Action = iota
+	// ActionDisconnect describes clients exceeding their quotas are disconnected, and their traffic is dropped until the
+	// quotas reset.
+	ActionDisconnect
+)
+
+func (action Action) String() string {
+	switch action {
+	case ActionThrottle:
+		return "throttle"
+	case ActionDisconnect:
+		return "disconnect"
+	default:
+		return strconv.Itoa(int(action))
+	}
+}
+
+// ParseAction returns the action by given name.
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "throttle":
+		return ActionThrottle, nil
+	case "disconnect":
+		return ActionDisconnect, nil
+	default:
+		return 0, fmt.Errorf("action %s not support", s)
+	}
+}
+
+// saveInterval is the interval usages are persisted in.
+const saveInterval = 1 * time.Minute
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+type limit struct {
+	daily   uint64
+	monthly uint64
+}
+
+type usage struct {
+	Daily       uint64 `json:"daily"`
+	Monthly     uint64 `json:"monthly"`
+	isExceeded  bool
+	tokens      float64
+	lastRefresh time.Time
+}
+
+// Quota is a quota of bytes transferred by each identity in a day and in a month. Usages are persisted in the file
+// and restored across restarts.
+type Quota struct {
+	lock     sync.Mutex
+	daily    uint64
+	monthly  uint64
+	action   Action
+	throttle int
+	path     string
+	day      string
+	month    string
+	usages   map[string]*usage
+	limits   map[string]*limit
+	hook     *hook.Hook
+	isClosed bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewQuota returns a new quota by given config, with usages restored from the file in the config. Identities exceeding
+// the quota are notified by the hook if it is not nil.
+func NewQuota(config *config.QuotaConfig, hook *hook.Hook) (*Quota, error) {
+	if config.Daily < 0 {
+		return nil, fmt.Errorf("daily %d out of range", config.Daily)
+	}
+	if config.Monthly < 0 {
+		return nil, fmt.Errorf("monthly %d out of range", config.Monthly)
+	}
+	if config.Throttle <= 0 {
+		return nil, fmt.Errorf("throttle %d out of range", config.Throttle)
+	}
+
+	action, err := ParseAction(config.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	quota := &Quota{
+		daily:    uint64(config.Daily) * 1024 * 1024,
+		monthly:  uint64(config.Monthly) * 1024 * 1024,
+		action:   action,
+		throttle: config.Throttle,
+		path:     config.File,
+		day:      now.Format(dayLayout),
+		month:    now.Format(monthLayout),
+		usages:   make(map[string]*usage),
+		limits:   make(map[string]*limit),
+		hook:     hook,
+		done:     make(chan struct{}),
+	}
+
+	if quota.path != "" {
+		err := quota.load()
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", quota.path, err)
+		}
+
+		quota.wg.Add(1)
+		go func() {
+			defer quota.wg.Done()
+
+			t := time.NewTicker(saveInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-quota.done:
+					return
+				case <-t.C:
+				}
+
+				err := quota.Save()
+				if err != nil {
+					log.Errorln(fmt.Errorf("save quota %s: %w", quota.path, err))
+				}
+			}
+		}()
+	}
+
+	return quota, nil
+}
+
+// SetLimit overrides the quota of the identity in MB a day and in a month, 0 uses the quota of all identities.
+func (quota *Quota) SetLimit(identity string, daily, monthly int) error {
+	if daily < 0 {
+		return fmt.Errorf("daily %d out of range", daily)
+	}
+	if monthly < 0 {
+		return fmt.Errorf("monthly %d out of range", monthly)
+	}
+
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	quota.limits[identity] = &limit{
+		daily:   uint64(daily) * 1024 * 1024,
+		monthly: uint64(monthly) * 1024 * 1024,
+	}
+
+	// Usages restored are judged again
+	u, ok := quota.usages[identity]
+	if ok {
+		u.isExceeded = quota.isExceeded(identity, u)
+	}
+
+	return nil
+}
+
+// Allow adds the size to the usage of the identity and returns if the traffic may pass. Traffic which does not pass is
+// not counted in the usage.
+func (quota *Quota) Allow(identity string, size int) bool {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	now := time.Now()
+	quota.reset(now)
+
+	u, ok := quota.usages[identity]
+	if !ok {
+		u = &usage{}
+		quota.usages[identity] = u
+	}
+
+	if u.isExceeded {
+		switch quota.action {
+		case ActionThrottle:
+			// Token bucket holding tokens no more than a second
+			u.tokens = u.tokens + now.Sub(u.lastRefresh).Seconds()*float64(quota.throttle)
+			if u.tokens > float64(quota.throttle) {
+				u.tokens = float64(quota.throttle)
+			}
+			u.lastRefresh = now
+
+			if u.tokens < float64(size) {
+				return false
+			}
+			u.tokens = u.tokens - float64(size)
+		case ActionDisconnect:
+			return false
+		default:
+			panic(fmt.Errorf("action %d out of range", quota.action))
+		}
+	}
+
+	u.Daily = u.Daily + uint64(size)
+	u.Monthly = u.Monthly + uint64(size)
+
+	if !u.isExceeded && quota.isExceeded(identity, u) {
+		u.isExceeded = true
+		u.lastRefresh = now
+
+		quota.hook.Notifyf(hook.EventQuotaExceeded, "Client %s exceeds quota", identity)
+
+		switch quota.action {
+		case ActionThrottle:
+			log.Infof("Client %s exceeds quota, throttle to %d Bytes/s\n", identity, quota.throttle)
+		case ActionDisconnect:
+			log.Infof("Client %s exceeds quota, disconnect until the quota resets\n", identity)
+		default:
+			panic(fmt.Errorf("action %d out of range", quota.action))
+		}
+	}
+
+	return true
+}
+
+// IsDisconnected returns if the identity exceeds its quota in the action of disconnect, which should be disconnected
+// until the quota resets.
+func (quota *Quota) IsDisconnected(identity string) bool {
+	if quota.action != ActionDisconnect {
+		return false
+	}
+
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	quota.reset(time.Now())
+
+	u, ok := quota.usages[identity]
+
+	return ok && u.isExceeded
+}
+
+// Save persists usages in the file.
+func (quota *Quota) Save() error {
+	if quota.path == "" {
+		return nil
+	}
+
+	quota.lock.Lock()
+	b, err := json.MarshalIndent(quota.snapshot(), "", "  ")
+	quota.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	// Write to a temporary file first, so the file is never left half written
+	tmp := quota.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	err = os.Rename(tmp, quota.path)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
+
+// Close saves usages and closes the quota after the periodic save has exited.
+func (quota *Quota) Close() error {
+	if !quota.isClosed {
+		quota.isClosed = true
+		close(quota.done)
+	}
+	quota.wg.Wait()
+
+	return quota.Save()
+}
+
+func (quota *Quota) MarshalJSON() ([]byte, error) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	return json.Marshal(quota.snapshot())
+}
+
+type quotaSnapshot struct {
+	Day    string            `json:"day"`
+	Month  string            `json:"month"`
+	Usages map[string]*usage `json:"usages"`
+}
+
+func (quota *Quota) snapshot() *quotaSnapshot {
+	usages := make(map[string]*usage)
+	for identity, u := range quota.usages {
+		usages[identity] = &usage{Daily: u.Daily, Monthly: u.Monthly}
+	}
+
+	return &quotaSnapshot{
+		Day:    quota.day,
+		Month:  quota.month,
+		Usages: usages,
+	}
+}
+
+func (quota *Quota) load() error {
+	b, err := ioutil.ReadFile(quota.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read: %w", err)
+	}
+
+	s := &quotaSnapshot{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	// Usages in past periods are not restored
+	if s.Month != quota.month {
+		return nil
+	}
+	for identity, u := range s.Usages {
+		if s.Day != quota.day {
+			u.Daily = 0
+		}
+		u.isExceeded = quota.isExceeded(identity, u)
+		u.lastRefresh = time.Now()
+
+		quota.usages[identity] = u
+	}
+
+	return nil
+}
+
+// reset resets usages when a new day or month begins.
+func (quota *Quota) reset(t time.Time) {
+	day, month := t.Format(dayLayout), t.Format(monthLayout)
+	if day == quota.day {
+		return
+	}
+
+	for identity, u := range quota.usages {
+		u.Daily = 0
+		if month != quota.month {
+			u.Monthly = 0
+		}
+		u.isExceeded = quota.isExceeded(identity, u)
+	}
+
+	quota.day = day
+	quota.month = month
+}
+
+func (quota *Quota) isExceeded(identity string, u *usage) bool {
+	daily, monthly := quota.daily, quota.monthly
+	l, ok := quota.limits[identity]
+	if ok {
+		if l.daily > 0 {
+			daily = l.daily
+		}
+		if l.monthly > 0 {
+			monthly = l.monthly
+		}
+	}
+
+	return (daily > 0 && u.Daily >= daily) || (monthly > 0 && u.Monthly >= monthly)
+}
@@ -41,6 +41,29 @@ func (addr MultiTCPAddr) Network() string {
 	return "tcp"
 }
 
+// MultiAddr represents multiple addresses.
+type MultiAddr struct {
+	Addrs []net.Addr
+}
+
+func (addr MultiAddr) String() string {
+	s := make([]string, 0)
+
+	for _, addr := range addr.Addrs {
+		s = append(s, addr.String())
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (addr MultiAddr) Network() string {
+	if len(addr.Addrs) <= 0 {
+		return ""
+	}
+
+	return addr.Addrs[0].Network()
+}
+
 // ParseTCPAddr returns an TCPAddr by the given address.
 func ParseTCPAddr(s string) (*net.TCPAddr, error) {
 	ipStr, portStr, err := net.SplitHostPort(s)
@@ -65,6 +88,53 @@ func ParseTCPAddr(s string) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
 }
 
+// ResolveTCPAddrs returns all TCPAddrs by the given address. IPv6 and IPv4 addresses are interleaved with an IPv6
+// address at first, the order which attempts should be made in dual-stack dialing.
+func ResolveTCPAddrs(s string) ([]*net.TCPAddr, error) {
+	ipStr, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("split host port: %w", err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port %s: %w", portStr, err)
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip != nil {
+		return []*net.TCPAddr{{IP: ip, Port: int(port)}}, nil
+	}
+
+	ips, err := net.LookupIP(ipStr)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %w", err)
+	}
+
+	ipv4Addrs := make([]*net.TCPAddr, 0)
+	ipv6Addrs := make([]*net.TCPAddr, 0)
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4Addrs = append(ipv4Addrs, &net.TCPAddr{IP: ip, Port: int(port)})
+		} else {
+			ipv6Addrs = append(ipv6Addrs, &net.TCPAddr{IP: ip, Port: int(port)})
+		}
+	}
+
+	// Interleave
+	result := make([]*net.TCPAddr, 0, len(ips))
+	for i := 0; i < len(ipv4Addrs) || i < len(ipv6Addrs); i++ {
+		if i < len(ipv6Addrs) {
+			result = append(result, ipv6Addrs[i])
+		}
+		if i < len(ipv4Addrs) {
+			result = append(result, ipv4Addrs[i])
+		}
+	}
+
+	return result, nil
+}
+
 func bpfFilter(prefix string, addr net.Addr) (string, error) {
 	switch t := addr.(type) {
 	case *net.IPAddr:
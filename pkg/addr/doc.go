@@ -0,0 +1,2 @@
+// Package addr implements addresses and their parsing in IkaGo.
+package addr
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"errors"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"ikago/pkg/stat"
+	"sync"
+)
+
+// Stats describes statistics of a client.
+type Stats struct {
+	Monitor    *stat.TrafficMonitor   `json:"monitor"`
+	Fragments  *stat.FragmentMonitor  `json:"fragments"`
+	Rejections *stat.RejectionMonitor `json:"rejections"`
+	Malformed  *stat.MalformedMonitor `json:"malformed"`
+	Latency    *stat.LatencyMonitor   `json:"latency"`
+	Delivery   *stat.DeliveryMonitor  `json:"delivery"`
+	Errors     *log.ErrorAggregator   `json:"errors"`
+}
+
+// Client is a client of IkaGo which captures packets from sources and proxies them to the server.
+type Client struct {
+	lock     sync.Mutex
+	cfg      config.Config
+	engine   *engine
+	isOpened bool
+}
+
+// New returns a client with the given configuration. Devices are selected here but nothing is opened until Start.
+func New(cfg *config.Config) (*Client, error) {
+	e, err := newEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{cfg: *cfg, engine: e}, nil
+}
+
+// Start opens devices and the connection to the server, and handles packets in background.
+func (c *Client) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.start()
+}
+
+func (c *Client) start() error {
+	if c.isOpened {
+		if !c.engine.closed() {
+			return errors.New("client is running")
+		}
+
+		// An engine can only be opened once
+		e, err := newEngine(&c.cfg)
+		if err != nil {
+			return err
+		}
+		c.engine = e
+	}
+
+	c.isOpened = true
+	err := c.engine.open()
+	if err != nil {
+		c.engine.closeAll(err)
+		return err
+	}
+
+	return nil
+}
+
+// Stop closes devices and the connection to the server. Firewall rules added by the client are left untouched.
+func (c *Client) Stop() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.isOpened {
+		return errors.New("client is not running")
+	}
+
+	c.engine.closeAll(nil)
+
+	return nil
+}
+
+// Wait blocks until the client is stopped and returns the error which stopped it, if any. Wait keeps blocking
+// across reloads.
+func (c *Client) Wait() error {
+	for {
+		c.lock.Lock()
+		e := c.engine
+		c.lock.Unlock()
+
+		<-e.done
+
+		c.lock.Lock()
+		reloaded := c.engine != e
+		c.lock.Unlock()
+		if !reloaded {
+			return e.err
+		}
+	}
+}
+
+// Stats returns statistics of the client. Statistics restart after reloading.
+func (c *Client) Stats() *Stats {
+	c.lock.Lock()
+	e := c.engine
+	c.lock.Unlock()
+
+	return &Stats{
+		Monitor:    e.monitor,
+		Fragments:  e.fragMonitor,
+		Rejections: e.rejMonitor,
+		Malformed:  e.malMonitor,
+		Latency:    e.latMonitor,
+		Delivery:   e.delMonitor,
+		Errors:     log.Aggregation(),
+	}
+}
+
+// Names returns names of addresses recorded from DNS responses.
+func (c *Client) Names() map[string]string {
+	c.lock.Lock()
+	e := c.engine
+	c.lock.Unlock()
+
+	names := make(map[string]string)
+
+	e.dnsLock.RLock()
+	for ip, name := range e.dns {
+		names[ip] = name
+	}
+	e.dnsLock.RUnlock()
+
+	return names
+}
+
+// Reload applies the configuration to the client. The configuration is verified before the client is stopped, and
+// the client is started again if it was running.
+func (c *Client) Reload(cfg *config.Config) error {
+	e, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	isRunning := c.isOpened && !c.engine.closed()
+	c.engine.closeAll(nil)
+
+	c.cfg = *cfg
+	c.engine = e
+	c.isOpened = false
+
+	if isRunning {
+		return c.start()
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+// +build darwin freebsd linux
+
+package client
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the CPU time of the process in both user and system.
+func processCPUTime() (time.Duration, error) {
+	var usage syscall.Rusage
+
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), nil
+}
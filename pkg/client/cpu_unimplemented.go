@@ -0,0 +1,12 @@
+// +build !darwin,!linux,!freebsd
+
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("cpu time not support")
+}
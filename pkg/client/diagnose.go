@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/pcap"
+)
+
+// Diagnose finds how middleboxes on the path to the server with the given configuration mangle traffic, and reports a
+// finding of each probe. Probes are messages in band with crafted TTL, DF, TOS, TCP options and sizes, and the server
+// reports their headers as received. Sources are not required.
+func Diagnose(ctx context.Context, cfg *config.Config, report func(*pcap.Finding)) error {
+	e, conn, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer e.closeAll(nil)
+
+	err = pcap.NewDiagnoser(conn).Run(ctx, report)
+	if err != nil {
+		return fmt.Errorf("diagnose: %w", err)
+	}
+
+	return nil
+}
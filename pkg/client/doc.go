@@ -0,0 +1,5 @@
+// Package client implements the client of IkaGo which can be embedded in other applications.
+//
+// Client is stable. Options global to package pcap, such as validation and extra filters, are shared by all clients and
+// servers in a process.
+package client
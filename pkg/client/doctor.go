@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/exec"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"net"
+	"time"
+)
+
+const (
+	// doctorNTPServer is the NTP server the clock is compared with.
+	doctorNTPServer = "pool.ntp.org:123"
+	// doctorTimeout is the time waiting for the NTP server and the handshake with the server.
+	doctorTimeout = 3 * time.Second
+	// ntpEpochOffset is the seconds from the epoch of NTP to the epoch of Unix.
+	ntpEpochOffset = 2208988800
+)
+
+// Check describes the result of a check of the environment. Checks not passed carry a hint of remediation.
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Doctor checks the environment of the client with the given configuration, which is the installation of pcap,
+// detection of devices and the gateway, capture privileges, firewall rules against resets of the kernel, clock skew
+// and reachability of the server by a handshake only, and reports the result of each check. Nothing in the system is
+// changed, and sources are not required.
+func Doctor(ctx context.Context, cfg *config.Config, report func(*Check)) error {
+	// Pcap
+	version := pcap.LibVersion()
+	if version == "" {
+		report(&Check{Name: "pcap", Detail: "library of pcap not found", Hint: "install libpcap, or Npcap in WinPcap API-compatible mode on Windows"})
+		return errors.New("missing pcap")
+	}
+	report(&Check{Name: "pcap", Passed: true, Detail: version})
+
+	// Devices
+	devs, err := pcap.FindAllDevs()
+	if err != nil || len(devs) <= 0 {
+		check := &Check{Name: "devices", Detail: "no device found", Hint: "check network interfaces are up with IPv4 addresses"}
+		if err != nil {
+			check.Detail = err.Error()
+		}
+		report(check)
+	} else {
+		report(&Check{Name: "devices", Passed: true, Detail: fmt.Sprintf("%d devices found", len(devs))})
+	}
+
+	// Gateway
+	gateway, err := pcap.FindGatewayAddr()
+	if err != nil {
+		report(&Check{Name: "gateway", Detail: err.Error(), Hint: "provide gateway by -gateway"})
+	} else {
+		report(&Check{Name: "gateway", Passed: true, Detail: gateway.String()})
+	}
+
+	// Clock skew, which fails proofs of stealth mode and cookies
+	offset, err := queryClockOffset(doctorNTPServer)
+	if err != nil {
+		report(&Check{Name: "clock", Detail: fmt.Sprintf("query %s: %s", doctorNTPServer, err), Hint: "allow NTP, or make sure the clock is synchronized"})
+	} else {
+		check := &Check{Name: "clock", Passed: true, Detail: fmt.Sprintf("offset %.3f s from %s", offset.Seconds(), doctorNTPServer)}
+		if offset > crypto.ProofWindow/3 || offset < -crypto.ProofWindow/3 {
+			check.Passed = false
+			check.Hint = fmt.Sprintf("synchronize the clock, -stealth and -cookie need clocks within %.0f seconds of the server until the skew is measured in band", crypto.ProofWindow.Seconds())
+		}
+		report(check)
+	}
+
+	// Configuration and devices in use, the firewall rule is checked instead of added
+	copied := *cfg
+	copied.Rule = false
+	e, err := createEngine(&copied)
+	if err != nil {
+		report(&Check{Name: "configuration", Detail: err.Error(), Hint: "fix the configuration, or provide devices by -upstream-device and -gateway"})
+		return errors.New("invalid configuration")
+	}
+	report(&Check{Name: "configuration", Passed: true, Detail: fmt.Sprintf("upstream device %s, gateway device %s", e.upDev.Alias(), e.gatewayDev.Alias())})
+
+	// Capture privileges
+	conn, err := pcap.CreateRawConn(e.upDev, e.gatewayDev, "tcp", e.captureOptions()...)
+	if err != nil {
+		report(&Check{Name: "privileges", Detail: err.Error(), Hint: "run as root or with CAP_NET_RAW and CAP_NET_ADMIN, or as administrator on Windows"})
+		return errors.New("cannot capture")
+	}
+	_ = conn.Close()
+	report(&Check{Name: "privileges", Passed: true, Detail: fmt.Sprintf("capture in %s", e.upDev.Alias())})
+
+	if e.mode != "faketcp" {
+		return nil
+	}
+
+	// Firewall rules against resets of the kernel
+	if e.hop != nil {
+		report(&Check{Name: "firewall", Passed: true, Detail: "skipped in port hopping"})
+	} else {
+		ok, err := exec.HasSpecificFirewallRule(e.serverIP, e.serverPort)
+		switch {
+		case err != nil:
+			report(&Check{Name: "firewall", Detail: err.Error(), Hint: "make sure resets of the kernel to the server are blocked"})
+		case !ok:
+			report(&Check{Name: "firewall", Detail: "resets of the kernel to the server are not blocked", Hint: "add firewall rule by -rule"})
+		default:
+			report(&Check{Name: "firewall", Passed: true, Detail: "resets of the kernel to the server are blocked"})
+		}
+	}
+
+	// Reachability of the server
+	start := time.Now()
+	e, upConn, err := connect(&copied)
+	if err != nil {
+		report(&Check{Name: "server", Detail: err.Error(), Hint: "check the server address"})
+		return nil
+	}
+	defer e.closeAll(nil)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-upConn.Established():
+		report(&Check{Name: "server", Passed: true, Detail: fmt.Sprintf("handshake with %s in %.3f ms", cfg.Server, float64(time.Now().Sub(start).Microseconds())/1000)})
+	case <-time.After(doctorTimeout):
+		report(&Check{Name: "server", Detail: fmt.Sprintf("no handshake with %s", cfg.Server), Hint: "check the server is up, its port is open, and -method, -cookie and -stealth match the server"})
+	}
+
+	return nil
+}
+
+// queryClockOffset returns the offset of the clock from the NTP server in SNTP.
+func queryClockOffset(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, doctorTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(doctorTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("set deadline: %w", err)
+	}
+
+	// Leap indicator of 0, version of 4 and mode of client
+	b := make([]byte, 48)
+	b[0] = 0x23
+
+	t1 := time.Now()
+	_, err = conn.Write(b)
+	if err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+	n, err := conn.Read(b)
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+	t4 := time.Now()
+	if n < 48 || b[0]&0x7 != 4 {
+		return 0, errors.New("invalid response")
+	}
+
+	t2, t3 := ntpTime(b[32:40]), ntpTime(b[40:48])
+
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	sec, frac := binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:8])
+
+	return time.Unix(int64(sec)-ntpEpochOffset, int64(frac)*1e9>>32)
+}
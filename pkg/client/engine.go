@@ -0,0 +1,1804 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/exec"
+	"ikago/internal/hook"
+	"ikago/internal/log"
+	"ikago/pkg/addr"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/stat"
+	"ikago/pkg/transform"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+type natIndicator struct {
+	srcHardwareAddr net.HardwareAddr
+	conn            *pcap.RawConn
+}
+
+const refreshInterval = 5 * time.Second
+
+const resolveInterval = 1 * time.Minute
+
+// queueSize and lowMemoryQueueSize are the max count of packets queued before they are handled, in normal and in
+// low-memory mode.
+const (
+	queueSize          = 1000
+	lowMemoryQueueSize = 64
+)
+
+// lowMemoryGCPercent is the percentage of garbage collection in low-memory mode.
+const lowMemoryGCPercent = 50
+
+// maxPorts is the max count of ports connected to the server simultaneously.
+const maxPorts = 16
+
+// engine is a single run of a client, it is created from a configuration and can
+// be opened only once.
+type engine struct {
+	publishIP    *net.IPAddr
+	upPort       uint16
+	ports        int
+	isStripe     bool
+	rotate       time.Duration
+	hop          *pcap.HopSchedule
+	state        string
+	sources      []*net.IPAddr
+	serverName   string
+	serverAddrs  []*net.TCPAddr
+	serverIP     net.IP
+	serverPort   uint16
+	routes       []*route
+	listenDevs   []*pcap.Device
+	upDevName    string
+	gateway      net.IP
+	gatewayMAC   net.HardwareAddr
+	upDev        *pcap.Device
+	gatewayDev   *pcap.Device
+	mac          net.HardwareAddr
+	mode         string
+	isRule       bool
+	isLowMemory  bool
+	crypt        crypto.Crypt
+	mtu          int
+	fragment     int
+	isNoFragment bool
+	defragConfig *config.DefragConfig
+	scheduler    pcap.Scheduler
+	congestion   pcap.CongestionControlFactory
+	dscp         uint8
+	isCopyTOS    bool
+	ttl          uint8
+	chaff        int
+	probe        time.Duration
+	feedback     time.Duration
+	rekey        time.Duration
+	adaptive     []float64
+	isBlackhole  bool
+	tolerance    int
+	impairment   *pcap.Impairment
+	cookie       *crypto.Cookie
+	validation   pcap.Validation
+	isChecksum   bool
+	preamble     pcap.Preamble
+	wireVersion  int
+	tls          *pcap.TLSMimicry
+	isTyped      bool
+	isPrefixed   bool
+	traceFilter  *pcap.TraceFilter
+	isTraceHex   bool
+	filter       string
+	pcapConfig   *config.PcapConfig
+	backend      string
+	tunnelFilter string
+	sflowConfig  *config.SFlowConfig
+	hook         *hook.Hook
+	appFilter    string
+	isKCP        bool
+	kcpConfig    *config.KCPConfig
+	queueSize    int
+
+	isClosed    bool
+	closeOnce   sync.Once
+	done        chan struct{}
+	err         error
+	listenConns []*pcap.RawConn
+	upConn      net.Conn
+	sflow       *pcap.SFlow
+	c           chan pcap.ConnPacket
+	natLock     sync.RWMutex
+	nat         map[string]*natIndicator
+	monitor     *stat.TrafficMonitor
+	fragMonitor *stat.FragmentMonitor
+	rejMonitor  *stat.RejectionMonitor
+	malMonitor  *stat.MalformedMonitor
+	latMonitor  *stat.LatencyMonitor
+	delMonitor  *stat.DeliveryMonitor
+	arpCache    *pcap.ARPCache
+	dnsLock     sync.RWMutex
+	dns         map[string]string
+}
+
+func newEngine(cfg *config.Config) (*engine, error) {
+	if len(cfg.Sources) <= 0 {
+		return nil, errors.New("missing sources")
+	}
+
+	return createEngine(cfg)
+}
+
+// createEngine returns an engine without sources verified, which can only be used to connect to the server.
+func createEngine(cfg *config.Config) (*engine, error) {
+	var (
+		err        error
+		gateway    net.IP
+		gatewayMAC net.HardwareAddr
+		mac        net.HardwareAddr
+	)
+
+	// Defaults are filled into a copy so the configuration is left untouched
+	copied := *cfg
+	cfg = &copied
+
+	// Buffers, caches and windows are lowered in low-memory mode
+	size := queueSize
+	if cfg.LowMemory {
+		cfg.ApplyLowMemory()
+		size = lowMemoryQueueSize
+	}
+
+	e := &engine{
+		sources:     make([]*net.IPAddr, 0),
+		listenDevs:  make([]*pcap.Device, 0),
+		done:        make(chan struct{}),
+		listenConns: make([]*pcap.RawConn, 0),
+		c:           make(chan pcap.ConnPacket, size),
+		queueSize:   size,
+		nat:         make(map[string]*natIndicator),
+		monitor:     stat.NewTrafficMonitor(),
+		fragMonitor: stat.NewFragmentMonitor(),
+		rejMonitor:  stat.NewRejectionMonitor(),
+		malMonitor:  stat.NewMalformedMonitor(),
+		latMonitor:  stat.NewLatencyMonitor(),
+		delMonitor:  stat.NewDeliveryMonitor(),
+		dns:         make(map[string]string),
+	}
+
+	// Application profile, settings set explicitly are kept
+	if cfg.App != "" {
+		app, err := config.FindApp(cfg.App, cfg.Apps)
+		if err != nil {
+			return nil, fmt.Errorf("find app: %w", err)
+		}
+
+		fs := make([]string, 0)
+		for _, port := range app.Ports {
+			rule, err := pcap.ParseClassRule(port)
+			if err != nil {
+				return nil, fmt.Errorf("parse port %s of app %s: %w", port, cfg.App, err)
+			}
+			fs = append(fs, rule.BPFFilter())
+		}
+		e.appFilter = strings.Join(fs, " || ")
+
+		if app.MTU > 0 && cfg.MTU <= 0 {
+			cfg.MTU = app.MTU
+		}
+		if app.KCP != "" {
+			kcpConfig, err := config.NewKCPPreset(app.KCP)
+			if err != nil {
+				return nil, fmt.Errorf("parse kcp preset of app %s: %w", cfg.App, err)
+			}
+
+			cfg.KCP = true
+			if cfg.KCPConfig == *config.NewKCPConfig() {
+				cfg.KCPConfig = *kcpConfig
+			}
+		}
+
+		var class *config.QoSClassConfig
+		switch strings.ToLower(app.Class) {
+		case "":
+			break
+		case "realtime":
+			class = &cfg.QoSConfig.Realtime
+		case "normal":
+			class = &cfg.QoSConfig.Normal
+		case "bulk":
+			class = &cfg.QoSConfig.Bulk
+		default:
+			return nil, fmt.Errorf("class %s of app %s not support", app.Class, cfg.App)
+		}
+		if class != nil {
+			// Rules are appended to a new slice so the configuration is left untouched
+			class.Match = append(append(make([]string, 0), class.Match...), app.Ports...)
+		}
+
+		log.Infof("Use app %s\n", cfg.App)
+	}
+
+	// Verify parameters
+	if cfg.Server == "" {
+		return nil, errors.New("missing server")
+	}
+	if cfg.Gateway != "" {
+		gateway = net.ParseIP(cfg.Gateway)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %s", cfg.Gateway)
+		}
+	}
+	if cfg.GatewayMAC != "" {
+		gatewayMAC, err = net.ParseMAC(cfg.GatewayMAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway hardware address %s", cfg.GatewayMAC)
+		}
+	}
+	switch cfg.MAC {
+	case "":
+		break
+	case "random":
+		mac, err = pcap.RandomHardwareAddr()
+		if err != nil {
+			return nil, fmt.Errorf("random hardware address: %w", err)
+		}
+	default:
+		mac, err = net.ParseMAC(cfg.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware address %s", cfg.MAC)
+		}
+	}
+	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
+		return nil, fmt.Errorf("monitor port %d out of range", cfg.Monitor)
+	}
+	if cfg.MTU < 576 || cfg.MTU > pcap.MaxJumboMTU {
+		if cfg.MTU == 0 {
+			cfg.MTU = pcap.MaxMTU
+		} else {
+			return nil, fmt.Errorf("mtu %d out of range", cfg.MTU)
+		}
+	}
+	if cfg.FragmentSize < 68 || cfg.FragmentSize > cfg.MTU {
+		if cfg.FragmentSize == 0 {
+			cfg.FragmentSize = cfg.MTU
+		} else {
+			return nil, fmt.Errorf("fragment size %d out of range", cfg.FragmentSize)
+		}
+	}
+	if cfg.PcapConfig.Buffer < 0 {
+		return nil, fmt.Errorf("pcap buffer %d out of range", cfg.PcapConfig.Buffer)
+	}
+	// Packets larger than the snaplen are truncated
+	if cfg.PcapConfig.SnapLen != 0 && (cfg.PcapConfig.SnapLen < cfg.MTU+14 || cfg.PcapConfig.SnapLen > 262144) {
+		return nil, fmt.Errorf("pcap snaplen %d out of range", cfg.PcapConfig.SnapLen)
+	}
+	if cfg.PcapConfig.Timeout < 0 {
+		return nil, fmt.Errorf("pcap timeout %d out of range", cfg.PcapConfig.Timeout)
+	}
+	if cfg.DefragConfig.Deadline < 0 {
+		return nil, fmt.Errorf("defrag deadline %d out of range", cfg.DefragConfig.Deadline)
+	}
+	if cfg.DefragConfig.Limit <= 0 {
+		return nil, fmt.Errorf("defrag limit %d out of range", cfg.DefragConfig.Limit)
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1000 {
+		return nil, fmt.Errorf("jitter %d out of range", cfg.Jitter)
+	}
+	if cfg.Priority < 0 {
+		return nil, fmt.Errorf("priority %d out of range", cfg.Priority)
+	}
+	if cfg.Probe < 0 {
+		return nil, fmt.Errorf("probe %d out of range", cfg.Probe)
+	}
+	if cfg.Feedback < 0 {
+		return nil, fmt.Errorf("feedback %d out of range", cfg.Feedback)
+	}
+	if cfg.Rekey < 0 {
+		return nil, fmt.Errorf("rekey %d out of range", cfg.Rekey)
+	}
+	if len(cfg.Adaptive) > pcap.MaxDuplicates {
+		return nil, fmt.Errorf("adaptive thresholds %d out of range", len(cfg.Adaptive))
+	}
+	for i, threshold := range cfg.Adaptive {
+		if threshold <= 0 || threshold > 100 {
+			return nil, fmt.Errorf("adaptive threshold %g out of range", threshold)
+		}
+		if i > 0 && threshold <= cfg.Adaptive[i-1] {
+			return nil, errors.New("adaptive thresholds not in ascending order")
+		}
+	}
+	if cfg.Chaff < 0 {
+		return nil, fmt.Errorf("chaff %d out of range", cfg.Chaff)
+	}
+	if cfg.KCPConfig.MTU > 1500 {
+		return nil, fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU)
+	}
+	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
+		return nil, fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow)
+	}
+	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
+		return nil, fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow)
+	}
+	if cfg.KCPConfig.DataShard < 0 {
+		return nil, fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard)
+	}
+	if cfg.KCPConfig.ParityShard < 0 {
+		return nil, fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard)
+	}
+	if cfg.KCPConfig.Interval < 0 {
+		return nil, fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval)
+	}
+	if cfg.KCPConfig.Resend < 0 {
+		return nil, fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend)
+	}
+	if cfg.KCPConfig.NC < 0 {
+		return nil, fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC)
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("upstream port %d out of range", cfg.Port)
+	}
+	if cfg.Ports < 0 || cfg.Ports > maxPorts {
+		return nil, fmt.Errorf("ports %d out of range", cfg.Ports)
+	}
+	if cfg.Ports == 0 {
+		cfg.Ports = 1
+	}
+	if cfg.Rotate < 0 {
+		return nil, fmt.Errorf("rotate %d out of range", cfg.Rotate)
+	}
+	if cfg.Hop < 0 {
+		return nil, fmt.Errorf("hop %d out of range", cfg.Hop)
+	}
+
+	// Randomize upstream port
+	if cfg.Port == 0 {
+		s := rand.NewSource(time.Now().UnixNano())
+		for cfg.Port == 0 || cfg.Port == cfg.Monitor {
+			r := rand.New(s)
+			cfg.Port = 49152 + r.Intn(16384)
+		}
+	}
+	if cfg.Monitor != 0 && cfg.Monitor == cfg.Port {
+		return nil, errors.New("same monitor port with upstream port")
+	}
+	e.upPort = uint16(cfg.Port)
+
+	// Sources
+	for _, source := range cfg.Sources {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source %s", source)
+		}
+		e.sources = append(e.sources, &net.IPAddr{IP: ip})
+	}
+
+	// Publish
+	if cfg.Publish != "" {
+		ip := net.ParseIP(cfg.Publish)
+		if ip == nil {
+			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
+		}
+		e.publishIP = &net.IPAddr{IP: ip}
+	}
+	if e.publishIP != nil {
+		log.Infof("Publish %s\n", e.publishIP.IP)
+	}
+
+	// Mode
+	switch cfg.Mode {
+	case "faketcp":
+		e.mode = "faketcp"
+		log.Infoln("Use FakeTCP")
+	case "tcp":
+		e.mode = "tcp"
+		log.Infoln("Use standard TCP")
+	default:
+		return nil, fmt.Errorf("mode %s not support", cfg.Mode)
+	}
+
+	// Multiple ports and rotation
+	e.ports = cfg.Ports
+	e.rotate = time.Duration(cfg.Rotate) * time.Second
+	if e.ports > 1 || e.rotate > 0 {
+		if e.mode != "faketcp" {
+			return nil, fmt.Errorf("ports and rotation cannot be set in mode %s", e.mode)
+		}
+		// Sessions of KCP are bound to ports
+		if cfg.KCP {
+			return nil, errors.New("ports and rotation cannot be set with kcp")
+		}
+		if e.ports > 1 {
+			log.Infof("Spread flows among %d ports\n", e.ports)
+		}
+		if e.rotate > 0 {
+			log.Infof("Rotate ports every %d s\n", cfg.Rotate)
+		}
+	}
+
+	// Striping
+	e.isStripe = cfg.Stripe
+	if e.isStripe {
+		if e.ports <= 1 {
+			return nil, errors.New("stripe requires ports")
+		}
+		log.Infof("Stripe packets among %d ports\n", e.ports)
+	}
+
+	// Port hopping
+	if cfg.Hop > 0 {
+		if e.mode != "faketcp" {
+			return nil, fmt.Errorf("hop cannot be set in mode %s", e.mode)
+		}
+		if cfg.KCP {
+			return nil, errors.New("hop cannot be set with kcp")
+		}
+		// Ports are rotated by hopping
+		if e.rotate > 0 {
+			return nil, errors.New("hop and rotation cannot be set together")
+		}
+		// Ports are derived from the password shared with the server
+		if cfg.Password == "" {
+			return nil, errors.New("hop requires password")
+		}
+		min, max, err := pcap.ParsePortRange(cfg.HopPorts)
+		if err != nil {
+			return nil, fmt.Errorf("parse hop ports %s: %w", cfg.HopPorts, err)
+		}
+		e.hop, err = pcap.NewHopSchedule([]byte(cfg.Password), min, max, time.Duration(cfg.Hop)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("create hop schedule: %w", err)
+		}
+		log.Infof("Hop among ports %d-%d every %d s\n", min, max, cfg.Hop)
+	}
+
+	// Session persistence
+	e.state = cfg.State
+	if e.state != "" {
+		if e.mode != "faketcp" {
+			return nil, fmt.Errorf("state cannot be set in mode %s", e.mode)
+		}
+		if cfg.KCP {
+			return nil, errors.New("state cannot be set with kcp")
+		}
+		// Only a single connection is resumed
+		if e.ports > 1 || e.rotate > 0 || e.hop != nil {
+			return nil, errors.New("state cannot be set with ports, rotation or hop")
+		}
+		// Keys changed in rekeys are not saved, so sessions resumed are in keys servers no longer accept
+		if cfg.Rekey > 0 {
+			return nil, errors.New("state cannot be set with rekey")
+		}
+		log.Infof("Persist session in %s\n", e.state)
+	}
+
+	// Server
+	e.serverName = cfg.Server
+	e.serverAddrs, err = e.resolveServer(e.serverName)
+	if err != nil {
+		return nil, fmt.Errorf("parse server %s: %w", cfg.Server, err)
+	}
+	e.serverIP = e.serverAddrs[0].IP
+	e.serverPort = uint16(e.serverAddrs[0].Port)
+
+	// Routes
+	err = e.parseRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range cfg.Routes {
+		log.Infof("Route %s through %s\n", strings.Join(r.Match, ", "), r.Server)
+	}
+
+	// Crypt
+	e.crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("parse crypt: %w", err)
+	}
+	if e.crypt.Method() != crypto.MethodPlain {
+		log.Infof("Encrypt with %s\n", crypto.Name(e.crypt))
+	}
+
+	// Transforms
+	pipeline, err := transform.NewPipeline(e.crypt, cfg.Transforms)
+	if err != nil {
+		return nil, fmt.Errorf("parse transforms: %w", err)
+	}
+	if len(cfg.Transforms) > 1 {
+		log.Infof("Transform in %s\n", pipeline)
+	}
+	e.crypt = pipeline
+
+	// Defragmentation
+	switch strings.ToLower(cfg.DefragConfig.Mode) {
+	case "easy":
+		break
+	case "strict":
+		log.Infoln("Use strict defragmentation")
+	default:
+		return nil, fmt.Errorf("defrag mode %s not support", cfg.DefragConfig.Mode)
+	}
+	e.defragConfig = &cfg.DefragConfig
+
+	// Validation
+	validation, err := pcap.ParseValidation(cfg.Validation)
+	if err != nil {
+		return nil, fmt.Errorf("parse validation: %w", err)
+	}
+	e.validation = validation
+	if validation != pcap.ValidationNormal {
+		log.Infof("Use %s validation\n", validation)
+	}
+
+	// Checksum
+	e.isChecksum = cfg.Checksum
+	if e.isChecksum {
+		log.Infoln("Verify checksums of packets in the tunnel")
+	}
+	e.isRule = cfg.Rule
+
+	// Low-memory mode
+	e.isLowMemory = cfg.LowMemory
+
+	// Preamble
+	e.preamble, err = pcap.ParsePreamble(cfg.Preamble)
+	if err != nil {
+		return nil, fmt.Errorf("parse preamble: %w", err)
+	}
+
+	// Wire version
+	e.wireVersion = cfg.WireVersion
+	if e.wireVersion == 0 {
+		e.wireVersion = pcap.WireVersion
+	}
+
+	// Filter
+	e.filter = cfg.Filter
+
+	// Pcap tuning
+	e.pcapConfig = &cfg.PcapConfig
+
+	// Backend
+	e.backend, err = pcap.ParseBackend(cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("parse backend: %w", err)
+	}
+
+	// sFlow
+	if cfg.SFlowConfig.Rate <= 0 {
+		return nil, fmt.Errorf("sflow rate %d out of range", cfg.SFlowConfig.Rate)
+	}
+	e.sflowConfig = &cfg.SFlowConfig
+
+	// Hook
+	if cfg.HookConfig.URL != "" || cfg.HookConfig.Script != "" {
+		e.hook, err = hook.New(cfg.HookConfig.URL, cfg.HookConfig.Script, cfg.HookConfig.Events)
+		if err != nil {
+			return nil, fmt.Errorf("create hook: %w", err)
+		}
+		log.Infoln("Notify events by hook")
+	}
+
+	// Traffic tunneled
+	if len(cfg.Tunnel) > 0 {
+		fs := make([]string, 0)
+		for _, s := range cfg.Tunnel {
+			rule, err := pcap.ParseRouteRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse tunnel %s: %w", s, err)
+			}
+			fs = append(fs, rule.BPFFilter())
+		}
+		e.tunnelFilter = strings.Join(fs, " || ")
+		log.Infof("Tunnel traffic in %s\n", strings.Join(cfg.Tunnel, ", "))
+	}
+
+	// Mode-related options
+	switch e.mode {
+	case "faketcp":
+		// MTU
+		e.mtu = cfg.MTU
+		if e.mtu != pcap.MaxMTU {
+			log.Infof("Set MTU to %d Bytes\n", e.mtu)
+		}
+
+		// Fragment size
+		e.fragment = cfg.FragmentSize
+		if e.fragment != e.mtu {
+			log.Infof("Set fragment size to %d Bytes\n", e.fragment)
+		}
+		e.isNoFragment = cfg.NoFragment
+		if e.isNoFragment {
+			log.Infof("Never fragment packets, packets larger than %d Bytes will be dropped\n", e.fragment)
+		}
+
+		// Traffic shaping
+		if cfg.Profile != "" {
+			if cfg.Jitter > 0 {
+				return nil, errors.New("jitter cannot be set with profile")
+			}
+
+			profile, err := pcap.FindProfile(cfg.Profile)
+			if err != nil {
+				return nil, fmt.Errorf("find profile: %w", err)
+			}
+
+			// KCP segments cannot be followed by padding
+			e.scheduler, err = pcap.NewProfileScheduler(profile, !cfg.KCP)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Shape traffic as %s\n", cfg.Profile)
+			if cfg.KCP {
+				log.Infoln("Packets will not be padded because KCP is enabled")
+			}
+		} else if cfg.Jitter > 0 {
+			e.scheduler, err = pcap.NewJitterScheduler(time.Duration(cfg.Jitter) * time.Millisecond)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Delay packets randomly within %d ms\n", cfg.Jitter)
+		}
+
+		// Priority
+		if cfg.Priority > 0 {
+			if e.scheduler != nil {
+				return nil, errors.New("priority cannot be set with jitter or profile")
+			}
+
+			e.scheduler, err = pcap.NewPriorityScheduler(cfg.Priority)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Prioritize packets within %d Bytes\n", cfg.Priority)
+		}
+
+		// QoS
+		qos := &cfg.QoSConfig
+		if len(qos.Realtime.Match) > 0 || len(qos.Normal.Match) > 0 || len(qos.Bulk.Match) > 0 ||
+			qos.Realtime.Rate > 0 || qos.Normal.Rate > 0 || qos.Bulk.Rate > 0 {
+			if e.scheduler != nil {
+				return nil, errors.New("qos cannot be set with jitter, profile or priority")
+			}
+
+			e.scheduler, err = pcap.NewQoSScheduler(qos)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Schedule traffic in classes with weights %d:%d:%d\n", qos.Realtime.Weight, qos.Normal.Weight, qos.Bulk.Weight)
+		}
+
+		// DSCP
+		if cfg.DSCP != "" {
+			e.dscp, err = pcap.ParseDSCP(cfg.DSCP)
+			if err != nil {
+				return nil, fmt.Errorf("parse dscp: %w", err)
+			}
+			log.Infof("Mark packets with DSCP %d\n", e.dscp)
+		}
+		e.isCopyTOS = cfg.CopyTOS
+		if e.isCopyTOS {
+			if cfg.DSCP != "" {
+				return nil, errors.New("copy tos cannot be set with dscp")
+			}
+			log.Infoln("Copy DSCP and ECN of packets tunneled")
+		}
+
+		// TTL
+		e.ttl, err = pcap.ParseTTL(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("parse ttl: %w", err)
+		}
+		if e.ttl > 0 {
+			log.Infof("Write packets in TTL %d\n", e.ttl)
+		}
+
+		// Cover traffic
+		e.chaff = cfg.Chaff
+		if e.chaff > 0 {
+			log.Infof("Send cover traffic in idle within %d Bytes/s\n", e.chaff)
+		}
+
+		// Preamble
+		if e.preamble == pcap.PreambleNone {
+			if cfg.Cookie != "" {
+				return nil, errors.New("cookie cannot be set without preamble")
+			}
+			log.Infoln("Handshake without preamble")
+		}
+
+		// Wire version
+		if e.wireVersion < pcap.MinWireVersion || e.wireVersion > pcap.WireVersion {
+			return nil, fmt.Errorf("wire version %d out of range", e.wireVersion)
+		}
+		if e.wireVersion < pcap.WireVersion {
+			log.Infof("Write in wire version %d\n", e.wireVersion)
+		}
+
+		// Cookie
+		if cfg.Cookie != "" {
+			e.cookie, err = crypto.NewCookie(cfg.Cookie)
+			if err != nil {
+				return nil, fmt.Errorf("cookie: %w", err)
+			}
+			log.Infoln("Lead TCP SYN with cookies")
+		}
+
+		// TLS mimicry
+		if cfg.TLSConfig.Enabled {
+			if cfg.TLSConfig.SNI == "" {
+				return nil, errors.New("missing tls sni")
+			}
+			e.tls, err = pcap.NewTLSMimicry(cfg.TLSConfig.SNI, cfg.TLSConfig.ALPN)
+			if err != nil {
+				return nil, fmt.Errorf("tls: %w", err)
+			}
+			log.Infof("Mimic TLS to %s\n", cfg.TLSConfig.SNI)
+		}
+
+		// Typed framing
+		e.isTyped = cfg.Typed
+		if e.isTyped {
+			log.Infoln("Frame packets with types")
+		}
+		if e.chaff > 0 && !e.isTyped && e.wireVersion < pcap.WireVersion3 {
+			return nil, fmt.Errorf("chaff cannot be set without typed in wire version %d", e.wireVersion)
+		}
+		if cfg.Rekey > 0 && !e.isTyped && e.wireVersion < pcap.WireVersion3 {
+			return nil, fmt.Errorf("rekey cannot be set without typed in wire version %d", e.wireVersion)
+		}
+
+		// Length-prefixed framing, which TLS records have already
+		e.isPrefixed = cfg.LengthPrefix && e.tls == nil
+		if e.isPrefixed {
+			log.Infoln("Prefix datagrams with lengths")
+		}
+
+		// Packet trace
+		if cfg.Trace != "" {
+			e.traceFilter, err = pcap.ParseTraceFilter(cfg.Trace)
+			if err != nil {
+				return nil, fmt.Errorf("parse trace: %w", err)
+			}
+			e.isTraceHex = cfg.TraceHex
+			log.Infof("Trace packets matching %s\n", e.traceFilter)
+		}
+
+		// Latency probes, which adaptive duplication measures loss by without delivery reports and MTU blackholes are
+		// detected by
+		if (len(cfg.Adaptive) > 0 && cfg.Feedback <= 0 || cfg.Blackhole) && cfg.Probe <= 0 {
+			cfg.Probe = 1000
+		}
+		e.probe = time.Duration(cfg.Probe) * time.Millisecond
+		if e.probe > 0 {
+			log.Infof("Probe latency every %d ms\n", cfg.Probe)
+		}
+
+		// Delivery reports
+		e.feedback = time.Duration(cfg.Feedback) * time.Millisecond
+		if e.feedback > 0 {
+			log.Infof("Report delivery every %d ms\n", cfg.Feedback)
+		}
+
+		// Rekeys in band
+		e.rekey = time.Duration(cfg.Rekey) * time.Second
+		if e.rekey > 0 {
+			log.Infof("Rekey every %d s\n", cfg.Rekey)
+		}
+
+		// Congestion control, KCP has its own
+		if cfg.Congestion != "" {
+			if cfg.KCP {
+				return nil, errors.New("congestion cannot be set with kcp")
+			}
+			e.congestion, err = pcap.FindCongestionControl(cfg.Congestion)
+			if err != nil {
+				return nil, fmt.Errorf("find congestion control: %w", err)
+			}
+			log.Infof("Pace writes by congestion control %s\n", cfg.Congestion)
+		}
+
+		// Adaptive duplication
+		e.adaptive = cfg.Adaptive
+		if len(e.adaptive) > 0 {
+			thresholds := make([]string, 0)
+			for _, threshold := range e.adaptive {
+				thresholds = append(thresholds, fmt.Sprintf("%g%%", threshold))
+			}
+			log.Infof("Duplicate packets adaptively when loss reaches %s\n", strings.Join(thresholds, ", "))
+		}
+
+		// MTU blackholes
+		e.isBlackhole = cfg.Blackhole
+		if e.isBlackhole {
+			log.Infoln("Detect MTU blackholes by large probes")
+		}
+
+		// Tolerance of packets failed to parse or decrypt
+		if cfg.Tolerance < 0 {
+			return nil, fmt.Errorf("tolerance %d out of range", cfg.Tolerance)
+		}
+		e.tolerance = cfg.Tolerance
+		if e.tolerance > 0 {
+			log.Infof("Skip up to %d packets failed to parse or decrypt in a row\n", e.tolerance)
+		}
+
+		// Impairment
+		if cfg.ImpairmentConfig != *config.NewImpairmentConfig() {
+			e.impairment, err = pcap.NewImpairment(&cfg.ImpairmentConfig)
+			if err != nil {
+				return nil, fmt.Errorf("create impairment: %w", err)
+			}
+			impairment := &cfg.ImpairmentConfig
+			log.Infof("Impair packets with %g%% loss, %d±%d ms delay, %g%% duplication and %g%% reordering\n",
+				impairment.Loss, impairment.Delay, impairment.Jitter, impairment.Duplicate, impairment.Reorder)
+		}
+
+		// KCP
+		e.isKCP = cfg.KCP
+		e.kcpConfig = &cfg.KCPConfig
+		if e.isKCP {
+			log.Infoln("Enable KCP")
+
+			// KCP segments larger than the fragment size will always be fragmented
+			size := e.kcpConfig.MTU + 20 + 20 + e.crypt.Cost()
+			if size > e.fragment {
+				if e.isNoFragment {
+					return nil, fmt.Errorf("kcp mtu %d out of range in no fragment", e.kcpConfig.MTU)
+				}
+				log.Infof("KCP MTU %d Bytes results in %d Bytes packets which exceed fragment size %d Bytes, consider decreasing KCP MTU\n",
+					e.kcpConfig.MTU, size, e.fragment)
+			}
+		}
+	case "tcp":
+		if cfg.Cookie != "" {
+			return nil, errors.New("cookie not support in standard TCP")
+		}
+		if e.preamble != pcap.PreambleTagged {
+			return nil, errors.New("preamble not support in standard TCP")
+		}
+		if cfg.WireVersion != 0 {
+			return nil, errors.New("wire version not support in standard TCP")
+		}
+		if cfg.TLSConfig.Enabled {
+			return nil, errors.New("tls not support in standard TCP")
+		}
+		if cfg.Tolerance > 0 {
+			return nil, errors.New("tolerance not support in standard TCP")
+		}
+		if cfg.NoFragment {
+			return nil, errors.New("no fragment not support in standard TCP")
+		}
+		if cfg.Trace != "" {
+			return nil, errors.New("trace not support in standard TCP")
+		}
+		if cfg.Typed {
+			return nil, errors.New("typed not support in standard TCP")
+		}
+		if cfg.LengthPrefix {
+			return nil, errors.New("length prefix not support in standard TCP")
+		}
+		if cfg.Feedback > 0 {
+			return nil, errors.New("feedback not support in standard TCP")
+		}
+		if cfg.Rekey > 0 {
+			return nil, errors.New("rekey not support in standard TCP")
+		}
+		if cfg.Congestion != "" {
+			return nil, errors.New("congestion not support in standard TCP")
+		}
+		if cfg.TTL != "" {
+			return nil, errors.New("ttl not support in standard TCP")
+		}
+	default:
+		return nil, fmt.Errorf("mode %s not support", e.mode)
+	}
+
+	if len(e.sources) == 1 {
+		log.Infof("Proxy %s through :%d to %s\n", e.sources[0], e.upPort, e.serverName)
+	} else {
+		log.Infoln("Proxy:")
+		for i, f := range e.sources {
+			if i != len(e.sources)-1 {
+				log.Infof("  %s\n", f)
+			} else {
+				log.Infof("  %s through :%d to %s\n", f, e.upPort, e.serverName)
+			}
+		}
+	}
+
+	// Find devices
+	e.listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	if err != nil {
+		return nil, fmt.Errorf("find listen devices: %w", err)
+	}
+	if len(cfg.ListenDevs) <= 0 {
+		// Remove loopback devices by default
+		result := make([]*pcap.Device, 0)
+
+		for _, dev := range e.listenDevs {
+			if dev.IsLoop() {
+				continue
+			}
+			result = append(result, dev)
+		}
+
+		e.listenDevs = result
+	}
+	if len(e.listenDevs) <= 0 {
+		return nil, errors.New("cannot determine listen device")
+	}
+
+	e.upDevName = cfg.UpDev
+	e.gateway = gateway
+	e.gatewayMAC = gatewayMAC
+	e.upDev, e.gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway, gatewayMAC)
+	if err != nil {
+		return nil, fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if e.upDev == nil && e.gatewayDev == nil {
+		return nil, errors.New("cannot determine upstream device and gateway device")
+	}
+	if e.upDev == nil {
+		return nil, errors.New("cannot determine upstream device")
+	}
+	if e.gatewayDev == nil {
+		return nil, errors.New("cannot determine gateway device")
+	}
+	if e.mode == "faketcp" && e.upDev.MTU() > 0 && e.mtu > e.upDev.MTU() {
+		return nil, fmt.Errorf("mtu %d exceeds mtu %d of upstream device %s", e.mtu, e.upDev.MTU(), e.upDev.Alias())
+	}
+
+	// Hardware address
+	if mac != nil {
+		if e.upDev.IsLoop() {
+			return nil, fmt.Errorf("cannot change hardware address of loopback device %s", e.upDev.Alias())
+		}
+		if e.upDev.IsPointToPoint() {
+			return nil, fmt.Errorf("cannot change hardware address of point-to-point device %s", e.upDev.Alias())
+		}
+
+		e.upDev.SetHardwareAddr(mac)
+		log.Infof("Use hardware address %s in %s\n", mac, e.upDev.Alias())
+		e.mac = mac
+	}
+
+	return e, nil
+}
+
+// prepare sets up package pcap, firewall rules and the ARP cache for the connection to the server.
+func (e *engine) prepare() error {
+	var err error
+
+	// Captures are tuned in options of each device opened
+	if e.backend != pcap.BackendPcap {
+		log.Infof("Capture with backend %s\n", e.backend)
+	}
+	if e.pcapConfig.Buffer > 0 {
+		log.Infof("Set pcap buffer to %d KB\n", e.pcapConfig.Buffer)
+	}
+	if e.pcapConfig.SnapLen > 0 {
+		log.Infof("Set pcap snaplen to %d Bytes\n", e.pcapConfig.SnapLen)
+	}
+	if e.pcapConfig.Immediate {
+		log.Infoln("Capture in immediate mode")
+	}
+	if e.pcapConfig.Timeout > 0 {
+		log.Infof("Set pcap timeout to %d ms\n", e.pcapConfig.Timeout)
+	}
+
+	// sFlow
+	if e.sflowConfig.Collector != "" {
+		e.sflow, err = pcap.NewSFlow(e.sflowConfig.Collector, e.sflowConfig.Rate)
+		if err != nil {
+			return fmt.Errorf("create sflow: %w", err)
+		}
+		log.Infof("Export sFlow samples of 1 in every %d packets to %s\n", e.sflowConfig.Rate, e.sflow)
+	}
+
+	// Rejections are counted in tables of the process, monitors of the rest are in options
+	pcap.SetRejectionMonitor(e.rejMonitor)
+
+	// Filter, which is compiled in each device opened
+	if e.filter != "" {
+		log.Infof("Capture with extra filter %s\n", e.filter)
+	}
+
+	// Garbage is collected more often so the heap is kept small
+	if e.isLowMemory {
+		debug.SetGCPercent(lowMemoryGCPercent)
+		log.Infoln("Use low-memory mode")
+	}
+
+	// Add firewall rule
+	if e.isRule {
+		err := exec.DisableIPForwarding()
+		if err != nil {
+			log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
+		} else {
+			log.Infoln("Disable IP forwarding")
+		}
+
+		switch e.mode {
+		case "faketcp":
+			// Ports of the server change in hopping
+			if e.hop != nil {
+				log.Infoln("Skip firewall rule in port hopping")
+			} else {
+				err = exec.AddSpecificFirewallRule(e.serverIP, e.serverPort)
+				if err != nil {
+					log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+				} else {
+					log.Infoln("Add firewall rule")
+				}
+			}
+			for _, r := range e.routes {
+				err = exec.AddSpecificFirewallRule(r.serverIP, r.serverPort)
+				if err != nil {
+					log.Errorln(fmt.Errorf("add firewall rule of route to %s: %w", r.serverName, err))
+				} else {
+					log.Infof("Add firewall rule of route to %s\n", r.serverName)
+				}
+			}
+		case "tcp":
+			break
+		default:
+			return fmt.Errorf("mode %s not support", e.mode)
+		}
+	}
+
+	// Reply ARP requests with the hardware address so replies are addressed to it
+	if e.mac != nil {
+		e.arpCache, err = pcap.NewARPCache(e.upDev, e.captureOptions()...)
+		if err != nil {
+			return fmt.Errorf("create arp cache: %w", err)
+		}
+		for _, ip := range e.upDev.IPAddrs() {
+			err = e.arpCache.Publish(ip.IP)
+			if err != nil {
+				log.Errorln(fmt.Errorf("publish %s: %w", ip.IP, err))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *engine) open() error {
+	err := e.prepare()
+	if err != nil {
+		return err
+	}
+
+	if len(e.listenDevs) == 1 {
+		log.Infof("Listen on %s\n", e.listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range e.listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if !e.gatewayDev.IsLoop() && !e.gatewayDev.IsPointToPoint() {
+		log.Infof("Route upstream from %s to %s\n", e.upDev, e.gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", e.upDev)
+	}
+
+	// Handle for routing upstream
+	opts := e.options()
+	switch e.mode {
+	case "faketcp":
+		if e.isKCP {
+			e.upConn, err = pcap.DialFakeTCPWithKCP(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)}, opts...)
+		} else if e.hop != nil {
+			e.upConn, err = pcap.DialHoppingFakeTCP(e.serverIP, e.ports, e.hop, opts...)
+		} else if e.ports > 1 || e.rotate > 0 {
+			e.upConn, err = pcap.DialMultiFakeTCP(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)}, e.ports, e.rotate, opts...)
+		} else if e.state != "" {
+			e.upConn, err = e.resume(opts)
+		} else {
+			e.upConn, err = pcap.DialFakeTCP(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)}, opts...)
+		}
+	case "tcp":
+		e.upConn, err = pcap.DialHappyEyeballs(e.serverAddrs, pcap.HappyEyeballsDelay, func(dstAddr *net.TCPAddr) (net.Conn, error) {
+			return pcap.DialTCP(dstAddr, opts...)
+		})
+		if err == nil {
+			e.serverIP = e.upConn.RemoteAddr().(*net.TCPAddr).IP
+		}
+	default:
+		err = fmt.Errorf("mode %s not support", e.mode)
+	}
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+	if e.isStripe {
+		e.upConn.(*pcap.MultiConn).SetStripe(true)
+	}
+	for _, r := range e.routes {
+		conn, err := e.dialRoute(r)
+		if err != nil {
+			return fmt.Errorf("open route to %s: %w", r.serverName, err)
+		}
+		r.conn = conn
+	}
+
+	// Filters for listening
+	filter, err := e.listenFilter()
+	if err != nil {
+		return err
+	}
+
+	// Handles for listening
+	captureOpts := append(e.captureOptions(), pcap.WithExtraFilter(e.filter))
+	for _, dev := range e.listenDevs {
+		var (
+			err  error
+			conn *pcap.RawConn
+		)
+
+		if dev.IsLoop() {
+			conn, err = pcap.CreateRawConn(dev, dev, filter, captureOpts...)
+		} else {
+			conn, err = pcap.CreateRawConn(dev, e.gatewayDev, filter, captureOpts...)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
+		}
+
+		e.listenConns = append(e.listenConns, conn)
+	}
+
+	// Watch address changes of the upstream device
+	go func() {
+		for !e.isClosed {
+			time.Sleep(refreshInterval)
+
+			err := e.refreshUpstream()
+			if err != nil {
+				log.Errorln(fmt.Errorf("refresh upstream device %s: %w", e.upDev.Alias(), err))
+			}
+		}
+	}()
+
+	// Resolve the server again if it is a host name
+	if isHostName(e.serverName) {
+		go func() {
+			for !e.isClosed {
+				time.Sleep(resolveInterval)
+
+				err := e.refreshServer()
+				if err != nil {
+					log.Errorln(fmt.Errorf("refresh server %s: %w", e.serverName, err))
+				}
+			}
+		}()
+	}
+
+	// Start handling
+	for i := 0; i < len(e.listenConns); i++ {
+		conn := e.listenConns[i]
+
+		go func() {
+			for {
+				packet, err := conn.ReadPacket()
+				if err != nil {
+					if e.isClosed {
+						return
+					}
+					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
+					continue
+				}
+
+				select {
+				case e.c <- pcap.ConnPacket{Packet: packet, Conn: conn}:
+				case <-e.done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case cp := <-e.c:
+				err := e.handleListen(cp.Packet, cp.Conn)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+					log.Verboseln(cp.Packet)
+				}
+			case <-e.done:
+				return
+			}
+		}
+	}()
+
+	for _, conn := range e.upConns() {
+		go e.readUpstream(conn)
+	}
+
+	// Save the state of the connection to the server
+	if e.state != "" {
+		go e.saveStates()
+	}
+
+	return nil
+}
+
+// readUpstream handles packets from the connection to a server until it is closed.
+func (e *engine) readUpstream(conn net.Conn) {
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			if e.isClosed {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				e.closeAll(fmt.Errorf("connection to server %s is closed, is the server or your network down?", conn.RemoteAddr()))
+				return
+			}
+			if errors.Is(err, pcap.ErrNegotiationTampered) {
+				e.closeAll(fmt.Errorf("negotiation with server %s is tampered, is the server out of date or under attack?", conn.RemoteAddr()))
+				return
+			}
+			log.Errorln(fmt.Errorf("read upstream: %w", err))
+			continue
+		}
+
+		err = e.handleUpstream(b[:n])
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", conn.RemoteAddr().String(), n)
+			continue
+		}
+	}
+}
+
+// options returns options of the connection to the server.
+func (e *engine) options() []pcap.Option {
+	opts := []pcap.Option{
+		pcap.WithDevices(e.upDev, e.gatewayDev),
+		pcap.WithReselect(e.reselectUpstream),
+		pcap.WithSrcPort(e.upPort),
+		pcap.WithCrypt(e.crypt),
+		pcap.WithMTU(e.mtu),
+		pcap.WithFragment(e.fragment),
+		pcap.WithNoFragment(e.isNoFragment),
+		pcap.WithDefrag(e.defragConfig),
+		pcap.WithScheduler(e.scheduler),
+		pcap.WithDSCP(e.dscp),
+		pcap.WithCopyTOS(e.isCopyTOS),
+		pcap.WithTTL(e.ttl),
+		pcap.WithChaff(e.chaff),
+		pcap.WithProbe(e.probe),
+		pcap.WithFeedback(e.feedback),
+		pcap.WithRekey(e.rekey),
+		pcap.WithCongestionControl(e.congestion),
+		pcap.WithAdaptive(e.adaptive),
+		pcap.WithBlackhole(e.isBlackhole),
+		pcap.WithTolerance(e.tolerance),
+		pcap.WithImpairment(e.impairment),
+		pcap.WithCookie(e.cookie),
+		pcap.WithPreamble(e.preamble),
+		pcap.WithWireVersion(e.wireVersion),
+		pcap.WithTLS(e.tls),
+		pcap.WithTyped(e.isTyped),
+		pcap.WithLengthPrefix(e.isPrefixed),
+		pcap.WithKCP(e.kcpConfig),
+		pcap.WithQueueSize(e.queueSize),
+		pcap.WithExtraFilter(e.filter),
+	}
+	opts = append(opts, e.captureOptions()...)
+
+	return append(opts, e.observeOptions()...)
+}
+
+// captureOptions returns options of captures in devices, which are tuned in the backend and the config of pcap.
+func (e *engine) captureOptions() []pcap.Option {
+	return []pcap.Option{
+		pcap.WithPcapConfig(e.pcapConfig),
+		pcap.WithBackend(e.backend),
+	}
+}
+
+// observeOptions returns options of monitors, the exporter, the trace and the hook connections are observed by.
+func (e *engine) observeOptions() []pcap.Option {
+	return []pcap.Option{
+		pcap.WithValidation(e.validation),
+		pcap.WithSFlow(e.sflow),
+		pcap.WithTrace(e.traceFilter, e.isTraceHex),
+		pcap.WithHook(e.hook),
+		pcap.WithFragmentMonitor(e.fragMonitor),
+		pcap.WithLatencyMonitor(e.latMonitor),
+		pcap.WithDeliveryMonitor(e.delMonitor),
+		pcap.WithMalformedMonitor(e.malMonitor),
+	}
+}
+
+func (e *engine) refreshUpstream() error {
+	var gateway net.IP
+
+	if !e.gatewayDev.IsLoop() && !e.gatewayDev.IsPointToPoint() {
+		gateway = e.gatewayDev.IPAddr().IP
+	}
+
+	changed, err := e.upDev.Refresh(gateway)
+	if err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Infof("Address of upstream device %s changed to %s\n", e.upDev.Alias(), e.upDev.IPAddr().IP)
+
+	// Reconnect with the new address
+	for _, conn := range e.upConns() {
+		switch conn.(type) {
+		case *pcap.FakeTCPConn:
+			err = conn.(*pcap.FakeTCPConn).Reconnect()
+			if err != nil {
+				return fmt.Errorf("reconnect: %w", err)
+			}
+		case *pcap.MultiConn:
+			err = conn.(*pcap.MultiConn).Reconnect()
+			if err != nil {
+				return fmt.Errorf("reconnect: %w", err)
+			}
+		default:
+			log.Infof("Connection to server %s may not recover from the address change, please restart IkaGo if it does not work\n", conn.RemoteAddr())
+		}
+	}
+
+	return nil
+}
+
+// reselectUpstream finds the upstream device and the gateway device again, so the connection to the server moves to
+// another device if the upstream device vanishes or is renamed.
+func (e *engine) reselectUpstream() (*pcap.Device, *pcap.Device, error) {
+	upDev, gatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(e.upDevName, e.gateway, e.gatewayMAC)
+	if err != nil {
+		return nil, nil, err
+	}
+	if upDev == nil || gatewayDev == nil {
+		return nil, nil, errors.New("cannot determine upstream device and gateway device")
+	}
+	if e.mac != nil && !upDev.IsLoop() && !upDev.IsPointToPoint() {
+		upDev.SetHardwareAddr(e.mac)
+	}
+
+	e.upDev = upDev
+	e.gatewayDev = gatewayDev
+
+	return upDev, gatewayDev, nil
+}
+
+func (e *engine) refreshServer() error {
+	addrs, err := e.resolveServer(e.serverName)
+	if err != nil {
+		return fmt.Errorf("parse server: %w", err)
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(e.serverIP) {
+			return nil
+		}
+	}
+
+	log.Infof("Address of server %s changed to %s\n", e.serverName, addrs[0].IP)
+
+	e.serverAddrs = addrs
+	e.serverIP = addrs[0].IP
+
+	// Add firewall rule for the new address
+	if e.isRule && e.mode == "faketcp" && e.hop == nil {
+		err = exec.AddSpecificFirewallRule(e.serverIP, e.serverPort)
+		if err != nil {
+			log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+		} else {
+			log.Infoln("Add firewall rule")
+		}
+	}
+
+	// Update filters for listening
+	filter, err := e.listenFilter()
+	if err != nil {
+		return err
+	}
+	for _, conn := range e.listenConns {
+		err = conn.SetFilter(filter)
+		if err != nil {
+			return fmt.Errorf("set filter of listen device %s: %w", conn.LocalDev().Alias(), err)
+		}
+	}
+
+	// Reconnect to the new address
+	switch e.upConn.(type) {
+	case *pcap.FakeTCPConn:
+		err = e.upConn.(*pcap.FakeTCPConn).SetRemoteAddr(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)})
+		if err != nil {
+			return fmt.Errorf("set remote address: %w", err)
+		}
+	case *pcap.MultiConn:
+		err = e.upConn.(*pcap.MultiConn).SetRemoteAddr(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)})
+		if err != nil {
+			return fmt.Errorf("set remote address: %w", err)
+		}
+	default:
+		log.Infoln("Connection to server may not recover from the address change, please restart IkaGo if it does not work")
+	}
+
+	return nil
+}
+
+func (e *engine) resolveServer(name string) ([]*net.TCPAddr, error) {
+	addrs, err := addr.ResolveTCPAddrs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// FakeTCP only supports IPv4
+	if e.mode == "faketcp" {
+		ipv4Addrs := make([]*net.TCPAddr, 0)
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				ipv4Addrs = append(ipv4Addrs, a)
+			}
+		}
+		addrs = ipv4Addrs
+	}
+	if len(addrs) <= 0 {
+		return nil, errors.New("missing address")
+	}
+
+	return addrs, nil
+}
+
+func (e *engine) listenFilter() (string, error) {
+	fs := make([]string, 0)
+	for _, f := range e.sources {
+		s, err := addr.SrcBPFFilter(f)
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", f, err)
+		}
+
+		fs = append(fs, s)
+	}
+	f := strings.Join(fs, " || ")
+
+	// Only packets of the application are proxied
+	transport := "(tcp || udp)"
+	if e.appFilter != "" {
+		transport = fmt.Sprintf("(tcp || udp) && (%s)", e.appFilter)
+	}
+
+	filter := fmt.Sprintf("ip && ((%s && (%s) && not (%s)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not (%s)))",
+		transport, f, e.serverFilter(), f, e.serverHostFilter())
+
+	// Only traffic declared is tunneled, non-first fragments carry no ports so they are captured anyway
+	if e.tunnelFilter != "" {
+		filter = fmt.Sprintf("(%s) && ((%s) || (ip[6:2] & 0x1fff) != 0)", filter, e.tunnelFilter)
+	}
+	if e.publishIP != nil {
+		s, err := addr.DstBPFFilter(e.publishIP)
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", e.publishIP, err)
+		}
+		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
+	}
+
+	return filter, nil
+}
+
+func (e *engine) closeAll(err error) {
+	e.closeOnce.Do(func() {
+		e.isClosed = true
+		// Save the state before the connection to the server is closed
+		if e.state != "" {
+			err := e.saveUpstream()
+			if err != nil {
+				log.Errorln(fmt.Errorf("save state %s: %w", e.state, err))
+			}
+		}
+		for _, handle := range e.listenConns {
+			if handle != nil {
+				handle.Close()
+			}
+		}
+		for _, conn := range e.upConns() {
+			conn.Close()
+		}
+		if e.sflow != nil {
+			e.sflow.Close()
+		}
+		if e.arpCache != nil {
+			e.arpCache.Close()
+		}
+		if e.scheduler != nil {
+			e.scheduler.Close()
+		}
+		if e.impairment != nil {
+			e.impairment.Close()
+		}
+		e.err = err
+		close(e.done)
+	})
+}
+
+func (e *engine) closed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *engine) publish(packet gopacket.Packet, conn *pcap.RawConn) error {
+	var (
+		indicator *pcap.PacketIndicator
+		arpLayer  *layers.ARP
+	)
+
+	// Parse packet
+	indicator, err := pcap.ParsePacket(packet, e.validation, e.malMonitor)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	if t := packet.LinkLayer().LayerType(); t != layers.LayerTypeEthernet {
+		return fmt.Errorf("link layer type %s not support", t)
+	}
+
+	// Create ARP reply
+	arpLayer = indicator.ARPLayer()
+	data, err := pcap.CreateARPReplyPacket(conn.LocalDev().HardwareAddr(), arpLayer)
+	if err != nil {
+		return fmt.Errorf("create arp reply: %w", err)
+	}
+
+	// Write packet data
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Reconnect
+	for _, conn := range e.upConns() {
+		switch conn.(type) {
+		case *pcap.FakeTCPConn:
+			err = conn.(*pcap.FakeTCPConn).Reconnect()
+		case *pcap.MultiConn:
+			err = conn.(*pcap.MultiConn).Reconnect()
+		default:
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+	}
+
+	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
+	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
+
+	return nil
+}
+
+func (e *engine) handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
+	var (
+		hardwareAddr net.HardwareAddr
+		data         []byte
+	)
+
+	// Parse packet
+	indicator, err := pcap.ParsePacket(packet, e.validation, e.malMonitor)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// ARP
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+		err := e.publish(packet, conn)
+		if err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		return nil
+	}
+
+	// Record source hardware address
+	hardwareAddr = indicator.SrcHardwareAddr()
+
+	data = make([]byte, 0)
+	data = append(data, packet.NetworkLayer().LayerContents()...)
+	data = append(data, packet.NetworkLayer().LayerPayload()...)
+
+	// Route by the destination
+	upConn := e.pick(data)
+
+	// Reply fragmentation needed if the packet cannot pass through the tunnel
+	if indicator.IsDF() && !isICMPv4Error(indicator) {
+		var maxSize int
+		switch upConn.(type) {
+		case *pcap.FakeTCPConn:
+			maxSize = upConn.(*pcap.FakeTCPConn).MaxPayload()
+		case *pcap.MultiConn:
+			maxSize = upConn.(*pcap.MultiConn).MaxPayload()
+		default:
+			break
+		}
+		if maxSize > 0 && indicator.MTU() > maxSize {
+			data, err := pcap.CreateFragNeededPacket(conn, hardwareAddr, indicator, maxSize)
+			if err != nil {
+				return fmt.Errorf("create fragmentation needed: %w", err)
+			}
+
+			_, err = conn.Write(data)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+
+			log.Verbosef("Reply fragmentation needed to %s: %d Bytes exceeds %d Bytes\n", indicator.SrcIP(), indicator.MTU(), maxSize)
+
+			return nil
+		}
+	}
+
+	e.sflow.Sample(pcap.SFlowSourceInner, data)
+
+	// Write packet data
+	_, err = upConn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Record the connection of the packet
+	ni, ok := e.nat[indicator.SrcIP().String()]
+	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
+		e.natLock.Lock()
+		e.nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
+		e.natLock.Unlock()
+	}
+
+	// Statistics
+	size := indicator.MTU()
+	if e.monitor != nil {
+		e.monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	}
+
+	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+
+	return nil
+}
+
+func (e *engine) handleUpstream(contents []byte) error {
+	var (
+		embIndicator     *pcap.PacketIndicator
+		newLinkLayer     gopacket.Layer
+		newLinkLayerType gopacket.LayerType
+		data             []byte
+	)
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	// Parse embedded packet
+	embIndicator, err := pcap.ParseEmbPacket(contents, e.validation, e.malMonitor)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	// Packets corrupted in the tunnel are dropped
+	if e.isChecksum {
+		err := pcap.VerifyChecksum(embIndicator)
+		if err != nil {
+			e.malMonitor.Add(stat.MalformedEventCorrupted)
+			return fmt.Errorf("verify checksum: %w", err)
+		}
+	}
+
+	e.sflow.Sample(pcap.SFlowSourceInner, contents)
+
+	// Check map
+	e.natLock.RLock()
+	ni, ok := e.nat[embIndicator.DstIP().String()]
+	e.natLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
+	}
+
+	// Decide Loopback or Ethernet
+	if ni.conn.IsLoop() {
+		newLinkLayerType = layers.LayerTypeLoopback
+	} else {
+		newLinkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create new link layer
+	switch newLinkLayerType {
+	case layers.LayerTypeLoopback:
+		newLinkLayer = pcap.CreateLoopbackLayer()
+	case layers.LayerTypeEthernet:
+		newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
+	default:
+		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	}
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Serialize layers
+	data, err = pcap.SerializeRaw(newLinkLayer.(gopacket.SerializableLayer),
+		gopacket.Payload(embIndicator.NetworkLayer().LayerContents()),
+		gopacket.Payload(embIndicator.NetworkPayload()))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = ni.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Statistics
+	if e.monitor != nil {
+		e.monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
+	}
+
+	// Record DNS
+	if embIndicator.DNSIndicator() != nil {
+		if embIndicator.DNSIndicator().IsResponse() {
+			name, ips := embIndicator.DNSIndicator().Answers()
+			if name != "" && len(ips) > 0 {
+				e.dnsLock.Lock()
+				for _, ip := range ips {
+					e.dns[ip.String()] = name
+					log.Verbosef("Record DNS record %s = %s\n", name, ip)
+				}
+				e.dnsLock.Unlock()
+			}
+		}
+	}
+
+	log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
+		embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+
+	return nil
+}
+
+func isICMPv4Error(indicator *pcap.PacketIndicator) bool {
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeICMPv4 {
+		return false
+	}
+
+	return !indicator.ICMPv4Indicator().IsQuery()
+}
+
+func isHostName(s string) bool {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+
+	return net.ParseIP(host) == nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/pcap"
+	"net"
+	"time"
+)
+
+// pingTimeout is the time after which an echo request not replied is lost.
+const pingTimeout = 2 * time.Second
+
+// Ping measures RTT, jitter and loss of the tunnel to the server with the given configuration. An echo request is sent
+// every interval until the context is done or count requests are sent, count of 0 means no limit. Echo messages take
+// the same FakeTCP path as packets tunneled, and sources are not required.
+func Ping(ctx context.Context, cfg *config.Config, interval time.Duration, count int, report func(*pcap.PingResult)) (*pcap.PingStats, error) {
+	e, conn, err := connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer e.closeAll(nil)
+
+	pinger := pcap.NewPinger(conn)
+	err = pinger.Run(ctx, interval, pingTimeout, count, report)
+	stats := pinger.Stats()
+	if err != nil {
+		return &stats, fmt.Errorf("ping: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// connect returns an engine only connected to the server in FakeTCP, which is closed with the engine.
+func connect(cfg *config.Config) (*engine, *pcap.FakeTCPConn, error) {
+	e, err := createEngine(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e.mode != "faketcp" {
+		return nil, nil, fmt.Errorf("mode %s not support", e.mode)
+	}
+
+	err = e.prepare()
+	if err != nil {
+		e.closeAll(err)
+		return nil, nil, err
+	}
+
+	// Messages in band are handled below KCP, so connections are always without KCP
+	conn, err := pcap.DialFakeTCP(&net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)}, e.options()...)
+	if err != nil {
+		e.closeAll(err)
+		return nil, nil, fmt.Errorf("open upstream: %w", err)
+	}
+	e.upConn = conn
+
+	return e, conn, nil
+}
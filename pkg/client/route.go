@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/pcap"
+	"net"
+	"strings"
+)
+
+// route is a server other than the default one, which packets matched by its rules are routed through.
+type route struct {
+	rules       []*pcap.RouteRule
+	serverName  string
+	serverAddrs []*net.TCPAddr
+	serverIP    net.IP
+	serverPort  uint16
+	conn        net.Conn
+}
+
+// parseRoutes parses routes and resolves their servers.
+func (e *engine) parseRoutes(cfgs []config.RouteConfig) error {
+	for _, cfg := range cfgs {
+		if len(cfg.Match) <= 0 {
+			return fmt.Errorf("missing match of route to %s", cfg.Server)
+		}
+
+		r := &route{
+			rules:      make([]*pcap.RouteRule, 0),
+			serverName: cfg.Server,
+		}
+		for _, match := range cfg.Match {
+			rule, err := pcap.ParseRouteRule(match)
+			if err != nil {
+				return fmt.Errorf("parse match %s of route to %s: %w", match, cfg.Server, err)
+			}
+			r.rules = append(r.rules, rule)
+		}
+
+		addrs, err := e.resolveServer(cfg.Server)
+		if err != nil {
+			return fmt.Errorf("parse server %s of route: %w", cfg.Server, err)
+		}
+		r.serverAddrs = addrs
+		r.serverIP = addrs[0].IP
+		r.serverPort = uint16(addrs[0].Port)
+
+		e.routes = append(e.routes, r)
+	}
+
+	return nil
+}
+
+// dialRoute connects to the server of the route with a random local port.
+func (e *engine) dialRoute(r *route) (net.Conn, error) {
+	opts := append(e.options(), pcap.WithSrcPort(0))
+
+	switch e.mode {
+	case "faketcp":
+		dstAddr := &net.TCPAddr{IP: r.serverIP, Port: int(r.serverPort)}
+		if e.isKCP {
+			return pcap.DialFakeTCPWithKCP(dstAddr, opts...)
+		}
+		return pcap.DialFakeTCP(dstAddr, opts...)
+	case "tcp":
+		return pcap.DialHappyEyeballs(r.serverAddrs, pcap.HappyEyeballsDelay, func(dstAddr *net.TCPAddr) (net.Conn, error) {
+			return pcap.DialTCP(dstAddr, opts...)
+		})
+	default:
+		return nil, fmt.Errorf("mode %s not support", e.mode)
+	}
+}
+
+// pick returns the connection the IP packet is routed through, which is of the first route matched, or to the default
+// server.
+func (e *engine) pick(data []byte) net.Conn {
+	for _, r := range e.routes {
+		for _, rule := range r.rules {
+			if rule.Match(data) {
+				return r.conn
+			}
+		}
+	}
+
+	return e.upConn
+}
+
+// upConns returns connections to all servers, the default one first.
+func (e *engine) upConns() []net.Conn {
+	conns := make([]net.Conn, 0, len(e.routes)+1)
+	if e.upConn != nil {
+		conns = append(conns, e.upConn)
+	}
+	for _, r := range e.routes {
+		if r.conn != nil {
+			conns = append(conns, r.conn)
+		}
+	}
+
+	return conns
+}
+
+// serverFilter returns the filter of packets from all servers, which are never proxied.
+func (e *engine) serverFilter() string {
+	// Packets from the server in hopping may come from any port hopped
+	serverPort := fmt.Sprintf("src port %d", e.serverPort)
+	if e.hop != nil {
+		min, max := e.hop.Range()
+		serverPort = fmt.Sprintf("src portrange %d-%d", min, max)
+	}
+
+	fs := []string{fmt.Sprintf("(src host %s && %s)", e.serverIP, serverPort)}
+	for _, r := range e.routes {
+		fs = append(fs, fmt.Sprintf("(src host %s && src port %d)", r.serverIP, r.serverPort))
+	}
+
+	return strings.Join(fs, " || ")
+}
+
+// serverHostFilter returns the filter of packets from hosts of all servers.
+func (e *engine) serverHostFilter() string {
+	fs := []string{fmt.Sprintf("src host %s", e.serverIP)}
+	for _, r := range e.routes {
+		fs = append(fs, fmt.Sprintf("src host %s", r.serverIP))
+	}
+
+	return strings.Join(fs, " || ")
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/transform"
+)
+
+// SelfTest starts a client and a server inside the process wired by devices in memory with the crypt, transforms and
+// defragmentation of the given configuration, and echoes count packets of each size through the whole path of
+// handshakes, encryption and fragmentation. The network of the system is not touched, and neither pcap nor privileges
+// are required.
+func SelfTest(ctx context.Context, cfg *config.Config, sizes []int, count int) (*pcap.SelfTestResult, error) {
+	crypt, err := crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("parse crypt: %w", err)
+	}
+
+	pipeline, err := transform.NewPipeline(crypt, cfg.Transforms)
+	if err != nil {
+		return nil, fmt.Errorf("parse transforms: %w", err)
+	}
+
+	opts := []pcap.Option{
+		pcap.WithCrypt(pipeline),
+		pcap.WithDefrag(&cfg.DefragConfig),
+		pcap.WithTyped(cfg.Typed),
+		pcap.WithLengthPrefix(cfg.LengthPrefix),
+	}
+
+	// Packets in memory are traced as well
+	if cfg.Trace != "" {
+		filter, err := pcap.ParseTraceFilter(cfg.Trace)
+		if err != nil {
+			return nil, fmt.Errorf("parse trace: %w", err)
+		}
+		opts = append(opts, pcap.WithTrace(filter, cfg.TraceHex))
+	}
+
+	result, err := pcap.SelfTest(ctx, sizes, count, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("self-test: %w", err)
+	}
+
+	return result, nil
+}
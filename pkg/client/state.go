@@ -0,0 +1,138 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/pcap"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+// stateInterval is the interval the state of the connection to the server is saved in.
+const stateInterval = 5 * time.Second
+
+// loadState returns the state saved in the file, or nil if there is none.
+func loadState(path string) (*pcap.ClientState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	state := &pcap.ClientState{}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	return state, nil
+}
+
+// saveState saves the state in the file.
+func saveState(path string, state *pcap.ClientState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	// Write to a temporary file first, so the file is never left half written
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
+
+// newSession returns a random session.
+func newSession() (uint64, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// resume resumes the connection to the server in the state saved, so the client restarted keeps its session, port
+// and TCP sequences in the server without handshaking. The server is dialed in the session saved, or a new one, if the
+// state is missing or cannot be resumed.
+func (e *engine) resume(opts []pcap.Option) (*pcap.FakeTCPConn, error) {
+	dstAddr := &net.TCPAddr{IP: e.serverIP, Port: int(e.serverPort)}
+
+	state, err := loadState(e.state)
+	if err != nil {
+		log.Errorln(fmt.Errorf("load state %s: %w", e.state, err))
+	}
+
+	var session uint64
+	if state != nil {
+		session = state.Session
+
+		if state.Addr == dstAddr.String() {
+			conn, err := pcap.ResumeFakeTCP(state, opts...)
+			if err == nil {
+				return conn, nil
+			}
+			log.Errorln(fmt.Errorf("resume: %w", err))
+		} else {
+			log.Infof("Server changed from %s, connect again\n", state.Addr)
+		}
+	}
+
+	if session == 0 {
+		session, err = newSession()
+		if err != nil {
+			return nil, fmt.Errorf("create session: %w", err)
+		}
+	}
+
+	return pcap.DialFakeTCP(dstAddr, append(opts, pcap.WithSession(session))...)
+}
+
+// saveUpstream saves the state of the connection to the server, connections not in FakeTCP are skipped.
+func (e *engine) saveUpstream() error {
+	conn, ok := e.upConn.(*pcap.FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	state, err := conn.State()
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+
+	return saveState(e.state, state)
+}
+
+// saveStates saves the state of the connection to the server every interval until the engine is closed.
+func (e *engine) saveStates() {
+	t := time.NewTicker(stateInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			err := e.saveUpstream()
+			if err != nil {
+				log.Errorln(fmt.Errorf("save state %s: %w", e.state, err))
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/pcap"
+	"time"
+)
+
+// TestResult describes the result of a throughput test at a packet size.
+type TestResult struct {
+	pcap.ThroughputResult
+	// CPU is the CPU time of the process in the test, 0 if it is not supported on the platform.
+	CPU time.Duration `json:"cpu"`
+}
+
+// CPUUsage returns the ratio of CPU time to the duration of the test, which may be over 1 on multiple cores.
+func (result *TestResult) CPUUsage() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+
+	return result.CPU.Seconds() / result.Duration.Seconds()
+}
+
+// Test measures throughput, CPU usage and loss of the tunnel to the server with the given configuration. Synthetic
+// packets of each size are pushed through the whole pipeline of encryption, fragmentation and scheduling as fast as
+// possible for the duration, and the result of each size is reported. Sources are not required.
+func Test(ctx context.Context, cfg *config.Config, sizes []int, duration time.Duration, report func(*TestResult)) error {
+	e, conn, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer e.closeAll(nil)
+
+	tester := pcap.NewThroughputTester(conn)
+	for _, size := range sizes {
+		cpu, cpuErr := processCPUTime()
+
+		result, err := tester.Run(ctx, size, duration)
+		if err != nil {
+			return fmt.Errorf("test %d Bytes: %w", size, err)
+		}
+
+		testResult := &TestResult{ThroughputResult: *result}
+		if cpuErr == nil {
+			now, err := processCPUTime()
+			if err == nil {
+				testResult.CPU = now - cpu
+			}
+		}
+
+		report(testResult)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AppConfig describes an application profile, which bundles settings of an application so they can be selected by
+// name.
+type AppConfig struct {
+	// Ports are rules of packets of the application in the form of protocol, port, range of ports or protocol/port,
+	// e.g. udp/7000-8000. Only packets matched are proxied.
+	Ports []string `json:"ports"`
+	// MTU is the MTU, 0 means not set.
+	MTU int `json:"mtu"`
+	// KCP is the name of the KCP preset, empty means KCP is not enabled.
+	KCP string `json:"kcp"`
+	// Class is the QoS class of packets matched, can be realtime, normal or bulk, empty means not set.
+	Class string `json:"class"`
+}
+
+var (
+	appsLock sync.RWMutex
+	apps     = map[string]*AppConfig{
+		// Game servers of Valorant
+		"valorant": {
+			Ports: []string{"udp/7000-8000"},
+			Class: "realtime",
+		},
+		// Online play of Nintendo Switch in peer to peer
+		"switch-games": {
+			Ports: []string{"udp/45000-65535"},
+			Class: "realtime",
+		},
+	}
+)
+
+// RegisterApp registers an application profile, an existing one will be replaced.
+func RegisterApp(name string, app *AppConfig) {
+	appsLock.Lock()
+	defer appsLock.Unlock()
+
+	apps[name] = app
+}
+
+// FindApp returns the application profile by its name. Profiles defined in the config are found first.
+func FindApp(name string, defined map[string]AppConfig) (*AppConfig, error) {
+	app, ok := defined[name]
+	if ok {
+		return &app, nil
+	}
+
+	appsLock.RLock()
+	defer appsLock.RUnlock()
+
+	builtin, ok := apps[name]
+	if !ok {
+		return nil, fmt.Errorf("app %s not support", name)
+	}
+
+	copied := *builtin
+
+	return &copied, nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Config describes the configuration of IkaGo.
+type Config struct {
+	ListenDevs   []string     `json:"listen-devices"`
+	UpDev        string       `json:"upstream-device"`
+	Gateway      string       `json:"gateway"`
+	GatewayMAC   string       `json:"gateway-mac"`
+	MAC          string       `json:"mac"`
+	Mode         string       `json:"mode"`
+	Method       string       `json:"method"`
+	Password     string       `json:"password"`
+	Transforms   []string     `json:"transforms"`
+	Rule         bool         `json:"rule"`
+	LowMemory    bool         `json:"low-memory"`
+	Verbose      bool         `json:"verbose"`
+	Log          string       `json:"log"`
+	Trace        string       `json:"trace"`
+	TraceHex     bool         `json:"trace-hex"`
+	ErrorWindow  int          `json:"error-window"`
+	Monitor      int          `json:"monitor"`
+	HookConfig   HookConfig   `json:"hook"`
+	MTU          int          `json:"mtu"`
+	FragmentSize int          `json:"fragment-size"`
+	NoFragment   bool         `json:"no-fragment"`
+	DefragConfig DefragConfig `json:"defrag"`
+	Jitter       int          `json:"jitter"`
+	Profile      string       `json:"profile"`
+	Priority     int          `json:"priority"`
+	QoSConfig    QoSConfig    `json:"qos"`
+	DSCP         string       `json:"dscp"`
+	CopyTOS      bool         `json:"copy-tos"`
+	TTL          string       `json:"ttl"`
+	DecrementTTL bool         `json:"decrement-ttl"`
+	Probe        int          `json:"probe"`
+	Feedback     int          `json:"feedback"`
+	Rekey        int          `json:"rekey"`
+	Congestion   string       `json:"congestion"`
+	Adaptive     []float64    `json:"adaptive"`
+	Blackhole    bool         `json:"blackhole"`
+	Chaff        int          `json:"chaff"`
+	Stealth      bool         `json:"stealth"`
+	Cookie       string       `json:"cookie"`
+	Preamble     string       `json:"preamble"`
+	WireVersion  int          `json:"wire-version"`
+	TLSConfig    TLSConfig    `json:"tls"`
+	Typed        bool         `json:"typed"`
+	LengthPrefix bool         `json:"length-prefix"`
+	Validation   string       `json:"validation"`
+	Checksum     bool         `json:"checksum"`
+	Tolerance    int          `json:"tolerance"`
+	Filter       string       `json:"filter"`
+	Tunnel       []string     `json:"tunnel"`
+	SFlowConfig  SFlowConfig  `json:"sflow"`
+	PcapConfig   PcapConfig   `json:"pcap"`
+	Backend      string       `json:"backend"`
+	QuotaConfig  QuotaConfig  `json:"quota"`
+	MaxClients   int          `json:"max-clients"`
+	Refuse       string       `json:"refuse"`
+	BanFile      string       `json:"ban-file"`
+	AdminToken   string       `json:"admin-token"`
+	Handover     string       `json:"handover"`
+	MirrorConfig MirrorConfig `json:"mirror"`
+	KCP          bool         `json:"kcp"`
+	KCPConfig    KCPConfig    `json:"kcp-tuning"`
+	Port         int          `json:"port"`
+	ListenPorts  []int        `json:"listen-ports"`
+	Ports        int          `json:"ports"`
+	Stripe       bool         `json:"stripe"`
+	Rotate       int          `json:"rotate"`
+	Hop          int          `json:"hop"`
+	HopPorts     string       `json:"hop-ports"`
+	State        string       `json:"state"`
+	Publish      string       `json:"publish"`
+	Sources      []string     `json:"sources"`
+	Server       string       `json:"server"`
+
+	// Network impairment is only simulated for testing
+	ImpairmentConfig ImpairmentConfig `json:"impairment"`
+
+	// Application profiles and routes are only used in the client
+	App    string               `json:"app"`
+	Apps   map[string]AppConfig `json:"apps"`
+	Routes []RouteConfig        `json:"routes"`
+
+	// Rotation, schedules and users are only used in the server
+	RotationConfig RotationConfig        `json:"rotation"`
+	ScheduleConfig ScheduleConfig        `json:"schedule"`
+	Users          map[string]UserConfig `json:"users"`
+}
+
+// NewConfig returns a new config.
+func NewConfig() *Config {
+	return &Config{
+		Mode:         "faketcp",
+		Method:       "plain",
+		Transforms:   []string{"encrypt"},
+		DefragConfig: *NewDefragConfig(),
+		QoSConfig:    *NewQoSConfig(),
+		Validation:   "normal",
+		Preamble:     "tagged",
+		TLSConfig:    *NewTLSConfig(),
+		Backend:      "pcap",
+		Tunnel:       make([]string, 0),
+		SFlowConfig:  *NewSFlowConfig(),
+		HookConfig:   *NewHookConfig(),
+		QuotaConfig:  *NewQuotaConfig(),
+		Refuse:       "ignore",
+		MirrorConfig: *NewMirrorConfig(),
+		KCPConfig:    *NewKCPConfig(),
+		HopPorts:     "20000-40000",
+		Sources:      make([]string, 0),
+
+		ImpairmentConfig: *NewImpairmentConfig(),
+
+		Apps:   make(map[string]AppConfig),
+		Routes: make([]RouteConfig, 0),
+
+		RotationConfig: *NewRotationConfig(),
+		ScheduleConfig: *NewScheduleConfig(),
+		Users:          make(map[string]UserConfig),
+	}
+}
+
+// ParseFile returns the config parsed from file.
+func ParseFile(path string) (*Config, error) {
+	config := NewConfig()
+
+	// Open file
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	// Empty file
+	size := fi.Size()
+	if size == 0 {
+		return nil, errors.New("empty file")
+	}
+
+	// Read file
+	buffer := make([]byte, size)
+	_, err = file.Read(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	// Trim comments
+	buffer, err = trimComments(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("trim comments: %w", err)
+	}
+
+	// Expand environment variables
+	buffer = []byte(os.ExpandEnv(string(buffer)))
+
+	// Unmarshal
+	err = json.Unmarshal(buffer, config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return config, nil
+}
+
+func trimComments(data []byte) ([]byte, error) {
+	// Windows CRLF to Unix LF
+	data = bytes.Replace(data, []byte("\r"), []byte(""), 0)
+
+	lines := bytes.Split(data, []byte("\n"))
+
+	filtered := make([][]byte, 0)
+	for _, line := range lines {
+		match, err := regexp.Match(`^\s*#`, line)
+		if err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+
+		if !match {
+			filtered = append(filtered, line)
+		}
+	}
+
+	return bytes.Join(filtered, []byte("\n")), nil
+}
@@ -0,0 +1,17 @@
+package config
+
+// DefragConfig describes the configuration of defragmentation.
+type DefragConfig struct {
+	Mode     string `json:"mode"`
+	Deadline int    `json:"deadline"`
+	Limit    int    `json:"limit"`
+}
+
+// NewDefragConfig returns a new defragmentation config.
+func NewDefragConfig() *DefragConfig {
+	return &DefragConfig{
+		Mode:     "easy",
+		Deadline: 30,
+		Limit:    4096,
+	}
+}
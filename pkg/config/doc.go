@@ -0,0 +1,4 @@
+// Package config implements the config of IkaGo clients and servers.
+//
+// Fields of configs are stable in their JSON names, new fields are always added with defaults in their constructors.
+package config
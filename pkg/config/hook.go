@@ -0,0 +1,15 @@
+package config
+
+// HookConfig describes the configuration of notifying events by a webhook or a script.
+type HookConfig struct {
+	URL    string   `json:"url"`
+	Script string   `json:"script"`
+	Events []string `json:"events"`
+}
+
+// NewHookConfig returns a new hook config.
+func NewHookConfig() *HookConfig {
+	return &HookConfig{
+		Events: make([]string, 0),
+	}
+}
@@ -0,0 +1,16 @@
+package config
+
+// ImpairmentConfig describes the configuration of network impairment simulation. Percents are in the range of 0 to 100
+// and durations are in milliseconds.
+type ImpairmentConfig struct {
+	Loss      float64 `json:"loss"`
+	Delay     int     `json:"delay"`
+	Jitter    int     `json:"jitter"`
+	Duplicate float64 `json:"duplicate"`
+	Reorder   float64 `json:"reorder"`
+}
+
+// NewImpairmentConfig returns a new impairment config, which impairs nothing.
+func NewImpairmentConfig() *ImpairmentConfig {
+	return &ImpairmentConfig{}
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"github.com/xtaci/kcp-go"
+)
+
+// KCPConfig describes the configuration of KCP.
+type KCPConfig struct {
+	MTU         int  `json:"mtu"`
+	SendWindow  int  `json:"sndwnd"`
+	RecvWindow  int  `json:"rcvwnd"`
+	DataShard   int  `json:"datashard"`
+	ParityShard int  `json:"parityshard"`
+	ACKNoDelay  bool `json:"acknodelay"`
+	NoDelay     bool `json:"nodelay"`
+	Interval    int  `json:"interval"`
+	Resend      int  `json:"resend"`
+	NC          int  `json:"nc"`
+}
+
+// NewKCPConfig returns a new KCP config.
+func NewKCPConfig() *KCPConfig {
+	return &KCPConfig{
+		MTU:         kcp.IKCP_MTU_DEF,
+		SendWindow:  kcp.IKCP_WND_SND,
+		RecvWindow:  kcp.IKCP_WND_RCV,
+		DataShard:   10,
+		ParityShard: 3,
+		Interval:    kcp.IKCP_INTERVAL,
+	}
+}
+
+// kcpPresets are presets of KCP tuning options in kcptun.
+var kcpPresets = map[string]func(config *KCPConfig){
+	"normal": func(config *KCPConfig) {
+		config.Interval = 40
+		config.Resend = 2
+		config.NC = 1
+	},
+	"fast": func(config *KCPConfig) {
+		config.Interval = 30
+		config.Resend = 2
+		config.NC = 1
+	},
+	"fast2": func(config *KCPConfig) {
+		config.NoDelay = true
+		config.Interval = 20
+		config.Resend = 2
+		config.NC = 1
+	},
+	"fast3": func(config *KCPConfig) {
+		config.NoDelay = true
+		config.Interval = 10
+		config.Resend = 2
+		config.NC = 1
+	},
+}
+
+// NewKCPPreset returns a new KCP config of the preset, which can be normal, fast, fast2 or fast3 in the order of
+// latency from the highest to the lowest, and bandwidth used from the lowest to the highest.
+func NewKCPPreset(name string) (*KCPConfig, error) {
+	preset, ok := kcpPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("kcp preset %s not support", name)
+	}
+
+	config := NewKCPConfig()
+	preset(config)
+
+	return config, nil
+}
@@ -0,0 +1,35 @@
+package config
+
+const (
+	// lowMemoryDefragDeadline and lowMemoryDefragLimit limit fragments kept in defragmentation in low-memory mode.
+	lowMemoryDefragDeadline = 10
+	lowMemoryDefragLimit    = 256
+	// lowMemoryWindow is the size of send and receive windows of KCP in low-memory mode.
+	lowMemoryWindow = 32
+	// lowMemoryPcapBuffer is the size of buffers of pcap handles in KB in low-memory mode.
+	lowMemoryPcapBuffer = 256
+)
+
+// ApplyLowMemory lowers buffers, caches and windows for routers with little memory. Only settings left in defaults are
+// lowered, so settings set explicitly are kept.
+func (config *Config) ApplyLowMemory() {
+	defrag := NewDefragConfig()
+	if config.DefragConfig.Deadline == defrag.Deadline {
+		config.DefragConfig.Deadline = lowMemoryDefragDeadline
+	}
+	if config.DefragConfig.Limit == defrag.Limit {
+		config.DefragConfig.Limit = lowMemoryDefragLimit
+	}
+
+	kcp := NewKCPConfig()
+	if config.KCPConfig.SendWindow == kcp.SendWindow {
+		config.KCPConfig.SendWindow = lowMemoryWindow
+	}
+	if config.KCPConfig.RecvWindow == kcp.RecvWindow {
+		config.KCPConfig.RecvWindow = lowMemoryWindow
+	}
+
+	if config.PcapConfig.Buffer == 0 {
+		config.PcapConfig.Buffer = lowMemoryPcapBuffer
+	}
+}
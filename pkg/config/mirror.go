@@ -0,0 +1,14 @@
+package config
+
+// MirrorConfig describes the configuration of mirroring packets tunneled.
+type MirrorConfig struct {
+	Target string `json:"target"`
+	Sample int    `json:"sample"`
+}
+
+// NewMirrorConfig returns a new mirror config.
+func NewMirrorConfig() *MirrorConfig {
+	return &MirrorConfig{
+		Sample: 1,
+	}
+}
@@ -0,0 +1,9 @@
+package config
+
+// PcapConfig describes the configuration of tuning pcap handles.
+type PcapConfig struct {
+	Buffer    int  `json:"buffer"`
+	SnapLen   int  `json:"snaplen"`
+	Immediate bool `json:"immediate"`
+	Timeout   int  `json:"timeout"`
+}
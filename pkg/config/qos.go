@@ -0,0 +1,24 @@
+package config
+
+// QoSConfig describes the configuration of traffic classes.
+type QoSConfig struct {
+	Realtime QoSClassConfig `json:"realtime"`
+	Normal   QoSClassConfig `json:"normal"`
+	Bulk     QoSClassConfig `json:"bulk"`
+}
+
+// QoSClassConfig describes the configuration of a traffic class.
+type QoSClassConfig struct {
+	Match  []string `json:"match"`
+	Weight int      `json:"weight"`
+	Rate   int      `json:"rate"`
+}
+
+// NewQoSConfig returns a new QoS config.
+func NewQoSConfig() *QoSConfig {
+	return &QoSConfig{
+		Realtime: QoSClassConfig{Match: make([]string, 0), Weight: 8},
+		Normal:   QoSClassConfig{Match: make([]string, 0), Weight: 4},
+		Bulk:     QoSClassConfig{Match: make([]string, 0), Weight: 1},
+	}
+}
@@ -0,0 +1,18 @@
+package config
+
+// QuotaConfig describes the configuration of transfer quotas.
+type QuotaConfig struct {
+	Daily    int    `json:"daily"`
+	Monthly  int    `json:"monthly"`
+	Action   string `json:"action"`
+	Throttle int    `json:"throttle"`
+	File     string `json:"file"`
+}
+
+// NewQuotaConfig returns a new quota config.
+func NewQuotaConfig() *QuotaConfig {
+	return &QuotaConfig{
+		Action:   "throttle",
+		Throttle: 16384,
+	}
+}
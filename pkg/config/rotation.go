@@ -0,0 +1,15 @@
+package config
+
+// RotationConfig describes the configuration of the old password of the server in rotation.
+type RotationConfig struct {
+	// Password is the old password, which is still accepted in the method of the server while clients move to the new
+	// one.
+	Password string `json:"password"`
+	// Grace is the time in seconds the old password is retired after, 0 means it is never retired until removed.
+	Grace int `json:"grace"`
+}
+
+// NewRotationConfig returns a new rotation config.
+func NewRotationConfig() *RotationConfig {
+	return &RotationConfig{}
+}
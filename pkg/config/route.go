@@ -0,0 +1,10 @@
+package config
+
+// RouteConfig describes a rule routing packets to destinations matched through a server other than the default one.
+type RouteConfig struct {
+	// Match are destinations in the form of a CIDR, a rule of ports in the same form as QoS, or both separated by a
+	// space, e.g. 203.0.113.0/24 udp/27015-27030. Packets matched by any of them are routed through the server.
+	Match []string `json:"match"`
+	// Server is the address of the server.
+	Server string `json:"server"`
+}
@@ -0,0 +1,18 @@
+package config
+
+// ScheduleConfig describes the configuration of time windows clients are allowed in.
+type ScheduleConfig struct {
+	// Allow are windows clients are allowed in, e.g. 18:00-21:00 and sat-sun 09:00-22:00. All the time is allowed if
+	// empty.
+	Allow []string `json:"allow"`
+	// Deny are windows clients are refused in, which override windows allowed.
+	Deny []string `json:"deny"`
+}
+
+// NewScheduleConfig returns a new schedule config.
+func NewScheduleConfig() *ScheduleConfig {
+	return &ScheduleConfig{
+		Allow: make([]string, 0),
+		Deny:  make([]string, 0),
+	}
+}
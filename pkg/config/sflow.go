@@ -0,0 +1,14 @@
+package config
+
+// SFlowConfig describes the configuration of exporting samples of traffic in sFlow.
+type SFlowConfig struct {
+	Collector string `json:"collector"`
+	Rate      int    `json:"rate"`
+}
+
+// NewSFlowConfig returns a new sFlow config.
+func NewSFlowConfig() *SFlowConfig {
+	return &SFlowConfig{
+		Rate: 1000,
+	}
+}
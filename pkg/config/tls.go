@@ -0,0 +1,15 @@
+package config
+
+// TLSConfig describes the configuration of TLS mimicry.
+type TLSConfig struct {
+	Enabled bool     `json:"enabled"`
+	SNI     string   `json:"sni"`
+	ALPN    []string `json:"alpn"`
+}
+
+// NewTLSConfig returns a new TLS config.
+func NewTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		ALPN: []string{"h2", "http/1.1"},
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+// UserConfig describes the configuration of a user of the server, identified by its own password.
+type UserConfig struct {
+	// Password is the password of the user, which is used in the method of the server.
+	Password string `json:"password"`
+	// Allow are destinations the user may reach in the same form as matches of routes, e.g. 203.0.113.0/24 and
+	// tcp/443. All destinations are allowed if empty.
+	Allow []string `json:"allow"`
+	// Daily and Monthly are the quota of the user in MB, which override the quota of the server if not 0.
+	Daily   int `json:"daily"`
+	Monthly int `json:"monthly"`
+	// Rate is the limit of the traffic of the user in Bytes/s, 0 is unlimited.
+	Rate int `json:"rate"`
+	// Schedule is time windows the user is allowed in besides the schedule of the server.
+	Schedule ScheduleConfig `json:"schedule"`
+}
@@ -58,6 +58,7 @@ func (c *AESCFBCrypt) Cost() int {
 
 // AESGCMCrypt describes an AES-GCM crypt.
 type AESGCMCrypt struct {
+	key   []byte
 	block cipher.Block
 	aead  cipher.AEAD
 }
@@ -77,6 +78,7 @@ func CreateAESGCMCrypt(key []byte) (*AESGCMCrypt, error) {
 	}
 
 	return &AESGCMCrypt{
+		key:   key,
 		block: block,
 		aead:  aead,
 	}, nil
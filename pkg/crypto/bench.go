@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// benchPassword is the password of crypt in benchmarks.
+const benchPassword = "ikago"
+
+// BenchResult describes the throughput of a method in Bytes per second.
+type BenchResult struct {
+	Method  string  `json:"method"`
+	IsAEAD  bool    `json:"aead"`
+	Encrypt float64 `json:"encrypt"`
+	Decrypt float64 `json:"decrypt"`
+}
+
+// Throughput returns the throughput of the method in both encryption and decryption, which is the lower one.
+func (result *BenchResult) Throughput() float64 {
+	if result.Encrypt < result.Decrypt {
+		return result.Encrypt
+	}
+
+	return result.Decrypt
+}
+
+// Bench measures the throughput of encrypting and decrypting data of the size in the method, each in about the
+// duration.
+func Bench(method string, size int, duration time.Duration) (*BenchResult, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+
+	crypt, err := ParseCrypt(method, benchPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	_, err = rand.Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	result := &BenchResult{Method: Name(crypt), IsAEAD: crypt.Method().IsAEAD()}
+
+	// Encrypt
+	var encrypted []byte
+	count, start := 0, time.Now()
+	for time.Now().Sub(start) < duration {
+		encrypted, err = crypt.Encrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %w", err)
+		}
+		count++
+	}
+	result.Encrypt = float64(count*size) / time.Now().Sub(start).Seconds()
+
+	// Decrypt
+	count, start = 0, time.Now()
+	for time.Now().Sub(start) < duration {
+		_, err = crypt.Decrypt(encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		count++
+	}
+	result.Decrypt = float64(count*size) / time.Now().Sub(start).Seconds()
+
+	return result, nil
+}
+
+// Recommend returns the result of the method in AEAD with the highest throughput in results, or nil if there is none.
+func Recommend(results []*BenchResult) *BenchResult {
+	var best *BenchResult
+	for _, result := range results {
+		if !result.IsAEAD {
+			continue
+		}
+		if best == nil || result.Throughput() > best.Throughput() {
+			best = result
+		}
+	}
+
+	return best
+}
@@ -10,6 +10,7 @@
 
 // ChaCha20Poly1305Crypt describes an ChaCha20-Poly1305 crypt.
 type ChaCha20Poly1305Crypt struct {
+	key  []byte
 	aead cipher.AEAD
 }
 
@@ -21,7 +22,7 @@ func CreateChaCha20Poly1305Crypt(key []byte) (*ChaCha20Poly1305Crypt, error) {
 		return nil, fmt.Errorf("new aead: %w", err)
 	}
 
-	return &ChaCha20Poly1305Crypt{aead: aead}, nil
+	return &ChaCha20Poly1305Crypt{key: key, aead: aead}, nil
 }
 
 func (c *ChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
@@ -61,6 +62,7 @@ func (c *ChaCha20Poly1305Crypt) Cost() int {
 
 // XChaCha20Poly1305Crypt describes an XChaCha20-Poly1305 crypt.
 type XChaCha20Poly1305Crypt struct {
+	key  []byte
 	aead cipher.AEAD
 }
 
@@ -72,7 +74,7 @@ func CreateXChaCha20Poly1305Crypt(key []byte) (*XChaCha20Poly1305Crypt, error) {
 		return nil, fmt.Errorf("new aead: %w", err)
 	}
 
-	return &XChaCha20Poly1305Crypt{aead: aead}, nil
+	return &XChaCha20Poly1305Crypt{key: key, aead: aead}, nil
 }
 
 func (c *XChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CookieWindow is the period a cookie is created in, cookies are accepted in the period and its neighbors.
+const CookieWindow = 30 * time.Second
+
+// CookieSize is the size of cookies, which is a random nonce and a truncated MAC of it.
+const CookieSize = 8
+
+const cookieNonceSize = 4
+
+// Cookie creates and checks keyed cookies leading TCP SYNs, so SYNs of genuine clients are told from background scans
+// by a MAC without any state or decryption. Cookies may be replayed in the window, so they are not proofs of clients.
+type Cookie struct {
+	key []byte
+}
+
+// NewCookie returns a new cookie keyed by the secret.
+func NewCookie(secret string) (*Cookie, error) {
+	if secret == "" {
+		return nil, errors.New("missing secret")
+	}
+
+	return &Cookie{key: DeriveKey(secret, sha256.Size)}, nil
+}
+
+// Create returns a new cookie.
+func (cookie *Cookie) Create() ([]byte, error) {
+	return cookie.CreateAt(time.Now())
+}
+
+// CreateAt returns a new cookie created at the time, which is the current time in the clock of the verifier if the skew
+// of clocks is known.
+func (cookie *Cookie) CreateAt(t time.Time) ([]byte, error) {
+	nonce, err := GenerateNonce(cookieNonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return append(nonce, cookie.mac(nonce, cookieSlot(t))...), nil
+}
+
+// Verify returns if the cookie is created with the same key in the current period or its neighbors.
+func (cookie *Cookie) Verify(b []byte) bool {
+	return cookie.VerifySkewed(b, 0)
+}
+
+// VerifySkewed returns if the cookie is created with the same key in the current period or its neighbors, or in the
+// period shifted by the skew of the clock of the client from the local clock or its neighbors. Skews beyond
+// MaxClockSkew are shifted by MaxClockSkew.
+func (cookie *Cookie) VerifySkewed(b []byte, skew time.Duration) bool {
+	if len(b) < CookieSize {
+		return false
+	}
+
+	nonce, mac := b[:cookieNonceSize], b[cookieNonceSize:CookieSize]
+	now := time.Now()
+	slots := []uint64{cookieSlot(now)}
+	if skew != 0 {
+		slots = append(slots, cookieSlot(now.Add(clampSkew(skew))))
+	}
+	for _, slot := range slots {
+		for _, s := range []uint64{slot, slot - 1, slot + 1} {
+			if hmac.Equal(mac, cookie.mac(nonce, s)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (cookie *Cookie) mac(nonce []byte, slot uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, slot)
+
+	h := hmac.New(sha256.New, cookie.key)
+	h.Write(nonce)
+	h.Write(b)
+
+	return h.Sum(nil)[:CookieSize-cookieNonceSize]
+}
+
+func cookieSlot(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(CookieWindow))
+}
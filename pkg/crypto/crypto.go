@@ -1,7 +1,6 @@
 package crypto
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 )
@@ -20,6 +19,10 @@
 	MethodChaCha20Poly1305
 	// MethodXChaCha20Poly1305 describes the encryption is in XChaCha20-Poly1305.
 	MethodXChaCha20Poly1305
+	// MethodOther describes the encryption is in a method registered by third parties.
+	MethodOther
+	// MethodOtherAEAD describes the encryption is in an authenticated method registered by third parties.
+	MethodOtherAEAD
 )
 
 func (m Method) String() string {
@@ -34,11 +37,25 @@ func (m Method) String() string {
 		return "ChaCha20-Poly1305"
 	case MethodXChaCha20Poly1305:
 		return "XChaCha20-Poly1305"
+	case MethodOther:
+		return "Other"
+	case MethodOtherAEAD:
+		return "Other AEAD"
 	default:
 		return strconv.Itoa(int(m))
 	}
 }
 
+// IsAEAD returns if the method is an authenticated encryption.
+func (m Method) IsAEAD() bool {
+	switch m {
+	case MethodAESGCM, MethodChaCha20Poly1305, MethodXChaCha20Poly1305, MethodOtherAEAD:
+		return true
+	default:
+		return false
+	}
+}
+
 // Crypt describes crypt of encryption.
 type Crypt interface {
 	// Encrypt returns the encrypted data.
@@ -51,32 +68,17 @@ type Crypt interface {
 	Cost() int
 }
 
-// ParseCrypt returns a crypt by given method and password.
+// ParseCrypt returns a crypt by given method and password. Methods are found in those registered.
 func ParseCrypt(method, password string) (Crypt, error) {
-	var (
-		err error
-		c   Crypt
-	)
-
-	switch strings.ToLower(method) {
-	case "plain":
-		c = CreatePlainCrypt()
-	case "aes-128-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 16))
-	case "aes-192-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 24))
-	case "aes-256-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 32))
-	case "chacha20-poly1305":
-		c, err = CreateChaCha20Poly1305Crypt(DeriveKey(password, 32))
-	case "xchacha20-poly1305":
-		c, err = CreateXChaCha20Poly1305Crypt(DeriveKey(password, 32))
-	default:
-		return nil, fmt.Errorf("method %s not support", method)
+	factory, err := findFactory(method)
+	if err != nil {
+		return nil, err
 	}
+
+	c, err := factory(password)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	return &namedCrypt{Crypt: c, name: strings.ToLower(method)}, nil
 }
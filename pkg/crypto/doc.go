@@ -0,0 +1,5 @@
+// Package crypto implements the encryption of packets transmitted in the tunnel of IkaGo.
+//
+// Crypt and the methods parsed by ParseMethod are stable, and data encrypted by a method can always be decrypted by
+// the same method in later versions.
+package crypto
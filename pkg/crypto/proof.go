@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ProofWindow is the max difference between the time a proof is created and the time it is verified.
+const ProofWindow = 30 * time.Second
+
+// MaxClockSkew is the max skew of clocks of peers windows of proofs and cookies are shifted by, beyond which clocks
+// must be synchronized.
+const MaxClockSkew = 5 * time.Minute
+
+const proofSize = 8
+
+var (
+	// ErrProofExpired describes a proof is created out of the window.
+	ErrProofExpired = errors.New("proof expired")
+	// ErrProofReplayed describes a proof has been accepted in the window.
+	ErrProofReplayed = errors.New("proof replayed")
+)
+
+// CreateProof returns a proof of the knowledge of the key of the crypt, which is the current time encrypted.
+func CreateProof(crypt Crypt) ([]byte, error) {
+	return CreateProofAt(crypt, time.Now())
+}
+
+// CreateProofAt returns a proof created at the time, which is the current time in the clock of the verifier if the skew
+// of clocks is known.
+func CreateProofAt(crypt Crypt, t time.Time) ([]byte, error) {
+	b := make([]byte, proofSize)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+
+	proof, err := crypt.Encrypt(b)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+
+	return proof, nil
+}
+
+// ProofVerifier is a verifier of proofs. Proofs are accepted only once in the window.
+//
+// Proofs of a prover whose skew of clock is known are also accepted in the window shifted by the skew, so only the
+// prover skewed is accepted out of ProofWindow. Proofs accepted are remembered until they are out of any window
+// shifted, so shifting never lets proofs forgotten be replayed.
+type ProofVerifier struct {
+	crypt     Crypt
+	lock      sync.Mutex
+	proofs    map[string]time.Time
+	lastPurge time.Time
+}
+
+// NewProofVerifier returns a new proof verifier verifies proofs created by the crypt. Only crypt in AEAD is supported,
+// because proofs created by other crypt can be forged.
+func NewProofVerifier(crypt Crypt) (*ProofVerifier, error) {
+	if !crypt.Method().IsAEAD() {
+		return nil, fmt.Errorf("method %s not support", crypt.Method())
+	}
+
+	return &ProofVerifier{
+		crypt:     crypt,
+		proofs:    make(map[string]time.Time),
+		lastPurge: time.Now(),
+	}, nil
+}
+
+// Verify verifies the proof created in the window.
+func (verifier *ProofVerifier) Verify(proof []byte) error {
+	return verifier.VerifySkewed(proof, 0)
+}
+
+// VerifySkewed verifies the proof created in the window, or in the window shifted by the skew of the clock of the
+// prover from the local clock. Skews beyond MaxClockSkew are shifted by MaxClockSkew.
+func (verifier *ProofVerifier) VerifySkewed(proof []byte, skew time.Duration) error {
+	b, err := verifier.crypt.Decrypt(proof)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	if len(b) != proofSize {
+		return errors.New("invalid proof")
+	}
+
+	now := time.Now()
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	if !isInProofWindow(t, now) && !isInProofWindow(t, now.Add(clampSkew(skew))) {
+		return fmt.Errorf("created at %s: %w", t.Format(time.RFC3339), ErrProofExpired)
+	}
+
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+
+	// Purge proofs out of the window shifted the most which cannot be replayed anymore
+	if now.Sub(verifier.lastPurge) > ProofWindow {
+		for p, t := range verifier.proofs {
+			if now.Sub(t) > MaxClockSkew+ProofWindow {
+				delete(verifier.proofs, p)
+			}
+		}
+		verifier.lastPurge = now
+	}
+
+	_, ok := verifier.proofs[string(proof)]
+	if ok {
+		return ErrProofReplayed
+	}
+	verifier.proofs[string(proof)] = t
+
+	return nil
+}
+
+// isInProofWindow returns if the time a proof is created is in the window around the time.
+func isInProofWindow(created, t time.Time) bool {
+	return t.Sub(created) <= ProofWindow && created.Sub(t) <= ProofWindow
+}
+
+// clampSkew returns the skew of clocks no larger than MaxClockSkew in either direction.
+func clampSkew(skew time.Duration) time.Duration {
+	switch {
+	case skew > MaxClockSkew:
+		return MaxClockSkew
+	case skew < -MaxClockSkew:
+		return -MaxClockSkew
+	default:
+		return skew
+	}
+}
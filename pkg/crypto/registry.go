@@ -0,0 +1,158 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory returns a crypt by given password.
+type Factory func(password string) (Crypt, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{
+		"plain": func(password string) (Crypt, error) {
+			return CreatePlainCrypt(), nil
+		},
+		"aes-128-gcm": func(password string) (Crypt, error) {
+			return createCrypt(CreateAESGCMCrypt(DeriveKey(password, 16)))
+		},
+		"aes-192-gcm": func(password string) (Crypt, error) {
+			return createCrypt(CreateAESGCMCrypt(DeriveKey(password, 24)))
+		},
+		"aes-256-gcm": func(password string) (Crypt, error) {
+			return createCrypt(CreateAESGCMCrypt(DeriveKey(password, 32)))
+		},
+		"chacha20-poly1305": func(password string) (Crypt, error) {
+			return createCrypt(CreateChaCha20Poly1305Crypt(DeriveKey(password, 32)))
+		},
+		"xchacha20-poly1305": func(password string) (Crypt, error) {
+			return createCrypt(CreateXChaCha20Poly1305Crypt(DeriveKey(password, 32)))
+		},
+	}
+)
+
+// Register registers a factory of crypt by the name of its method, an existing one will be replaced. Names are case
+// insensitive.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	factories[strings.ToLower(name)] = factory
+}
+
+// Methods returns the names of methods registered in order.
+func Methods() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func findFactory(name string) (Factory, error) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	factory, ok := factories[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("method %s not support", name)
+	}
+
+	return factory, nil
+}
+
+// createCrypt converts results of constructors of crypt, so a typed nil is never returned as a crypt.
+func createCrypt(c Crypt, err error) (Crypt, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// namedCrypt is a crypt with the name of its method registered.
+type namedCrypt struct {
+	Crypt
+	name string
+}
+
+// Named describes crypt knowing the name of its method.
+type Named interface {
+	// Name returns the name of the method.
+	Name() string
+}
+
+func (c *namedCrypt) Name() string {
+	return c.name
+}
+
+// Name returns the name of the method of the crypt. Crypt not created by ParseCrypt and not named are named by their
+// methods.
+func Name(crypt Crypt) string {
+	c, ok := crypt.(Named)
+	if ok {
+		return c.Name()
+	}
+
+	return strings.ToLower(crypt.Method().String())
+}
+
+// MethodTagSize is the size of method tags.
+const MethodTagSize = 8
+
+const methodTagSaltSize = 4
+
+// ErrUnknownMethod describes a method tag matches no method registered.
+var ErrUnknownMethod = errors.New("unknown method")
+
+// CreateMethodTag returns a tag of the name of a method, which is salted randomly so tags of the same method are never
+// alike.
+func CreateMethodTag(name string) ([]byte, error) {
+	salt := make([]byte, methodTagSaltSize)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	return append(salt, methodTagHash(salt, name)...), nil
+}
+
+// MatchMethodTag returns if the tag is created from the name of the method.
+func MatchMethodTag(tag []byte, name string) bool {
+	if len(tag) != MethodTagSize {
+		return false
+	}
+
+	return hmac.Equal(tag[methodTagSaltSize:], methodTagHash(tag[:methodTagSaltSize], name))
+}
+
+// ParseMethodTag returns the name of the method registered which the tag is created from.
+func ParseMethodTag(tag []byte) (string, error) {
+	for _, name := range Methods() {
+		if MatchMethodTag(tag, name) {
+			return name, nil
+		}
+	}
+
+	return "", ErrUnknownMethod
+}
+
+func methodTagHash(salt []byte, name string) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write([]byte(strings.ToLower(name)))
+
+	return h.Sum(nil)[:MethodTagSize-methodTagSaltSize]
+}
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// rekeyInfo is the info keys are derived in rekeys, so keys derived are never alike keys derived for other uses.
+const rekeyInfo = "ikago rekey"
+
+// Rekeyer describes crypt whose key can be derived again, so peers change keys in band without handshaking again.
+type Rekeyer interface {
+	// Rekey returns a new crypt in the same method of a key derived from the key of the crypt and the salt.
+	Rekey(salt []byte) (Crypt, error)
+}
+
+// Rekey returns a new crypt of a key derived from the key of the crypt and the salt.
+func Rekey(crypt Crypt, salt []byte) (Crypt, error) {
+	r, ok := crypt.(Rekeyer)
+	if !ok {
+		return nil, fmt.Errorf("rekey not support in method %s", Name(crypt))
+	}
+
+	return r.Rekey(salt)
+}
+
+// deriveRekey derives a key of the same size from the key and the salt in HKDF-SHA256.
+func deriveRekey(key, salt []byte) ([]byte, error) {
+	result := make([]byte, len(key))
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(rekeyInfo)), result)
+	if err != nil {
+		return nil, fmt.Errorf("derive: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *namedCrypt) Rekey(salt []byte) (Crypt, error) {
+	crypt, err := Rekey(c.Crypt, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &namedCrypt{Crypt: crypt, name: c.name}, nil
+}
+
+// Rekey returns the plain crypt itself, which has no key.
+func (c *PlainCrypt) Rekey(salt []byte) (Crypt, error) {
+	return c, nil
+}
+
+func (c *AESGCMCrypt) Rekey(salt []byte) (Crypt, error) {
+	key, err := deriveRekey(c.key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return createCrypt(CreateAESGCMCrypt(key))
+}
+
+func (c *ChaCha20Poly1305Crypt) Rekey(salt []byte) (Crypt, error) {
+	key, err := deriveRekey(c.key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return createCrypt(CreateChaCha20Poly1305Crypt(key))
+}
+
+func (c *XChaCha20Poly1305Crypt) Rekey(salt []byte) (Crypt, error) {
+	key, err := deriveRekey(c.key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return createCrypt(CreateXChaCha20Poly1305Crypt(key))
+}
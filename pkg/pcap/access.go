@@ -0,0 +1,226 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errOutOfSchedule = errors.New("out of schedule")
+
+// accessWindow describes a window of time in days of the week, which may cross midnight into the next day.
+type accessWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// parseWeekday returns the day of the week by its name or the first 3 letters of its name, e.g. mon or monday.
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("day %s not support", s)
+}
+
+// parseClock returns minutes from midnight of the time in HH:MM, in which 24:00 is the end of the day.
+func parseClock(s string) (int, error) {
+	strs := strings.Split(s, ":")
+	if len(strs) != 2 {
+		return 0, fmt.Errorf("time %s not support", s)
+	}
+
+	hour, err := strconv.Atoi(strs[0])
+	if err != nil {
+		return 0, fmt.Errorf("parse hour %s: %w", strs[0], err)
+	}
+	minute, err := strconv.Atoi(strs[1])
+	if err != nil {
+		return 0, fmt.Errorf("parse minute %s: %w", strs[1], err)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("time %s out of range", s)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// parseAccessWindow returns the window in the form of days and a time range, e.g. mon-fri 18:00-21:00, where days are
+// a day or a range of days of the week and are every day if omitted. Time ranges ending before they start cross
+// midnight, e.g. 22:00-06:00.
+func parseAccessWindow(s string) (*accessWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("window %s not support", s)
+	}
+
+	window := &accessWindow{}
+
+	// Days
+	if len(fields) == 2 {
+		days := strings.Split(fields[0], "-")
+		if len(days) > 2 {
+			return nil, fmt.Errorf("days %s not support", fields[0])
+		}
+
+		first, err := parseWeekday(days[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(days) == 2 {
+			last, err = parseWeekday(days[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for d := first; ; d = (d + 1) % 7 {
+			window.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	} else {
+		for i := range window.days {
+			window.days[i] = true
+		}
+	}
+
+	// Time range
+	clocks := strings.Split(fields[len(fields)-1], "-")
+	if len(clocks) != 2 {
+		return nil, fmt.Errorf("time range %s not support", fields[len(fields)-1])
+	}
+
+	var err error
+	window.start, err = parseClock(clocks[0])
+	if err != nil {
+		return nil, err
+	}
+	window.end, err = parseClock(clocks[1])
+	if err != nil {
+		return nil, err
+	}
+	if window.start == window.end {
+		return nil, fmt.Errorf("time range %s is empty", fields[len(fields)-1])
+	}
+
+	return window, nil
+}
+
+// contains returns if the time is in the window.
+func (window *accessWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if window.start < window.end {
+		return window.days[day] && minute >= window.start && minute < window.end
+	}
+
+	// Windows crossing midnight start in their days and end in the next days
+	return (window.days[day] && minute >= window.start) || (window.days[(day+6)%7] && minute < window.end)
+}
+
+// AccessSchedule describes windows of time clients are allowed in, which are windows allowed except windows denied.
+// Methods of a nil schedule allow all the time.
+type AccessSchedule struct {
+	allow []*accessWindow
+	deny  []*accessWindow
+}
+
+// ParseAccessSchedule returns the schedule of windows allowed and windows denied in local time, e.g. 18:00-21:00 and
+// sat-sun 09:00-22:00. All the time is allowed if no window is allowed. It returns nil if there is no window.
+func ParseAccessSchedule(allow, deny []string) (*AccessSchedule, error) {
+	if len(allow) <= 0 && len(deny) <= 0 {
+		return nil, nil
+	}
+
+	schedule := &AccessSchedule{
+		allow: make([]*accessWindow, 0, len(allow)),
+		deny:  make([]*accessWindow, 0, len(deny)),
+	}
+	for _, s := range allow {
+		window, err := parseAccessWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse allow %s: %w", s, err)
+		}
+		schedule.allow = append(schedule.allow, window)
+	}
+	for _, s := range deny {
+		window, err := parseAccessWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse deny %s: %w", s, err)
+		}
+		schedule.deny = append(schedule.deny, window)
+	}
+
+	return schedule, nil
+}
+
+// IsOpen returns if clients are allowed at the time.
+func (schedule *AccessSchedule) IsOpen(t time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+
+	for _, window := range schedule.deny {
+		if window.contains(t) {
+			return false
+		}
+	}
+	if len(schedule.allow) <= 0 {
+		return true
+	}
+	for _, window := range schedule.allow {
+		if window.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Access describes schedules of the server and of users clients are allowed in, handshakes out of which are never
+// responded. Methods of a nil access allow all the time.
+type Access struct {
+	server *AccessSchedule
+	users  map[string]*AccessSchedule
+}
+
+// NewAccess returns a new access of the schedule of the server and schedules of users, either of which may be nil.
+func NewAccess(server *AccessSchedule, users map[string]*AccessSchedule) *Access {
+	access := &Access{
+		server: server,
+		users:  make(map[string]*AccessSchedule),
+	}
+	for name, schedule := range users {
+		if schedule != nil {
+			access.users[name] = schedule
+		}
+	}
+
+	return access
+}
+
+// IsAllowed returns if the client, identified as the user if not empty, is allowed at the time.
+func (access *Access) IsAllowed(user string, t time.Time) bool {
+	if access == nil {
+		return true
+	}
+	if !access.server.IsOpen(t) {
+		return false
+	}
+	if user == "" {
+		return true
+	}
+
+	return access.users[user].IsOpen(t)
+}
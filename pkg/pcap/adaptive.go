@@ -0,0 +1,163 @@
+package pcap
+
+import (
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+const (
+	// probeTimeout is the time after which a latency probe not replied is lost.
+	probeTimeout = 2 * time.Second
+	// lossWindow is the count of latency probes the loss is measured in.
+	lossWindow = 20
+	// lossMinSamples is the min count of latency probes replied or lost before the loss is measured.
+	lossMinSamples = 5
+	// MaxDuplicates is the max count of extra copies of packets written in adaptive duplication.
+	MaxDuplicates = 3
+	// dedupWindow is the count of recent TCP sequences of each peer remembered to drop duplicated packets.
+	dedupWindow = 1024
+)
+
+// lossMeter measures the loss of latency probes in a window of recent probes.
+type lossMeter struct {
+	pending map[uint32]time.Time
+	results []bool
+	next    int
+	count   int
+}
+
+func newLossMeter() *lossMeter {
+	return &lossMeter{
+		pending: make(map[uint32]time.Time),
+		results: make([]bool, lossWindow),
+	}
+}
+
+// send records a latency probe sent.
+func (m *lossMeter) send(seq uint32, sent time.Time) {
+	m.pending[seq] = sent
+}
+
+// reply records the reply of a latency probe, replies of probes unknown or lost are ignored.
+func (m *lossMeter) reply(seq uint32, sent time.Time) {
+	t, ok := m.pending[seq]
+	if !ok || !t.Equal(sent) {
+		return
+	}
+	delete(m.pending, seq)
+
+	m.record(false)
+}
+
+// expire records latency probes not replied within the timeout as lost.
+func (m *lossMeter) expire(timeout time.Duration) {
+	for seq, sent := range m.pending {
+		if time.Now().Sub(sent) < timeout {
+			continue
+		}
+		delete(m.pending, seq)
+
+		m.record(true)
+	}
+}
+
+func (m *lossMeter) record(isLost bool) {
+	m.results[m.next] = isLost
+	m.next = (m.next + 1) % len(m.results)
+	if m.count < len(m.results) {
+		m.count++
+	}
+}
+
+// loss returns the percent of latency probes lost, and false if there are not enough probes measured.
+func (m *lossMeter) loss() (float64, bool) {
+	if m.count < lossMinSamples {
+		return 0, false
+	}
+
+	lost := 0
+	for i := 0; i < m.count; i++ {
+		if m.results[i] {
+			lost++
+		}
+	}
+
+	return float64(lost) / float64(m.count) * 100, true
+}
+
+// seqWindow remembers recent TCP sequences of a peer, so packets duplicated by the peer or by the network are dropped.
+type seqWindow struct {
+	seqs map[uint32]struct{}
+	ring []uint32
+	next int
+}
+
+func newSeqWindow() *seqWindow {
+	return &seqWindow{
+		seqs: make(map[uint32]struct{}),
+		ring: make([]uint32, 0, dedupWindow),
+	}
+}
+
+// isDuplicate returns if the sequence has been seen, and remembers it.
+func (w *seqWindow) isDuplicate(seq uint32) bool {
+	_, ok := w.seqs[seq]
+	if ok {
+		return true
+	}
+
+	if len(w.ring) < cap(w.ring) {
+		w.ring = append(w.ring, seq)
+	} else {
+		delete(w.seqs, w.ring[w.next])
+		w.ring[w.next] = seq
+		w.next = (w.next + 1) % len(w.ring)
+	}
+	w.seqs[seq] = struct{}{}
+
+	return false
+}
+
+// adapt updates the count of extra copies of packets written to the client by its loss. A copy is added when the loss
+// reaches each threshold, and removed when the loss falls below half of the threshold, so duplication does not flap
+// around a threshold.
+func (c *FakeTCPConn) adapt(addr net.Addr, client *clientIndicator) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client.probes.expire(probeTimeout)
+	if len(c.adaptive) <= 0 {
+		return
+	}
+
+	loss, ok := client.probes.loss()
+
+	// Loss measured by delivery reports covers all packets rather than probes only, and is preferred
+	if client.delivery != nil {
+		if l, isMeasured := client.delivery.loss(); isMeasured {
+			loss, ok = l, true
+		}
+	}
+	if !ok {
+		return
+	}
+
+	duplicates := client.duplicates
+	for duplicates < len(c.adaptive) && loss >= c.adaptive[duplicates] {
+		duplicates++
+	}
+	for duplicates > 0 && loss < c.adaptive[duplicates-1]/2 {
+		duplicates--
+	}
+	if duplicates == client.duplicates {
+		return
+	}
+
+	client.duplicates = duplicates
+	if duplicates > 0 {
+		log.Infof("Loss to %s is %.1f%%, write packets in %d copies\n", addr, loss, duplicates+1)
+	} else {
+		log.Infof("Loss to %s recovers to %.1f%%, stop duplicating packets\n", addr, loss)
+	}
+}
@@ -0,0 +1,149 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientTimeout is the time without packets after which a client is no longer counted as connected.
+const clientTimeout = 2 * time.Minute
+
+// Admission is an admission control limits the count of clients connected simultaneously. Methods of a nil admission
+// admit all clients.
+type Admission struct {
+	lock    sync.Mutex
+	max     int
+	isReset bool
+	clients map[string]time.Time
+}
+
+// NewAdmission returns a new admission admits no more than max clients. Clients rejected will be reset if isReset is
+// true, or ignored silently.
+func NewAdmission(max int, isReset bool) (*Admission, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("max %d out of range", max)
+	}
+
+	return &Admission{
+		max:     max,
+		isReset: isReset,
+		clients: make(map[string]time.Time),
+	}, nil
+}
+
+// Admit returns if the client is admitted. Clients connected are always admitted, and new clients are admitted only if
+// the count of clients connected is under the max.
+func (admission *Admission) Admit(addr net.Addr) bool {
+	if admission == nil {
+		return true
+	}
+
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	now := time.Now()
+
+	_, ok := admission.clients[addr.String()]
+	if !ok {
+		// Forget clients timed out
+		for a, t := range admission.clients {
+			if now.Sub(t) > clientTimeout {
+				delete(admission.clients, a)
+			}
+		}
+
+		if len(admission.clients) >= admission.max {
+			return false
+		}
+	}
+
+	admission.clients[addr.String()] = now
+
+	return true
+}
+
+// Touch marks the client as connected now.
+func (admission *Admission) Touch(addr net.Addr) {
+	if admission == nil {
+		return
+	}
+
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	_, ok := admission.clients[addr.String()]
+	if ok {
+		admission.clients[addr.String()] = time.Now()
+	}
+}
+
+// Release marks the client as disconnected.
+func (admission *Admission) Release(addr net.Addr) {
+	if admission == nil {
+		return
+	}
+
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	delete(admission.clients, addr.String())
+}
+
+// IsReset returns if clients rejected should be reset.
+func (admission *Admission) IsReset() bool {
+	if admission == nil {
+		return false
+	}
+
+	return admission.isReset
+}
+
+// refuse refuses the client of the TCP SYN, by a TCP RST in the TTL or silently.
+func (admission *Admission) refuse(conn *RawConn, indicator *PacketIndicator, ttl uint8) {
+	log.Verbosef("Refuse client %s because of too many clients\n", indicator.Src().String())
+
+	if !admission.IsReset() {
+		return
+	}
+
+	err := writeRST(conn, indicator, ttl)
+	if err != nil {
+		log.Errorln(fmt.Errorf("reset client %s: %w", indicator.Src().String(), err))
+	}
+}
+
+// writeRST writes a TCP RST in the TTL in response to the TCP SYN.
+func writeRST(conn *RawConn, indicator *PacketIndicator, ttl uint8) error {
+	if indicator.TCPLayer() == nil {
+		return errors.New("missing tcp layer")
+	}
+
+	ack := indicator.TCPLayer().Seq + 1 + uint32(len(indicator.Payload()))
+
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(indicator.DstPort(), indicator.SrcPort(), 0, ack, conn, indicator.SrcIP(), randUint16(), ttl, indicator.SrcHardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer RST & ACK
+	tcpLayer := transportLayer.(*layers.TCP)
+	FlagTCPLayer(tcpLayer, false, false, true)
+	tcpLayer.RST = true
+
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
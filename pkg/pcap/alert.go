@@ -0,0 +1,110 @@
+package pcap
+
+import (
+	"errors"
+	"ikago/internal/log"
+	"ikago/pkg/crypto"
+	"ikago/pkg/stat"
+	"net"
+	"sync"
+	"time"
+)
+
+// alertThreshold is the count of rejected packets from a source in alertWindow which raises an alert.
+const alertThreshold = 10
+
+// alertWindow is the window rejected packets are counted in, also the min interval between alerts of a source.
+const alertWindow = 1 * time.Minute
+
+type rejectionIndicator struct {
+	count     int
+	start     time.Time
+	lastAlert time.Time
+}
+
+var (
+	rejectionMonitor *stat.RejectionMonitor
+	rejectionsLock   sync.Mutex
+	rejections       = make(map[string]*rejectionIndicator)
+	lastPurge        = time.Now()
+)
+
+// SetRejectionMonitor sets the monitor recording statistics of packets rejected in authentication.
+func SetRejectionMonitor(monitor *stat.RejectionMonitor) {
+	rejectionMonitor = monitor
+}
+
+// reject records a packet from the address rejected in authentication, and raises an alert if packets are rejected
+// repeatedly from the same source.
+func reject(addr net.Addr, err error) {
+	// Packets without proof are probes rather than forgeries, and packets backed off are not verified at all
+	if errors.Is(err, errMissingProof) || errors.Is(err, errBackingOff) {
+		return
+	}
+
+	reason := stat.RejectionForged
+	if errors.Is(err, crypto.ErrProofReplayed) || errors.Is(err, crypto.ErrProofExpired) {
+		reason = stat.RejectionReplayed
+	}
+
+	if rejectionMonitor != nil {
+		rejectionMonitor.Add(reason)
+	}
+
+	// Sources are identified by IP, as attackers may change ports freely
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+
+	now := time.Now()
+
+	rejectionsLock.Lock()
+	defer rejectionsLock.Unlock()
+
+	// Purge sources out of the window
+	if now.Sub(lastPurge) > alertWindow {
+		for s, indicator := range rejections {
+			if now.Sub(indicator.start) > alertWindow && now.Sub(indicator.lastAlert) > alertWindow {
+				delete(rejections, s)
+			}
+		}
+		lastPurge = now
+	}
+
+	indicator, ok := rejections[ip.String()]
+	if !ok {
+		indicator = &rejectionIndicator{start: now}
+		rejections[ip.String()] = indicator
+	}
+	if now.Sub(indicator.start) > alertWindow {
+		indicator.count = 0
+		indicator.start = now
+	}
+	indicator.count++
+
+	if indicator.count < alertThreshold || now.Sub(indicator.lastAlert) <= alertWindow {
+		return
+	}
+	indicator.lastAlert = now
+
+	if rejectionMonitor != nil {
+		rejectionMonitor.AddAlert()
+	}
+
+	log.Errorf("Reject %d packets from %s in %s, last as %s, is it under injection attack?\n", indicator.count, ip, alertWindow, reason)
+}
+
+// addrIP returns the IP of the address, or nil if the address does not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		return t.IP
+	case *net.UDPAddr:
+		return t.IP
+	case *net.IPAddr:
+		return t.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,228 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+	"sync"
+)
+
+// ARPCache is a cache of hardware addresses of IPv4 neighbors learned by ARP. It also replies ARP requests for
+// published addresses.
+type ARPCache struct {
+	neighborTable
+	conn        *RawConn
+	publishLock sync.RWMutex
+	publishes   map[string]bool
+	isClosed    bool
+}
+
+// NewARPCache returns a new ARP cache learns neighbors in the device, which is captured in options of captures.
+func NewARPCache(dev *Device, opts ...Option) (*ARPCache, error) {
+	if dev.IsLoop() {
+		return nil, fmt.Errorf("loopback device %s not support", dev.Alias())
+	}
+	if dev.IsPointToPoint() {
+		return nil, fmt.Errorf("point-to-point device %s not support", dev.Alias())
+	}
+
+	conn, err := CreateRawConn(dev, dev, "arp", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
+	}
+
+	cache := &ARPCache{
+		neighborTable: newNeighborTable(),
+		conn:          conn,
+		publishes:     make(map[string]bool),
+	}
+
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				if cache.isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("read device %s: %w", dev.Alias(), err))
+				continue
+			}
+
+			err = cache.handle(packet)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle arp in device %s: %w", dev.Alias(), err))
+				continue
+			}
+		}
+	}()
+
+	return cache, nil
+}
+
+// Resolve returns the hardware address of the neighbor. Stale neighbors are returned as is and solicited again in the
+// background.
+func (cache *ARPCache) Resolve(ip net.IP) (net.HardwareAddr, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("ip %s not support", ip)
+	}
+
+	return cache.resolve(ip.To4(), cache.solicit)
+}
+
+// Publish replies ARP requests for the IP as it is owned by the device, and announces it by a gratuitous ARP.
+func (cache *ARPCache) Publish(ip net.IP) error {
+	if ip.To4() == nil {
+		return fmt.Errorf("ip %s not support", ip)
+	}
+
+	cache.publishLock.Lock()
+	cache.publishes[ip.To4().String()] = true
+	cache.publishLock.Unlock()
+
+	data, err := CreateARPRequestPacket(cache.conn.LocalDev().HardwareAddr(), ip, ip)
+	if err != nil {
+		return fmt.Errorf("create gratuitous arp: %w", err)
+	}
+
+	_, err = cache.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the ARP cache.
+func (cache *ARPCache) Close() error {
+	cache.isClosed = true
+
+	return cache.conn.Close()
+}
+
+func (cache *ARPCache) solicit(ip net.IP) (net.HardwareAddr, error) {
+	return cache.wait(ip, func() error {
+		srcIPAddr := cache.conn.LocalDev().IPAddr()
+		if srcIPAddr == nil {
+			return errors.New("missing address")
+		}
+
+		data, err := CreateARPRequestPacket(cache.conn.LocalDev().HardwareAddr(), srcIPAddr.IP, ip)
+		if err != nil {
+			return fmt.Errorf("create arp request: %w", err)
+		}
+
+		_, err = cache.conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (cache *ARPCache) handle(packet gopacket.Packet) error {
+	arpLayer := packet.Layer(layers.LayerTypeARP)
+	if arpLayer == nil {
+		return nil
+	}
+	arp := arpLayer.(*layers.ARP)
+
+	srcIP := net.IP(arp.SourceProtAddress)
+
+	// Both requests and replies describe the sender, except probes in address conflict detection
+	if !srcIP.IsUnspecified() {
+		cache.learn(srcIP, net.HardwareAddr(arp.SourceHwAddress))
+	}
+
+	if arp.Operation != layers.ARPRequest {
+		return nil
+	}
+
+	cache.publishLock.RLock()
+	_, ok := cache.publishes[net.IP(arp.DstProtAddress).String()]
+	cache.publishLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := CreateARPReplyPacket(cache.conn.LocalDev().HardwareAddr(), arp)
+	if err != nil {
+		return fmt.Errorf("create arp reply: %w", err)
+	}
+
+	_, err = cache.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	log.Verbosef("Reply an %s request: %s -> %s\n", layers.LayerTypeARP, srcIP, net.IP(arp.DstProtAddress))
+
+	return nil
+}
+
+// CreateARPRequestPacket returns an ARP request packet resolving the target IP.
+func CreateARPRequestPacket(srcHardwareAddr net.HardwareAddr, srcIP, targetIP net.IP) ([]byte, error) {
+	if srcIP.To4() == nil {
+		return nil, fmt.Errorf("ip %s not support", srcIP)
+	}
+	if targetIP.To4() == nil {
+		return nil, fmt.Errorf("ip %s not support", targetIP)
+	}
+
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcHardwareAddr,
+		SourceProtAddress: srcIP.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    targetIP.To4(),
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       srcHardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	data, err := Serialize(ethernetLayer, arpLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
+
+// CreateARPReplyPacket returns an ARP reply packet answering the request as the requested IP is owned by the hardware
+// address.
+func CreateARPReplyPacket(srcHardwareAddr net.HardwareAddr, request *layers.ARP) ([]byte, error) {
+	arpLayer := &layers.ARP{
+		AddrType:          request.AddrType,
+		Protocol:          request.Protocol,
+		HwAddressSize:     request.HwAddressSize,
+		ProtAddressSize:   request.ProtAddressSize,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   srcHardwareAddr,
+		SourceProtAddress: request.DstProtAddress,
+		DstHwAddress:      request.SourceHwAddress,
+		DstProtAddress:    request.SourceProtAddress,
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       srcHardwareAddr,
+		DstMAC:       request.SourceHwAddress,
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	data, err := Serialize(ethernetLayer, arpLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,40 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+const (
+	// BackendPcap describes capturing with libpcap, Npcap or WinPcap.
+	BackendPcap = "pcap"
+	// BackendPFRing describes capturing with PF_RING, which is only available on Linux built with tag pfring.
+	BackendPFRing = "pfring"
+)
+
+// captureHandle is a handle capturing and sending packets in a device.
+type captureHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	SetBPFFilter(filter string) error
+	LinkType() layers.LinkType
+	Close()
+}
+
+// ParseBackend returns the backend by given name, which is BackendPcap if the name is empty.
+func ParseBackend(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case "", BackendPcap:
+		return BackendPcap, nil
+	case BackendPFRing:
+		if !isPFRingSupported {
+			return "", errors.New("pfring not support in this build")
+		}
+		return BackendPFRing, nil
+	default:
+		return "", fmt.Errorf("backend %s not support", s)
+	}
+}
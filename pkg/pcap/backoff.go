@@ -0,0 +1,94 @@
+package pcap
+
+import (
+	"errors"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// backoffThreshold is the count of failed handshakes from a source after which further handshakes from the source
+// are not processed for a while.
+const backoffThreshold = 5
+
+// backoffBase is the duration of the first backoff, which doubles on each further failed handshake.
+const backoffBase = 1 * time.Second
+
+// backoffMax is the max duration of backoffs, also the time after which failed handshakes are forgotten.
+const backoffMax = 1 * time.Hour
+
+var errBackingOff = errors.New("backing off")
+
+type handshakeIndicator struct {
+	failures    int
+	lastFailure time.Time
+	until       time.Time
+}
+
+var (
+	handshakesLock     sync.Mutex
+	handshakes         = make(map[string]*handshakeIndicator)
+	lastHandshakePurge = time.Now()
+)
+
+// isBackingOff returns if handshakes from the IP should not be processed now.
+func isBackingOff(ip net.IP) bool {
+	handshakesLock.Lock()
+	defer handshakesLock.Unlock()
+
+	indicator, ok := handshakes[string(ip.To16())]
+	if !ok {
+		return false
+	}
+
+	return time.Now().Before(indicator.until)
+}
+
+// failHandshake records a failed handshake from the IP, and backs off exponentially once failures reach the
+// threshold.
+func failHandshake(ip net.IP) {
+	now := time.Now()
+
+	handshakesLock.Lock()
+	defer handshakesLock.Unlock()
+
+	// Purge sources not failing for a long time
+	if now.Sub(lastHandshakePurge) > backoffMax {
+		for s, indicator := range handshakes {
+			if now.Sub(indicator.lastFailure) > backoffMax && now.After(indicator.until) {
+				delete(handshakes, s)
+			}
+		}
+		lastHandshakePurge = now
+	}
+
+	key := string(ip.To16())
+	indicator, ok := handshakes[key]
+	if !ok || now.Sub(indicator.lastFailure) > backoffMax {
+		indicator = &handshakeIndicator{}
+		handshakes[key] = indicator
+	}
+	indicator.failures++
+	indicator.lastFailure = now
+
+	if indicator.failures < backoffThreshold {
+		return
+	}
+
+	duration := backoffMax
+	if n := indicator.failures - backoffThreshold; n < 32 && backoffBase<<uint(n) < backoffMax {
+		duration = backoffBase << uint(n)
+	}
+	indicator.until = now.Add(duration)
+
+	log.Errorf("Back off handshakes from %s for %s after %d failures\n", ip, duration, indicator.failures)
+}
+
+// succeedHandshake forgets failed handshakes from the IP.
+func succeedHandshake(ip net.IP) {
+	handshakesLock.Lock()
+	defer handshakesLock.Unlock()
+
+	delete(handshakes, string(ip.To16()))
+}
@@ -0,0 +1,113 @@
+package pcap
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+)
+
+var errBanned = errors.New("banned")
+
+// Bans is a list of IPs and users banned, whose handshakes are never responded. Methods of a nil list ban nothing.
+type Bans struct {
+	lock  sync.RWMutex
+	ips   map[string]bool
+	users map[string]bool
+}
+
+// NewBans returns a new empty list of bans.
+func NewBans() *Bans {
+	return &Bans{
+		ips:   make(map[string]bool),
+		users: make(map[string]bool),
+	}
+}
+
+// BanIP bans the IP, and returns false if it has been banned.
+func (bans *Bans) BanIP(ip net.IP) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if bans.ips[ip.String()] {
+		return false
+	}
+	bans.ips[ip.String()] = true
+
+	return true
+}
+
+// UnbanIP unbans the IP, and returns false if it has not been banned.
+func (bans *Bans) UnbanIP(ip net.IP) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if !bans.ips[ip.String()] {
+		return false
+	}
+	delete(bans.ips, ip.String())
+
+	return true
+}
+
+// BanUser bans the user, and returns false if it has been banned.
+func (bans *Bans) BanUser(name string) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if bans.users[name] {
+		return false
+	}
+	bans.users[name] = true
+
+	return true
+}
+
+// UnbanUser unbans the user, and returns false if it has not been banned.
+func (bans *Bans) UnbanUser(name string) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if !bans.users[name] {
+		return false
+	}
+	delete(bans.users, name)
+
+	return true
+}
+
+// IsBanned returns if the client at the address, identified as the user if not empty, is banned.
+func (bans *Bans) IsBanned(addr net.Addr, user string) bool {
+	if bans == nil {
+		return false
+	}
+
+	bans.lock.RLock()
+	defer bans.lock.RUnlock()
+
+	if ip := addrIP(addr); ip != nil && bans.ips[ip.String()] {
+		return true
+	}
+
+	return user != "" && bans.users[user]
+}
+
+// List returns IPs and users banned in order.
+func (bans *Bans) List() ([]string, []string) {
+	bans.lock.RLock()
+	defer bans.lock.RUnlock()
+
+	ips := make([]string, 0, len(bans.ips))
+	for ip := range bans.ips {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	users := make([]string, 0, len(bans.users))
+	for user := range bans.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	return ips, users
+}
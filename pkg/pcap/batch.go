@@ -0,0 +1,148 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// WriteBatch writes datagrams concatenated in the buffer to the address in one pass, whose sizes are in order, like a
+// write of GSO split in datagrams. Datagrams are queued in the pipeline of the peer together rather than written one by
+// one, which suits bursts like flushes of KCP. The count of datagrams written is returned, and datagrams following the
+// first one failed are not written.
+func (c *FakeTCPConn) WriteBatch(b []byte, sizes []int, addr net.Addr) (n int, err error) {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	// UDP addresses are accepted as TCP addresses because KCP resolves addresses in UDP
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		dstIP = addr.(*net.TCPAddr).IP
+		dstPort = uint16(addr.(*net.TCPAddr).Port)
+	case *net.UDPAddr:
+		dstIP = addr.(*net.UDPAddr).IP
+		dstPort = uint16(addr.(*net.UDPAddr).Port)
+	default:
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("type %T not support", t),
+		}
+	}
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("%w %s", ErrUnauthorizedClient, addr),
+		}
+	}
+
+	// Split datagrams, and those too large to be carried by IP fragmentation in segments
+	ws := make([]*pendingWrite, 0, len(sizes))
+	owners := make([]int, 0, len(sizes))
+	max := c.maxDatagram(client, dstIP)
+	offset := 0
+	for i, size := range sizes {
+		if size <= 0 || offset+size > len(b) {
+			return 0, &net.OpError{
+				Op:     "write",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("size %d out of range", size),
+			}
+		}
+
+		p := b[offset : offset+size]
+		offset = offset + size
+		if c.isTypedTo(client) {
+			p = createDataFrame(p)
+		}
+
+		datagrams := [][]byte{p}
+		if len(p) > max && !c.isNoFragment {
+			// Peers in untyped framing cannot tell segments from data
+			if !c.isTypedTo(client) {
+				return 0, &net.OpError{
+					Op:     "write",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("%w: size %d out of range in untyped framing", ErrMTUExceeded, size),
+				}
+			}
+
+			datagrams, err = c.createSegments(p, max)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "write",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    err,
+				}
+			}
+		}
+
+		for _, datagram := range datagrams {
+			ws = append(ws, &pendingWrite{p: datagram, dstIP: dstIP, dstPort: dstPort})
+			owners = append(owners, i)
+		}
+	}
+	results := make([]chan error, len(ws))
+	for i, w := range ws {
+		results[i] = make(chan error, 1)
+		w.result = results[i]
+	}
+
+	// Buffered so goroutines losing the race never block
+	ch := make(chan error, 1)
+	c.spawn(func() {
+		err := c.queueWrites(client, ws...)
+		if err != nil {
+			ch <- err
+		}
+	})
+	// Timeout, writes not written yet are cancelled so they are never written after the timeout is returned
+	if !c.writeDeadline.IsZero() {
+		c.spawn(func() {
+			if c.sleep(c.writeDeadline.Sub(time.Now())) {
+				for _, w := range ws {
+					w.cancel()
+				}
+			}
+		})
+	}
+
+	// Results are in order of datagrams in the pipeline
+	for i := range ws {
+		select {
+		case <-c.closed:
+			err = ErrClosed
+		case err = <-ch:
+		case err = <-results[i]:
+		}
+		if err != nil {
+			return owners[i], &net.OpError{
+				Op:     "write",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    err,
+			}
+		}
+	}
+
+	return len(sizes), nil
+}
@@ -0,0 +1,85 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/google/gopacket"
+	"net"
+	"time"
+)
+
+var (
+	benchSrcIP  = net.IPv4(10, 255, 0, 1).To4()
+	benchDstIP  = net.IPv4(10, 255, 0, 2).To4()
+	benchSrcMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	benchDstMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// BenchResult describes the throughput of serializing and parsing packets in FakeTCP in Bytes of payloads per second.
+type BenchResult struct {
+	Size      int     `json:"size"`
+	Fragment  int     `json:"fragment"`
+	Serialize float64 `json:"serialize"`
+	Parse     float64 `json:"parse"`
+}
+
+// Bench measures the throughput of serializing payloads of the size in FakeTCP packets in fragments of the size as
+// they are written, and parsing them as they are read, each in about the duration.
+func Bench(size, fragment int, duration time.Duration) (*BenchResult, error) {
+	if size <= 0 || size > IPv4MaxSize-20-20 {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+	if fragment < 68 {
+		return nil, fmt.Errorf("fragment %d out of range", fragment)
+	}
+
+	payload := make([]byte, size)
+	_, err := rand.Read(payload)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	result := &BenchResult{Size: size, Fragment: fragment}
+
+	// Serialize
+	var fragments [][]byte
+	count, start := 0, time.Now()
+	for time.Now().Sub(start) < duration {
+		transportLayer := CreateTCPLayer(443, 443, uint32(count), 0)
+		networkLayer, err := CreateIPv4Layer(benchSrcIP, benchDstIP, uint16(count), 64, transportLayer)
+		if err != nil {
+			return nil, fmt.Errorf("create network layer: %w", err)
+		}
+		linkLayer, err := CreateEthernetLayer(benchSrcMAC, benchDstMAC, networkLayer)
+		if err != nil {
+			return nil, fmt.Errorf("create link layer: %w", err)
+		}
+
+		fragments, err = CreateFragmentPackets(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload), fragment)
+		if err != nil {
+			return nil, fmt.Errorf("create fragments: %w", err)
+		}
+		count++
+	}
+	result.Serialize = float64(count*size) / time.Now().Sub(start).Seconds()
+
+	// Parse
+	count, start = 0, time.Now()
+	for time.Now().Sub(start) < duration {
+		for _, fragment := range fragments {
+			packet, err := ParseRawPacket(fragment)
+			if err != nil {
+				return nil, fmt.Errorf("parse packet: %w", err)
+			}
+
+			_, err = InterpretPacket(packet)
+			if err != nil {
+				return nil, fmt.Errorf("interpret packet: %w", err)
+			}
+		}
+		count++
+	}
+	result.Parse = float64(count*size) / time.Now().Sub(start).Seconds()
+
+	return result, nil
+}
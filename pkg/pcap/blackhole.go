@@ -0,0 +1,107 @@
+package pcap
+
+import (
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+// blackholeThreshold is the count of consecutive large probes lost while small probes are replied, which indicates an
+// MTU blackhole.
+const blackholeThreshold = 3
+
+// blackholeSizes are sizes of fragments fallen back to in MTU blackholes, in descending order.
+var blackholeSizes = []int{1400, 1280, 1200, 1024, 576}
+
+// blackholeDetector detects MTU blackholes to a peer by large probes, which are latency probes padded to the size of
+// fragments.
+type blackholeDetector struct {
+	pending  map[uint32]time.Time
+	misses   int
+	fragment int
+}
+
+func newBlackholeDetector() *blackholeDetector {
+	return &blackholeDetector{pending: make(map[uint32]time.Time)}
+}
+
+// reply records the reply of a large probe, replies of probes unknown or lost are ignored.
+func (d *blackholeDetector) reply(seq uint32, sent time.Time) {
+	t, ok := d.pending[seq]
+	if !ok || !t.Equal(sent) {
+		return
+	}
+	delete(d.pending, seq)
+
+	d.misses = 0
+}
+
+// fragmentOf returns the size of fragments of packets written to the client, which is lowered in MTU blackholes.
+func (c *FakeTCPConn) fragmentOf(client *clientIndicator) int {
+	if client.blackhole != nil && client.blackhole.fragment > 0 && client.blackhole.fragment < c.fragment {
+		return client.blackhole.fragment
+	}
+
+	return c.fragment
+}
+
+// sendLargeProbe sends a latency probe to the client as large as the packets not fragmented.
+func (c *FakeTCPConn) sendLargeProbe(addr net.Addr, client *clientIndicator, seq uint32) error {
+	dstIP := addrIP(addr)
+
+	c.lock.Lock()
+	size := c.fragmentOf(client) - headerSize(dstIP) - c.crypt.Cost() - c.recordCost()
+	if max := c.maxPayloadTo(dstIP); size > max {
+		size = max
+	}
+	if size < echoSize {
+		size = echoSize
+	}
+	sent := time.Now()
+	client.blackhole.pending[seq] = sent
+	c.lock.Unlock()
+
+	b := make([]byte, size)
+	copy(b, createEcho(echoRequest, seq, sent))
+
+	// Probes are not counted as writes so chaff is still sent in idle
+	_, err := c.writeMessage(b, addr, true)
+
+	return err
+}
+
+// detectBlackhole counts large probes lost to the client while small probes are replied, and falls back to smaller
+// fragments once an MTU blackhole is detected, until large probes are replied again.
+func (c *FakeTCPConn) detectBlackhole(addr net.Addr, client *clientIndicator) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	d := client.blackhole
+	for seq, sent := range d.pending {
+		if time.Now().Sub(sent) < probeTimeout {
+			continue
+		}
+		delete(d.pending, seq)
+
+		// Loss of large probes means nothing if small probes are lost as well
+		if loss, ok := client.probes.loss(); !ok || loss >= 50 {
+			continue
+		}
+		d.misses++
+	}
+	if d.misses < blackholeThreshold {
+		return
+	}
+	d.misses = 0
+
+	current := c.fragmentOf(client)
+	for _, size := range blackholeSizes {
+		if size < current {
+			d.fragment = size
+			log.Errorf("Packets of %d Bytes to %s are lost while small ones pass, which may be an MTU blackhole, fall back to fragments of %d Bytes\n",
+				current, addr, size)
+			return
+		}
+	}
+	log.Errorf("Packets of %d Bytes to %s are still lost while small ones pass, check MTU of the path\n", current, addr)
+}
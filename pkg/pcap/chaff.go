@@ -0,0 +1,73 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// chaffIdle is the time without writes after which a client is considered idle and chaff is sent to it.
+const chaffIdle = 1 * time.Second
+
+// minChaffSize and maxChaffSize are the range of sizes of chaff.
+const (
+	minChaffSize = 40
+	maxChaffSize = 200
+)
+
+// createChaff returns a chaff of random size and contents, which is a heartbeat frame. Chaff is never told from data
+// by its contents, so it is only sent in typed framing.
+func createChaff(r *rand.Rand) []byte {
+	b := make([]byte, minChaffSize+r.Intn(maxChaffSize-minChaffSize+1))
+
+	r.Read(b)
+	b[0] = frameHeartbeat
+
+	return b
+}
+
+// sendChaff sends chaff to idle clients in typed framing until the connection is closed, chaff sent is no more than the
+// rate in bytes per second.
+func (c *FakeTCPConn) sendChaff(rate int) {
+	r := rand.New(rand.NewSource(int64(randUint32())))
+
+	for !c.isClosed {
+		chaff := createChaff(r)
+
+		// Idle clients
+		addrs := make([]net.Addr, 0)
+		c.clientsLock.RLock()
+		for a, client := range c.clients {
+			if time.Now().Sub(client.lastWrite) < chaffIdle || !c.isTypedTo(client) {
+				continue
+			}
+
+			addr, err := net.ResolveTCPAddr("tcp", a)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		c.clientsLock.RUnlock()
+
+		for _, addr := range addrs {
+			_, err := c.writeTo(chaff, addr, true)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("send chaff to %s: %w", addr, err))
+			}
+		}
+
+		// Wait randomly between once and twice the time the bandwidth allows, so the rate is always under the cap
+		size := len(chaff) + 20 + 20 + c.crypt.Cost()
+		if len(addrs) > 1 {
+			size = size * len(addrs)
+		}
+		interval := time.Duration(float64(size) / float64(rate) * float64(time.Second) * (1 + r.Float64()))
+
+		if !c.sleep(interval) {
+			return
+		}
+	}
+}
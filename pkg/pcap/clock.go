@@ -0,0 +1,148 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/crypto"
+	"net"
+	"time"
+)
+
+// clockSize is the size of clock messages, which is a byte of type, 8 bytes of the time the request is sent and 8 bytes
+// of the time the request is received, which is 0 in requests.
+const clockSize = 17
+
+// clockWarning is the skew of clocks logged, beyond which windows of proofs and cookies of clients are shifted.
+const clockWarning = crypto.ProofWindow / 3
+
+// createClockMessage returns a clock message.
+func createClockMessage(t byte, sent, received time.Time) []byte {
+	b := make([]byte, clockSize)
+
+	b[0] = t
+	binary.BigEndian.PutUint64(b[1:9], uint64(sent.UnixNano()))
+	if !received.IsZero() {
+		binary.BigEndian.PutUint64(b[9:17], uint64(received.UnixNano()))
+	}
+
+	return b
+}
+
+// sendClockRequest asks the remote address for its clock, so the skew of clocks is measured in band.
+func (c *FakeTCPConn) sendClockRequest(addr net.Addr) {
+	if !c.isTypedToAddr(addr) {
+		return
+	}
+
+	// Requests are not counted as writes so chaff is still sent in idle
+	_, err := c.writeTo(createClockMessage(clockRequest, time.Now(), time.Time{}), addr, true)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("send clock request to %s: %w", addr, err))
+	}
+}
+
+// handleClock replies clock requests, and records skews of clocks of the address measured by clock messages. Skews
+// measured by requests include the delay of the path, while those by replies do not as in NTP.
+func (c *FakeTCPConn) handleClock(contents []byte, addr net.Addr) error {
+	if len(contents) < clockSize {
+		return fmt.Errorf("clock size %d out of range", len(contents))
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(contents[1:9])))
+
+	switch contents[0] {
+	case clockRequest:
+		c.recordClock(addr, sent.Sub(now))
+
+		// Replies are not counted as writes either
+		_, err := c.writeMessage(createClockMessage(clockReply, sent, now), addr, true)
+		if err != nil {
+			return fmt.Errorf("reply: %w", err)
+		}
+	case clockReply:
+		received := time.Unix(0, int64(binary.BigEndian.Uint64(contents[9:17])))
+		rtt := now.Sub(sent)
+		if rtt < 0 {
+			return fmt.Errorf("rtt %s out of range", rtt)
+		}
+
+		c.recordClock(addr, received.Sub(sent)-rtt/2)
+	}
+
+	return nil
+}
+
+// recordClock records the skew of the clock of the address from the local clock. Listeners shift windows of proofs and
+// cookies of each client by its skew, so clients whose clocks drift are still accepted.
+func (c *FakeTCPConn) recordClock(addr net.Addr, skew time.Duration) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	isSkewed := client.isClocked && absDuration(client.skew) > clockWarning
+	client.skew, client.isClocked = skew, true
+	c.lock.Unlock()
+
+	if c.latMonitor != nil {
+		c.latMonitor.AddSkew(skew)
+	}
+
+	// Only listeners keep skews of clients
+	if c.skews != nil {
+		c.skews.record(addrIP(addr), skew)
+	}
+
+	// Skews are measured repeatedly, but logged only once
+	if absDuration(skew) <= clockWarning || isSkewed {
+		return
+	}
+	if c.skews != nil {
+		log.Infof("Clock of client %s is skewed by %s, windows of its proofs and cookies are shifted by it up to %s for %s\n",
+			addr, skew.Round(time.Millisecond), crypto.MaxClockSkew, skewDecay)
+	} else {
+		log.Infof("Clock of server %s is skewed by %s, proofs and cookies are created in its clock up to %s\n", addr,
+			skew.Round(time.Millisecond), crypto.MaxClockSkew)
+	}
+}
+
+// ClockOffset returns the skew of the clock of the remote address from the local clock measured in band, and false if
+// it has not been measured.
+func (c *FakeTCPConn) ClockOffset() (time.Duration, bool) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return client.skew, client.isClocked
+}
+
+// clockNow returns the current time in the clock of the client, so proofs and cookies created for the server are in
+// its window even if the local clock is skewed. Skews beyond MaxClockSkew are not trusted. The connection must be
+// locked.
+func (client *clientIndicator) clockNow() time.Time {
+	now := time.Now()
+	if !client.isClocked || absDuration(client.skew) > crypto.MaxClockSkew {
+		return now
+	}
+
+	return now.Add(client.skew)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
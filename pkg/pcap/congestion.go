@@ -0,0 +1,374 @@
+package pcap
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CongestionControl decides the rate writes to a peer are paced at by signals of the path to the peer, so bulk
+// transfers do not fill buffers of the path and add latency to other traffic. Each peer has its own congestion control,
+// which is always accessed in the lock of the connection.
+type CongestionControl interface {
+	// OnSent records a datagram of the size written to the peer, which is delayed by pacing if paced is set. Writes
+	// never delayed are limited by the application rather than the rate.
+	OnSent(size int, paced bool, now time.Time)
+	// OnDelivered records the count of datagrams the peer reports it has received in total in delivery reports.
+	OnDelivered(received uint64, now time.Time)
+	// OnRTT records a RTT to the peer measured by latency probes.
+	OnRTT(rtt time.Duration, now time.Time)
+	// PacingRate returns the rate in Bytes per second writes are paced at, 0 means writes are not paced.
+	PacingRate(now time.Time) float64
+}
+
+// CongestionControlFactory returns a new congestion control of a peer.
+type CongestionControlFactory func() CongestionControl
+
+var (
+	congestionControlsLock sync.RWMutex
+	congestionControls     = map[string]CongestionControlFactory{
+		"bbr": func() CongestionControl {
+			return newBBR()
+		},
+	}
+)
+
+// RegisterCongestionControl registers a congestion control, an existing one will be replaced.
+func RegisterCongestionControl(name string, factory CongestionControlFactory) {
+	congestionControlsLock.Lock()
+	defer congestionControlsLock.Unlock()
+
+	congestionControls[name] = factory
+}
+
+// FindCongestionControl returns the factory of the congestion control by its name.
+func FindCongestionControl(name string) (CongestionControlFactory, error) {
+	congestionControlsLock.RLock()
+	defer congestionControlsLock.RUnlock()
+
+	factory, ok := congestionControls[name]
+	if !ok {
+		return nil, fmt.Errorf("congestion control %s not support", name)
+	}
+
+	return factory, nil
+}
+
+const (
+	// bbrWindow is the time the max bandwidth and the min RTT are measured in.
+	bbrWindow = 10 * time.Second
+	// bbrStartupGain is the gain of pacing in startup, which doubles the rate each round.
+	bbrStartupGain = 2.885
+	// bbrFullReports is the count of reports the bandwidth does not grow by bbrFullGrowth before the path is full.
+	bbrFullReports = 3
+	// bbrFullGrowth is the growth of the bandwidth in a report, below which the path is considered full.
+	bbrFullGrowth = 1.25
+	// bbrInitialRate is the rate writes are paced at before the first rate is sampled, so the queue of the path is
+	// not filled before the bandwidth is known.
+	bbrInitialRate = 1 << 20
+	// bbrDefaultRound is the time of a round if no RTT is measured.
+	bbrDefaultRound = 200 * time.Millisecond
+	// bbrProbeRTTInflight is the max Bytes in flight the min RTT is measured in.
+	bbrProbeRTTInflight = 4 * MaxMTU
+	// bbrMaxDrain is the max time a queue is drained in, Bytes not reported received by then are taken as lost.
+	bbrMaxDrain = 3 * time.Second
+	// bbrMinRate is the min rate writes are paced at, so delivery reports and probes always get through.
+	bbrMinRate = 16 * 1024
+)
+
+// bbrCycle is gains of pacing in rounds of probing bandwidth, which probe for more bandwidth in a round and drain the
+// queue built in the next.
+var bbrCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+type bbrSample struct {
+	rate float64
+	t    time.Time
+}
+
+// bbr is a congestion control like BBR, which estimates the bottleneck bandwidth by the max rate the peer receives in a
+// window, and paces writes around it. Rates are sampled by delivery reports, so losses never reduce the rate directly
+// and the queue of the path is kept short.
+//
+// Each report is a round in startup, so the bandwidth is found in a few reports regardless of the RTT. The queue built
+// in startup is drained until datagrams in flight are no more than the bandwidth-delay product. If the min RTT is not
+// measured again in the window, writes are almost stopped until the queue is empty so the min RTT is measured without
+// it. Writes limited by the application never lower the bandwidth, and writes which are no longer limited start over
+// from startup, so a bulk transfer following a game finds the bandwidth quickly.
+type bbr struct {
+	mode         bbrMode
+	firstSent    time.Time
+	sentBytes    uint64
+	sentCount    uint64
+	isPaced      bool
+	received     uint64
+	lastSample   time.Time
+	samples      []bbrSample
+	minRTT       time.Duration
+	minRTTTime   time.Time
+	fullBw       float64
+	fullReports  int
+	drainStart   time.Time
+	probeRTTDone time.Time
+	lost         float64
+	cycle        int
+	cycleStart   time.Time
+	isDelivered  bool
+	isAppLimited bool
+}
+
+func newBBR() *bbr {
+	return &bbr{samples: make([]bbrSample, 0)}
+}
+
+func (b *bbr) OnSent(size int, paced bool, now time.Time) {
+	if b.firstSent.IsZero() {
+		b.firstSent = now
+	}
+	b.sentBytes = b.sentBytes + uint64(size)
+	b.sentCount++
+	b.isPaced = b.isPaced || paced
+}
+
+func (b *bbr) OnDelivered(received uint64, now time.Time) {
+	if !b.isDelivered {
+		b.isDelivered = true
+		b.received, b.lastSample = received, now
+		return
+	}
+
+	interval := now.Sub(b.lastSample).Seconds()
+	if interval <= 0 || received < b.received || b.sentCount <= 0 {
+		return
+	}
+
+	// Reports carry counts of datagrams, which are converted to Bytes by the average size of datagrams sent
+	rate := float64(received-b.received) * b.average() / interval
+	b.received, b.lastSample = received, now
+
+	// Samples limited by the application never lower the bandwidth
+	max := b.maxBw()
+	isAppLimited := !b.isPaced && rate < max
+	b.isPaced = false
+	if !isAppLimited {
+		b.addSample(rate, now)
+	}
+
+	switch b.mode {
+	case bbrStartup:
+		if isAppLimited {
+			break
+		}
+		max = b.maxBw()
+		if max >= b.fullBw*bbrFullGrowth {
+			b.fullBw, b.fullReports = max, 0
+			break
+		}
+		b.fullReports++
+		if b.fullReports >= bbrFullReports {
+			b.mode, b.drainStart = bbrDrain, now
+		}
+	case bbrDrain:
+		if b.inflight() <= b.maxBw()*b.round().Seconds() || b.isDrainExpired(now) {
+			b.mode, b.cycle, b.cycleStart = bbrProbeBW, 0, now
+		}
+	case bbrProbeBW:
+		// Writes in drain or probing RTT are limited by pacing rather than the application
+		if b.isAppLimited && !isAppLimited {
+			b.mode, b.fullBw, b.fullReports = bbrStartup, 0, 0
+
+			// Queues are empty after writes limited by the application, Bytes still in flight are lost
+			b.lost = b.lost + b.inflight()
+		}
+		b.isAppLimited = isAppLimited
+	case bbrProbeRTT:
+		if b.probeRTTDone.IsZero() {
+			if b.inflight() <= bbrProbeRTTInflight || b.isDrainExpired(now) {
+				b.probeRTTDone = now.Add(bbrDefaultRound)
+			}
+		} else if !now.Before(b.probeRTTDone) {
+			b.mode, b.cycle, b.cycleStart = bbrProbeBW, 0, now
+		}
+	}
+}
+
+// isDrainExpired returns if the queue has been drained for too long, which is the case Bytes lost are taken as in
+// flight. Bytes in flight are reset then.
+func (b *bbr) isDrainExpired(now time.Time) bool {
+	if now.Sub(b.drainStart) <= bbrMaxDrain {
+		return false
+	}
+	b.lost = b.lost + b.inflight()
+
+	return true
+}
+
+func (b *bbr) OnRTT(rtt time.Duration, now time.Time) {
+	if rtt <= 0 {
+		return
+	}
+	if b.minRTT > 0 && rtt > b.minRTT && now.Sub(b.minRTTTime) > bbrWindow && b.mode == bbrProbeBW {
+		// Measure the min RTT again without the queue
+		b.mode, b.drainStart, b.probeRTTDone, b.minRTT = bbrProbeRTT, now, time.Time{}, 0
+		return
+	}
+	if b.minRTT <= 0 || rtt <= b.minRTT {
+		b.minRTT, b.minRTTTime = rtt, now
+	}
+}
+
+func (b *bbr) PacingRate(now time.Time) float64 {
+	max := b.maxBw()
+	if max <= 0 {
+		// Peers may never report, whose writes are not paced in the end
+		if b.firstSent.IsZero() || now.Sub(b.firstSent) < bbrWindow {
+			return bbrInitialRate
+		}
+		return 0
+	}
+
+	var gain float64
+	switch b.mode {
+	case bbrStartup:
+		gain = bbrStartupGain
+	case bbrDrain:
+		gain = 1 / bbrStartupGain
+	case bbrProbeRTT:
+		return bbrMinRate
+	default:
+		if now.Sub(b.cycleStart) >= b.round() {
+			b.cycle = (b.cycle + 1) % len(bbrCycle)
+			b.cycleStart = now
+		}
+		gain = bbrCycle[b.cycle]
+	}
+
+	return math.Max(max*gain, bbrMinRate)
+}
+
+// addSample adds a sample of bandwidth, samples out of the window are removed but the latest one is always kept.
+func (b *bbr) addSample(rate float64, now time.Time) {
+	b.samples = append(b.samples, bbrSample{rate: rate, t: now})
+
+	i := 0
+	for i < len(b.samples)-1 && now.Sub(b.samples[i].t) > bbrWindow {
+		i++
+	}
+	b.samples = b.samples[i:]
+}
+
+// maxBw returns the max bandwidth in the window.
+func (b *bbr) maxBw() float64 {
+	var max float64
+	for _, sample := range b.samples {
+		if sample.rate > max {
+			max = sample.rate
+		}
+	}
+
+	return max
+}
+
+// average returns the average size of datagrams sent.
+func (b *bbr) average() float64 {
+	return float64(b.sentBytes) / float64(b.sentCount)
+}
+
+// inflight returns Bytes sent but neither reported received nor taken as lost.
+func (b *bbr) inflight() float64 {
+	return float64(b.sentBytes) - float64(b.received)*b.average() - b.lost
+}
+
+// round returns the time of a round, which is the min RTT.
+func (b *bbr) round() time.Duration {
+	if b.minRTT <= 0 {
+		return bbrDefaultRound
+	}
+
+	return b.minRTT
+}
+
+// pacer paces writes to a peer in a token bucket filled at the rate of the congestion control. A burst of a few
+// datagrams is allowed, so pacing does not add latency to small packets.
+type pacer struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// pacingBurst is the max Bytes written in a burst.
+const pacingBurst = 4 * MaxMTU
+
+// wait takes tokens for a write of the size at the rate, and returns the time before the write may be performed.
+func (p *pacer) wait(size int, rate float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		p.tokens, p.lastRefill = pacingBurst, now
+		return 0
+	}
+
+	if !p.lastRefill.IsZero() {
+		p.tokens = p.tokens + now.Sub(p.lastRefill).Seconds()*rate
+	}
+	if p.tokens > pacingBurst {
+		p.tokens = pacingBurst
+	}
+	p.lastRefill = now
+
+	p.tokens = p.tokens - float64(size)
+	if p.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(-p.tokens / rate * float64(time.Second)))
+}
+
+// congestionOf returns the congestion control of the client, which is created once it is needed. The connection must
+// be locked.
+func (c *FakeTCPConn) congestionOf(client *clientIndicator) CongestionControl {
+	if c.congestion == nil {
+		return nil
+	}
+	if client.congestion == nil {
+		client.congestion = c.congestion()
+		client.pacer = &pacer{}
+	}
+
+	return client.congestion
+}
+
+// pace waits until the write of the size to the client may be performed by its congestion control, and returns false
+// if the connection is closed in waiting.
+func (c *FakeTCPConn) pace(client *clientIndicator, size int) bool {
+	c.lock.Lock()
+	cc := c.congestionOf(client)
+	if cc == nil {
+		c.lock.Unlock()
+		return true
+	}
+	now := time.Now()
+	d := client.pacer.wait(size, cc.PacingRate(now), now)
+	cc.OnSent(size, d > 0, now)
+	c.lock.Unlock()
+
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-c.closed:
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -1,26 +1,30 @@
 package pcap
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/jackpal/gateway"
-	"ikago/internal/addr"
 	"ikago/internal/log"
+	"ikago/pkg/addr"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Device describes an network device.
 type Device struct {
-	name         string
-	alias        string
-	ipAddrs      []*net.IPNet
-	hardwareAddr net.HardwareAddr
-	isLoop       bool
+	lock           sync.RWMutex
+	name           string
+	alias          string
+	ipAddrs        []*net.IPNet
+	hardwareAddr   net.HardwareAddr
+	mtu            int
+	isLoop         bool
+	isPointToPoint bool
 }
 
 // Name returns the pcap name of the device.
@@ -35,21 +39,59 @@ func (dev *Device) Alias() string {
 
 // IPAddrs returns all IP address of the device.
 func (dev *Device) IPAddrs() []*net.IPNet {
+	dev.lock.RLock()
+	defer dev.lock.RUnlock()
+
 	return dev.ipAddrs
 }
 
 // HardwareAddr returns the hardware address of the device.
 func (dev *Device) HardwareAddr() net.HardwareAddr {
+	dev.lock.RLock()
+	defer dev.lock.RUnlock()
+
 	return dev.hardwareAddr
 }
 
+// SetHardwareAddr sets the hardware address of the device, frames injected will use this address.
+func (dev *Device) SetHardwareAddr(hardwareAddr net.HardwareAddr) {
+	dev.setHardwareAddr(hardwareAddr)
+}
+
+func (dev *Device) setHardwareAddr(hardwareAddr net.HardwareAddr) bool {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if dev.hardwareAddr.String() == hardwareAddr.String() {
+		return false
+	}
+
+	dev.hardwareAddr = hardwareAddr
+
+	return true
+}
+
+// MTU returns the MTU of the device, or 0 if it is unknown.
+func (dev *Device) MTU() int {
+	return dev.mtu
+}
+
 // IsLoop returns if the device is a loopback device.
 func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
+// IsPointToPoint returns if the device is a point-to-point device like utun in macOS, which has no hardware address, so
+// packets are routed in it directly as in loopback devices.
+func (dev *Device) IsPointToPoint() bool {
+	return dev.isPointToPoint
+}
+
 // IPAddr returns the first IP address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
+	dev.lock.RLock()
+	defer dev.lock.RUnlock()
+
 	if len(dev.ipAddrs) > 0 {
 		return dev.ipAddrs[0]
 	}
@@ -57,7 +99,63 @@ func (dev *Device) IPAddr() *net.IPNet {
 	return nil
 }
 
-func (dev Device) String() string {
+// Refresh reloads IP addresses of the device and returns if the first IP address is changed. If gateway is not nil,
+// only the address in the same domain of the gateway will be kept. If the device does not have any valid address
+// currently, its IP addresses will remain unchanged.
+func (dev *Device) Refresh(gateway net.IP) (bool, error) {
+	inter, err := net.InterfaceByName(dev.alias)
+	if err != nil {
+		return false, fmt.Errorf("find interface: %w", err)
+	}
+
+	addrs, err := inter.Addrs()
+	if err != nil {
+		return false, fmt.Errorf("parse interface %s: %w", inter.Name, err)
+	}
+
+	as := make([]*net.IPNet, 0)
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		// Only pass IPv4 address
+		if ipnet.IP.To4() == nil {
+			continue
+		}
+
+		// Test if the IP is in the same domain of the gateway's
+		if gateway != nil && !ipnet.Contains(gateway) {
+			continue
+		}
+
+		as = append(as, ipnet)
+	}
+	if len(as) <= 0 {
+		return false, nil
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	// Keep the current address if it is still valid
+	for _, a := range as {
+		if len(dev.ipAddrs) > 0 && a.IP.Equal(dev.ipAddrs[0].IP) {
+			return false, nil
+		}
+	}
+
+	if gateway != nil {
+		dev.ipAddrs = as[:1]
+	} else {
+		dev.ipAddrs = as
+	}
+
+	return true, nil
+}
+
+func (dev *Device) String() string {
 	var result string
 
 	if dev.hardwareAddr != nil {
@@ -75,21 +173,17 @@ func (dev Device) String() string {
 	if dev.isLoop {
 		result = result + " (Loopback)"
 	}
+	if dev.isPointToPoint {
+		result = result + " (Point-to-Point)"
+	}
 
 	return result
 }
 
-const flagPcapLoopback = 1
-
-var blacklist map[string]bool
-
-// FindAllDevs returns all valid network devices in current computer.
+// FindAllDevs returns all valid network devices in current computer. Devices are enumerated by APIs of the system
+// instead of pcap, so they are found even if libpcap is not installed.
 func FindAllDevs() ([]*Device, error) {
-	t := make([]*Device, 0)
 	result := make([]*Device, 0)
-	if blacklist == nil {
-		blacklist = make(map[string]bool)
-	}
 
 	// Enumerate system's network interfaces
 	inters, err := net.Interfaces()
@@ -130,65 +224,27 @@ func FindAllDevs() ([]*Device, error) {
 			as = append(as, ipnet)
 		}
 
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
-	}
-
-	// Enumerate pcap devices
-	mid := make([]*Device, 0)
-	devs, err := pcap.FindAllDevs()
-	if err != nil {
-		return nil, fmt.Errorf("find pcap devices: %w", err)
-	}
-	for _, dev := range devs {
-		// Check blacklist
-		_, ok := blacklist[dev.Name]
-		if ok {
+		// Ignore interfaces without any address except loopback interfaces
+		if len(as) <= 0 && !isLoop {
 			continue
 		}
 
-		// Match pcap device with interface
-		if dev.Flags&flagPcapLoopback != 0 {
-			d := FindLoopDev(t)
-			if d == nil {
-				continue
-			}
-			if d.name != "" {
-				// return nil, errors.New("too many loopback devices")
-				blacklist[dev.Name] = true
-				blacklist[d.name] = true
-				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
-			}
-			d.name = dev.Name
-			mid = append(mid, d)
-		} else {
-			if len(dev.Addresses) <= 0 {
-				continue
-			}
-			for _, a := range dev.Addresses {
-				d := FindDev(t, a.IP)
-				if d == nil {
-					continue
-				}
-				if d.name != "" {
-					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
-					blacklist[dev.Name] = true
-					blacklist[d.name] = true
-					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
-					break
-				}
-				d.name = dev.Name
-				mid = append(mid, d)
-				break
-			}
+		// Match pcap device name with interface
+		name, err := findDevName(inter, isLoop)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("find device name of interface %s: %w", inter.Name, err))
+			continue
 		}
-	}
 
-	// Check blacklist
-	for _, dev := range mid {
-		_, ok := blacklist[dev.name]
-		if !ok {
-			result = append(result, dev)
-		}
+		result = append(result, &Device{
+			name:           name,
+			alias:          inter.Name,
+			ipAddrs:        as,
+			hardwareAddr:   inter.HardwareAddr,
+			mtu:            inter.MTU,
+			isLoop:         isLoop,
+			isPointToPoint: inter.Flags&net.FlagPointToPoint != 0,
+		})
 	}
 
 	return result, nil
@@ -218,9 +274,16 @@ func FindDev(devs []*Device, ip net.IP) *Device {
 	return nil
 }
 
-// FindGatewayAddr returns the gateway's address.
+// FindGatewayAddr returns the gateway's address in the default route of the system.
 func FindGatewayAddr() (net.IP, error) {
-	ip, err := gateway.DiscoverGateway()
+	ip, err := findGatewayAddr()
+	if err == nil {
+		return ip, nil
+	}
+	log.Verboseln(fmt.Errorf("find default route: %w", err))
+
+	// Fall back to routing tables printed by commands
+	ip, err = gateway.DiscoverGateway()
 	if err != nil {
 		return nil, fmt.Errorf("discover gateway: %w", err)
 	}
@@ -228,8 +291,61 @@ func FindGatewayAddr() (net.IP, error) {
 	return ip, nil
 }
 
-// FindGatewayDev returns the gateway device.
+// FindGatewayDev returns the gateway device. The hardware address of the gateway is resolved by ARP or neighbor
+// discovery and kept refreshed.
 func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
+	var (
+		err      error
+		resolver NeighborResolver
+	)
+
+	if ip.To4() != nil {
+		resolver, err = NewARPCache(dev)
+	} else {
+		resolver, err = NewNeighborCache(dev)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create neighbor resolver: %w", err)
+	}
+
+	hardwareAddr, err := resolver.Resolve(ip)
+	if err != nil {
+		_ = resolver.Close()
+
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("resolve %s: %w", ip, err)
+		}
+
+		// Fall back to the ARP table of the system
+		log.Verboseln(fmt.Errorf("resolve %s: %w", ip, err))
+
+		return probeGatewayDev(dev, ip)
+	}
+
+	gatewayDev := CreateGatewayDev(ip, hardwareAddr)
+
+	// Refresh the hardware address
+	go func() {
+		for {
+			time.Sleep(neighborReachableTime)
+
+			hardwareAddr, err := resolver.Resolve(ip)
+			if err != nil {
+				log.Errorln(fmt.Errorf("resolve gateway %s: %w", ip, err))
+				continue
+			}
+
+			if gatewayDev.setHardwareAddr(hardwareAddr) {
+				log.Infof("Hardware address of gateway %s changed to %s\n", ip, hardwareAddr)
+			}
+		}
+	}()
+
+	return gatewayDev, nil
+}
+
+// probeGatewayDev returns the gateway device by capturing a packet sent to the gateway by the system.
+func probeGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 	f, err := addr.DstBPFFilter(&net.TCPAddr{
 		IP:   ip,
 		Port: 65535,
@@ -238,7 +354,7 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, fmt.Errorf("parse filter %s: %w", ip, err)
 	}
 
-	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("ip && udp && %s", f))
+	conn, err := createPureRawConn(dev.Name(), snapLen(dev, nil), fmt.Sprintf("ip && udp && %s", f), &options{})
 	if err != nil {
 		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
 	}
@@ -276,9 +392,7 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, errors.New("invalid packet")
 	}
 
-	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
-
-	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+	return CreateGatewayDev(ip, ethernetPacket.DstMAC), nil
 }
 
 // FindListenDevs returns all valid pcap devices for listening.
@@ -310,8 +424,31 @@ func FindListenDevs(names []string) ([]*Device, error) {
 	return result, nil
 }
 
-// FindUpstreamDevAndGatewayDev returns the pcap device for routing upstream and the gateway.
-func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDev *Device, err error) {
+// RandomHardwareAddr returns a random locally administered unicast hardware address.
+func RandomHardwareAddr() (net.HardwareAddr, error) {
+	b := make([]byte, 6)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Locally administered and unicast
+	b[0] = b[0]&0xfe | 0x02
+
+	return b, nil
+}
+
+// CreateGatewayDev returns the gateway device with designated IP and hardware address.
+func CreateGatewayDev(ip net.IP, hardwareAddr net.HardwareAddr) *Device {
+	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+
+	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: hardwareAddr}
+}
+
+// FindUpstreamDevAndGatewayDev returns the pcap device for routing upstream and the gateway. If the gateway's hardware
+// address is designated, frames will always be sent to it instead of the detected one.
+func FindUpstreamDevAndGatewayDev(name string, gateway net.IP, gatewayHardwareAddr net.HardwareAddr) (upDev, gatewayDev *Device, err error) {
 	devs, err := FindAllDevs()
 	if err != nil {
 		return nil, nil, fmt.Errorf("find all devices: %w", err)
@@ -329,8 +466,8 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			return nil, nil, fmt.Errorf("unknown upstream device %s", name)
 		}
 
-		// Find gateway device
-		if upDev.isLoop {
+		// Find gateway device, packets are routed directly in loopback and point-to-point devices
+		if upDev.isLoop || upDev.isPointToPoint {
 			gatewayDev = upDev
 		} else {
 			// Find gateway's address
@@ -341,9 +478,13 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 				}
 			}
 
-			gatewayDev, err = FindGatewayDev(upDev, gateway)
-			if err != nil {
-				return nil, nil, fmt.Errorf("find gateway device: %w", err)
+			if gatewayHardwareAddr != nil {
+				gatewayDev = CreateGatewayDev(gateway, gatewayHardwareAddr)
+			} else {
+				gatewayDev, err = FindGatewayDev(upDev, gateway)
+				if err != nil {
+					return nil, nil, fmt.Errorf("find gateway device: %w", err)
+				}
 			}
 
 			// Test if device's IP is in the same domain of the gateway's
@@ -384,9 +525,13 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			// Test if device's IP is in the same domain of the gateway's
 			for _, a := range dev.ipAddrs {
 				if a.Contains(gateway) {
-					gatewayDev, err = FindGatewayDev(dev, gateway)
-					if err != nil {
-						continue
+					if gatewayHardwareAddr != nil {
+						gatewayDev = CreateGatewayDev(gateway, gatewayHardwareAddr)
+					} else {
+						gatewayDev, err = FindGatewayDev(dev, gateway)
+						if err != nil {
+							continue
+						}
 					}
 					upDev = &Device{
 						name:         dev.name,
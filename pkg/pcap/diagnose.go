@@ -0,0 +1,507 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/pkg/crypto"
+	"net"
+	"strings"
+	"time"
+)
+
+// diagnosisHeaderSize is the size of headers of diagnosis probes and reports, which is a byte of type, 4 bytes of id,
+// a byte of TTL, a byte of flags, a byte of TOS, 4 bytes of TCP sequence, 2 bytes of TCP window and a byte of the size
+// of TCP options, followed by TCP options. Probes carry what is sent, and reports carry what is received.
+const diagnosisHeaderSize = 15
+
+const diagnosisFlagDF = 0x01
+
+const (
+	// diagnosisTimeout is the time waiting for a report of each probe.
+	diagnosisTimeout = 1 * time.Second
+	// diagnosisRetries is the max count of each probe sent.
+	diagnosisRetries = 3
+	// diagnosisFragment is the size of fragments of the probe of fragments.
+	diagnosisFragment = 576
+)
+
+// diagnosisHeaders describes headers of a probe, as sent or as received.
+type diagnosisHeaders struct {
+	id      uint32
+	ttl     uint8
+	isDF    bool
+	tos     uint8
+	seq     uint32
+	window  uint16
+	options []layers.TCPOption
+}
+
+// craftedProbe describes a probe crafted to find how the path mangles traffic.
+type craftedProbe struct {
+	name     string
+	ttl      uint8
+	isDF     bool
+	tos      uint8
+	options  []layers.TCPOption
+	size     int
+	fragment int
+}
+
+var craftedProbes = []craftedProbe{
+	{name: "baseline", ttl: 128, size: 64},
+	{name: "ttl", ttl: 64, size: 64},
+	{name: "df", ttl: 128, isDF: true, size: 512},
+	{name: "tos", ttl: 128, tos: 0xba, size: 64},
+	{name: "options", ttl: 128, size: 64, options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}},
+	{name: "experimental option", ttl: 128, size: 64, options: []layers.TCPOption{
+		{OptionType: 253, OptionLength: 4, OptionData: []byte{0x49, 0x4b}},
+	}},
+	{name: "large", ttl: 128, size: 1300},
+	{name: "fragments", ttl: 128, size: 1300, fragment: diagnosisFragment},
+}
+
+func serializeTCPOptions(options []layers.TCPOption) []byte {
+	b := make([]byte, 0)
+	for _, option := range options {
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList, layers.TCPOptionKindNop:
+			continue
+		}
+		b = append(b, byte(option.OptionType), 2+byte(len(option.OptionData)))
+		b = append(b, option.OptionData...)
+	}
+
+	return b
+}
+
+func parseTCPOptions(b []byte) []layers.TCPOption {
+	options := make([]layers.TCPOption, 0)
+	for len(b) >= 2 && int(b[1]) >= 2 && len(b) >= int(b[1]) {
+		options = append(options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKind(b[0]),
+			OptionLength: b[1],
+			OptionData:   b[2:b[1]],
+		})
+		b = b[b[1]:]
+	}
+
+	return options
+}
+
+// createDiagnosis returns a diagnosis probe or report of the headers, padded to the size.
+func createDiagnosis(t byte, headers *diagnosisHeaders, size int) []byte {
+	options := serializeTCPOptions(headers.options)
+
+	b := make([]byte, diagnosisHeaderSize, diagnosisHeaderSize+len(options))
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:5], headers.id)
+	b[5] = headers.ttl
+	if headers.isDF {
+		b[6] = diagnosisFlagDF
+	}
+	b[7] = headers.tos
+	binary.BigEndian.PutUint32(b[8:12], headers.seq)
+	binary.BigEndian.PutUint16(b[12:14], headers.window)
+	b[14] = byte(len(options))
+	b = append(b, options...)
+
+	if len(b) < size {
+		b = append(b, make([]byte, size-len(b))...)
+	}
+
+	return b
+}
+
+// parseDiagnosis returns the headers in a diagnosis probe or report.
+func parseDiagnosis(b []byte) (*diagnosisHeaders, error) {
+	if len(b) < diagnosisHeaderSize || len(b) < diagnosisHeaderSize+int(b[14]) {
+		return nil, fmt.Errorf("diagnosis size %d out of range", len(b))
+	}
+
+	return &diagnosisHeaders{
+		id:      binary.BigEndian.Uint32(b[1:5]),
+		ttl:     b[5],
+		isDF:    b[6]&diagnosisFlagDF != 0,
+		tos:     b[7],
+		seq:     binary.BigEndian.Uint32(b[8:12]),
+		window:  binary.BigEndian.Uint16(b[12:14]),
+		options: parseTCPOptions(b[diagnosisHeaderSize : diagnosisHeaderSize+int(b[14])]),
+	}, nil
+}
+
+// handleDiagnosis replies diagnosis probes with what is received, and queues diagnosis reports.
+func (c *FakeTCPConn) handleDiagnosis(contents []byte, indicator *PacketIndicator, addr net.Addr) error {
+	headers, err := parseDiagnosis(contents)
+	if err != nil {
+		return err
+	}
+
+	switch contents[0] {
+	case diagnosisProbe:
+		received := &diagnosisHeaders{
+			id:   headers.id,
+			ttl:  indicator.TTL(),
+			isDF: indicator.IsDF(),
+		}
+		if indicator.IPv4Layer() != nil {
+			received.tos = indicator.IPv4Layer().TOS
+		} else if indicator.IPv6Layer() != nil {
+			received.tos = indicator.IPv6Layer().TrafficClass
+		}
+		if indicator.TCPLayer() != nil {
+			received.seq = indicator.TCPLayer().Seq
+			received.window = indicator.TCPLayer().Window
+			received.options = indicator.TCPLayer().Options
+		}
+
+		_, err := c.writeMessage(createDiagnosis(diagnosisReport, received, 0), addr, false)
+		if err != nil {
+			return fmt.Errorf("report: %w", err)
+		}
+	case diagnosisReport:
+		// Reports are dropped if nobody is diagnosing
+		select {
+		case c.diagnoses <- headers:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// writeProbe writes the diagnosis probe with headers crafted, and returns the headers sent.
+func (c *FakeTCPConn) writeProbe(probe *craftedProbe, id uint32) (*diagnosisHeaders, error) {
+	addr := c.RemoteAddr().(*net.TCPAddr)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil, errors.New("client unrecognized")
+	}
+	if !c.isTypedTo(client) {
+		return nil, errUntyped
+	}
+
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(addr.Port), client.seq, client.ack, c.conn, addr.IP, client.id, probe.ttl, c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return nil, fmt.Errorf("create layers: %w", err)
+	}
+
+	tcpLayer := transportLayer.(*layers.TCP)
+	tcpLayer.Options = probe.options
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		t.TOS = probe.tos
+		if probe.isDF {
+			t.Flags = t.Flags | layers.IPv4DontFragment
+		}
+	case *layers.IPv6:
+		t.TrafficClass = probe.tos
+	}
+
+	sent := &diagnosisHeaders{
+		id:      id,
+		ttl:     probe.ttl,
+		isDF:    probe.isDF,
+		tos:     probe.tos,
+		seq:     tcpLayer.Seq,
+		window:  tcpLayer.Window,
+		options: probe.options,
+	}
+
+	contents, err := client.crypt.Encrypt(createDiagnosis(diagnosisProbe, sent, probe.size))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	if c.tls != nil {
+		contents = frameTLSRecord(tlsRecordApplicationData, contents)
+	}
+
+	fragment := c.fragment
+	if probe.fragment > 0 {
+		fragment = probe.fragment
+	}
+	fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), fragment)
+	if err != nil {
+		return nil, fmt.Errorf("fragment: %w", err)
+	}
+	if probe.fragment > 0 && len(fragments) <= 1 {
+		return nil, errors.New("not fragmented")
+	}
+
+	for _, frag := range fragments {
+		err := c.writeFrame(frag)
+		if err != nil {
+			return nil, fmt.Errorf("write: %w", err)
+		}
+	}
+
+	client.seq = client.seq + uint32(len(contents))
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	return sent, nil
+}
+
+// Finding describes how the path treats a probe. Findings not passed carry a hint of what to do.
+type Finding struct {
+	Probe  string `json:"probe"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Diagnoser finds how middleboxes on the path of a FakeTCP connection mangle traffic by sending probes with crafted
+// headers, and comparing them with what the server reports to receive. The server replies probes as long as it reads
+// from the connection.
+type Diagnoser struct {
+	conn *FakeTCPConn
+	seq  uint32
+}
+
+// NewDiagnoser returns a diagnoser of the connection. Nothing else should read from the connection while diagnosing.
+func NewDiagnoser(conn *FakeTCPConn) *Diagnoser {
+	return &Diagnoser{conn: conn, seq: randUint32()}
+}
+
+// Run sends each probe and reports findings of it.
+func (d *Diagnoser) Run(ctx context.Context, report func(*Finding)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Wait for the handshake
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.conn.established:
+	case <-time.After(d.conn.timeout):
+		return errors.New("not connected")
+	}
+
+	// Read for diagnosis reports
+	errs := d.conn.drain(ctx)
+
+	var (
+		baseline         *diagnosisHeaders
+		baselineReceived *diagnosisHeaders
+		large            bool
+	)
+	for i := range craftedProbes {
+		probe := &craftedProbes[i]
+
+		sent, received, err := d.probe(ctx, errs, probe)
+		if err != nil {
+			return fmt.Errorf("probe %s: %w", probe.name, err)
+		}
+
+		var finding *Finding
+		switch probe.name {
+		case "baseline":
+			if received == nil {
+				return errors.New("baseline probe lost, is the server reachable?")
+			}
+			baseline, baselineReceived = sent, received
+			finding = diagnoseBaseline(sent, received)
+		case "ttl":
+			finding = diagnoseTTL(baseline, baselineReceived, sent, received)
+		case "df":
+			finding = diagnoseDF(received)
+		case "tos":
+			finding = diagnoseTOS(sent, received)
+		case "options", "experimental option":
+			finding = diagnoseOptions(probe.name, sent, received)
+		case "large":
+			large = received != nil
+			finding = &Finding{Probe: probe.name, Passed: large, Detail: fmt.Sprintf("packets of %d Bytes pass", probe.size)}
+			if !large {
+				finding.Detail = fmt.Sprintf("packets of %d Bytes are lost while small ones pass", probe.size)
+				finding.Hint = "decrease -mtu"
+			}
+		case "fragments":
+			finding = &Finding{Probe: probe.name, Passed: received != nil, Detail: "IP fragments pass"}
+			if received == nil {
+				finding.Detail = "IP fragments are lost"
+				if large {
+					finding.Detail = "IP fragments are lost while unfragmented packets of the same size pass"
+				}
+				finding.Hint = "increase -fragment-size up to -mtu, and decrease -mtu so packets are never fragmented"
+			}
+		}
+
+		report(finding)
+	}
+
+	// Skew of clocks, which is measured once connected
+	report(diagnoseClock(d.conn))
+
+	return nil
+}
+
+// probe sends the probe until it is reported, and returns the headers sent and received. Headers received are nil if
+// the probe is lost.
+func (d *Diagnoser) probe(ctx context.Context, errs <-chan error, probe *craftedProbe) (*diagnosisHeaders, *diagnosisHeaders, error) {
+	var sent *diagnosisHeaders
+
+	for i := 0; i < diagnosisRetries; i++ {
+		d.seq++
+		id := d.seq
+
+		var err error
+		sent, err = d.conn.writeProbe(probe, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		timer := time.NewTimer(diagnosisTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, nil, ctx.Err()
+			case err := <-errs:
+				timer.Stop()
+				return nil, nil, fmt.Errorf("read: %w", err)
+			case received := <-d.conn.diagnoses:
+				if received.id != id {
+					continue
+				}
+				timer.Stop()
+
+				return sent, received, nil
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+
+	return sent, nil, nil
+}
+
+func diagnoseClock(conn *FakeTCPConn) *Finding {
+	skew, ok := conn.ClockOffset()
+	if !ok {
+		return &Finding{Probe: "clock", Detail: "skew of clocks is not measured", Hint: "the server may not support clock messages, upgrade it"}
+	}
+
+	finding := &Finding{Probe: "clock", Passed: true, Detail: fmt.Sprintf("clock of the server is skewed by %s", skew.Round(time.Millisecond))}
+	switch d := absDuration(skew); {
+	case d > crypto.MaxClockSkew:
+		finding.Passed = false
+		finding.Hint = fmt.Sprintf("synchronize the clock, -stealth and -cookie need clocks within %s of the server", crypto.MaxClockSkew)
+	case d > clockWarning:
+		finding.Passed = false
+		finding.Hint = "proofs and cookies are created in the clock of the server, but synchronize the clock"
+	}
+
+	return finding
+}
+
+func diagnoseBaseline(sent, received *diagnosisHeaders) *Finding {
+	finding := &Finding{Probe: "baseline", Passed: true}
+
+	details := []string{fmt.Sprintf("path of %d hops", int(sent.ttl)-int(received.ttl))}
+	if received.seq != sent.seq {
+		finding.Passed = false
+		details = append(details, fmt.Sprintf("TCP sequences are rewritten by %d", int32(received.seq-sent.seq)))
+		finding.Hint = "a stateful middlebox tracks the flow, keep -validation normal or loose"
+	}
+	if received.window != sent.window {
+		finding.Passed = false
+		details = append(details, fmt.Sprintf("TCP window is rewritten from %d to %d", sent.window, received.window))
+		finding.Hint = "a stateful middlebox tracks the flow, keep -validation normal or loose"
+	}
+	finding.Detail = strings.Join(details, ", ")
+
+	return finding
+}
+
+func diagnoseTTL(baseline, baselineReceived, sent, received *diagnosisHeaders) *Finding {
+	if received == nil {
+		return &Finding{Probe: "ttl", Detail: fmt.Sprintf("packets of TTL %d are lost", sent.ttl), Hint: "the path is longer than expected"}
+	}
+
+	hops, baselineHops := int(sent.ttl)-int(received.ttl), int(baseline.ttl)-int(baselineReceived.ttl)
+	if hops != baselineHops {
+		return &Finding{
+			Probe:  "ttl",
+			Detail: fmt.Sprintf("TTL is normalized, %d and %d are received as %d and %d", baseline.ttl, sent.ttl, baselineReceived.ttl, received.ttl),
+			Hint:   "a middlebox rewrites IP headers, fingerprints of TTL are not preserved",
+		}
+	}
+
+	return &Finding{Probe: "ttl", Passed: true, Detail: "TTL is preserved"}
+}
+
+func diagnoseDF(received *diagnosisHeaders) *Finding {
+	if received == nil {
+		return &Finding{Probe: "df", Detail: "packets with DF are lost", Hint: "ICMP of path MTU may be blocked, decrease -mtu"}
+	}
+	if !received.isDF {
+		return &Finding{Probe: "df", Detail: "DF is cleared", Hint: "packets may be fragmented on the path, decrease -mtu"}
+	}
+
+	return &Finding{Probe: "df", Passed: true, Detail: "DF is preserved"}
+}
+
+func diagnoseTOS(sent, received *diagnosisHeaders) *Finding {
+	if received == nil {
+		return &Finding{Probe: "tos", Detail: "packets with DSCP and ECN are lost", Hint: "never set -dscp"}
+	}
+	if received.tos != sent.tos {
+		return &Finding{
+			Probe:  "tos",
+			Detail: fmt.Sprintf("DSCP %d and ECN %d are rewritten to DSCP %d and ECN %d", sent.tos>>2, sent.tos&0x3, received.tos>>2, received.tos&0x3),
+			Hint:   "-dscp and -copy-tos take no effect on the path",
+		}
+	}
+
+	return &Finding{Probe: "tos", Passed: true, Detail: "DSCP and ECN are preserved"}
+}
+
+func diagnoseOptions(name string, sent, received *diagnosisHeaders) *Finding {
+	if received == nil {
+		return &Finding{Probe: name, Detail: "packets with TCP options are lost", Hint: "a middlebox drops TCP it cannot parse"}
+	}
+
+	details := make([]string, 0)
+	for _, option := range sent.options {
+		found := false
+		for _, r := range received.options {
+			if r.OptionType != option.OptionType {
+				continue
+			}
+			found = true
+			if !bytes.Equal(r.OptionData, option.OptionData) {
+				if option.OptionType == layers.TCPOptionKindMSS && len(r.OptionData) == 2 {
+					details = append(details, fmt.Sprintf("MSS is clamped from %d to %d", binary.BigEndian.Uint16(option.OptionData), binary.BigEndian.Uint16(r.OptionData)))
+				} else {
+					details = append(details, fmt.Sprintf("TCP option %s is rewritten", option.OptionType))
+				}
+			}
+		}
+		if !found {
+			details = append(details, fmt.Sprintf("TCP option %s is stripped", option.OptionType))
+		}
+	}
+	if len(details) > 0 {
+		return &Finding{Probe: name, Detail: strings.Join(details, ", "), Hint: "a middlebox normalizes TCP, decrease -mtu if MSS is clamped"}
+	}
+
+	return &Finding{Probe: name, Passed: true, Detail: "TCP options are preserved"}
+}
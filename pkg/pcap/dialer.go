@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"errors"
+	"github.com/xtaci/kcp-go"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer dials connections sharing options. Devices are found once when the dialer is created, and filters are compiled
+// once for all connections of the dialer, so several connections to the same server can be opened cheaply.
+//
+// Each connection is on its own local port, the port set by WithSrcPort is used first and random ports are used once it
+// is in use.
+type Dialer struct {
+	options   *options
+	portsLock sync.Mutex
+	ports     map[uint16]bool
+	rand      *rand.Rand
+}
+
+// NewDialer returns a dialer with the options.
+func NewDialer(opts ...Option) (*Dialer, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: "pcap",
+			Err: err,
+		}
+	}
+	o.filters = newFilterCache()
+
+	return &Dialer{
+		options: o,
+		ports:   make(map[uint16]bool),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// allocate returns options of a new connection with a local port not in use, the port set by WithSrcPort is skipped if
+// random is true.
+func (d *Dialer) allocate(isRandom bool) (*options, error) {
+	d.portsLock.Lock()
+	defer d.portsLock.Unlock()
+
+	if len(d.ports) >= 16384 {
+		return nil, errors.New("ports exhausted")
+	}
+
+	port := d.options.srcPort
+	for d.ports[port] || (isRandom && port == d.options.srcPort) {
+		port = uint16(49152 + d.rand.Intn(16384))
+	}
+	d.ports[port] = true
+
+	o := *d.options
+	o.srcPort = port
+
+	return &o, nil
+}
+
+// release marks the local port as not in use.
+func (d *Dialer) release(port uint16) {
+	d.portsLock.Lock()
+	defer d.portsLock.Unlock()
+
+	delete(d.ports, port)
+}
+
+// DialFakeTCP establishes FakeTCP connection to the remote address.
+func (d *Dialer) DialFakeTCP(dstAddr *net.TCPAddr) (*FakeTCPConn, error) {
+	return d.dialFakeTCP(dstAddr, false)
+}
+
+func (d *Dialer) dialFakeTCP(dstAddr *net.TCPAddr, isRandom bool) (*FakeTCPConn, error) {
+	o, err := d.allocate(isRandom)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	conn, err := dialFakeTCP(dstAddr, o)
+	if err != nil {
+		d.release(o.srcPort)
+		return nil, err
+	}
+
+	// Release the port once the connection is closed
+	go func() {
+		<-conn.ctx.Done()
+		d.release(o.srcPort)
+	}()
+
+	return conn, nil
+}
+
+// DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
+func (d *Dialer) DialFakeTCPWithKCP(dstAddr *net.TCPAddr) (*kcp.UDPSession, error) {
+	conn, err := d.DialFakeTCP(dstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := newKCPSession(conn, dstAddr, d.options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// DialTCP connects to the remote address in standard TCP.
+func (d *Dialer) DialTCP(dstAddr *net.TCPAddr) (*TCPConn, error) {
+	o, err := d.allocate(false)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	conn, err := dialTCP(dstAddr, o)
+	if err != nil {
+		d.release(o.srcPort)
+		return nil, err
+	}
+
+	var once sync.Once
+	conn.release = func() {
+		once.Do(func() {
+			d.release(o.srcPort)
+		})
+	}
+
+	return conn, nil
+}
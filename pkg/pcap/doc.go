@@ -0,0 +1,8 @@
+// Package pcap implements the tunnel of IkaGo over packet capture, including devices, connections and listeners in
+// FakeTCP and in standard TCP, and the parsing and creation of packets.
+//
+// Dial and listen functions return net.Conn and net.Listener. PacketIndicator and its parsing by ParsePacket,
+// InterpretPacket, ParseEmbPacket and ParseRawPacket are shared with tools reading captures of IkaGo, so they interpret
+// packets exactly as the tunnel does. These are the stable part of this package. Packet creation helpers may change
+// between minor versions.
+package pcap
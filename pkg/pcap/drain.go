@@ -0,0 +1,166 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// drainSize is the size of drain notices, which is a byte of type and 8 bytes of the time the server goes away.
+const drainSize = 9
+
+// Drain describes listeners which stop accepting new clients because the server is going away. Methods of a nil drain
+// never drain.
+type Drain struct {
+	lock       sync.RWMutex
+	isDraining bool
+	deadline   time.Time
+}
+
+// NewDrain returns a new drain not started.
+func NewDrain() *Drain {
+	return &Drain{}
+}
+
+// Start starts draining until the deadline, and returns false if it has been started.
+func (drain *Drain) Start(deadline time.Time) bool {
+	drain.lock.Lock()
+	defer drain.lock.Unlock()
+
+	if drain.isDraining {
+		return false
+	}
+	drain.isDraining = true
+	drain.deadline = deadline
+
+	return true
+}
+
+// Deadline returns the time the server goes away, and false if it is not draining.
+func (drain *Drain) Deadline() (time.Time, bool) {
+	if drain == nil {
+		return time.Time{}, false
+	}
+
+	drain.lock.RLock()
+	defer drain.lock.RUnlock()
+
+	return drain.deadline, drain.isDraining
+}
+
+// IsDraining returns if the drain has been started.
+func (drain *Drain) IsDraining() bool {
+	_, ok := drain.Deadline()
+
+	return ok
+}
+
+// createDrainNotice returns a drain notice.
+func createDrainNotice(deadline time.Time) []byte {
+	b := make([]byte, drainSize)
+
+	b[0] = drainNotice
+	binary.BigEndian.PutUint64(b[1:9], uint64(deadline.UnixNano()))
+
+	return b
+}
+
+// handleDrain logs the time the server at the address goes away.
+func (c *FakeTCPConn) handleDrain(contents []byte, addr net.Addr) error {
+	if len(contents) < drainSize {
+		return fmt.Errorf("drain size %d out of range", len(contents))
+	}
+
+	deadline := time.Unix(0, int64(binary.BigEndian.Uint64(contents[1:9])))
+
+	c.lock.Lock()
+	isNoticed := c.drainDeadline.Equal(deadline)
+	c.drainDeadline = deadline
+	c.lock.Unlock()
+
+	// Notices are repeated, but logged only once
+	if !isNoticed {
+		log.Infof("Server %s is going away at %s in %s\n", addr, deadline.Format(time.RFC3339),
+			deadline.Sub(time.Now()).Round(time.Second))
+	}
+
+	return nil
+}
+
+// NoticeDrain notices the remote client that the server is going away at the deadline.
+func (c *FakeTCPConn) NoticeDrain(deadline time.Time) error {
+	// Notices are not counted as writes so chaff is still sent in idle
+	_, err := c.writeMessage(createDrainNotice(deadline), c.RemoteAddr(), true)
+
+	return err
+}
+
+// DrainDeadline returns the time the remote server goes away noticed, and false if it has not noticed.
+func (c *FakeTCPConn) DrainDeadline() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.drainDeadline, !c.drainDeadline.IsZero()
+}
+
+// Finish closes the connection after a TCP FIN is sent to the remote address, so the peer knows it is closed.
+func (c *FakeTCPConn) Finish() error {
+	err := c.writeFIN(c.RemoteAddr())
+	if err != nil {
+		log.Verboseln(fmt.Errorf("finish %s: %w", c.RemoteAddr(), err))
+	}
+
+	return c.Close()
+}
+
+// writeFIN writes a TCP FIN to the address.
+func (c *FakeTCPConn) writeFIN(addr net.Addr) error {
+	dstAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("type %T not support", addr)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return errors.New("client unrecognized")
+	}
+
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(dstAddr.Port), client.seq, client.ack, c.conn, dstAddr.IP, client.id, ttlOr(c.ttl, defaultTTL), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	MarkNetworkLayer(networkLayer, c.dscp)
+
+	// Make TCP layer FIN & ACK
+	tcpLayer := transportLayer.(*layers.TCP)
+	FlagTCPLayer(tcpLayer, false, false, true)
+	tcpLayer.FIN = true
+
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	err = c.writeFrame(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// FIN takes a sequence
+	client.seq++
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+// dscps are names of DSCP values in RFC 2474, RFC 2597 and RFC 3246.
+var dscps = map[string]uint8{
+	"cs0":  0,
+	"cs1":  8,
+	"af11": 10,
+	"af12": 12,
+	"af13": 14,
+	"cs2":  16,
+	"af21": 18,
+	"af22": 20,
+	"af23": 22,
+	"cs3":  24,
+	"af31": 26,
+	"af32": 28,
+	"af33": 30,
+	"cs4":  32,
+	"af41": 34,
+	"af42": 36,
+	"af43": 38,
+	"cs5":  40,
+	"va":   44,
+	"ef":   46,
+	"cs6":  48,
+	"cs7":  56,
+}
+
+// ParseDSCP returns the DSCP value by its name, like ef and af41, or by its number from 0 to 63.
+func ParseDSCP(s string) (uint8, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	dscp, ok := dscps[s]
+	if ok {
+		return dscp, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("dscp %s not support", s)
+	}
+	if n > 63 {
+		return 0, fmt.Errorf("dscp %d out of range", n)
+	}
+
+	return uint8(n), nil
+}
+
+// MarkNetworkLayer sets the DSCP value in a network layer, the ECN bits are left unchanged.
+func MarkNetworkLayer(layer gopacket.SerializableLayer, dscp uint8) {
+	switch t := layer.(type) {
+	case *layers.IPv4:
+		t.TOS = dscp<<2 | t.TOS&0x03
+	case *layers.IPv6:
+		t.TrafficClass = dscp<<2 | t.TrafficClass&0x03
+	}
+}
+
+// ECN codepoints in RFC 3168.
+const (
+	ecnNotECT uint8 = 0
+	ecnECT1   uint8 = 1
+	ecnECT0   uint8 = 2
+	ecnCE     uint8 = 3
+)
+
+// parseTOS returns the TOS of the IPv4 packet or the traffic class of the IPv6 packet.
+func parseTOS(data []byte) (uint8, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return 0, false
+		}
+		return data[1], true
+	case 6:
+		if len(data) < 40 {
+			return 0, false
+		}
+		return data[0]<<4 | data[1]>>4, true
+	default:
+		return 0, false
+	}
+}
+
+// decapsulateECN marks the IPv4 or IPv6 packet as congestion experienced if its outer packet is marked and itself is
+// ECN-capable, in the normal mode of RFC 6040. The DSCP of the packet is kept as it was sent.
+func decapsulateECN(data []byte, outer uint8) {
+	if outer&0x03 != ecnCE {
+		return
+	}
+
+	tos, ok := parseTOS(data)
+	if !ok {
+		return
+	}
+	if ecn := tos & 0x03; ecn != ecnECT0 && ecn != ecnECT1 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		data[1] = data[1] | ecnCE
+
+		// Checksum of the header
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return
+		}
+		data[10], data[11] = 0, 0
+		var sum uint32
+		for i := 0; i < ihl; i = i + 2 {
+			sum = sum + uint32(binary.BigEndian.Uint16(data[i:i+2]))
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		binary.BigEndian.PutUint16(data[10:12], ^uint16(sum))
+	case 6:
+		data[1] = data[1] | ecnCE<<4
+	}
+}
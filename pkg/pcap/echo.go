@@ -0,0 +1,396 @@
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages in band are frames of their own types in typed framing, and are never written in untyped framing where they
+// cannot be told from data.
+const (
+	echoRequest byte = 0x10
+	echoReply   byte = 0x11
+	testData    byte = 0x12
+	testQuery   byte = 0x13
+	testReport  byte = 0x14
+
+	sessionAnnouncement byte = 0x15
+	drainNotice         byte = 0x16
+
+	diagnosisProbe  byte = 0x17
+	diagnosisReport byte = 0x18
+
+	segmentData byte = 0x1a
+
+	clockRequest byte = 0x1b
+	clockReply   byte = 0x1c
+)
+
+// echoSize is the size of echo messages, each is a byte of type, 4 bytes of sequence and 8 bytes of the time the
+// request is sent.
+const echoSize = 13
+
+// echoQueueSize is the max count of echo replies queued before they are read.
+const echoQueueSize = 64
+
+type echo struct {
+	seq  uint32
+	sent time.Time
+}
+
+// createEcho returns an echo message.
+func createEcho(t byte, seq uint32, sent time.Time) []byte {
+	b := make([]byte, echoSize)
+
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:5], seq)
+	binary.BigEndian.PutUint64(b[5:13], uint64(sent.UnixNano()))
+
+	return b
+}
+
+// isMessage returns if the frame is a message in band.
+func isMessage(contents []byte) bool {
+	return len(contents) > 0 && contents[0]>>4 == 1
+}
+
+// handleMessage handles the message in band from the address, carried by the packet.
+func (c *FakeTCPConn) handleMessage(contents []byte, indicator *PacketIndicator, addr net.Addr) error {
+	switch contents[0] {
+	case echoRequest, echoReply:
+		return c.handleEcho(contents, addr)
+	case testData, testQuery, testReport:
+		return c.handleTest(contents, addr)
+	case sessionAnnouncement:
+		return c.handleSession(contents, addr)
+	case drainNotice:
+		return c.handleDrain(contents, addr)
+	case diagnosisProbe, diagnosisReport:
+		return c.handleDiagnosis(contents, indicator, addr)
+	case clockRequest, clockReply:
+		return c.handleClock(contents, addr)
+	default:
+		return fmt.Errorf("message type %d not support", contents[0])
+	}
+}
+
+// handleEcho replies echo requests and queues echo replies, those unknown are dropped.
+func (c *FakeTCPConn) handleEcho(contents []byte, addr net.Addr) error {
+	if len(contents) < echoSize {
+		return fmt.Errorf("echo size %d out of range", len(contents))
+	}
+
+	switch contents[0] {
+	case echoRequest:
+		reply := make([]byte, echoSize)
+		copy(reply, contents[:echoSize])
+		reply[0] = echoReply
+
+		_, err := c.writeMessage(reply, addr, false)
+		if err != nil {
+			return fmt.Errorf("reply: %w", err)
+		}
+	case echoReply:
+		e := echo{
+			seq:  binary.BigEndian.Uint32(contents[1:5]),
+			sent: time.Unix(0, int64(binary.BigEndian.Uint64(contents[5:13]))),
+		}
+
+		c.recordProbe(addr, e)
+
+		// Replies are dropped if nobody is pinging
+		select {
+		case c.echoes <- e:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// recordProbe records the reply of a latency probe to the address for its loss, and the RTT and the jitter from its
+// last RTT.
+func (c *FakeTCPConn) recordProbe(addr net.Addr, e echo) {
+	rtt := time.Now().Sub(e.sent)
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client.probes.reply(e.seq, e.sent)
+	if client.blackhole != nil {
+		client.blackhole.reply(e.seq, e.sent)
+	}
+	if cc := c.congestionOf(client); cc != nil {
+		cc.OnRTT(rtt, time.Now())
+	}
+
+	if c.latMonitor == nil {
+		return
+	}
+
+	c.latMonitor.AddRTT(rtt)
+	if client.lastRTT > 0 {
+		c.latMonitor.AddJitter(rtt - client.lastRTT)
+	}
+	client.lastRTT = rtt
+}
+
+// sendProbes sends echo requests to all peers every interval until the connection is closed, and adapts duplication by
+// the loss of them. Large echo requests are sent as well to detect MTU blackholes.
+func (c *FakeTCPConn) sendProbes(interval time.Duration) {
+	var seq uint32
+
+	for c.sleep(interval) {
+		addrs := make([]net.Addr, 0)
+		clients := make([]*clientIndicator, 0)
+		c.clientsLock.RLock()
+		for a, client := range c.clients {
+			// Probes are never sent to clients in untyped framing
+			if !c.isTypedTo(client) {
+				continue
+			}
+
+			addr, err := net.ResolveTCPAddr("tcp", a)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+			clients = append(clients, client)
+		}
+		c.clientsLock.RUnlock()
+
+		for i, addr := range addrs {
+			c.adapt(addr, clients[i])
+
+			seq++
+			sent := time.Now()
+			c.lock.Lock()
+			clients[i].probes.send(seq, sent)
+			c.lock.Unlock()
+
+			// Probes are not counted as writes so chaff is still sent in idle
+			_, err := c.writeTo(createEcho(echoRequest, seq, sent), addr, true)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("send probe to %s: %w", addr, err))
+			}
+
+			// Large probes detect MTU blackholes
+			if c.isBlackhole {
+				c.lock.Lock()
+				if clients[i].blackhole == nil {
+					clients[i].blackhole = newBlackholeDetector()
+				}
+				c.lock.Unlock()
+
+				c.detectBlackhole(addr, clients[i])
+
+				seq++
+				err := c.sendLargeProbe(addr, clients[i], seq)
+				if err != nil {
+					log.Verboseln(fmt.Errorf("send large probe to %s: %w", addr, err))
+				}
+			}
+		}
+	}
+}
+
+// PingStats describes statistics of a ping.
+type PingStats struct {
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Lost     int           `json:"lost"`
+	Last     time.Duration `json:"last"`
+	Best     time.Duration `json:"best"`
+	Worst    time.Duration `json:"worst"`
+	Average  time.Duration `json:"average"`
+	// Jitter is the mean deviation of RTT in RFC 3550.
+	Jitter time.Duration `json:"jitter"`
+}
+
+// Loss returns the ratio of requests lost, requests neither replied nor lost yet are not counted.
+func (stats PingStats) Loss() float64 {
+	if stats.Received+stats.Lost <= 0 {
+		return 0
+	}
+
+	return float64(stats.Lost) / float64(stats.Received+stats.Lost)
+}
+
+// PingResult describes the result of an echo request.
+type PingResult struct {
+	Seq    uint32
+	RTT    time.Duration
+	IsLost bool
+	Stats  PingStats
+}
+
+// Pinger measures RTT, jitter and loss of a FakeTCP connection with echo messages in band, so it measures the path
+// packets tunneled actually take. The server replies echo requests as long as it reads from the connection.
+type Pinger struct {
+	conn    *FakeTCPConn
+	lock    sync.Mutex
+	seq     uint32
+	pending map[uint32]time.Time
+	stats   PingStats
+	sum     time.Duration
+}
+
+// NewPinger returns a pinger of the connection. Nothing else should read from the connection while pinging.
+func NewPinger(conn *FakeTCPConn) *Pinger {
+	return &Pinger{
+		conn:    conn,
+		pending: make(map[uint32]time.Time),
+	}
+}
+
+// Run sends an echo request every interval until the context is done or count requests are sent, count of 0 means
+// no limit. Requests not replied within the timeout are lost. Each reply and loss is reported.
+func (p *Pinger) Run(ctx context.Context, interval, timeout time.Duration, count int, report func(*PingResult)) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval %s out of range", interval)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout %s out of range", timeout)
+	}
+	if count < 0 {
+		return fmt.Errorf("count %d out of range", count)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Read for echo replies
+	errs := p.conn.drain(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.send()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("read: %w", err)
+		case e := <-p.conn.echoes:
+			result, ok := p.receive(e)
+			if ok {
+				report(result)
+			}
+		case <-ticker.C:
+			for _, result := range p.expire(timeout) {
+				report(result)
+			}
+
+			if count > 0 && p.Stats().Sent >= count {
+				if p.isDone() {
+					return nil
+				}
+				continue
+			}
+
+			p.send()
+		}
+	}
+}
+
+// Stats returns a copy of statistics of the pinger.
+func (p *Pinger) Stats() PingStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.stats
+}
+
+func (p *Pinger) send() {
+	p.lock.Lock()
+	p.seq++
+	seq := p.seq
+	sent := time.Now()
+	p.pending[seq] = sent
+	p.stats.Sent++
+	p.lock.Unlock()
+
+	// Requests failed to send are counted as lost, and are messages rather than data
+	_, err := p.conn.writeMessage(createEcho(echoRequest, seq, sent), p.conn.RemoteAddr(), false)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("send echo request %d: %w", seq, err))
+	}
+}
+
+// receive records the echo reply, replies of requests lost or replied are dropped.
+func (p *Pinger) receive(e echo) (*PingResult, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sent, ok := p.pending[e.seq]
+	if !ok || !sent.Equal(e.sent) {
+		return nil, false
+	}
+	delete(p.pending, e.seq)
+
+	rtt := time.Now().Sub(sent)
+
+	if p.stats.Received > 0 {
+		d := rtt - p.stats.Last
+		if d < 0 {
+			d = -d
+		}
+		p.stats.Jitter = p.stats.Jitter + (d-p.stats.Jitter)/16
+	}
+	if p.stats.Received <= 0 || rtt < p.stats.Best {
+		p.stats.Best = rtt
+	}
+	if rtt > p.stats.Worst {
+		p.stats.Worst = rtt
+	}
+	p.stats.Received++
+	p.stats.Last = rtt
+	p.sum = p.sum + rtt
+	p.stats.Average = p.sum / time.Duration(p.stats.Received)
+
+	return &PingResult{Seq: e.seq, RTT: rtt, Stats: p.stats}, true
+}
+
+// expire drops requests not replied within the timeout and returns them as lost.
+func (p *Pinger) expire(timeout time.Duration) []*PingResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	results := make([]*PingResult, 0)
+	for seq, sent := range p.pending {
+		if time.Now().Sub(sent) < timeout {
+			continue
+		}
+		delete(p.pending, seq)
+		p.stats.Lost++
+
+		results = append(results, &PingResult{Seq: seq, IsLost: true, Stats: p.stats})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Seq < results[j].Seq
+	})
+
+	return results
+}
+
+// isDone returns if all requests are replied or lost.
+func (p *Pinger) isDone() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.pending) <= 0
+}
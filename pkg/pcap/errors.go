@@ -0,0 +1,18 @@
+package pcap
+
+import "errors"
+
+// Errors of connections and listeners, which are wrapped in net.OpError so callers may tell causes of failures by
+// errors.Is.
+var (
+	// ErrUnauthorizedClient describes a packet is from, or a write is to, a peer which is not connected.
+	ErrUnauthorizedClient = errors.New("unauthorized client")
+	// ErrDecrypt describes a packet fails to decrypt, which may be corrupted, forged or encrypted by a wrong password.
+	ErrDecrypt = errors.New("decrypt")
+	// ErrTimeout describes a read or a write is not done before its deadline.
+	ErrTimeout error = &timeoutError{Err: "timeout"}
+	// ErrClosed describes the connection or the listener is closed.
+	ErrClosed = errors.New("closed")
+	// ErrMTUExceeded describes a write is too large to be written.
+	ErrMTUExceeded = errors.New("mtu exceeded")
+)
@@ -0,0 +1,2211 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/xtaci/kcp-go"
+	"ikago/internal/hook"
+	"ikago/internal/log"
+	"ikago/pkg/addr"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/stat"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type clientIndicator struct {
+	crypt      crypto.Crypt
+	cryptLock  sync.Mutex
+	version    int
+	seq        uint32
+	ack        uint32
+	id         uint16
+	lastWrite  time.Time
+	lastRTT    time.Duration
+	probes     *lossMeter
+	duplicates int
+	seen       *seqWindow
+	blackhole  *blackholeDetector
+	stream     *datagramStream
+	writes     chan *pendingWrite
+	queuing    int
+	segments   *segmentReassembler
+	sent       uint64
+	received   uint64
+	delivery   *deliveryMeter
+	congestion CongestionControl
+	pacer      *pacer
+	session    uint64
+	user       string
+	skew       time.Duration
+	isClocked  bool
+	rekey      *rekeyState
+}
+
+const establishDeadline = 3 * time.Second
+
+// FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
+type FakeTCPConn struct {
+	// skipped is accessed atomically and kept first for alignment in 32-bit platforms
+	skipped       uint64
+	segment       uint32
+	lock          sync.Mutex
+	conn          *RawConn
+	defrag        Defragmenter
+	srcPort       uint16
+	dstAddr       *net.TCPAddr
+	crypt         crypto.Crypt
+	mtu           int
+	fragment      int
+	isNoFragment  bool
+	scheduler     Scheduler
+	congestion    CongestionControlFactory
+	dscp          uint8
+	isCopyTOS     bool
+	ttl           uint8
+	probe         time.Duration
+	feedback      time.Duration
+	adaptive      []float64
+	isBlackhole   bool
+	session       uint64
+	impairment    *Impairment
+	verifier      *crypto.ProofVerifier
+	skews         *skewTable
+	cookie        *crypto.Cookie
+	preamble      Preamble
+	version       int
+	syns          [][]byte
+	tls           *TLSMimicry
+	isTyped       bool
+	isPrefixed    bool
+	datagrams     []*pendingDatagram
+	users         *Users
+	keyring       *Keyring
+	bans          *Bans
+	draining      *Drain
+	drainDeadline time.Time
+	access        *Access
+	admission     *Admission
+	tolerance     int
+	failures      uint32
+	timeout       time.Duration
+	validation    Validation
+	sflow         *SFlow
+	traceFilter   *TraceFilter
+	isTraceHex    bool
+	hook          *hook.Hook
+	latMonitor    *stat.LatencyMonitor
+	delMonitor    *stat.DeliveryMonitor
+	queMonitor    *stat.QueueMonitor
+	malformed     *quarantine
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	appear        time.Time
+	isConnected   bool
+	established   chan struct{}
+	isReconnected bool
+	lastReconnect time.Time
+	isClosed      bool
+	closeOnce     sync.Once
+	closed        chan struct{}
+	clientsLock   sync.RWMutex
+	clients       map[string]*clientIndicator
+	echoes        chan echo
+	testsLock     sync.Mutex
+	tests         map[string]*testCounter
+	reports       chan *testCounter
+	diagnoses     chan *diagnosisHeaders
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newConn returns a connection with the defragmenter, observed by monitors, the exporter, the trace and the hook of
+// options.
+func newConn(o *options, defrag Defragmenter) *FakeTCPConn {
+	conn := &FakeTCPConn{
+		defrag:      defrag,
+		mtu:         MaxMTU,
+		fragment:    MaxMTU,
+		timeout:     establishDeadline,
+		validation:  o.validation,
+		sflow:       o.sflow,
+		traceFilter: o.traceFilter,
+		isTraceHex:  o.isTraceHex,
+		hook:        o.hook,
+		latMonitor:  o.latMonitor,
+		delMonitor:  o.delMonitor,
+		queMonitor:  o.queMonitor,
+		malformed:   newMalformedCounter(o.malMonitor),
+		clients:     make(map[string]*clientIndicator),
+		echoes:      make(chan echo, echoQueueSize),
+		established: make(chan struct{}),
+		closed:      make(chan struct{}),
+		tests:       make(map[string]*testCounter),
+		reports:     make(chan *testCounter, echoQueueSize),
+		diagnoses:   make(chan *diagnosisHeaders, echoQueueSize),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(o.ctx)
+	conn.defrag.SetMonitor(o.fragMonitor)
+	return conn
+}
+
+// spawn runs the function in a goroutine accounted by the connection.
+func (c *FakeTCPConn) spawn(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+// watch closes the connection when its context is done.
+func (c *FakeTCPConn) watch() {
+	c.spawn(func() {
+		<-c.ctx.Done()
+
+		if !c.isClosed {
+			_ = c.Close()
+		}
+	})
+}
+
+// sleep returns true after the duration, or false if the context of the connection is done before.
+func (c *FakeTCPConn) sleep(duration time.Duration) bool {
+	t := time.NewTimer(duration)
+	defer t.Stop()
+
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// DialFakeTCP establishes FakeTCP connection for pcap networks.
+func DialFakeTCP(dstAddr *net.TCPAddr, opts ...Option) (*FakeTCPConn, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	return dialFakeTCP(dstAddr, o)
+}
+
+func dialFakeTCP(dstAddr *net.TCPAddr, o *options) (*FakeTCPConn, error) {
+	srcAddr := &net.TCPAddr{
+		IP:   o.srcDev.IPAddr().IP,
+		Port: int(o.srcPort),
+	}
+
+	conn, err := dialFakeTCPPassive(dstAddr, o)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	conn.appear = time.Now()
+	conn.resumeOnRecovery()
+
+	// Handshake
+	err = conn.handshakeSYN()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("handshake: %w", err),
+		}
+	}
+
+	conn.spawn(func() {
+		if conn.sleep(conn.timeout) && !conn.isConnected {
+			log.Errorf("Cannot receive response from server %s, is it down?\n", dstAddr.String())
+		}
+	})
+
+	return conn, nil
+}
+
+func dialFakeTCPPassive(dstAddr *net.TCPAddr, o *options) (*FakeTCPConn, error) {
+	if o.rekey > 0 {
+		if !o.isTyped && !isFramed(o.wireVersion) {
+			return nil, errors.New("rekey not support in untyped framing")
+		}
+
+		err := checkRekey(o.crypt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter, err := dialFilter(o.srcPort, dstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	defrag, err := NewDefragmenter(o.defragConfig)
+	if err != nil {
+		return nil, fmt.Errorf("create defragmenter: %w", err)
+	}
+
+	rawConn, err := createRawConn(o.srcDev, o.dstDev, filter, o)
+	if err != nil {
+		return nil, fmt.Errorf("create raw connection: %w", err)
+	}
+
+	conn := newConn(o, defrag)
+	conn.srcPort = o.srcPort
+	conn.dstAddr = dstAddr
+	conn.crypt = o.crypt
+	conn.mtu = o.mtu
+	conn.fragment = o.fragment
+	conn.isNoFragment = o.isNoFragment
+	conn.scheduler = o.scheduler
+	conn.congestion = o.congestion
+	conn.dscp = o.dscp
+	conn.isCopyTOS = o.isCopyTOS
+	conn.ttl = o.ttl
+	conn.probe = o.probe
+	conn.feedback = o.feedback
+	conn.adaptive = o.adaptive
+	conn.isBlackhole = o.isBlackhole
+	conn.session = o.session
+	conn.impairment = o.impairment
+	conn.cookie = o.cookie
+	conn.preamble = o.preamble
+	conn.version = o.wireVersion
+	conn.tls = o.tls
+	conn.isTyped = o.isTyped
+	conn.isPrefixed = o.isPrefixed
+	conn.tolerance = o.tolerance
+	conn.timeout = o.timeout
+	conn.conn = rawConn
+	conn.watch()
+
+	if o.chaff > 0 {
+		conn.spawn(func() {
+			conn.sendChaff(o.chaff)
+		})
+	}
+	if o.probe > 0 {
+		conn.spawn(func() {
+			conn.sendProbes(o.probe)
+		})
+	}
+	if o.feedback > 0 {
+		conn.spawn(func() {
+			conn.sendFeedback(o.feedback)
+		})
+	}
+	if o.rekey > 0 {
+		conn.spawn(func() {
+			conn.sendRekeys(o.rekey)
+		})
+	}
+	if o.session != 0 {
+		conn.spawn(conn.announceSessions)
+	}
+
+	return conn, nil
+}
+
+func dialFilter(srcPort uint16, dstAddr *net.TCPAddr) (string, error) {
+	filter, err := addr.SrcBPFFilter(dstAddr)
+	if err != nil {
+		return "", fmt.Errorf("parse filter %s: %w", dstAddr, err)
+	}
+	dstIP := &net.IPAddr{IP: dstAddr.IP}
+	filter2, err := addr.SrcBPFFilter(dstIP)
+	if err != nil {
+		return "", fmt.Errorf("parse filter %s: %w", dstIP, err)
+	}
+
+	return fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcPort, filter, filter2), nil
+}
+
+func listenFakeTCPMulticast(o *options) (*FakeTCPConn, error) {
+	addrs := make([]*net.TCPAddr, 0)
+	for _, ip := range o.srcDev.IPAddrs() {
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(o.srcPort)})
+	}
+	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
+
+	defrag, err := NewDefragmenter(o.defragConfig)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddrs,
+			Err:    fmt.Errorf("create defragmenter: %w", err),
+		}
+	}
+
+	rawConn, err := createRawConn(o.srcDev, o.dstDev, fmt.Sprintf("tcp && dst port %d", o.srcPort), o)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddrs,
+			Err:    fmt.Errorf("create connection: %w", err),
+		}
+	}
+
+	conn := newConn(o, defrag)
+	conn.srcPort = o.srcPort
+	conn.crypt = o.crypt
+	conn.mtu = o.mtu
+	conn.fragment = o.fragment
+	conn.isNoFragment = o.isNoFragment
+	conn.scheduler = o.scheduler
+	conn.congestion = o.congestion
+	conn.dscp = o.dscp
+	conn.isCopyTOS = o.isCopyTOS
+	conn.ttl = o.ttl
+	conn.probe = o.probe
+	conn.feedback = o.feedback
+	conn.adaptive = o.adaptive
+	conn.isBlackhole = o.isBlackhole
+	conn.session = o.session
+	conn.impairment = o.impairment
+	conn.verifier = o.verifier
+	conn.skews = newSkewTable()
+	conn.cookie = o.cookie
+	conn.preamble = o.preamble
+	conn.version = o.wireVersion
+	conn.tls = o.tls
+	conn.isTyped = o.isTyped
+	conn.isPrefixed = o.isPrefixed
+	conn.users = o.users
+	conn.keyring = o.keyring
+	conn.bans = o.bans
+	conn.draining = o.drain
+	conn.access = o.access
+	conn.admission = o.admission
+	conn.tolerance = o.tolerance
+	conn.timeout = o.timeout
+	conn.conn = rawConn
+	conn.watch()
+
+	if o.chaff > 0 {
+		conn.spawn(func() {
+			conn.sendChaff(o.chaff)
+		})
+	}
+	if o.probe > 0 {
+		conn.spawn(func() {
+			conn.sendProbes(o.probe)
+		})
+	}
+	if o.feedback > 0 {
+		conn.spawn(func() {
+			conn.sendFeedback(o.feedback)
+		})
+	}
+
+	return conn, nil
+}
+
+func (c *FakeTCPConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+
+	return n, err
+}
+
+func (c *FakeTCPConn) handshakeSYN() error {
+	var (
+		transportLayer gopacket.SerializableLayer
+		networkLayer   gopacket.SerializableLayer
+		linkLayer      gopacket.SerializableLayer
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		// Initial TCP Seq
+		client = &clientIndicator{
+			crypt:     c.crypt,
+			version:   c.version,
+			seq:       c.preamble.initialSeq(),
+			id:        randUint16(),
+			lastWrite: time.Now(),
+			probes:    newLossMeter(),
+			seen:      newSeqWindow(),
+		}
+
+		// Map client
+		c.clientsLock.Lock()
+		c.clients[c.RemoteAddr().String()] = client
+		c.clientsLock.Unlock()
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, client.id, ttlOr(c.ttl, defaultTTL), c.RemoteDev().HardwareAddr())
+	if err != nil {
+		return err
+	}
+	MarkNetworkLayer(networkLayer, c.dscp)
+
+	// Make TCP layer SYN
+	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+
+	// Preamble, created in the clock of the server
+	payload, err := c.createPreamble(client.clockNow())
+	if err != nil {
+		return fmt.Errorf("create preamble: %w", err)
+	}
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq, the preamble takes sequences after the SYN
+	client.seq = client.seq + seqSpace(transportLayer.(*layers.TCP), payload)
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	// Remember recent TCP SYN, whose transcripts may be signed by the server
+	if len(payload) > 0 {
+		c.syns = append(c.syns, payload)
+		if len(c.syns) > maxTranscripts {
+			c.syns = c.syns[len(c.syns)-maxTranscripts:]
+		}
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(c.srcPort),
+	}
+	log.Verbosef("Send TCP SYN: %s -> %s\n", srcAddr.String(), c.RemoteAddr().String())
+	c.trace(TraceOut, c.RemoteAddr(), TraceSYN, transportLayer.(*layers.TCP).Seq, transportLayer.(*layers.TCP).Ack, payload)
+
+	return nil
+}
+
+// createPreamble returns the payload of the TCP SYN, which is the cookie, the method tag for negotiation of the method
+// and the version of the wire format, and the proof for servers in stealth mode in order, or nothing without a
+// preamble. The proof and the cookie are created at the time.
+func (c *FakeTCPConn) createPreamble(t time.Time) ([]byte, error) {
+	if c.preamble == PreambleNone {
+		return nil, nil
+	}
+
+	payload, err := createWireTag(crypto.Name(c.crypt), c.version)
+	if err != nil {
+		return nil, fmt.Errorf("create method tag: %w", err)
+	}
+
+	if c.crypt.Method().IsAEAD() {
+		proof, err := crypto.CreateProofAt(c.crypt, t)
+		if err != nil {
+			return nil, fmt.Errorf("create proof: %w", err)
+		}
+		payload = append(payload, proof...)
+	}
+
+	if c.cookie != nil {
+		cookie, err := c.cookie.CreateAt(t)
+		if err != nil {
+			return nil, fmt.Errorf("create cookie: %w", err)
+		}
+		payload = append(cookie, payload...)
+	}
+
+	return payload, nil
+}
+
+// handshakeSYNACK responds the TCP SYN of the client in the version of the wire format negotiated.
+func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator, version int) error {
+	var (
+		err               error
+		newTransportLayer gopacket.SerializableLayer
+		newNetworkLayer   gopacket.SerializableLayer
+		newLinkLayer      gopacket.SerializableLayer
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[indicator.Src().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		// Initial TCP Seq
+		client = &clientIndicator{
+			crypt:     c.crypt,
+			seq:       c.preamble.initialSeq(),
+			id:        randUint16(),
+			lastWrite: time.Now(),
+			probes:    newLossMeter(),
+			seen:      newSeqWindow(),
+		}
+
+		// Map client
+		c.clientsLock.Lock()
+		c.clients[indicator.Src().String()] = client
+		c.clientsLock.Unlock()
+	}
+	// Clients may reconnect in another version
+	client.version = version
+	client.ack = indicator.TCPLayer().Seq + seqSpace(indicator.TCPLayer(), indicator.Payload())
+	// Sequences of the peer start over
+	client.seen = newSeqWindow()
+
+	// Create layers
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), client.id, ttlOr(c.ttl, defaultResponseTTL), indicator.SrcHardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	MarkNetworkLayer(newNetworkLayer, c.dscp)
+
+	// Make TCP layer SYN & ACK
+	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+
+	// Transcript of negotiation, so the client knows its TCP SYN is not tampered
+	transcript, err := signTranscript(client.crypt, indicator.Payload())
+	if err != nil {
+		return fmt.Errorf("sign transcript: %w", err)
+	}
+
+	// Serialize layers
+	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer, gopacket.Payload(transcript))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq, the transcript takes sequences after the SYN
+	client.seq = client.seq + seqSpace(newTransportLayer.(*layers.TCP), transcript)
+
+	// IPv4 Id
+	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(indicator.DstPort()),
+	}
+	log.Verbosef("Send TCP SYN+ACK: %s <- %s\n", indicator.Src().String(), srcAddr.String())
+	c.trace(TraceOut, indicator.Src(), TraceSYNACK, newTransportLayer.(*layers.TCP).Seq, newTransportLayer.(*layers.TCP).Ack, transcript)
+
+	return nil
+}
+
+func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
+	var (
+		err               error
+		newTransportLayer gopacket.SerializableLayer
+		newNetworkLayer   gopacket.SerializableLayer
+		newLinkLayer      gopacket.SerializableLayer
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[indicator.Src().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnauthorizedClient, indicator.Src())
+	}
+
+	// TCP Ack, the transcript takes sequences after the SYN
+	client.ack = indicator.TCPLayer().Seq + seqSpace(indicator.TCPLayer(), indicator.Payload())
+	// Sequences of the peer start over
+	client.seen = newSeqWindow()
+
+	// Create layers
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), client.id, ttlOr(c.ttl, defaultTTL), indicator.SrcHardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	MarkNetworkLayer(newNetworkLayer, c.dscp)
+
+	// Make TCP layer ACK
+	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+
+	// Serialize layers
+	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(indicator.DstPort()),
+	}
+	log.Verbosef("Send TCP ACK: %s -> %s\n", srcAddr.String(), indicator.Src().String())
+	c.trace(TraceOut, indicator.Src(), TraceACK, newTransportLayer.(*layers.TCP).Seq, newTransportLayer.(*layers.TCP).Ack, nil)
+
+	return nil
+}
+
+func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.RemoteAddr())
+}
+
+func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
+	return c.tolerate(c.readFrom(p))
+}
+
+func (c *FakeTCPConn) readFrom(p []byte) (n int, a net.Addr, err error) {
+	// Datagrams coalesced with the datagram read before
+	if d, ok := c.popDatagram(); ok {
+		c.clientsLock.RLock()
+		client, ok := c.clients[d.addr.String()]
+		c.clientsLock.RUnlock()
+		if !ok {
+			return 0, d.addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   d.addr,
+				Err:    skippable(fmt.Errorf("%w %s", ErrUnauthorizedClient, d.addr)),
+			}
+		}
+
+		return c.readDatagram(p, d.datagram, client, d.indicator, d.addr)
+	}
+
+	packet, a, err := c.readPacketFrom()
+	if err != nil {
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    err,
+		}
+	}
+
+	// Parse packet, which has been validated or reassembled
+	indicator, err := InterpretPacket(packet)
+	if err != nil {
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    skippable(fmt.Errorf("parse packet: %w", err)),
+		}
+	}
+
+	// Trace TCP flags, while data is traced once decrypted
+	if tcpLayer := indicator.TCPLayer(); tcpLayer != nil {
+		if t := traceTypeOfTCP(tcpLayer, indicator.Payload()); t != "" {
+			c.trace(TraceIn, a, t, tcpLayer.Seq, tcpLayer.Ack, indicator.Payload())
+		}
+	}
+
+	// Check TCP flags
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		if indicator.IsRST() {
+			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), a.String())
+
+			// Never respond in stealth mode
+			if c.verifier != nil {
+				return 0, a, nil
+			}
+
+			// Re-establish connection, but not too often in case the server keeps refusing
+			if time.Now().Sub(c.lastReconnect) >= c.timeout {
+				err := c.Reconnect()
+				if err != nil {
+					return 0, a, &net.OpError{
+						Op:     "read",
+						Net:    "pcap",
+						Source: c.LocalAddr(),
+						Addr:   a,
+						Err:    fmt.Errorf("reconnect: %w", err),
+					}
+				}
+			}
+		}
+		if indicator.IsFIN() {
+			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), a.String())
+		}
+	}
+
+	// Reply TCP SYN
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		if indicator.IsSYN() {
+			// SYN+ACK
+			if indicator.IsACK() {
+				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), a.String())
+
+				// Never respond in stealth mode
+				if c.verifier != nil || c.users != nil {
+					return 0, a, nil
+				}
+
+				// Abort if the negotiation is tampered
+				c.lock.Lock()
+				err = verifyTranscript(c.crypt, c.syns, indicator.Payload())
+				c.lock.Unlock()
+				if err != nil {
+					log.Errorln(fmt.Errorf("verify negotiation with server %s: %w", a.String(), err))
+					_ = c.Close()
+					return 0, a, &net.OpError{
+						Op:     "read",
+						Net:    "pcap",
+						Source: c.LocalAddr(),
+						Addr:   a,
+						Err:    fmt.Errorf("verify negotiation: %w", err),
+					}
+				}
+
+				// Connections reconnecting are connected but not reconnected yet
+				isReconnecting := c.isConnected && !c.isReconnected
+
+				if !c.isConnected {
+					t := time.Now()
+					duration := t.Sub(c.appear)
+
+					log.Infof("Connected to server %s in %.3f ms (RTT)\n", a.String(), float64(duration.Microseconds())/1000)
+
+					c.isConnected = true
+					close(c.established)
+				}
+				c.isReconnected = true
+				if isReconnecting {
+					log.Infof("Reconnected to server %s\n", a.String())
+					c.hook.Notifyf(hook.EventReconnected, "Reconnected to server %s", a.String())
+				}
+
+				err = c.handshakeACK(indicator)
+
+				// Forge TLS handshake following
+				if err == nil && c.tls != nil && c.tls.SNI != "" {
+					err = c.sendClientHello(a)
+				}
+
+				// Announce the session once connected
+				if err == nil && c.session != 0 {
+					c.spawn(c.announceSession)
+				}
+
+				// Measure the skew of clocks once connected
+				if err == nil {
+					c.spawn(func() {
+						c.sendClockRequest(a)
+					})
+				}
+			} else {
+				log.Verbosef("Receive TCP SYN: %s -> %s\n", a.String(), indicator.Dst().String())
+
+				// Never accept scans without cookie, clients whose clocks are skewed are accepted in windows shifted
+				skew := c.skews.of(indicator.SrcIP())
+				var payload []byte
+				payload, err = checkCookie(c.cookie, indicator, skew)
+				if err != nil {
+					refuseScan(c.conn, indicator, c.verifier != nil || c.users != nil, ttlOr(c.ttl, defaultResponseTTL), err)
+					return 0, a, nil
+				}
+
+				// Never respond to clients in other methods or versions not supported
+				var (
+					version int
+					proof   []byte
+				)
+				version, proof, err = negotiateSYN(c.crypt, payload, c.preamble.untaggedVersion(c.version))
+				if err != nil {
+					logNegotiation(a, err)
+					return 0, a, nil
+				}
+
+				// Never respond to clients without proof in stealth mode, or of unknown users or keys
+				var (
+					name  string
+					crypt crypto.Crypt
+				)
+				switch {
+				case c.users != nil:
+					name, crypt, err = identifySYN(c.users, indicator, proof, skew)
+				case c.keyring != nil:
+					crypt, err = identifyKey(c.keyring, c.verifier != nil, indicator, proof, skew)
+				default:
+					err = verifySYN(c.verifier, indicator, proof, skew)
+				}
+				if err != nil {
+					reject(a, err)
+					log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", a.String(), err))
+					return 0, a, nil
+				}
+
+				// Never respond to clients banned
+				if c.bans.IsBanned(a, name) {
+					log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", a.String(), errBanned))
+					return 0, a, nil
+				}
+
+				// Never respond to clients out of their schedules
+				if !c.access.IsAllowed(name, time.Now()) {
+					log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", a.String(), errOutOfSchedule))
+					return 0, a, nil
+				}
+
+				// Never respond to new clients in draining, while clients connected may reconnect
+				c.clientsLock.RLock()
+				_, ok := c.clients[a.String()]
+				c.clientsLock.RUnlock()
+				if !ok && c.draining.IsDraining() {
+					log.Verbosef("Refuse client %s because of draining\n", a.String())
+					return 0, a, nil
+				}
+
+				if crypt != nil {
+					c.identify(a, name, crypt)
+				}
+
+				// Refuse clients over the max
+				if !c.admission.Admit(a) {
+					c.admission.refuse(c.conn, indicator, ttlOr(c.ttl, defaultResponseTTL))
+					return 0, a, nil
+				}
+
+				err = c.handshakeSYNACK(indicator, version)
+			}
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("handshake: %w", err),
+				}
+			}
+
+			return 0, a, nil
+		}
+	}
+
+	if indicator.Payload() == nil {
+		return 0, a, nil
+	}
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[a.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    skippable(fmt.Errorf("%w %s", ErrUnauthorizedClient, a)),
+		}
+	}
+
+	c.admission.Touch(a)
+
+	// TCP Ack, always use the expected one
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		expectedAck := indicator.TCPLayer().Seq + seqSpace(indicator.TCPLayer(), indicator.Payload())
+		if seqAfter(expectedAck, client.ack) {
+			client.ack = expectedAck
+		}
+	}
+
+	// Drop packets duplicated by adaptive duplication or by the network
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		if client.seen.isDuplicate(indicator.TCPLayer().Seq) {
+			return 0, a, nil
+		}
+	}
+
+	// Reply TLS handshake, and unframe TLS records
+	payload := indicator.Payload()
+	if c.tls != nil {
+		if isTLSHandshake(payload) {
+			err := c.handleTLSHandshake(payload, a)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("handle tls handshake from %s: %w", a, err))
+			}
+			return 0, a, nil
+		}
+
+		payload, err = unframeTLSRecord(payload)
+		if err != nil {
+			reject(a, err)
+			c.malformed.add(addrIP(a), stat.MalformedEventParse)
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    skippable(fmt.Errorf("unframe tls record: %w", err)),
+			}
+		}
+	}
+
+	// Recover datagrams coalesced or segmented again by middleboxes, TLS records are never prefixed
+	if c.isPrefixed && c.tls == nil {
+		if client.stream == nil {
+			client.stream = newDatagramStream()
+		}
+
+		datagrams, err := client.stream.push(indicator.TCPLayer().Seq, payload)
+		if len(datagrams) > 1 {
+			c.pushDatagrams(datagrams[1:], indicator, a)
+		}
+		if err != nil {
+			c.malformed.add(addrIP(a), stat.MalformedEventParse)
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    skippable(fmt.Errorf("recover datagrams: %w", err)),
+			}
+		}
+		if len(datagrams) <= 0 {
+			return 0, a, nil
+		}
+
+		payload = datagrams[0]
+	}
+
+	return c.readDatagram(p, payload, client, indicator, a)
+}
+
+// readDatagram decrypts the datagram from the client and reads the contents, or handles them if they are not data.
+func (c *FakeTCPConn) readDatagram(p []byte, payload []byte, client *clientIndicator, indicator *PacketIndicator, a net.Addr) (int, net.Addr, error) {
+	// Decrypt
+	contents, err := c.decrypt(client, payload, a)
+	if err != nil {
+		reject(a, err)
+		c.malformed.add(addrIP(a), stat.MalformedEventDecrypt)
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    skippable(fmt.Errorf("%w: %v", ErrDecrypt, err)),
+		}
+	}
+
+	isTyped := c.isTypedTo(client)
+	if tcpLayer := indicator.TCPLayer(); tcpLayer != nil {
+		c.trace(TraceIn, a, traceTypeOf(contents, isTyped), tcpLayer.Seq, tcpLayer.Ack, contents)
+	}
+
+	// Datagrams decrypted are counted as received in delivery reports
+	c.lock.Lock()
+	client.received++
+	c.lock.Unlock()
+
+	// Reassemble datagrams from segments, which are frames of their own type
+	if isTyped && isSegment(contents) {
+		if client.segments == nil {
+			client.segments = newSegmentReassembler()
+		}
+
+		contents, err = client.segments.push(contents)
+		if err != nil {
+			c.malformed.add(addrIP(a), stat.MalformedEventParse)
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    skippable(fmt.Errorf("reassemble segments: %w", err)),
+			}
+		}
+		if contents == nil {
+			return 0, a, nil
+		}
+	}
+
+	// Typed frames, datagrams in untyped framing are always data
+	if isTyped {
+		contents, err = c.handleFrame(contents, indicator, a)
+		if err != nil {
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    skippable(fmt.Errorf("frame: %w", err)),
+			}
+		}
+		if contents == nil {
+			return 0, a, nil
+		}
+	}
+
+	n := copy(p, contents)
+
+	// Pass congestion experienced back to the packet tunneled
+	if c.isCopyTOS && indicator.IPv4Layer() != nil {
+		decapsulateECN(p[:n], indicator.IPv4Layer().TOS)
+	}
+
+	return len(contents), a, nil
+}
+
+// drain reads from the connection until the context is done so messages in band are handled, and packets read are
+// dropped. The error once the connection is closed is sent to the channel returned.
+func (c *FakeTCPConn) drain(ctx context.Context) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		b := make([]byte, 65535)
+		for ctx.Err() == nil {
+			_, _, err := c.ReadFrom(b)
+			if err != nil && c.isClosed {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return errs
+}
+
+func (c *FakeTCPConn) readPacketFrom() (gopacket.Packet, net.Addr, error) {
+	type tuple struct {
+		packet gopacket.Packet
+		err    error
+	}
+
+	// Buffered so goroutines losing the race never block
+	ch := make(chan tuple, 2)
+	c.spawn(func() {
+		for {
+			packet, err := c.conn.ReadPacket()
+			if err != nil {
+				ch <- tuple{err: err}
+				return
+			}
+			c.sflow.Sample(SFlowSourceTunnel, packet.Data())
+
+			// Parse packet
+			indicator, err := parsePacket(packet, c.validation, c.malformed)
+			if err != nil {
+				ch <- tuple{err: skippable(fmt.Errorf("parse packet: %w", err))}
+				return
+			}
+
+			// Handle fragments
+			indicator, err = c.defrag.Append(indicator)
+			if err != nil {
+				ch <- tuple{err: skippable(fmt.Errorf("defrag: %w", err))}
+				return
+			}
+			if indicator != nil {
+				ch <- tuple{packet: indicator.packet}
+				return
+			}
+		}
+	})
+	// Timeout
+	if !c.readDeadline.IsZero() {
+		c.spawn(func() {
+			if c.sleep(c.readDeadline.Sub(time.Now())) {
+				ch <- tuple{err: ErrTimeout}
+			}
+		})
+	}
+
+	tu := <-ch
+	if tu.err != nil {
+		return nil, nil, tu.err
+	}
+
+	// Parse packet, which has been validated or reassembled
+	indicator, err := InterpretPacket(tu.packet)
+	if err != nil {
+		return nil, nil, skippable(fmt.Errorf("parse packet: %w", err))
+	}
+
+	// Addresses in FakeTCP are always TCP addresses
+	if indicator.TransportLayer() == nil {
+		return nil, indicator.Src(), skippable(errors.New("missing transport layer"))
+	}
+	if t := indicator.TransportLayer().LayerType(); t != layers.LayerTypeTCP {
+		return nil, indicator.Src(), skippable(fmt.Errorf("transport layer type %s not support", t))
+	}
+
+	return tu.packet, indicator.Src(), nil
+}
+
+func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.isTypedToAddr(addr) {
+		n, err = c.writeTo(createDataFrame(p), addr, false)
+		if n > 0 {
+			n = n - frameTypeSize
+		}
+
+		return n, err
+	}
+
+	return c.writeTo(p, addr, false)
+}
+
+func (c *FakeTCPConn) writeTo(p []byte, addr net.Addr, isChaff bool) (n int, err error) {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	// Buffered so goroutines losing the race never block
+	ch := make(chan error, 2)
+
+	// UDP addresses are accepted as TCP addresses because KCP resolves addresses in UDP
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		dstIP = addr.(*net.TCPAddr).IP
+		dstPort = uint16(addr.(*net.TCPAddr).Port)
+	case *net.UDPAddr:
+		dstIP = addr.(*net.UDPAddr).IP
+		dstPort = uint16(addr.(*net.UDPAddr).Port)
+	default:
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("type %T not support", t),
+		}
+	}
+
+	// Write datagrams too large to be carried by IP fragmentation in segments
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if ok && !c.isNoFragment {
+		if max := c.maxDatagram(client, dstIP); len(p) > max {
+			// Peers in untyped framing cannot tell segments from data
+			if !c.isTypedTo(client) {
+				return 0, &net.OpError{
+					Op:     "write",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("%w: size %d out of range in untyped framing", ErrMTUExceeded, len(p)),
+				}
+			}
+
+			return c.writeSegments(p, addr, max)
+		}
+	}
+
+	// Writes are encrypted and fragmented in the pipeline of the client
+	w := &pendingWrite{p: p, dstIP: dstIP, dstPort: dstPort, isChaff: isChaff, result: ch}
+	c.spawn(func() {
+		if !ok {
+			ch <- fmt.Errorf("%w %s", ErrUnauthorizedClient, addr)
+			return
+		}
+
+		err := c.queueWrites(client, w)
+		if err != nil {
+			ch <- err
+		}
+	})
+	// Timeout, the write is cancelled so it is never written after the timeout is returned
+	if !c.writeDeadline.IsZero() {
+		c.spawn(func() {
+			if c.sleep(c.writeDeadline.Sub(time.Now())) {
+				w.cancel()
+			}
+		})
+	}
+
+	select {
+	case <-c.closed:
+		err = ErrClosed
+	case err = <-ch:
+	}
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    err,
+		}
+	}
+
+	return len(p), nil
+}
+
+// write encrypts, fragments and writes the data to the client in the pipeline of the client. Only states of the client
+// are accessed in the lock, so a slow encryption never blocks writes to other clients.
+func (c *FakeTCPConn) write(client *clientIndicator, w *pendingWrite) error {
+	// Pad
+	c.lock.Lock()
+	crypt := client.crypt
+	max := c.maxPayloadTo(w.dstIP) + c.frameCost()
+	if size := c.fragmentOf(client) - headerSize(w.dstIP) - crypt.Cost() - c.recordCost(); size < max {
+		max = size
+	}
+	c.lock.Unlock()
+
+	data := w.p
+	padder, ok := c.scheduler.(Padder)
+	if ok {
+		data = padder.Pad(data, max)
+	}
+
+	// Encrypt, crypts not authenticated like AES-CFB keep states of streams so they are never used concurrently by the
+	// client, while pipelines of other clients are never blocked
+	var (
+		contents []byte
+		err      error
+	)
+	if crypt.Method().IsAEAD() {
+		contents, err = crypt.Encrypt(data)
+	} else {
+		client.cryptLock.Lock()
+		contents, err = crypt.Encrypt(data)
+		client.cryptLock.Unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	if c.tls != nil {
+		contents = frameTLSRecord(tlsRecordApplicationData, contents)
+	} else if c.isPrefixed {
+		contents = prefixLength(contents)
+	}
+
+	c.lock.Lock()
+
+	fragment := c.fragmentOf(client)
+	if c.isNoFragment && headerSize(w.dstIP)+len(contents) > fragment {
+		c.lock.Unlock()
+		return fmt.Errorf("%w: size %d exceeds fragment size %d", ErrMTUExceeded, len(w.p), fragment)
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, w.dstPort, client.seq, client.ack, c.conn, w.dstIP, client.id, ttlOr(c.ttl, defaultTTL), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		c.lock.Unlock()
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	seq, ack := client.seq, client.ack
+
+	// TCP Seq, which is advanced once by the whole contents even if they are written in IP fragments, since fragments
+	// are of the same segment whose TCP header is only in the first fragment
+	client.seq = client.seq + uint32(len(contents))
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	client.sent++
+
+	if !w.isChaff {
+		client.lastWrite = time.Now()
+	}
+
+	duplicates := client.duplicates
+
+	c.lock.Unlock()
+
+	MarkNetworkLayer(networkLayer, c.dscp)
+	if ipv4Layer, ok := networkLayer.(*layers.IPv4); ok && c.isNoFragment {
+		FlagIPv4Layer(ipv4Layer, true, false, 0)
+	}
+
+	// Copy DSCP and ECN of the packet tunneled
+	if c.isCopyTOS && !w.isChaff {
+		tos, ok := parseTOS(w.p)
+		ipv4Layer, isIPv4 := networkLayer.(*layers.IPv4)
+		if ok && isIPv4 {
+			ipv4Layer.TOS = tos
+		}
+	}
+
+	// Fragment
+	fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Duplicate adaptively, copies of chaff and probes are never written
+	if !w.isChaff && duplicates > 0 {
+		frames := make([][]byte, 0, len(fragments)*(duplicates+1))
+		for i := 0; i <= duplicates; i++ {
+			frames = append(frames, fragments...)
+		}
+		fragments = frames
+	}
+
+	// Write packet data
+	if prioritizer, ok := c.scheduler.(Prioritizer); ok {
+		// Fragments are scheduled one by one so small packets may be written between them
+		for _, frag := range fragments {
+			frag := frag
+			prioritizer.SchedulePriority(func() error {
+				return c.writeFrame(frag)
+			}, w.p, len(frag))
+		}
+	} else if c.scheduler != nil {
+		c.scheduler.Schedule(func() error {
+			for _, frag := range fragments {
+				err := c.writeFrame(frag)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	} else {
+		for _, frag := range fragments {
+			err := c.writeFrame(frag)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+		}
+	}
+
+	if c.traceFilter != nil {
+		c.trace(TraceOut, &net.TCPAddr{IP: w.dstIP, Port: int(w.dstPort)}, traceTypeOf(w.p, c.isTypedTo(client)), seq, ack, w.p)
+	}
+
+	return nil
+}
+
+// writeFrame writes the frame through the impairment if any.
+func (c *FakeTCPConn) writeFrame(b []byte) error {
+	c.sflow.Sample(SFlowSourceTunnel, b)
+
+	if c.impairment != nil {
+		return c.impairment.Impair(func() error {
+			_, err := c.conn.Write(b)
+			return err
+		})
+	}
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Established returns a channel closed once the connection is established.
+func (c *FakeTCPConn) Established() <-chan struct{} {
+	return c.established
+}
+
+// MaxPayload returns the max size of data which can be written to the connection without fragmentation.
+func (c *FakeTCPConn) MaxPayload() int {
+	return c.maxPayloadTo(c.dstAddr.IP)
+}
+
+// maxPayloadTo returns the max size of data which can be written to the IP without fragmentation, whose headers are of
+// the family of the IP.
+func (c *FakeTCPConn) maxPayloadTo(dstIP net.IP) int {
+	// Packets are never larger than fragments if they are never fragmented
+	size := c.mtu
+	if c.isNoFragment && c.fragment < size {
+		size = c.fragment
+	}
+
+	return size - headerSize(dstIP) - c.crypt.Cost() - c.recordCost() - c.frameCost()
+}
+
+// recordCost returns the size of headers of TLS records or lengths framing data.
+func (c *FakeTCPConn) recordCost() int {
+	if c.tls != nil {
+		return tlsRecordHeaderSize
+	}
+	if c.isPrefixed {
+		return lengthPrefixSize
+	}
+
+	return 0
+}
+
+func (c *FakeTCPConn) Close() error {
+	// Close peers gracefully
+	if !c.isClosed {
+		c.sendClose()
+	}
+
+	c.isClosed = true
+	c.cancel()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	err := c.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: c.LocalAddr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Wait waits until all goroutines of the connection have exited, which happens only after the connection is closed.
+func (c *FakeTCPConn) Wait() {
+	c.wg.Wait()
+}
+
+// Shutdown closes the connection and waits until all its goroutines have exited or the context is done.
+func (c *FakeTCPConn) Shutdown(ctx context.Context) error {
+	err := c.Close()
+	if err != nil {
+		return err
+	}
+
+	return wait(ctx, c.Wait)
+}
+
+// wait calls the function and returns when it returns or the context is done. The function keeps running in the
+// background if the context is done first.
+func wait(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// LocalDev returns the local device.
+func (c *FakeTCPConn) LocalDev() *Device {
+	return c.conn.LocalDev()
+}
+
+func (c *FakeTCPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
+}
+
+// RemoteDev returns the remote device.
+func (c *FakeTCPConn) RemoteDev() *Device {
+	return c.conn.RemoteDev()
+}
+
+func (c *FakeTCPConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *FakeTCPConn) SetDeadline(t time.Time) error {
+	readDeadline := c.readDeadline
+
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetWriteDeadline(t)
+	if err != nil {
+		_ = c.SetReadDeadline(readDeadline)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FakeTCPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *FakeTCPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+
+	return nil
+}
+
+// Reconnect reconnects the connection by sending TCP SYN.
+func (c *FakeTCPConn) Reconnect() error {
+	c.isReconnected = false
+	c.lastReconnect = time.Now()
+
+	err := c.handshakeSYN()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	c.spawn(func() {
+		if c.sleep(c.timeout) && !c.isReconnected {
+			log.Errorf("Cannot receive response from server %s, is it down?\n", c.RemoteAddr().String())
+			c.hook.Notifyf(hook.EventUnreachable, "Server %s is unreachable", c.RemoteAddr().String())
+		}
+	})
+
+	return nil
+}
+
+// resumeOnRecovery resumes the session with the server after the device of the connection is recovered. The session is
+// confirmed if the address of the connection remains, otherwise the connection handshakes again from the new address of
+// the device selected again.
+func (c *FakeTCPConn) resumeOnRecovery() {
+	c.conn.setRecovered(func(dev *Device) {
+		if prev, ip := dev.IPAddr(), c.LocalDev().IPAddr(); prev != nil && ip != nil && prev.IP.Equal(ip.IP) {
+			c.spawn(c.confirmResume)
+			return
+		}
+
+		log.Infof("Address changed to %s, connect to server %s again\n", c.LocalAddr(), c.RemoteAddr())
+
+		err := c.Reconnect()
+		if err != nil {
+			log.Errorln(fmt.Errorf("reconnect to %s: %w", c.RemoteAddr(), err))
+		}
+	})
+}
+
+// SetRemoteAddr changes the remote address of the connection and reconnects to the new address.
+func (c *FakeTCPConn) SetRemoteAddr(dstAddr *net.TCPAddr) error {
+	filter, err := dialFilter(c.srcPort, dstAddr)
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.SetFilter(filter)
+	if err != nil {
+		return fmt.Errorf("set filter: %w", err)
+	}
+
+	c.lock.Lock()
+
+	// Move client
+	c.clientsLock.Lock()
+	client, ok := c.clients[c.dstAddr.String()]
+	if ok {
+		delete(c.clients, c.dstAddr.String())
+		c.clients[dstAddr.String()] = client
+	}
+	c.clientsLock.Unlock()
+
+	c.dstAddr = dstAddr
+
+	c.lock.Unlock()
+
+	return c.Reconnect()
+}
+
+// FakeTCPListener is a pcap network listener in FakeTCP network.
+type FakeTCPListener struct {
+	conn        *RawConn
+	options     *options
+	portsLock   sync.RWMutex
+	ports       []uint16
+	isClosed    bool
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	clientsLock sync.RWMutex
+	clients     map[string]*FakeTCPConn
+	skews       *skewTable
+	quarantine  *quarantine
+}
+
+// ListenFakeTCP announces on the local port in FakeTCP network. If a verifier is set, the listener is in stealth mode,
+// clients which do not carry a valid proof in their SYN will never be responded. If an admission is set, clients over
+// its max will be refused.
+func ListenFakeTCP(srcPort uint16, opts ...Option) (*FakeTCPListener, error) {
+	o, err := newListenOptions(srcPort, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return listenFakeTCP(o)
+}
+
+func listenFakeTCP(o *options) (*FakeTCPListener, error) {
+	addrs := make([]*net.TCPAddr, 0)
+	for _, ip := range o.srcDev.IPAddrs() {
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(o.srcPort)})
+	}
+	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
+
+	ports := []uint16{o.srcPort}
+
+	conn, err := createRawConn(o.srcDev, o.dstDev, listenFilter(ports), o)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddrs,
+			Err:    fmt.Errorf("create handshake connection: %w", err),
+		}
+	}
+
+	// Only sources not authenticated are quarantined, packets from clients accepted are read in their connections
+	listener := &FakeTCPListener{
+		conn:       conn,
+		options:    o,
+		ports:      ports,
+		clients:    make(map[string]*FakeTCPConn),
+		skews:      newSkewTable(),
+		quarantine: newQuarantine(o.malMonitor),
+	}
+	conn.quarantine = listener.quarantine
+
+	// Close when the context is done, connections accepted are closed by themselves
+	ctx, cancel := context.WithCancel(o.ctx)
+	listener.cancel = cancel
+	listener.wg.Add(1)
+	go func() {
+		defer listener.wg.Done()
+
+		<-ctx.Done()
+
+		if !listener.isClosed {
+			_ = listener.Close()
+		}
+	}()
+
+	return listener, nil
+}
+
+func (l *FakeTCPListener) Accept() (net.Conn, error) {
+	packet, err := l.conn.ReadPacket()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("read device %s: %w", l.Dev().Alias(), err),
+		}
+	}
+
+	// Parse packet
+	indicator, err := parsePacket(packet, l.options.validation, l.quarantine)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("parse packet: %w", err),
+		}
+	}
+
+	// Never accept scans without cookie before any state is allocated, clients whose clocks are skewed are accepted in
+	// windows shifted
+	skew := l.skews.of(indicator.SrcIP())
+	payload, err := checkCookie(l.options.cookie, indicator, skew)
+	if err != nil {
+		refuseScan(l.conn, indicator, l.options.verifier != nil || l.options.users != nil, ttlOr(l.options.ttl, defaultResponseTTL), err)
+		return nil, nil
+	}
+
+	l.clientsLock.RLock()
+	client, ok := l.clients[indicator.Src().String()]
+	l.clientsLock.RUnlock()
+	if ok && !client.isClosed {
+		// Duplicate
+		return nil, nil
+	}
+
+	// Never respond to clients in other methods or versions not supported
+	untagged := l.options.preamble.untaggedVersion(l.options.wireVersion)
+	version, proof, err := negotiateSYN(l.options.crypt, payload, untagged)
+	if err != nil {
+		logNegotiation(indicator.Src(), err)
+		return nil, nil
+	}
+
+	// Never respond to clients without proof in stealth mode, or of unknown users or keys
+	name, crypt := "", l.options.crypt
+	switch {
+	case l.options.users != nil:
+		name, crypt, err = identifySYN(l.options.users, indicator, proof, skew)
+	case l.options.keyring != nil:
+		crypt, err = identifyKey(l.options.keyring, l.options.verifier != nil, indicator, proof, skew)
+	default:
+		err = verifySYN(l.options.verifier, indicator, proof, skew)
+	}
+	if err != nil {
+		reject(indicator.Src(), err)
+		log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", indicator.Src().String(), err))
+		return nil, nil
+	}
+
+	// Never respond to clients banned
+	if l.options.bans.IsBanned(indicator.Src(), name) {
+		log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", indicator.Src().String(), errBanned))
+		return nil, nil
+	}
+
+	// Never respond to clients out of their schedules
+	if !l.options.access.IsAllowed(name, time.Now()) {
+		log.Verboseln(fmt.Errorf("drop tcp syn from %s: %w", indicator.Src().String(), errOutOfSchedule))
+		return nil, nil
+	}
+
+	// Never respond to new clients in draining
+	if l.options.drain.IsDraining() {
+		log.Verbosef("Refuse client %s because of draining\n", indicator.Src().String())
+		return nil, nil
+	}
+
+	// Refuse clients over the max
+	if !l.options.admission.Admit(indicator.Src()) {
+		l.options.admission.refuse(l.conn, indicator, ttlOr(l.options.ttl, defaultResponseTTL))
+		return nil, nil
+	}
+
+	// Connections are accepted on the port the client connects to
+	conn, err := l.dialClient(indicator.Src().(*net.TCPAddr), indicator.DstPort(), &clientIndicator{
+		crypt:     crypt,
+		version:   version,
+		seq:       l.options.preamble.initialSeq(),
+		ack:       0,
+		id:        randUint16(),
+		lastWrite: time.Now(),
+		probes:    newLossMeter(),
+		seen:      newSeqWindow(),
+		user:      name,
+	})
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   indicator.Src(),
+			Err:    err,
+		}
+	}
+
+	// Handshaking with client (SYN+ACK)
+	err = conn.handshakeSYNACK(indicator, version)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "handshake",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   indicator.Src(),
+			Err:    err,
+		}
+	}
+
+	// Map client
+	l.clientsLock.Lock()
+	l.clients[indicator.Src().String()] = conn
+	l.clientsLock.Unlock()
+
+	return conn, nil
+}
+
+// dialClient returns a connection on the port to the client, which shares options of the listener.
+func (l *FakeTCPListener) dialClient(dstAddr *net.TCPAddr, port uint16, client *clientIndicator) (*FakeTCPConn, error) {
+	o := *l.options
+	o.srcPort = port
+
+	conn, err := dialFakeTCPPassive(dstAddr, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.clients[dstAddr.String()] = client
+	conn.skews = l.skews
+	conn.verifier = l.options.verifier
+	conn.users = l.options.users
+	conn.keyring = l.options.keyring
+	conn.bans = l.options.bans
+	conn.draining = l.options.drain
+	conn.access = l.options.access
+	conn.admission = l.options.admission
+
+	return conn, nil
+}
+
+// listenFilter returns the filter of SYNs to the ports.
+func listenFilter(ports []uint16) string {
+	strs := make([]string, 0, len(ports))
+	for _, port := range ports {
+		strs = append(strs, fmt.Sprintf("dst port %d", port))
+	}
+
+	return fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && (%s)", strings.Join(strs, " || "))
+}
+
+// Ports returns ports the listener announces on.
+func (l *FakeTCPListener) Ports() []uint16 {
+	l.portsLock.RLock()
+	defer l.portsLock.RUnlock()
+
+	ports := make([]uint16, len(l.ports))
+	copy(ports, l.ports)
+
+	return ports
+}
+
+// SetPorts replaces ports the listener announces on. Connections accepted on ports removed are kept.
+func (l *FakeTCPListener) SetPorts(ports []uint16) error {
+	if len(ports) <= 0 {
+		return &net.OpError{
+			Op:   "set",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  errors.New("missing ports"),
+		}
+	}
+
+	l.portsLock.Lock()
+	defer l.portsLock.Unlock()
+
+	err := l.conn.SetFilter(listenFilter(ports))
+	if err != nil {
+		return &net.OpError{
+			Op:   "set",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("set filter: %w", err),
+		}
+	}
+
+	l.ports = make([]uint16, len(ports))
+	copy(l.ports, ports)
+
+	return nil
+}
+
+func (l *FakeTCPListener) Close() error {
+	l.isClosed = true
+	l.cancel()
+
+	err := l.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Wait waits until all goroutines of the listener and connections accepted have exited, which happens only after they
+// are closed.
+func (l *FakeTCPListener) Wait() {
+	l.wg.Wait()
+
+	l.clientsLock.RLock()
+	conns := make([]*FakeTCPConn, 0, len(l.clients))
+	for _, conn := range l.clients {
+		conns = append(conns, conn)
+	}
+	l.clientsLock.RUnlock()
+
+	for _, conn := range conns {
+		conn.Wait()
+	}
+}
+
+// Shutdown closes the listener and connections accepted, and waits until all their goroutines have exited or the
+// context is done.
+func (l *FakeTCPListener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+	if err != nil {
+		return err
+	}
+
+	l.clientsLock.RLock()
+	for _, conn := range l.clients {
+		if !conn.isClosed {
+			_ = conn.Close()
+		}
+	}
+	l.clientsLock.RUnlock()
+
+	return wait(ctx, l.Wait)
+}
+
+// Dev returns the device.
+func (l *FakeTCPListener) Dev() *Device {
+	return l.conn.LocalDev()
+}
+
+func (l *FakeTCPListener) Addr() net.Addr {
+	return &net.TCPAddr{
+		IP:   l.Dev().IPAddr().IP,
+		Port: int(l.options.srcPort),
+	}
+}
+
+// DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
+func DialFakeTCPWithKCP(dstAddr *net.TCPAddr, opts ...Option) (*kcp.UDPSession, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	return dialFakeTCPWithKCP(dstAddr, o)
+}
+
+func dialFakeTCPWithKCP(dstAddr *net.TCPAddr, o *options) (*kcp.UDPSession, error) {
+	conn, err := dialFakeTCP(dstAddr, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKCPSession(conn, dstAddr, o)
+}
+
+// newKCPSession returns a KCP session over the FakeTCP connection.
+func newKCPSession(conn *FakeTCPConn, dstAddr *net.TCPAddr, o *options) (*kcp.UDPSession, error) {
+	sess, err := kcp.NewConn(dstAddr.String(), nil, o.kcpConfig.DataShard, o.kcpConfig.ParityShard, conn)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	// Tuning
+	err = tuneKCP(sess, o.kcpConfig)
+	if err != nil {
+		sess.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    fmt.Errorf("tune: %w", err),
+		}
+	}
+
+	return sess, nil
+}
+
+// ListenFakeTCPWithKCP listens for incoming packets addressed to the local port in the FakeTCP network with KCP support.
+func ListenFakeTCPWithKCP(srcPort uint16, opts ...Option) (*kcp.Listener, error) {
+	o, err := newListenOptions(srcPort, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return listenFakeTCPWithKCP(o)
+}
+
+func listenFakeTCPWithKCP(o *options) (*kcp.Listener, error) {
+	conn, err := listenFakeTCPMulticast(o)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := kcp.ServeConn(nil, o.kcpConfig.DataShard, o.kcpConfig.ParityShard, conn)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	return listener, err
+}
+
+var (
+	errMissingProof   = errors.New("missing proof")
+	errMethodMismatch = errors.New("method mismatch")
+	errInvalidCookie  = errors.New("invalid cookie")
+)
+
+// negotiateSYN checks the method tag leading the payload of the TCP SYN against the method of the crypt in versions of
+// the wire format supported, and returns the version and the rest of the payload. TCP SYN without payload are not
+// negotiated, whose clients are regarded in the version given, see untaggedVersion.
+func negotiateSYN(crypt crypto.Crypt, payload []byte, version int) (int, []byte, error) {
+	if len(payload) <= 0 {
+		return version, nil, nil
+	}
+	if len(payload) < crypto.MethodTagSize {
+		return 0, nil, errors.New("malformed method tag")
+	}
+
+	tag := payload[:crypto.MethodTagSize]
+	expected := crypto.Name(crypt)
+	if v, ok := matchWireTag(tag, expected); ok {
+		return v, payload[crypto.MethodTagSize:], nil
+	}
+
+	name, v, err := parseWireTag(tag)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, fmt.Errorf("%w: use %s in wire version %d but %s expected", errMethodMismatch, name, v, expected)
+}
+
+// checkCookie checks the cookie leading the payload of the TCP SYN if the cookie is not nil, and returns the payload
+// following it. Cookies are also accepted in the window shifted by the skew of the clock of the source.
+func checkCookie(cookie *crypto.Cookie, indicator *PacketIndicator, skew time.Duration) ([]byte, error) {
+	payload := indicator.Payload()
+	if cookie == nil {
+		return payload, nil
+	}
+
+	if !cookie.VerifySkewed(payload, skew) {
+		return nil, errInvalidCookie
+	}
+
+	return payload[crypto.CookieSize:], nil
+}
+
+// refuseScan refuses the TCP SYN without cookie by a TCP RST in the TTL as a closed port, or silently in stealth mode.
+func refuseScan(conn *RawConn, indicator *PacketIndicator, isStealth bool, ttl uint8, err error) {
+	log.Verboseln(fmt.Errorf("refuse tcp syn from %s: %w", indicator.Src().String(), err))
+
+	if isStealth {
+		return
+	}
+
+	err = writeRST(conn, indicator, ttl)
+	if err != nil {
+		log.Errorln(fmt.Errorf("reset %s: %w", indicator.Src().String(), err))
+	}
+}
+
+// logNegotiation logs the failed negotiation, which is an error only if the client is in another method.
+func logNegotiation(addr net.Addr, err error) {
+	err = fmt.Errorf("negotiate with %s: %w", addr.String(), err)
+	if errors.Is(err, errMethodMismatch) {
+		log.Errorln(err)
+	} else {
+		log.Verboseln(err)
+	}
+}
+
+// verifySYN verifies the proof carried in the TCP SYN if the verifier is not nil, which is also accepted in the window
+// shifted by the skew of the clock of the source. Sources failing repeatedly are backed off, whose TCP SYN will not be
+// verified for a while.
+func verifySYN(verifier *crypto.ProofVerifier, indicator *PacketIndicator, proof []byte, skew time.Duration) error {
+	if verifier == nil {
+		return nil
+	}
+
+	if isBackingOff(indicator.SrcIP()) {
+		return errBackingOff
+	}
+
+	err := func() error {
+		if len(proof) <= 0 {
+			return errMissingProof
+		}
+
+		return verifier.VerifySkewed(proof, skew)
+	}()
+	if err != nil {
+		failHandshake(indicator.SrcIP())
+		return err
+	}
+
+	succeedHandshake(indicator.SrcIP())
+
+	return nil
+}
+
+func tuneKCP(sess *kcp.UDPSession, config *config.KCPConfig) error {
+	ok := sess.SetMtu(config.MTU)
+	if !ok {
+		return fmt.Errorf("cannot set mtu")
+	}
+
+	sess.SetWindowSize(config.SendWindow, config.RecvWindow)
+
+	sess.SetACKNoDelay(config.ACKNoDelay)
+
+	sess.SetNoDelay(btoi(config.NoDelay), config.Interval, config.Resend, config.NC)
+
+	return nil
+}
+
+// TuneKCP tunes a KCP connection.
+func TuneKCP(sess *kcp.UDPSession, config *config.KCPConfig) error {
+	err := tuneKCP(sess, config)
+	if err != nil {
+		return &net.OpError{
+			Op:     "tune",
+			Net:    "pcap",
+			Source: sess.LocalAddr(),
+			Addr:   sess.RemoteAddr(),
+			Err:    err,
+		}
+	}
+
+	return nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
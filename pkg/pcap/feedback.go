@@ -0,0 +1,160 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/stat"
+	"net"
+	"time"
+)
+
+// deliverySize is the size of delivery reports, which are stats frames, each is a byte of type, 8 bytes of the count of packets sent to the
+// peer and 8 bytes of the count of packets received from the peer.
+const deliverySize = 17
+
+// deliveryMinPackets is the min count of packets sent in a direction before the loss in the direction is measured.
+const deliveryMinPackets = 16
+
+// createDeliveryReport returns a delivery report.
+func createDeliveryReport(sent, received uint64) []byte {
+	b := make([]byte, deliverySize)
+
+	b[0] = frameStats
+	binary.BigEndian.PutUint64(b[1:9], sent)
+	binary.BigEndian.PutUint64(b[9:17], received)
+
+	return b
+}
+
+// deliveryMeter measures one-way losses to and from a peer by counts of packets in delivery reports of the peer. Each
+// loss is measured since the last time it was measured, once enough packets are sent in the direction.
+type deliveryMeter struct {
+	isStarted    bool
+	sent         uint64
+	received     uint64
+	peerSent     uint64
+	peerReceived uint64
+	outbound     float64
+	inbound      float64
+	isOutbound   bool
+	isInbound    bool
+}
+
+func newDeliveryMeter() *deliveryMeter {
+	return &deliveryMeter{}
+}
+
+// update records counts of packets of the local and the peer.
+func (m *deliveryMeter) update(sent, received, peerSent, peerReceived uint64) {
+	if !m.isStarted {
+		m.isStarted = true
+		m.sent, m.received, m.peerSent, m.peerReceived = sent, received, peerSent, peerReceived
+		return
+	}
+
+	if sent-m.sent >= deliveryMinPackets {
+		m.outbound = lossOf(sent-m.sent, peerReceived-m.peerReceived)
+		m.isOutbound = true
+		m.sent, m.peerReceived = sent, peerReceived
+	}
+	if peerSent-m.peerSent >= deliveryMinPackets {
+		m.inbound = lossOf(peerSent-m.peerSent, received-m.received)
+		m.isInbound = true
+		m.peerSent, m.received = peerSent, received
+	}
+}
+
+// loss returns the percent of packets lost to the peer, and false if there are not enough packets measured.
+func (m *deliveryMeter) loss() (float64, bool) {
+	return m.outbound, m.isOutbound
+}
+
+// lossOf returns the percent of packets lost in packets sent. Packets in flight may be received more than sent in an
+// interval, which is no loss.
+func lossOf(sent, received uint64) float64 {
+	if received >= sent {
+		return 0
+	}
+
+	return float64(sent-received) / float64(sent) * 100
+}
+
+// handleDelivery records the delivery report from the address.
+func (c *FakeTCPConn) handleDelivery(contents []byte, addr net.Addr) error {
+	if len(contents) < deliverySize {
+		return fmt.Errorf("delivery size %d out of range", len(contents))
+	}
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unrecognized", addr.String())
+	}
+
+	peerSent := binary.BigEndian.Uint64(contents[1:9])
+	peerReceived := binary.BigEndian.Uint64(contents[9:17])
+
+	c.lock.Lock()
+	if client.delivery == nil {
+		client.delivery = newDeliveryMeter()
+	}
+	client.delivery.update(client.sent, client.received, peerSent, peerReceived)
+	if cc := c.congestionOf(client); cc != nil {
+		cc.OnDelivered(peerReceived, time.Now())
+	}
+	delivery := stat.Delivery{
+		Sent:         client.sent,
+		Received:     client.received,
+		OutboundLoss: client.delivery.outbound,
+		InboundLoss:  client.delivery.inbound,
+	}
+	c.lock.Unlock()
+
+	if c.delMonitor != nil {
+		c.delMonitor.Set(addr.String(), delivery)
+	}
+
+	// Adapt by delivery reports if there are no latency probes
+	if c.probe <= 0 {
+		c.adapt(addr, client)
+	}
+
+	return nil
+}
+
+// sendFeedback sends delivery reports to all peers every interval until the connection is closed.
+func (c *FakeTCPConn) sendFeedback(interval time.Duration) {
+	for c.sleep(interval) {
+		addrs := make([]net.Addr, 0)
+		clients := make([]*clientIndicator, 0)
+		c.clientsLock.RLock()
+		for a, client := range c.clients {
+			// Reports are never sent to clients in untyped framing
+			if !c.isTypedTo(client) {
+				continue
+			}
+
+			addr, err := net.ResolveTCPAddr("tcp", a)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+			clients = append(clients, client)
+		}
+		c.clientsLock.RUnlock()
+
+		for i, addr := range addrs {
+			c.lock.Lock()
+			report := createDeliveryReport(clients[i].sent, clients[i].received)
+			c.lock.Unlock()
+
+			// Reports are not counted as writes so chaff is still sent in idle
+			_, err := c.writeTo(report, addr, true)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("send delivery report to %s: %w", addr, err))
+			}
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"ikago/pkg/stat"
+	"sort"
+	"strings"
+	"time"
+)
+
+type fragFlow struct {
+	id  uint32
+	src string
+}
+
+type fragIndicator struct {
+	length   uint16
+	offset   uint16
+	frags    []*PacketIndicator
+	lastSeen time.Time
+}
+
+func newFragIndicator() *fragIndicator {
+	return &fragIndicator{
+		frags:    make([]*PacketIndicator, 0),
+		lastSeen: time.Now(),
+	}
+}
+
+func (indicator *fragIndicator) append(ind *PacketIndicator) {
+	indicator.frags = append(indicator.frags, ind)
+	indicator.lastSeen = time.Now()
+
+	if ind.MoreFragments() {
+		indicator.length = indicator.length + uint16(len(ind.NetworkPayload()))
+	} else {
+		// Final fragment
+		indicator.offset = ind.FragOffset()
+	}
+
+	// Sort
+	if len(indicator.frags) <= 1 {
+		return
+	}
+	sort.Slice(indicator.frags, func(i, j int) bool {
+		return indicator.frags[i].FragOffset() < indicator.frags[j].FragOffset()
+	})
+}
+
+func (indicator *fragIndicator) overlaps(ind *PacketIndicator) bool {
+	start := int(ind.FragOffset()) * 8
+	end := start + len(ind.NetworkPayload())
+
+	for _, frag := range indicator.frags {
+		s := int(frag.FragOffset()) * 8
+		e := s + len(frag.NetworkPayload())
+
+		if start < e && s < end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (indicator *fragIndicator) isCompleted() bool {
+	return indicator.length/8 == indicator.offset
+}
+
+func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
+	var (
+		err             error
+		newNetworkLayer gopacket.NetworkLayer
+		contents        []byte
+		data            []byte
+		ind             *PacketIndicator
+	)
+
+	if !indicator.isCompleted() {
+		return nil, errors.New("incomplete fragments")
+	}
+
+	// Create new network layer
+	fragmenter, err := FindFragmenter(indicator.frags[0].NetworkLayer().LayerType())
+	if err != nil {
+		return nil, err
+	}
+
+	newNetworkLayer, err = fragmenter.Reassemble(indicator.frags[0])
+	if err != nil {
+		return nil, fmt.Errorf("reassemble: %w", err)
+	}
+
+	// Concatenate network payloads
+	contents = make([]byte, 0)
+	for _, frag := range indicator.frags {
+		contents = append(contents, frag.NetworkPayload()...)
+	}
+
+	// Serialize
+	if indicator.frags[0].LinkLayer() == nil {
+		data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(contents))
+	} else {
+		data, err = Serialize(indicator.frags[0].LinkLayer().(gopacket.SerializableLayer),
+			newNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(contents))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	// Parse packet, fragments are validated as they are parsed, so packets reassembled are not validated again
+	if indicator.frags[0].LinkLayer() == nil {
+		ind, err = ParseEmbPacket(data, ValidationLoose, nil)
+	} else {
+		var packet gopacket.Packet
+
+		packet, err = ParseRawPacket(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse packet: %w", err)
+		}
+
+		ind, err = InterpretPacket(packet)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse packet: %w", err)
+	}
+
+	return ind, nil
+}
+
+// maxFragFlows is the default max count of flows of fragments in progress in a defragmenter.
+const maxFragFlows = 4096
+
+// Defragmenter is a machine defragments packets.
+type Defragmenter interface {
+	// Append adds a fragment to the defragmenter.
+	Append(ind *PacketIndicator) (*PacketIndicator, error)
+	// AppendOriginal adds a fragment to the defragmenter and returns packets with and without defragmentation.
+	AppendOriginal(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error)
+	// SetDeadline sets the deadline associated with the fragments.
+	SetDeadline(t time.Duration)
+	// SetLimit sets the max count of flows of fragments in progress.
+	SetLimit(n int)
+	// SetMonitor sets the monitor recording statistics of the defragmenter.
+	SetMonitor(monitor *stat.FragmentMonitor)
+}
+
+// NewDefragmenter returns a new defragmenter by given config.
+func NewDefragmenter(config *config.DefragConfig) (Defragmenter, error) {
+	var defrag Defragmenter
+
+	switch strings.ToLower(config.Mode) {
+	case "easy":
+		defrag = NewEasyDefragmenter()
+	case "strict":
+		defrag = NewStrictDefragmenter()
+	default:
+		return nil, fmt.Errorf("defrag mode %s not support", config.Mode)
+	}
+
+	if config.Deadline < 0 {
+		return nil, fmt.Errorf("defrag deadline %d out of range", config.Deadline)
+	}
+	if config.Limit <= 0 {
+		return nil, fmt.Errorf("defrag limit %d out of range", config.Limit)
+	}
+
+	defrag.SetDeadline(time.Duration(config.Deadline) * time.Second)
+	defrag.SetLimit(config.Limit)
+
+	return defrag, nil
+}
+
+func addFragmentEvent(monitor *stat.FragmentMonitor, event stat.FragmentEvent) {
+	if monitor != nil {
+		monitor.Add(event)
+	}
+}
+
+// EasyDefragmenter is a machine defragments packets which also accepts non-standard packets.
+type EasyDefragmenter struct {
+	frags     map[fragFlow]*fragIndicator
+	deadline  time.Duration
+	limit     int
+	lastSweep time.Time
+	monitor   *stat.FragmentMonitor
+}
+
+// NewEasyDefragmenter returns a new easy defragmenter.
+func NewEasyDefragmenter() *EasyDefragmenter {
+	return &EasyDefragmenter{
+		frags: make(map[fragFlow]*fragIndicator),
+		limit: maxFragFlows,
+	}
+}
+
+func (defrag *EasyDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator, error) {
+	indicator, _, err := defrag.AppendOriginal(ind)
+
+	return indicator, err
+}
+
+// AppendOriginal adds a fragment to the defragmenter and returns packets with and without defragmentation.
+func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	if !ind.IsFrag() {
+		return ind, append(make([]*PacketIndicator, 0), ind), nil
+	}
+
+	// Discard old fragments
+	defrag.sweep()
+
+	flow := fragFlow{
+		id:  ind.NetworkId(),
+		src: ind.SrcIP().String(),
+	}
+	fragIndicator, ok := defrag.frags[flow]
+
+	// Replace old fragments
+	if ok && defrag.deadline > 0 && time.Now().Sub(fragIndicator.lastSeen) > defrag.deadline {
+		log.Verbosef("Recycle fragments %d from %s\n", flow.id, flow.src)
+		delete(defrag.frags, flow)
+		addFragmentEvent(defrag.monitor, stat.FragmentEventExpired)
+		ok = false
+	}
+
+	if !ok {
+		if len(defrag.frags) >= defrag.limit {
+			addFragmentEvent(defrag.monitor, stat.FragmentEventOverLimit)
+			return nil, nil, fmt.Errorf("too many fragments in progress, drop fragment %d from %s", flow.id, flow.src)
+		}
+
+		fragIndicator = newFragIndicator()
+		defrag.frags[flow] = fragIndicator
+		addFragmentEvent(defrag.monitor, stat.FragmentEventStarted)
+	}
+
+	// Drop oversize fragments
+	if int(ind.FragOffset())*8+len(ind.NetworkPayload()) > IPv4MaxSize {
+		delete(defrag.frags, flow)
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("fragment %d from %s too large", flow.id, flow.src)
+	}
+
+	fragIndicator.append(ind)
+
+	if !fragIndicator.isCompleted() {
+		return nil, nil, nil
+	}
+
+	// Remove completed fragments
+	delete(defrag.frags, flow)
+
+	// Concatenate fragments
+	indicator, err := fragIndicator.concatenate()
+	if err != nil {
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("concatenate: %w", err)
+	}
+
+	addFragmentEvent(defrag.monitor, stat.FragmentEventCompleted)
+
+	return indicator, fragIndicator.frags, nil
+}
+
+func (defrag *EasyDefragmenter) sweep() {
+	if defrag.deadline <= 0 {
+		return
+	}
+
+	// Sweep at most once a second
+	now := time.Now()
+	if now.Sub(defrag.lastSweep) < time.Second {
+		return
+	}
+	defrag.lastSweep = now
+
+	for flow, fragIndicator := range defrag.frags {
+		if now.Sub(fragIndicator.lastSeen) > defrag.deadline {
+			log.Verbosef("Recycle fragments %d from %s\n", flow.id, flow.src)
+			delete(defrag.frags, flow)
+			addFragmentEvent(defrag.monitor, stat.FragmentEventExpired)
+		}
+	}
+}
+
+func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
+	defrag.deadline = t
+}
+
+func (defrag *EasyDefragmenter) SetLimit(n int) {
+	defrag.limit = n
+}
+
+func (defrag *EasyDefragmenter) SetMonitor(monitor *stat.FragmentMonitor) {
+	defrag.monitor = monitor
+}
+
+// StrictDefragmenter is a machine defragments packets which drops invalid packets.
+type StrictDefragmenter struct {
+	defragmenter *ip4defrag.IPv4Defragmenter
+	ipv4Frags    map[fragFlow]*fragIndicator
+	ipv6Frags    map[fragFlow]*fragIndicator
+	deadline     time.Duration
+	limit        int
+	monitor      *stat.FragmentMonitor
+}
+
+// NewStrictDefragmenter returns a new strict defragmenter.
+func NewStrictDefragmenter() *StrictDefragmenter {
+	return &StrictDefragmenter{
+		defragmenter: ip4defrag.NewIPv4Defragmenter(),
+		ipv4Frags:    make(map[fragFlow]*fragIndicator),
+		ipv6Frags:    make(map[fragFlow]*fragIndicator),
+		limit:        maxFragFlows,
+	}
+}
+
+func (defrag *StrictDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator, error) {
+	indicator, _, err := defrag.AppendOriginal(ind)
+
+	return indicator, err
+}
+
+func (defrag *StrictDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	if !ind.IsFrag() {
+		return ind, append(make([]*PacketIndicator, 0), ind), nil
+	}
+
+	switch t := ind.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return defrag.appendIPv4(ind)
+	case layers.LayerTypeIPv6:
+		return defrag.appendIPv6(ind)
+	default:
+		return nil, nil, fmt.Errorf("network layer type %s not support", t)
+	}
+}
+
+func (defrag *StrictDefragmenter) appendIPv4(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	// Discard old fragments
+	if defrag.deadline > 0 {
+		now := time.Now()
+		for flow, fragIndicator := range defrag.ipv4Frags {
+			if now.Sub(fragIndicator.lastSeen) > defrag.deadline {
+				delete(defrag.ipv4Frags, flow)
+				addFragmentEvent(defrag.monitor, stat.FragmentEventExpired)
+			}
+		}
+		defrag.defragmenter.DiscardOlderThan(now.Add(-defrag.deadline))
+	}
+
+	flow := fragFlow{
+		id:  ind.NetworkId(),
+		src: ind.SrcIP().String(),
+	}
+	fragIndicator, ok := defrag.ipv4Frags[flow]
+	if !ok {
+		if len(defrag.ipv4Frags) >= defrag.limit {
+			addFragmentEvent(defrag.monitor, stat.FragmentEventOverLimit)
+			return nil, nil, fmt.Errorf("too many fragments in progress, drop fragment %d from %s", flow.id, flow.src)
+		}
+
+		fragIndicator = newFragIndicator()
+		defrag.ipv4Frags[flow] = fragIndicator
+		addFragmentEvent(defrag.monitor, stat.FragmentEventStarted)
+	}
+
+	layer, err := defrag.defragmenter.DefragIPv4(ind.IPv4Layer())
+	if err != nil {
+		delete(defrag.ipv4Frags, flow)
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("defrag: %w", err)
+	}
+
+	// Record original fragments
+	fragIndicator.append(ind)
+
+	if layer == nil {
+		return nil, nil, nil
+	}
+
+	// Remove completed fragments
+	delete(defrag.ipv4Frags, flow)
+
+	// Serialize
+	data, err := Serialize(layer, gopacket.Payload(layer.Payload))
+	if err != nil {
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	// Fragments are validated as they are parsed
+	indicator, err := ParseEmbPacket(data, ValidationLoose, nil)
+	if err != nil {
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("parse packet: %w", err)
+	}
+
+	addFragmentEvent(defrag.monitor, stat.FragmentEventCompleted)
+
+	return indicator, fragIndicator.frags, nil
+}
+
+func (defrag *StrictDefragmenter) appendIPv6(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	// Discard old fragments
+	if defrag.deadline > 0 {
+		now := time.Now()
+		for flow, fragIndicator := range defrag.ipv6Frags {
+			if now.Sub(fragIndicator.lastSeen) > defrag.deadline {
+				delete(defrag.ipv6Frags, flow)
+				addFragmentEvent(defrag.monitor, stat.FragmentEventExpired)
+			}
+		}
+	}
+
+	flow := fragFlow{
+		id:  ind.NetworkId(),
+		src: ind.SrcIP().String(),
+	}
+
+	fragIndicator, ok := defrag.ipv6Frags[flow]
+	if !ok {
+		if len(defrag.ipv6Frags) >= defrag.limit {
+			addFragmentEvent(defrag.monitor, stat.FragmentEventOverLimit)
+			return nil, nil, fmt.Errorf("too many fragments in progress, drop fragment %d from %s", flow.id, flow.src)
+		}
+
+		fragIndicator = newFragIndicator()
+		defrag.ipv6Frags[flow] = fragIndicator
+		addFragmentEvent(defrag.monitor, stat.FragmentEventStarted)
+	}
+
+	// Fragments except the last one must be in multiples of 8 Bytes (RFC 8200)
+	if ind.MoreFragments() && len(ind.NetworkPayload())%8 != 0 {
+		delete(defrag.ipv6Frags, flow)
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("fragment %d from %s not aligned", flow.id, flow.src)
+	}
+
+	// Drop the whole datagram if any fragments overlap (RFC 5722)
+	if fragIndicator.overlaps(ind) {
+		delete(defrag.ipv6Frags, flow)
+		addFragmentEvent(defrag.monitor, stat.FragmentEventOverlapped)
+		return nil, nil, fmt.Errorf("fragment %d from %s overlapped", flow.id, flow.src)
+	}
+
+	fragIndicator.append(ind)
+
+	if !fragIndicator.isCompleted() {
+		return nil, nil, nil
+	}
+
+	// Remove completed fragments
+	delete(defrag.ipv6Frags, flow)
+
+	// Concatenate fragments
+	indicator, err := fragIndicator.concatenate()
+	if err != nil {
+		addFragmentEvent(defrag.monitor, stat.FragmentEventInvalid)
+		return nil, nil, fmt.Errorf("concatenate: %w", err)
+	}
+
+	addFragmentEvent(defrag.monitor, stat.FragmentEventCompleted)
+
+	return indicator, fragIndicator.frags, nil
+}
+
+func (defrag *StrictDefragmenter) SetDeadline(t time.Duration) {
+	defrag.deadline = t
+}
+
+func (defrag *StrictDefragmenter) SetLimit(n int) {
+	defrag.limit = n
+}
+
+func (defrag *StrictDefragmenter) SetMonitor(monitor *stat.FragmentMonitor) {
+	defrag.monitor = monitor
+}
+
+// CreateFragmentPackets creates fragments by given layers and fragment size.
+func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopacket.Layer, fragment int) ([][]byte, error) {
+	var (
+		err                 error
+		networkLayerData    []byte
+		networkLayerPayload []byte
+		fragments           [][]byte
+	)
+
+	// Serialize intermediate headers
+	networkLayerData, err = Serialize(networkLayer.(gopacket.SerializableLayer))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+	if transportLayer == nil {
+		networkLayerPayload, err = Serialize(networkLayer.(gopacket.SerializableLayer),
+			payload.(gopacket.SerializableLayer))
+	} else {
+		networkLayerPayload, err = Serialize(networkLayer.(gopacket.SerializableLayer),
+			transportLayer.(gopacket.SerializableLayer),
+			payload.(gopacket.SerializableLayer))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+	networkLayerPayload = networkLayerPayload[len(networkLayerData):]
+
+	fragments = make([][]byte, 0)
+
+	// Fragment
+	if len(networkLayerData)+len(networkLayerPayload) > fragment {
+		fragmenter, err := FindFragmenter(networkLayer.LayerType())
+		if err != nil {
+			return nil, err
+		}
+
+		// Create headers of fragments
+		headers, headerSize, err := fragmenter.Fragment(networkLayer.(gopacket.NetworkLayer))
+		if err != nil {
+			return nil, fmt.Errorf("fragment: %w", err)
+		}
+
+		// Create fragments
+		for i := 0; i < len(networkLayerPayload); {
+			var (
+				err  error
+				data []byte
+			)
+			length := min(fragment-headerSize, len(networkLayerPayload)-i)
+			remain := len(networkLayerPayload) - i - length
+
+			// Align
+			if remain > 0 {
+				length = length / 8 * 8
+				remain = len(networkLayerPayload) - i - length
+			}
+
+			// Leave at least 8 Bytes for last fragment
+			if remain > 0 && remain < 8 {
+				length = length - 8
+				remain = len(networkLayerPayload) - i - length
+			}
+
+			fragmenter.Flag(headers, remain > 0, uint16(i/8))
+
+			// Serialize layers
+			ls := make([]gopacket.SerializableLayer, 0)
+			if linkLayer != nil {
+				ls = append(ls, linkLayer.(gopacket.SerializableLayer))
+			}
+			ls = append(ls, headers...)
+			ls = append(ls, gopacket.Payload(networkLayerPayload[i:i+length]))
+
+			data, err = Serialize(ls...)
+			if err != nil {
+				return nil, fmt.Errorf("serialize: %w", err)
+			}
+
+			fragments = append(fragments, data)
+
+			i = i + length
+		}
+	} else {
+		var (
+			err  error
+			data []byte
+		)
+
+		// Serialize layers
+		if linkLayer == nil {
+			data, err = Serialize(networkLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(networkLayerPayload))
+		} else {
+			data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
+				networkLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(networkLayerPayload))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("serialize: %w", err)
+		}
+
+		fragments = append(fragments, data)
+	}
+
+	return fragments, nil
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sync"
+)
+
+// Fragmenter is a machine fragments and reassembles packets in a network layer.
+type Fragmenter interface {
+	// Fragment returns the headers leading each fragment of a packet in the network layer and the size of them. The
+	// headers are shared by all fragments and should be reflagged by Flag before serializing a fragment.
+	Fragment(networkLayer gopacket.NetworkLayer) ([]gopacket.SerializableLayer, int, error)
+	// Flag reflags the headers of a fragment.
+	Flag(headers []gopacket.SerializableLayer, mf bool, offset uint16)
+	// Reassemble returns the network layer of the packet reassembled from fragments by the first fragment.
+	Reassemble(first *PacketIndicator) (gopacket.NetworkLayer, error)
+}
+
+var (
+	fragmentersLock sync.RWMutex
+	fragmenters     = map[gopacket.LayerType]Fragmenter{
+		layers.LayerTypeIPv4: &IPv4Fragmenter{},
+		layers.LayerTypeIPv6: &IPv6Fragmenter{},
+	}
+)
+
+// RegisterFragmenter registers a fragmenter for a network layer type, an existing one will be replaced.
+func RegisterFragmenter(t gopacket.LayerType, fragmenter Fragmenter) {
+	fragmentersLock.Lock()
+	defer fragmentersLock.Unlock()
+
+	fragmenters[t] = fragmenter
+}
+
+// FindFragmenter returns the fragmenter for a network layer type.
+func FindFragmenter(t gopacket.LayerType) (Fragmenter, error) {
+	fragmentersLock.RLock()
+	defer fragmentersLock.RUnlock()
+
+	fragmenter, ok := fragmenters[t]
+	if !ok {
+		return nil, fmt.Errorf("network layer type %s not support", t)
+	}
+
+	return fragmenter, nil
+}
+
+// IPv4Fragmenter is a machine fragments and reassembles IPv4 packets.
+type IPv4Fragmenter struct{}
+
+func (fragmenter *IPv4Fragmenter) Fragment(networkLayer gopacket.NetworkLayer) ([]gopacket.SerializableLayer, int, error) {
+	ipv4Layer, ok := networkLayer.(*layers.IPv4)
+	if !ok {
+		return nil, 0, fmt.Errorf("type %T not support", networkLayer)
+	}
+
+	temp := *ipv4Layer
+	newIPv4Layer := &temp
+
+	data, err := Serialize(newIPv4Layer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("serialize: %w", err)
+	}
+
+	return []gopacket.SerializableLayer{newIPv4Layer}, len(data), nil
+}
+
+func (fragmenter *IPv4Fragmenter) Flag(headers []gopacket.SerializableLayer, mf bool, offset uint16) {
+	FlagIPv4Layer(headers[0].(*layers.IPv4), false, mf, offset)
+}
+
+func (fragmenter *IPv4Fragmenter) Reassemble(first *PacketIndicator) (gopacket.NetworkLayer, error) {
+	ipv4Layer := first.IPv4Layer()
+	if ipv4Layer == nil {
+		return nil, fmt.Errorf("network layer type %s not support", first.NetworkLayer().LayerType())
+	}
+
+	temp := *ipv4Layer
+	newIPv4Layer := &temp
+
+	FlagIPv4Layer(newIPv4Layer, false, false, 0)
+
+	return newIPv4Layer, nil
+}
+
+// IPv6Fragmenter is a machine fragments and reassembles IPv6 packets.
+type IPv6Fragmenter struct{}
+
+func (fragmenter *IPv6Fragmenter) Fragment(networkLayer gopacket.NetworkLayer) ([]gopacket.SerializableLayer, int, error) {
+	ipv6Layer, ok := networkLayer.(*layers.IPv6)
+	if !ok {
+		return nil, 0, fmt.Errorf("type %T not support", networkLayer)
+	}
+
+	temp := *ipv6Layer
+	newIPv6Layer := &temp
+
+	// Insert the fragment header
+	fragmentLayer := CreateIPv6FragmentLayer(nextIPv6FragmentId(), newIPv6Layer.NextHeader)
+	newIPv6Layer.NextHeader = layers.IPProtocolIPv6Fragment
+
+	data, err := Serialize(newIPv6Layer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("serialize: %w", err)
+	}
+
+	return []gopacket.SerializableLayer{newIPv6Layer, fragmentLayer}, len(data) + IPv6FragmentHeaderSize, nil
+}
+
+func (fragmenter *IPv6Fragmenter) Flag(headers []gopacket.SerializableLayer, mf bool, offset uint16) {
+	FlagIPv6FragmentLayer(headers[1].(*IPv6Fragment), mf, offset)
+}
+
+func (fragmenter *IPv6Fragmenter) Reassemble(first *PacketIndicator) (gopacket.NetworkLayer, error) {
+	ipv6Layer := first.IPv6Layer()
+	if ipv6Layer == nil {
+		return nil, fmt.Errorf("network layer type %s not support", first.NetworkLayer().LayerType())
+	}
+
+	temp := *ipv6Layer
+	newIPv6Layer := &temp
+
+	// Remove the fragment header
+	newIPv6Layer.NextHeader = first.NextHeader()
+	newIPv6Layer.HopByHop = nil
+
+	return newIPv6Layer, nil
+}
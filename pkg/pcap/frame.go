@@ -0,0 +1,161 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+// Frames in typed framing carry a byte of type under the encryption, so control frames are never inferred from the
+// contents of data. Messages in band and segments are frames of their own types. Rekey frames change keys in band, and
+// stats frames carry delivery reports.
+const (
+	frameData      byte = 0x00
+	frameHeartbeat byte = 0x01
+	frameRekey     byte = 0x02
+	frameStats     byte = 0x03
+	frameClose     byte = 0x04
+)
+
+// frameTypeSize is the size of the type of frames in typed framing.
+const frameTypeSize = 1
+
+// errUntyped describes a message in band is written to a peer in untyped framing, where it cannot be told from data.
+var errUntyped = errors.New("untyped framing")
+
+// frameCost returns the size of the type of frames framing data.
+func (c *FakeTCPConn) frameCost() int {
+	if c.isTyped || isFramed(c.version) {
+		return frameTypeSize
+	}
+
+	return 0
+}
+
+// isTypedTo returns if datagrams to and from the client are in typed framing, which is set by WithTyped or implied by
+// the version of the wire format of the client.
+func (c *FakeTCPConn) isTypedTo(client *clientIndicator) bool {
+	return c.isTyped || isFramed(client.version)
+}
+
+// isTypedToAddr returns if datagrams to and from the address are in typed framing.
+func (c *FakeTCPConn) isTypedToAddr(addr net.Addr) bool {
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+
+	return ok && c.isTypedTo(client)
+}
+
+// writeMessage writes the message in band to the address, which is a frame of its own type. Messages are never written
+// to peers in untyped framing.
+func (c *FakeTCPConn) writeMessage(p []byte, addr net.Addr, isChaff bool) (int, error) {
+	if !c.isTypedToAddr(addr) {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    errUntyped,
+		}
+	}
+
+	return c.writeTo(p, addr, isChaff)
+}
+
+// createDataFrame returns the data framed in a data frame.
+func createDataFrame(data []byte) []byte {
+	b := make([]byte, frameTypeSize+len(data))
+
+	b[0] = frameData
+	copy(b[frameTypeSize:], data)
+
+	return b
+}
+
+// handleFrame handles the frame from the address, carried by the packet, and returns the data if it is a data frame.
+func (c *FakeTCPConn) handleFrame(contents []byte, indicator *PacketIndicator, addr net.Addr) ([]byte, error) {
+	if len(contents) < frameTypeSize {
+		return nil, errors.New("empty frame")
+	}
+
+	switch t := contents[0]; {
+	case t == frameData:
+		return contents[frameTypeSize:], nil
+	case t == frameHeartbeat:
+		return nil, nil
+	case t == frameRekey:
+		err := c.handleRekey(contents, addr)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("handle rekey from %s: %w", addr, err))
+		}
+		return nil, nil
+	case t == frameStats:
+		err := c.handleDelivery(contents, addr)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("handle delivery report from %s: %w", addr, err))
+		}
+		return nil, nil
+	case t == frameClose:
+		c.handleClose(addr)
+		return nil, nil
+	case isMessage(contents):
+		err := c.handleMessage(contents, indicator, addr)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("handle message from %s: %w", addr, err))
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("frame type %d not support", t)
+	}
+}
+
+// handleClose forgets the client closing gracefully, or reconnects to the server closing gracefully, but not too often
+// in case the server keeps closing.
+func (c *FakeTCPConn) handleClose(addr net.Addr) {
+	if c.dstAddr == nil {
+		c.clientsLock.Lock()
+		delete(c.clients, addr.String())
+		c.clientsLock.Unlock()
+
+		log.Infof("Client %s closed\n", addr)
+		return
+	}
+
+	log.Infof("Server %s closed\n", addr)
+
+	if time.Now().Sub(c.lastReconnect) >= c.timeout {
+		err := c.Reconnect()
+		if err != nil {
+			log.Errorln(fmt.Errorf("reconnect: %w", err))
+		}
+	}
+}
+
+// sendClose sends close frames to all peers in typed framing, so they close gracefully rather than waiting for a
+// timeout.
+func (c *FakeTCPConn) sendClose() {
+	addrs := make([]string, 0)
+	c.clientsLock.RLock()
+	for a, client := range c.clients {
+		if c.isTypedTo(client) {
+			addrs = append(addrs, a)
+		}
+	}
+	c.clientsLock.RUnlock()
+
+	for _, a := range addrs {
+		addr, err := net.ResolveTCPAddr("tcp", a)
+		if err != nil {
+			continue
+		}
+
+		// Close frames are not counted as writes
+		_, err = c.writeTo([]byte{frameClose}, addr, true)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("send close to %s: %w", addr, err))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ClientState describes the state of a client connected to a FakeTCP listener, which can be restored in another
+// process so the client keeps connected across restarts. States of connections dialed describe the clients themselves,
+// which can be resumed by ResumeFakeTCP.
+type ClientState struct {
+	// Dev is the alias of the device the client is connected in.
+	Dev string `json:"device"`
+	// Addr is the address of the client, or of the server in states of connections dialed.
+	Addr string `json:"addr"`
+	// Port is the port the client connects to, which is the local port of the connection.
+	Port    uint16 `json:"port"`
+	Seq     uint32 `json:"seq"`
+	Ack     uint32 `json:"ack"`
+	Id      uint16 `json:"id"`
+	Session uint64 `json:"session"`
+	User    string `json:"user"`
+	// Version is the version of the wire format of the client, states without it are of WireVersion1.
+	Version int `json:"version"`
+}
+
+// State returns the state of the remote client of the connection accepted, or of the connection itself if it is dialed.
+// Connections accepted should be closed first so the state is not changed afterwards.
+func (c *FakeTCPConn) State() (*ClientState, error) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("client %s unrecognized", c.RemoteAddr())
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Connections dialed announce their own sessions
+	session := client.session
+	if session == 0 {
+		session = c.session
+	}
+
+	return &ClientState{
+		Dev:     c.conn.LocalDev().Alias(),
+		Addr:    c.RemoteAddr().String(),
+		Port:    c.srcPort,
+		Seq:     client.seq,
+		Ack:     client.ack,
+		Id:      client.id,
+		Session: session,
+		User:    client.user,
+		Version: client.version,
+	}, nil
+}
+
+// Restore returns the connection to the client in the state without handshaking, as if it is accepted by the
+// listener.
+func (l *FakeTCPListener) Restore(state *ClientState) (*FakeTCPConn, error) {
+	addr, err := net.ResolveTCPAddr("tcp4", state.Addr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "restore",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Err:    fmt.Errorf("parse address %s: %w", state.Addr, err),
+		}
+	}
+
+	var conn *FakeTCPConn
+	err = func() error {
+		if state.Dev != l.Dev().Alias() {
+			return fmt.Errorf("device %s mismatch", state.Dev)
+		}
+
+		// Clients of users are restored with crypts of their users
+		crypt := l.options.crypt
+		if state.User != "" {
+			if l.options.users == nil {
+				return fmt.Errorf("user %s not support", state.User)
+			}
+
+			var ok bool
+			crypt, ok = l.options.users.find(state.User)
+			if !ok {
+				return fmt.Errorf("%w %s", errUnknownUser, state.User)
+			}
+		} else if l.options.users != nil {
+			return errors.New("missing user")
+		}
+
+		// States before versioning are of the first version
+		version := state.Version
+		if version == 0 {
+			version = WireVersion1
+		}
+		err := checkWireVersion(version)
+		if err != nil {
+			return err
+		}
+
+		conn, err = l.dialClient(addr, state.Port, &clientIndicator{
+			crypt:     crypt,
+			version:   version,
+			seq:       state.Seq,
+			ack:       state.Ack,
+			id:        state.Id,
+			lastWrite: time.Now(),
+			probes:    newLossMeter(),
+			seen:      newSeqWindow(),
+			session:   state.Session,
+			user:      state.User,
+		})
+		if err != nil {
+			return fmt.Errorf("dial: %w", err)
+		}
+
+		l.options.admission.Admit(addr)
+
+		// Map client
+		l.clientsLock.Lock()
+		l.clients[addr.String()] = conn
+		l.clientsLock.Unlock()
+
+		return nil
+	}()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "restore",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   addr,
+			Err:    err,
+		}
+	}
+
+	return conn, nil
+}
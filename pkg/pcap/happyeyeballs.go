@@ -0,0 +1,88 @@
+package pcap
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// HappyEyeballsDelay is the head start given to an attempt before the next one is made in dual-stack dialing.
+const HappyEyeballsDelay = 300 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// DialHappyEyeballs dials addresses in order by the dial function, starting the next attempt once the previous one
+// fails or does not complete within the delay, and returns the first connection which completes the handshake.
+// Connections completing later will be closed.
+func DialHappyEyeballs(dstAddrs []*net.TCPAddr, delay time.Duration, dial func(dstAddr *net.TCPAddr) (net.Conn, error)) (net.Conn, error) {
+	if len(dstAddrs) <= 0 {
+		return nil, errors.New("missing address")
+	}
+	if len(dstAddrs) == 1 {
+		return dial(dstAddrs[0])
+	}
+
+	results := make(chan dialResult, len(dstAddrs))
+	next := 0
+	pending := 0
+
+	start := func() {
+		dstAddr := dstAddrs[next]
+		next++
+		pending++
+
+		go func() {
+			conn, err := dial(dstAddr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	start()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+
+			if result.err == nil {
+				// Close connections completing later
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						result := <-results
+						if result.err == nil {
+							_ = result.conn.Close()
+						}
+					}
+				}(pending)
+
+				return result.conn, nil
+			}
+
+			lastErr = result.err
+
+			// Start the next attempt immediately
+			if next < len(dstAddrs) {
+				start()
+
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(dstAddrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,127 @@
+package pcap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HopSchedule is a schedule of ports the client and the server hop together. Time is divided into slots of the
+// interval, and the port of each slot is derived from the key, so peers sharing the key agree on the port without
+// negotiation, and observers without the key cannot predict it.
+type HopSchedule struct {
+	key      []byte
+	min      uint16
+	max      uint16
+	interval time.Duration
+}
+
+// NewHopSchedule returns a new schedule hopping among ports from min to max every interval.
+func NewHopSchedule(key []byte, min, max uint16, interval time.Duration) (*HopSchedule, error) {
+	if len(key) <= 0 {
+		return nil, errors.New("missing key")
+	}
+	if min == 0 || min > max {
+		return nil, fmt.Errorf("ports %d-%d out of range", min, max)
+	}
+	if interval < time.Second {
+		return nil, fmt.Errorf("interval %s out of range", interval)
+	}
+
+	// Keys of hopping are separated from keys of encryption
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("ikago port hopping"))
+
+	return &HopSchedule{
+		key:      mac.Sum(nil),
+		min:      min,
+		max:      max,
+		interval: interval,
+	}, nil
+}
+
+// ParsePortRange returns the first and the last port of the range in the format of min-max.
+func ParsePortRange(s string) (uint16, uint16, error) {
+	strs := strings.Split(s, "-")
+	if len(strs) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %s", s)
+	}
+
+	min, err := strconv.ParseUint(strings.TrimSpace(strs[0]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse min: %w", err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(strs[1]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse max: %w", err)
+	}
+	if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("invalid range %s", s)
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+// Interval returns the interval of hopping.
+func (s *HopSchedule) Interval() time.Duration {
+	return s.interval
+}
+
+// Range returns the first and the last port hopped among.
+func (s *HopSchedule) Range() (uint16, uint16) {
+	return s.min, s.max
+}
+
+func (s *HopSchedule) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(s.interval)
+}
+
+func (s *HopSchedule) port(slot int64) uint16 {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(slot))
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(b)
+	sum := mac.Sum(nil)
+
+	return s.min + uint16(binary.BigEndian.Uint32(sum[:4])%(uint32(s.max-s.min)+1))
+}
+
+// Port returns the port of the slot at the time.
+func (s *HopSchedule) Port(t time.Time) uint16 {
+	return s.port(s.slot(t))
+}
+
+// Ports returns ports of the previous, the current and the next slot at the time, which are listened by the server,
+// so clients with clocks skewed within an interval, or hopping at the boundary, can still connect.
+func (s *HopSchedule) Ports(t time.Time) []uint16 {
+	slot := s.slot(t)
+
+	ports := make([]uint16, 0, 3)
+	for i := slot - 1; i <= slot+1; i++ {
+		port := s.port(i)
+
+		isDuplicate := false
+		for _, p := range ports {
+			if p == port {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate {
+			ports = append(ports, port)
+		}
+	}
+
+	return ports
+}
+
+// Next returns the time the next slot after the time starts.
+func (s *HopSchedule) Next(t time.Time) time.Time {
+	return time.Unix(0, (s.slot(t)+1)*int64(s.interval))
+}
@@ -5,7 +5,7 @@
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"ikago/internal/addr"
+	"ikago/pkg/addr"
 	"net"
 )
 
@@ -311,3 +311,107 @@ func (indicator *ICMPv4Indicator) EmbDst() net.Addr {
 		}
 	}
 }
+
+// CreateFragNeededPacket returns an ICMPv4 fragmentation needed packet sent from the conn in reply to the given packet
+// which cannot pass through with the next-hop MTU.
+func CreateFragNeededPacket(conn *RawConn, dstHardwareAddr net.HardwareAddr, indicator *PacketIndicator, mtu int) ([]byte, error) {
+	var (
+		err           error
+		linkLayerType gopacket.LayerType
+		linkLayer     gopacket.SerializableLayer
+	)
+
+	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeIPv4 {
+		return nil, fmt.Errorf("network layer type %s not support", t)
+	}
+	if mtu < 68 || mtu > 65535 {
+		return nil, fmt.Errorf("mtu %d out of range", mtu)
+	}
+
+	// Create transport layer with the IPv4 header and 8 bytes content of the original packet
+	payload := make([]byte, 0)
+	payload = append(payload, indicator.NetworkLayer().LayerContents()...)
+	payload = append(payload, indicator.NetworkPayload()[:min(8, len(indicator.NetworkPayload()))]...)
+
+	icmpv4Layer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		// Unused: 0,
+		// Next-hop MTU
+		Seq: uint16(mtu),
+	}
+
+	// Create network layer
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       randUint16(),
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    conn.LocalDev().IPAddr().IP,
+		DstIP:    indicator.SrcIP(),
+	}
+
+	// Decide Loopback or Ethernet
+	if conn.IsLoop() {
+		linkLayerType = layers.LayerTypeLoopback
+	} else {
+		linkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create link layer
+	switch linkLayerType {
+	case layers.LayerTypeLoopback:
+		linkLayer = CreateLoopbackLayer()
+	case layers.LayerTypeEthernet:
+		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, ipv4Layer)
+	default:
+		return nil, fmt.Errorf("link layer type %s not support", linkLayerType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, ipv4Layer, icmpv4Layer, gopacket.Payload(payload))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
+
+// CreateTimeExceededPacket returns an embedded ICMPv4 time exceeded packet sent from the IP in reply to the given packet
+// whose TTL expires in transit.
+func CreateTimeExceededPacket(srcIP net.IP, indicator *PacketIndicator) ([]byte, error) {
+	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeIPv4 {
+		return nil, fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Create transport layer with the IPv4 header and 8 bytes content of the original packet
+	payload := make([]byte, 0)
+	payload = append(payload, indicator.NetworkLayer().LayerContents()...)
+	payload = append(payload, indicator.NetworkPayload()[:min(8, len(indicator.NetworkPayload()))]...)
+
+	icmpv4Layer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+	}
+
+	// Create network layer
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       randUint16(),
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    srcIP,
+		DstIP:    indicator.SrcIP(),
+	}
+
+	// Serialize layers
+	data, err := Serialize(ipv4Layer, icmpv4Layer, gopacket.Payload(payload))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
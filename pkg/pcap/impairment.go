@@ -0,0 +1,235 @@
+package pcap
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type impairedWrite struct {
+	due   time.Time
+	seq   uint64
+	write func() error
+}
+
+// impairedQueue is a queue of delayed writes in the order they are due, writes due at the same time are in the order
+// they are impaired.
+type impairedQueue []*impairedWrite
+
+func (q impairedQueue) Len() int {
+	return len(q)
+}
+
+func (q impairedQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+
+	return q[i].due.Before(q[j].due)
+}
+
+func (q impairedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *impairedQueue) Push(x interface{}) {
+	*q = append(*q, x.(*impairedWrite))
+}
+
+func (q *impairedQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+
+	return w
+}
+
+// Impairment simulates an impaired network in the manner of netem, packets are lost, delayed, duplicated and
+// reordered randomly before they are written, so settings of KCP and FEC can be validated and bugs of lossy networks can
+// be reproduced without tc. Each packet, or each fragment, is impaired independently.
+type Impairment struct {
+	lock      sync.Mutex
+	loss      float64
+	delay     time.Duration
+	jitter    time.Duration
+	duplicate float64
+	reorder   float64
+	rand      *rand.Rand
+	seq       uint64
+	queue     impairedQueue
+	wake      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	isClosed  bool
+}
+
+// NewImpairment returns a new impairment with the config.
+func NewImpairment(config *config.ImpairmentConfig) (*Impairment, error) {
+	if config.Loss < 0 || config.Loss > 100 {
+		return nil, fmt.Errorf("loss %g out of range", config.Loss)
+	}
+	if config.Delay < 0 {
+		return nil, fmt.Errorf("delay %d out of range", config.Delay)
+	}
+	if config.Jitter < 0 {
+		return nil, fmt.Errorf("jitter %d out of range", config.Jitter)
+	}
+	if config.Duplicate < 0 || config.Duplicate > 100 {
+		return nil, fmt.Errorf("duplicate %g out of range", config.Duplicate)
+	}
+	if config.Reorder < 0 || config.Reorder > 100 {
+		return nil, fmt.Errorf("reorder %g out of range", config.Reorder)
+	}
+	// Packets are reordered by skipping the delay
+	if config.Reorder > 0 && config.Delay <= 0 {
+		return nil, errors.New("reorder requires delay")
+	}
+
+	impairment := &Impairment{
+		loss:      config.Loss / 100,
+		delay:     time.Duration(config.Delay) * time.Millisecond,
+		jitter:    time.Duration(config.Jitter) * time.Millisecond,
+		duplicate: config.Duplicate / 100,
+		reorder:   config.Reorder / 100,
+		rand:      rand.New(rand.NewSource(int64(randUint32()))),
+		queue:     make(impairedQueue, 0),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	impairment.wg.Add(1)
+	go func() {
+		defer impairment.wg.Done()
+		impairment.run()
+	}()
+
+	return impairment, nil
+}
+
+// Impair performs the write impaired. Writes not delayed are performed immediately and their errors are returned,
+// errors of writes delayed are logged.
+func (impairment *Impairment) Impair(write func() error) error {
+	impairment.lock.Lock()
+
+	// Writes after the impairment is closed are lost as the link is gone
+	if impairment.isClosed || impairment.rand.Float64() < impairment.loss {
+		impairment.lock.Unlock()
+		return nil
+	}
+
+	n := 1
+	if impairment.rand.Float64() < impairment.duplicate {
+		n = 2
+	}
+
+	immediate := 0
+	for i := 0; i < n; i++ {
+		delay := impairment.delay
+		if impairment.jitter > 0 {
+			delay = delay - impairment.jitter + time.Duration(impairment.rand.Int63n(2*int64(impairment.jitter)+1))
+		}
+		// Reordered packets jump ahead of those delayed
+		if impairment.reorder > 0 && impairment.rand.Float64() < impairment.reorder {
+			delay = 0
+		}
+
+		if delay <= 0 {
+			immediate++
+			continue
+		}
+
+		impairment.seq++
+		heap.Push(&impairment.queue, &impairedWrite{
+			due:   time.Now().Add(delay),
+			seq:   impairment.seq,
+			write: write,
+		})
+	}
+	impairment.lock.Unlock()
+
+	if immediate < n {
+		select {
+		case impairment.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	for i := 0; i < immediate; i++ {
+		err := write()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the impairment, writes delayed are lost.
+func (impairment *Impairment) Close() error {
+	impairment.lock.Lock()
+	if impairment.isClosed {
+		impairment.lock.Unlock()
+		return nil
+	}
+	impairment.isClosed = true
+	impairment.queue = make(impairedQueue, 0)
+	close(impairment.done)
+	impairment.lock.Unlock()
+
+	impairment.wg.Wait()
+
+	return nil
+}
+
+func (impairment *Impairment) run() {
+	for {
+		// Writes due
+		batch := make([]func() error, 0)
+		wait := time.Duration(-1)
+
+		impairment.lock.Lock()
+		now := time.Now()
+		for len(impairment.queue) > 0 {
+			if impairment.queue[0].due.After(now) {
+				wait = impairment.queue[0].due.Sub(now)
+				break
+			}
+			batch = append(batch, heap.Pop(&impairment.queue).(*impairedWrite).write)
+		}
+		impairment.lock.Unlock()
+
+		for _, write := range batch {
+			err := write()
+			if err != nil {
+				log.Verboseln(fmt.Errorf("write impaired: %w", err))
+			}
+		}
+
+		// Wait for the next write due or new writes
+		if wait < 0 {
+			select {
+			case <-impairment.done:
+				return
+			case <-impairment.wake:
+			}
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-impairment.done:
+			timer.Stop()
+			return
+		case <-impairment.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync/atomic"
+)
+
+// IPv6FragmentHeaderSize is the size of the IPv6 fragment extension header.
+const IPv6FragmentHeaderSize = 8
+
+var ipv6FragmentId = randUint32()
+
+// IPv6Fragment is an IPv6 fragment extension header which can also be serialized.
+type IPv6Fragment struct {
+	layers.IPv6Fragment
+}
+
+// SerializeTo writes the serialized form of this layer into the serialization buffer.
+func (layer *IPv6Fragment) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(IPv6FragmentHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	bytes[0] = uint8(layer.NextHeader)
+	bytes[1] = layer.Reserved1
+	binary.BigEndian.PutUint16(bytes[2:], layer.FragmentOffset<<3|uint16(layer.Reserved2&0x3)<<1)
+	if layer.MoreFragments {
+		bytes[3] = bytes[3] | 0x1
+	}
+	binary.BigEndian.PutUint32(bytes[4:], layer.Identification)
+
+	return nil
+}
+
+// CreateIPv6Layer returns an IPv6 layer.
+func CreateIPv6Layer(srcIP, dstIP net.IP, hop uint8, transportLayer gopacket.TransportLayer) (*layers.IPv6, error) {
+	ipv6Layer := &layers.IPv6{
+		Version: 6,
+		// Length: 0,
+		// NextHeader: 0,
+		HopLimit: hop,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+
+	// Protocol
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		ipv6Layer.NextHeader = layers.IPProtocolTCP
+
+		// Checksum of transport layer
+		tcpLayer := transportLayer.(*layers.TCP)
+		err := tcpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeUDP:
+		ipv6Layer.NextHeader = layers.IPProtocolUDP
+
+		// Checksum of transport layer
+		udpLayer := transportLayer.(*layers.UDP)
+		err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return ipv6Layer, nil
+}
+
+// CreateIPv6FragmentLayer returns an IPv6 fragment layer.
+func CreateIPv6FragmentLayer(id uint32, nextHeader layers.IPProtocol) *IPv6Fragment {
+	return &IPv6Fragment{
+		IPv6Fragment: layers.IPv6Fragment{
+			NextHeader:     nextHeader,
+			Identification: id,
+		},
+	}
+}
+
+// FlagIPv6FragmentLayer reflags flags in an IPv6 fragment layer.
+func FlagIPv6FragmentLayer(layer *IPv6Fragment, mf bool, offset uint16) {
+	layer.MoreFragments = mf
+	layer.FragmentOffset = offset
+}
+
+func nextIPv6FragmentId() uint32 {
+	return atomic.AddUint32(&ipv6FragmentId, 1)
+}
@@ -0,0 +1,168 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/pkg/crypto"
+	"sync"
+	"time"
+)
+
+var errUnknownKey = errors.New("unknown key")
+
+// Key describes a key of the server in rotation, which is identified by the ID, e.g. its password, and retires at the
+// time unless it is zero.
+type Key struct {
+	ID     string
+	Crypt  crypto.Crypt
+	Retire time.Time
+}
+
+type keyIndicator struct {
+	id       string
+	crypt    crypto.Crypt
+	verifier *crypto.ProofVerifier
+	retire   time.Time
+}
+
+// Keyring identifies clients by proofs created by any key of the server not retired, and each client keeps the crypt of
+// the key it handshakes in, so keys are rotated without dropping sessions. Clients without a valid proof of any key are
+// in the current key unless listeners are in stealth mode.
+type Keyring struct {
+	lock sync.RWMutex
+	keys []*keyIndicator
+}
+
+// NewKeyring returns a new keyring of keys, the first of which is the current key.
+func NewKeyring(keys []*Key) (*Keyring, error) {
+	keyring := &Keyring{}
+
+	err := keyring.Set(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// Set sets keys of the keyring, the first of which is the current key. Keys of IDs in the keyring keep their crypts, so
+// clients in them are kept. Only crypt in AEAD is supported, because proofs created by other crypt can be forged.
+func (keyring *Keyring) Set(keys []*Key) error {
+	if len(keys) <= 0 {
+		return errors.New("missing key")
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	indicators := make([]*keyIndicator, 0, len(keys))
+	for _, key := range keys {
+		var indicator *keyIndicator
+		for _, k := range keyring.keys {
+			if k.id == key.ID {
+				indicator = &keyIndicator{id: k.id, crypt: k.crypt, verifier: k.verifier, retire: key.Retire}
+				break
+			}
+		}
+		if indicator == nil {
+			verifier, err := crypto.NewProofVerifier(key.Crypt)
+			if err != nil {
+				return fmt.Errorf("create proof verifier: %w", err)
+			}
+			indicator = &keyIndicator{id: key.ID, crypt: key.Crypt, verifier: verifier, retire: key.Retire}
+		}
+		indicators = append(indicators, indicator)
+	}
+	keyring.keys = indicators
+
+	return nil
+}
+
+// Current returns the crypt of the current key.
+func (keyring *Keyring) Current() crypto.Crypt {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	return keyring.keys[0].crypt
+}
+
+// Retire returns the time the key of the crypt retires, and false if it never retires. Crypts of keys removed are
+// retired already.
+func (keyring *Keyring) Retire(crypt crypto.Crypt) (time.Time, bool) {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	for _, key := range keyring.keys {
+		if key.crypt == crypt {
+			return key.retire, !key.retire.IsZero()
+		}
+	}
+
+	return time.Time{}, true
+}
+
+// identify returns the crypt of the key not retired whose proof it is, which is also accepted in the window shifted by
+// the skew. Proofs of a key expired or replayed are not tried against others.
+func (keyring *Keyring) identify(proof []byte, skew time.Duration) (crypto.Crypt, error) {
+	if len(proof) <= 0 {
+		return nil, errMissingProof
+	}
+
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	now := time.Now()
+	for _, key := range keyring.keys {
+		if !key.retire.IsZero() && !now.Before(key.retire) {
+			continue
+		}
+
+		err := key.verifier.VerifySkewed(proof, skew)
+		if err == nil {
+			return key.crypt, nil
+		}
+		if errors.Is(err, crypto.ErrProofExpired) || errors.Is(err, crypto.ErrProofReplayed) {
+			return nil, err
+		}
+	}
+
+	return nil, errUnknownKey
+}
+
+// identifyKey identifies the key of the proof carried in the TCP SYN. Clients of no key are in the current key unless
+// isStealth is set, where sources failing repeatedly are backed off in the same way as verifySYN.
+func identifyKey(keyring *Keyring, isStealth bool, indicator *PacketIndicator, proof []byte, skew time.Duration) (crypto.Crypt, error) {
+	if isStealth && isBackingOff(indicator.SrcIP()) {
+		return nil, errBackingOff
+	}
+
+	crypt, err := keyring.identify(proof, skew)
+	if err != nil {
+		if !isStealth {
+			return keyring.Current(), nil
+		}
+		failHandshake(indicator.SrcIP())
+		return nil, err
+	}
+
+	if isStealth {
+		succeedHandshake(indicator.SrcIP())
+	}
+
+	return crypt, nil
+}
+
+// Crypt returns the crypt of the remote client, which is of the key it handshakes in.
+func (c *FakeTCPConn) Crypt() (crypto.Crypt, bool) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return client.baseCrypt(), true
+}
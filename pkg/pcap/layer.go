@@ -1,12 +1,36 @@
 package pcap
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
+	"time"
 )
 
+const (
+	// ipv4HeaderSize is the size of IPv4 headers without options.
+	ipv4HeaderSize = 20
+	// ipv6HeaderSize is the size of IPv6 headers without extension headers.
+	ipv6HeaderSize = 40
+	// tcpHeaderSize is the size of TCP headers without options.
+	tcpHeaderSize = 20
+)
+
+// headerSize returns the size of the IP header and the TCP header of packets to the IP, which are of the network layer
+// CreateLayers creates. Fragments of IPv6 carry the fragment extension header as well, which is counted by the
+// fragmenter.
+func headerSize(dstIP net.IP) int {
+	if dstIP.To4() == nil {
+		return ipv6HeaderSize + tcpHeaderSize
+	}
+
+	return ipv4HeaderSize + tcpHeaderSize
+}
+
 // CreateTCPLayer returns a TCP layer.
 func CreateTCPLayer(srcPort, dstPort uint16, seq, ack uint32) *layers.TCP {
 	return &layers.TCP{
@@ -95,9 +119,9 @@ func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 	layer.FragOffset = offset
 }
 
-// CreateLoopbackLayer returns a loopback layer.
+// CreateLoopbackLayer returns a loopback layer of IPv4, whose family is required by the Npcap loopback adapter.
 func CreateLoopbackLayer() *layers.Loopback {
-	return &layers.Loopback{}
+	return &layers.Loopback{Family: layers.ProtocolFamilyIPv4}
 }
 
 // CreateEthernetLayer returns an Ethernet layer.
@@ -112,6 +136,8 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		ethernetLayer.EthernetType = layers.EthernetTypeIPv6
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -148,7 +174,7 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 }
 
 // CreateLayers return layers of transmission between client and server.
-func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
+func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, ttl uint8,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
 	var (
 		linkLayerType gopacket.LayerType
@@ -157,8 +183,21 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	// Create transport layer
 	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
 
-	// Create new network layer
-	networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
+	// Create new network layer in the family of the destination
+	if dstIP.To4() == nil {
+		srcIP := ipv6AddrOf(conn.LocalDev())
+		if srcIP == nil {
+			return nil, nil, nil, fmt.Errorf("device %s without ipv6 address", conn.LocalDev().Alias())
+		}
+		if conn.IsLoop() {
+			return nil, nil, nil, errors.New("ipv6 not support in loopback headers")
+		}
+
+		networkLayer, err = CreateIPv6Layer(srcIP, dstIP, ttl, transportLayer.(gopacket.TransportLayer))
+	} else {
+		networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, ttl,
+			transportLayer.(gopacket.TransportLayer))
+	}
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
@@ -185,3 +224,50 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 
 	return transportLayer, networkLayer, linkLayer, nil
 }
+
+// ipv6AddrOf returns the first IPv6 address of the device, or nil if the device does not have any.
+func ipv6AddrOf(dev *Device) net.IP {
+	for _, ipnet := range dev.IPAddrs() {
+		if ipnet.IP.To4() == nil {
+			return ipnet.IP
+		}
+	}
+
+	return nil
+}
+
+// randUint16 returns a random uint16, used as the initial IPv4 identification which is not predictable.
+func randUint16() uint16 {
+	b := make([]byte, 2)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint16(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+// randUint32 returns a random uint32, used as the initial IPv6 fragment identification which is not predictable.
+func randUint32() uint32 {
+	b := make([]byte, 4)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// randUint64 returns a random uint64, used as sessions which are not predictable.
+func randUint64() uint64 {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
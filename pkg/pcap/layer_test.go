@@ -0,0 +1,57 @@
+package pcap
+
+import (
+	"ikago/pkg/crypto"
+	"net"
+	"testing"
+)
+
+func TestHeaderSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   net.IP
+		dst   net.IP
+		size  int
+		isErr bool
+	}{
+		{name: "ipv4", src: testSrcIPv4, dst: testDstIPv4, size: 40},
+		{name: "ipv6", src: testSrcIPv6, dst: testDstIPv6, size: 60},
+		{name: "ipv6 from ipv4", src: testSrcIPv4, dst: testDstIPv6, isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDev, dstDev, err := NewMemoryDevs(tt.src, tt.dst)
+			if err != nil {
+				t.Fatalf("create devices: %v", err)
+			}
+			conn, err := CreateRawConn(srcDev, dstDev, "tcp")
+			if err != nil {
+				t.Fatalf("create raw connection: %v", err)
+			}
+			defer conn.Close()
+
+			transportLayer, networkLayer, _, err := CreateLayers(1, 2, 0, 0, conn, tt.dst, 0, 64, testDstMAC)
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("create layers: want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("create layers: %v", err)
+			}
+
+			// Headers in the wire are of the size counted
+			b := mustSerialize(t, networkLayer, transportLayer)
+			if len(b) != tt.size || headerSize(tt.dst) != tt.size {
+				t.Errorf("header size = %d in wire, %d counted, want %d", len(b), headerSize(tt.dst), tt.size)
+			}
+
+			c := &FakeTCPConn{mtu: MaxMTU, crypt: crypto.CreatePlainCrypt(), dstAddr: &net.TCPAddr{IP: tt.dst}}
+			if got, want := c.MaxPayload(), MaxMTU-tt.size-c.frameCost(); got != want {
+				t.Errorf("max payload = %d, want %d", got, want)
+			}
+		})
+	}
+}
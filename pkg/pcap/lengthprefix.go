@@ -0,0 +1,103 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// lengthPrefixSize is the size of the length prefixed to each datagram in length-prefixed framing.
+const lengthPrefixSize = 2
+
+// prefixLength returns the datagram prefixed with its length.
+func prefixLength(b []byte) []byte {
+	result := make([]byte, lengthPrefixSize+len(b))
+
+	binary.BigEndian.PutUint16(result[:lengthPrefixSize], uint16(len(b)))
+	copy(result[lengthPrefixSize:], b)
+
+	return result
+}
+
+// datagramStream recovers datagrams prefixed with lengths from payloads of a peer, which may be coalesced or
+// segmented again by middleboxes proxying TCP.
+type datagramStream struct {
+	buffer    []byte
+	next      uint32
+	isStarted bool
+}
+
+func newDatagramStream() *datagramStream {
+	return &datagramStream{}
+}
+
+// push appends the payload in the sequence to the stream and returns datagrams completed. Datagrams received partially
+// are dropped once a payload is lost or out of order, and the stream starts again from the payload.
+func (s *datagramStream) push(seq uint32, payload []byte) ([][]byte, error) {
+	if !s.isStarted || seq != s.next {
+		s.buffer = nil
+	}
+	s.isStarted = true
+	s.next = seq + uint32(len(payload))
+
+	s.buffer = append(s.buffer, payload...)
+
+	datagrams := make([][]byte, 0, 1)
+	for len(s.buffer) >= lengthPrefixSize {
+		size := int(binary.BigEndian.Uint16(s.buffer[:lengthPrefixSize]))
+		if size <= 0 {
+			s.buffer = nil
+			return datagrams, errors.New("empty datagram")
+		}
+		if len(s.buffer) < lengthPrefixSize+size {
+			break
+		}
+
+		datagram := make([]byte, size)
+		copy(datagram, s.buffer[lengthPrefixSize:lengthPrefixSize+size])
+		datagrams = append(datagrams, datagram)
+
+		s.buffer = s.buffer[lengthPrefixSize+size:]
+	}
+
+	// Never hold the backing array of datagrams consumed
+	if len(s.buffer) <= 0 {
+		s.buffer = nil
+	} else {
+		s.buffer = append(make([]byte, 0, len(s.buffer)), s.buffer...)
+	}
+
+	return datagrams, nil
+}
+
+// pendingDatagram is a datagram recovered but not read yet, because it is coalesced with a datagram read before.
+type pendingDatagram struct {
+	datagram  []byte
+	indicator *PacketIndicator
+	addr      net.Addr
+}
+
+// popDatagram returns the first datagram pending.
+func (c *FakeTCPConn) popDatagram() (*pendingDatagram, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.datagrams) <= 0 {
+		return nil, false
+	}
+
+	d := c.datagrams[0]
+	c.datagrams = c.datagrams[1:]
+
+	return d, true
+}
+
+// pushDatagrams queues datagrams pending.
+func (c *FakeTCPConn) pushDatagrams(datagrams [][]byte, indicator *PacketIndicator, addr net.Addr) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, datagram := range datagrams {
+		c.datagrams = append(c.datagrams, &pendingDatagram{datagram: datagram, indicator: indicator, addr: addr})
+	}
+}
@@ -0,0 +1,150 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryQueueSize is the max count of frames queued in each handle in memory, frames over it are dropped as a NIC.
+const memoryQueueSize = 1024
+
+// memoryPrefix is the prefix of names of devices in memory.
+const memoryPrefix = "memory"
+
+var (
+	memoryLock  sync.RWMutex
+	memoryPeers = make(map[string]string)
+	memoryConns = make(map[string][]*memoryHandle)
+	memoryCount uint32
+)
+
+// memoryHandle is a handle capturing and sending frames in a device in memory.
+type memoryHandle struct {
+	dev    string
+	frames chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewMemoryDevs returns a pair of devices wired to each other in memory with the IP addresses, frames written in one are
+// captured in the other. Devices in memory are always captured in memory regardless of the backend.
+func NewMemoryDevs(ip1, ip2 net.IP) (*Device, *Device, error) {
+	n := atomic.AddUint32(&memoryCount, 1)
+
+	devs := make([]*Device, 0, 2)
+	for i, ip := range []net.IP{ip1, ip2} {
+		hardwareAddr, err := RandomHardwareAddr()
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate hardware address: %w", err)
+		}
+
+		devs = append(devs, &Device{
+			name:         fmt.Sprintf("%s%d.%d", memoryPrefix, n, i),
+			alias:        fmt.Sprintf("Memory %d.%d", n, i),
+			ipAddrs:      []*net.IPNet{{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}},
+			hardwareAddr: hardwareAddr,
+			mtu:          MaxMTU,
+		})
+	}
+
+	memoryLock.Lock()
+	memoryPeers[devs[0].Name()] = devs[1].Name()
+	memoryPeers[devs[1].Name()] = devs[0].Name()
+	memoryLock.Unlock()
+
+	return devs[0], devs[1], nil
+}
+
+// isMemoryDev returns if the device of the name is in memory.
+func isMemoryDev(dev string) bool {
+	memoryLock.RLock()
+	defer memoryLock.RUnlock()
+
+	_, ok := memoryPeers[dev]
+
+	return ok
+}
+
+func openMemory(dev string) (captureHandle, error) {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+
+	if _, ok := memoryPeers[dev]; !ok {
+		return nil, errors.New("device not in memory")
+	}
+
+	handle := &memoryHandle{
+		dev:    dev,
+		frames: make(chan []byte, memoryQueueSize),
+		done:   make(chan struct{}),
+	}
+	memoryConns[dev] = append(memoryConns[dev], handle)
+
+	return handle, nil
+}
+
+func (h *memoryHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case <-h.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	case b := <-h.frames:
+		return b, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(b), Length: len(b)}, nil
+	}
+}
+
+// WritePacketData writes the frame to all handles in the peer device. Frames are not filtered, so each device should
+// be opened once.
+func (h *memoryHandle) WritePacketData(data []byte) error {
+	select {
+	case <-h.done:
+		return ErrClosed
+	default:
+	}
+
+	memoryLock.RLock()
+	defer memoryLock.RUnlock()
+
+	for _, peer := range memoryConns[memoryPeers[h.dev]] {
+		b := make([]byte, len(data))
+		copy(b, data)
+
+		select {
+		case peer.frames <- b:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (h *memoryHandle) SetBPFFilter(filter string) error {
+	return nil
+}
+
+func (h *memoryHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (h *memoryHandle) Close() {
+	h.once.Do(func() {
+		close(h.done)
+
+		memoryLock.Lock()
+		defer memoryLock.Unlock()
+
+		handles := memoryConns[h.dev]
+		for i, handle := range handles {
+			if handle == h {
+				memoryConns[h.dev] = append(handles[:i], handles[i+1:]...)
+				break
+			}
+		}
+	})
+}
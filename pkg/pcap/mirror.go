@@ -0,0 +1,183 @@
+package pcap
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"ikago/internal/log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// mirrorFlushInterval is the interval packets mirrored to a file are flushed.
+const mirrorFlushInterval = time.Second
+
+// Mirror copies packets to a device or a pcap file, sampling 1 in every few packets. Methods of a nil mirror copy
+// nothing.
+type Mirror struct {
+	lock      sync.Mutex
+	sample    int
+	count     int
+	conn      *RawConn
+	file      *os.File
+	buffer    *bufio.Writer
+	writer    *pcapgo.Writer
+	lastFlush time.Time
+}
+
+// CreateMirror creates a mirror to the target, which is a device if a device is named so, or a pcap file otherwise.
+// Every packet is mirrored if the sample is 1. Options of captures apply to the device.
+func CreateMirror(target string, sample int, opts ...Option) (*Mirror, error) {
+	if sample <= 0 {
+		return nil, fmt.Errorf("sample %d out of range", sample)
+	}
+
+	dev, err := findMirrorDev(target)
+	if err == nil {
+		// Nothing is captured in the device
+		conn, err := CreateRawConn(dev, dev, "less 0", opts...)
+		if err != nil {
+			return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
+		}
+
+		return &Mirror{sample: sample, conn: conn}, nil
+	}
+
+	file, err := os.Create(target)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+
+	buffer := bufio.NewWriter(file)
+	writer := pcapgo.NewWriter(buffer)
+	err = writer.WriteFileHeader(IPv4MaxSize, layers.LinkTypeRaw)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write file header: %w", err)
+	}
+
+	return &Mirror{sample: sample, file: file, buffer: buffer, writer: writer, lastFlush: time.Now()}, nil
+}
+
+// findMirrorDev returns the device of the name. Devices mirrored to have no address usually, so they are also found in
+// interfaces of the system.
+func findMirrorDev(name string) (*Device, error) {
+	devs, err := FindAllDevs()
+	if err == nil {
+		for _, dev := range devs {
+			if dev.Alias() == name {
+				return dev, nil
+			}
+		}
+	}
+
+	inter, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Device{name: inter.Name, alias: inter.Name, hardwareAddr: inter.HardwareAddr, mtu: inter.MTU}, nil
+}
+
+// Mirror copies the IP packet if it is sampled.
+func (m *Mirror) Mirror(data []byte) {
+	if m == nil || len(data) <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.count++
+	if m.count < m.sample {
+		return
+	}
+	m.count = 0
+
+	err := m.write(data)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("mirror: %w", err))
+	}
+}
+
+func (m *Mirror) write(data []byte) error {
+	if m.conn != nil {
+		t := layers.EthernetTypeIPv4
+		if data[0]>>4 == 6 {
+			t = layers.EthernetTypeIPv6
+		}
+
+		srcMAC := m.conn.LocalDev().HardwareAddr()
+		if srcMAC == nil {
+			srcMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+		}
+
+		b, err := Serialize(&layers.Ethernet{
+			SrcMAC:       srcMAC,
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			EthernetType: t,
+		}, gopacket.Payload(data))
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+
+		_, err = m.conn.Write(b)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		return nil
+	}
+
+	err := m.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Packets are flushed periodically, so the file is readable while being written
+	if time.Now().Sub(m.lastFlush) >= mirrorFlushInterval {
+		m.lastFlush = time.Now()
+
+		err = m.buffer.Flush()
+		if err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the mirror.
+func (m *Mirror) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.conn != nil {
+		return m.conn.Close()
+	}
+
+	err := m.buffer.Flush()
+	if err != nil {
+		m.file.Close()
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return m.file.Close()
+}
+
+// String returns the target of the mirror.
+func (m *Mirror) String() string {
+	if m.conn != nil {
+		return m.conn.LocalDev().Alias()
+	}
+
+	return m.file.Name()
+}
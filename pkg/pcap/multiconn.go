@@ -0,0 +1,460 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueSize is the max count of packets queued before they are read by default.
+const defaultQueueSize = 1000
+
+// rotateGrace is the time connections rotated out are kept reading, so packets in flight to their ports are received.
+const rotateGrace = 30 * time.Second
+
+type multiConnPacket struct {
+	b   []byte
+	err error
+}
+
+// MultiConn is a FakeTCP connection over several local ports to the same server. Packets tunneled are spread among
+// ports by their flows, so packets of a flow are kept in order, and ports are rotated periodically to new random ports,
+// so a single port is not a stable target to block. The server keeps NAT of the client across ports by the session the
+// connections announce. In port hopping, connections are rotated at the start of each slot to the port of the slot.
+type MultiConn struct {
+	dialer       *Dialer
+	lock         sync.RWMutex
+	dstAddr      *net.TCPAddr
+	conns        []*FakeTCPConn
+	isStripe     bool
+	next         uint32
+	rotate       time.Duration
+	schedule     *HopSchedule
+	c            chan multiConnPacket
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	isClosed     bool
+	readDeadline time.Time
+}
+
+// DialMultiFakeTCP establishes count FakeTCP connections on different local ports, and rotates them every interval,
+// rotate of 0 means no rotation. The port set by WithSrcPort is used by the first connection, and random ports are used
+// by the others. A session is announced if it is not set by WithSession.
+func DialMultiFakeTCP(dstAddr *net.TCPAddr, count int, rotate time.Duration, opts ...Option) (*MultiConn, error) {
+	if count <= 0 {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  fmt.Errorf("count %d out of range", count),
+		}
+	}
+	if rotate < 0 {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  fmt.Errorf("rotate %s out of range", rotate),
+		}
+	}
+
+	return dialMultiFakeTCP(dstAddr, count, rotate, nil, opts...)
+}
+
+// DialHoppingFakeTCP establishes count FakeTCP connections on different local ports to the port of the current slot of
+// the schedule in the remote IP, and hops to the port of the next slot with new local ports at the start of it.
+func DialHoppingFakeTCP(dstIP net.IP, count int, schedule *HopSchedule, opts ...Option) (*MultiConn, error) {
+	dstAddr := &net.TCPAddr{IP: dstIP, Port: int(schedule.Port(time.Now()))}
+
+	if count <= 0 {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  fmt.Errorf("count %d out of range", count),
+		}
+	}
+
+	return dialMultiFakeTCP(dstAddr, count, 0, schedule, opts...)
+}
+
+func dialMultiFakeTCP(dstAddr *net.TCPAddr, count int, rotate time.Duration, schedule *HopSchedule, opts ...Option) (*MultiConn, error) {
+	dialer, err := NewDialer(append([]Option{WithSession(randUint64())}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MultiConn{
+		dialer:   dialer,
+		dstAddr:  dstAddr,
+		conns:    make([]*FakeTCPConn, 0, count),
+		rotate:   rotate,
+		schedule: schedule,
+		c:        make(chan multiConnPacket, dialer.options.queueSize),
+	}
+	c.ctx, c.cancel = context.WithCancel(dialer.options.ctx)
+
+	for i := 0; i < count; i++ {
+		conn, err := c.dial(i > 0)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+	}
+
+	if rotate > 0 || schedule != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.rotateAll()
+		}()
+	}
+
+	return c, nil
+}
+
+// dial establishes a connection on a new local port and reads from it until it is closed. The port set by WithSrcPort
+// is skipped if random is true.
+func (c *MultiConn) dial(isRandom bool) (*FakeTCPConn, error) {
+	c.lock.RLock()
+	dstAddr := c.dstAddr
+	c.lock.RUnlock()
+
+	// Connect to the port of the current slot in hopping
+	if c.schedule != nil {
+		dstAddr = &net.TCPAddr{IP: dstAddr.IP, Port: int(c.schedule.Port(time.Now())), Zone: dstAddr.Zone}
+	}
+
+	conn, err := c.dialer.dialFakeTCP(dstAddr, isRandom)
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for {
+			b := make([]byte, 65535)
+			n, err := conn.Read(b)
+			if err != nil {
+				if conn.isClosed {
+					return
+				}
+				select {
+				case c.c <- multiConnPacket{err: err}:
+				case <-c.ctx.Done():
+					return
+				}
+				continue
+			}
+			if n <= 0 {
+				continue
+			}
+
+			select {
+			case c.c <- multiConnPacket{b: b[:n]}:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+// rotateAll replaces connections with connections on new local ports every interval, or at the start of each slot in
+// hopping. Connections rotated out are closed after a grace period.
+func (c *MultiConn) rotateAll() {
+	for {
+		wait := c.rotate
+		if c.schedule != nil {
+			wait = c.schedule.Next(time.Now()).Sub(time.Now())
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		c.lock.RLock()
+		count := len(c.conns)
+		c.lock.RUnlock()
+
+		if c.schedule != nil {
+			port := c.schedule.Port(time.Now())
+
+			c.lock.Lock()
+			c.dstAddr = &net.TCPAddr{IP: c.dstAddr.IP, Port: int(port), Zone: c.dstAddr.Zone}
+			c.lock.Unlock()
+
+			log.Infof("Hop to port %d\n", port)
+		}
+
+		for i := 0; i < count; i++ {
+			err := c.rotateOne(i)
+			if err != nil {
+				log.Errorln(fmt.Errorf("rotate port: %w", err))
+			}
+		}
+	}
+}
+
+func (c *MultiConn) rotateOne(i int) error {
+	conn, err := c.dial(true)
+	if err != nil {
+		return err
+	}
+
+	// Only connections established take over
+	select {
+	case <-c.ctx.Done():
+		conn.Close()
+		return c.ctx.Err()
+	case <-conn.established:
+	case <-time.After(conn.timeout):
+		conn.Close()
+		return fmt.Errorf("connect from %s: %w", conn.LocalAddr(), errors.New("timeout"))
+	}
+
+	c.lock.Lock()
+	old := c.conns[i]
+	c.conns[i] = conn
+	c.lock.Unlock()
+
+	log.Infof("Rotate port from :%d to :%d\n", old.srcPort, conn.srcPort)
+
+	go func() {
+		t := time.NewTimer(rotateGrace)
+		defer t.Stop()
+
+		select {
+		case <-c.ctx.Done():
+		case <-t.C:
+		}
+		old.Close()
+	}()
+
+	return nil
+}
+
+// SetStripe sets if packets are striped among connections in turn regardless of their flows, so the bandwidth of a
+// single flow is not limited by policers of each connection. Packets of a flow may be reordered when striped, which is
+// left to the protocols tunneled.
+func (c *MultiConn) SetStripe(isStripe bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.isStripe = isStripe
+}
+
+// pick returns the connection of the flow of the packet tunneled, or the next connection in striping.
+func (c *MultiConn) pick(b []byte) *FakeTCPConn {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(c.conns) == 1 {
+		return c.conns[0]
+	}
+	if c.isStripe {
+		return c.conns[atomic.AddUint32(&c.next, 1)%uint32(len(c.conns))]
+	}
+
+	return c.conns[flowHash(b)%uint32(len(c.conns))]
+}
+
+// flowHash returns the hash of the flow of the IP packet, which is of its addresses, protocol and ports.
+func flowHash(b []byte) uint32 {
+	h := fnv.New32a()
+
+	if len(b) >= 20 && b[0]>>4 == 4 {
+		h.Write(b[12:20])
+	} else if len(b) >= 40 && b[0]>>4 == 6 {
+		h.Write(b[8:40])
+	}
+
+	protocol, srcPort, dstPort := parseProtocolAndPorts(b)
+	h.Write([]byte{protocol, byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort)})
+
+	return h.Sum32()
+}
+
+func (c *MultiConn) Read(b []byte) (n int, err error) {
+	var timeout <-chan time.Time
+	if !c.readDeadline.IsZero() {
+		t := time.NewTimer(c.readDeadline.Sub(time.Now()))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-c.ctx.Done():
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    ErrClosed,
+		}
+	case <-timeout:
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    ErrTimeout,
+		}
+	case p := <-c.c:
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		return copy(b, p.b), nil
+	}
+}
+
+func (c *MultiConn) Write(b []byte) (n int, err error) {
+	return c.pick(b).Write(b)
+}
+
+func (c *MultiConn) Close() error {
+	c.lock.Lock()
+	if c.isClosed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	c.cancel()
+	conns := c.conns
+	c.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	c.wg.Wait()
+
+	return nil
+}
+
+// LocalAddr returns the local address of the first connection.
+func (c *MultiConn) LocalAddr() net.Addr {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(c.conns) <= 0 {
+		return nil
+	}
+
+	return c.conns[0].LocalAddr()
+}
+
+// LocalAddrs returns local addresses of all connections.
+func (c *MultiConn) LocalAddrs() []net.Addr {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	addrs := make([]net.Addr, 0)
+	for _, conn := range c.conns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+
+	return addrs
+}
+
+func (c *MultiConn) RemoteAddr() net.Addr {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.dstAddr
+}
+
+func (c *MultiConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *MultiConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *MultiConn) SetWriteDeadline(t time.Time) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, conn := range c.conns {
+		err := conn.SetWriteDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MaxPayload returns the max size of data which can be written to the connection without fragmentation.
+func (c *MultiConn) MaxPayload() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.conns[0].MaxPayload()
+}
+
+// Reconnect re-establishes all connections.
+func (c *MultiConn) Reconnect() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, conn := range c.conns {
+		err := conn.Reconnect()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetRemoteAddr sets the remote address of all connections and re-establishes them. Only the IP is set in hopping, and
+// connections keep their ports of the schedule.
+func (c *MultiConn) SetRemoteAddr(dstAddr *net.TCPAddr) error {
+	c.lock.Lock()
+	if c.schedule != nil {
+		dstAddr = &net.TCPAddr{IP: dstAddr.IP, Port: c.dstAddr.Port, Zone: dstAddr.Zone}
+	}
+	c.dstAddr = dstAddr
+	c.lock.Unlock()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, conn := range c.conns {
+		addr := dstAddr
+		if c.schedule != nil {
+			addr = &net.TCPAddr{IP: dstAddr.IP, Port: conn.RemoteAddr().(*net.TCPAddr).Port, Zone: dstAddr.Zone}
+		}
+
+		err := conn.SetRemoteAddr(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
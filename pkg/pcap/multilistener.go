@@ -0,0 +1,95 @@
+package pcap
+
+import (
+	"ikago/pkg/addr"
+	"net"
+	"sync"
+)
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// MultiListener is a listener which accepts connections from multiple listeners.
+type MultiListener struct {
+	listeners []net.Listener
+	c         chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMultiListener returns a listener which merges connections accepted from all given listeners.
+func NewMultiListener(listeners ...net.Listener) *MultiListener {
+	l := &MultiListener{
+		listeners: listeners,
+		c:         make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+
+	for _, listener := range listeners {
+		go l.accept(listener)
+	}
+
+	return l
+}
+
+func (l *MultiListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+
+		// Duplicate
+		if conn == nil && err == nil {
+			continue
+		}
+
+		select {
+		case l.c <- acceptResult{conn: conn, err: err}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.c:
+		return result.conn, result.err
+	case <-l.closed:
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  ErrClosed,
+		}
+	}
+}
+
+func (l *MultiListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		for _, listener := range l.listeners {
+			e := listener.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *MultiListener) Addr() net.Addr {
+	addrs := make([]net.Addr, 0)
+	for _, listener := range l.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+
+	return addr.MultiAddr{Addrs: addrs}
+}
@@ -0,0 +1,234 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+)
+
+// NeighborCache is a cache of hardware addresses of IPv6 neighbors learned by neighbor discovery.
+type NeighborCache struct {
+	neighborTable
+	conn     *RawConn
+	srcIP    net.IP
+	isClosed bool
+}
+
+// NewNeighborCache returns a new neighbor cache learns neighbors in the device, which is captured in options of
+// captures.
+func NewNeighborCache(dev *Device, opts ...Option) (*NeighborCache, error) {
+	if dev.IsLoop() {
+		return nil, fmt.Errorf("loopback device %s not support", dev.Alias())
+	}
+	if dev.IsPointToPoint() {
+		return nil, fmt.Errorf("point-to-point device %s not support", dev.Alias())
+	}
+
+	// Neighbor solicitation and advertisement
+	conn, err := CreateRawConn(dev, dev, "icmp6 && (ip6[40] == 135 || ip6[40] == 136)", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
+	}
+
+	cache := &NeighborCache{
+		neighborTable: newNeighborTable(),
+		conn:          conn,
+		srcIP:         findLinkLocalAddr(dev),
+	}
+
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				if cache.isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("read device %s: %w", dev.Alias(), err))
+				continue
+			}
+
+			cache.handle(packet)
+		}
+	}()
+
+	return cache, nil
+}
+
+// Resolve returns the hardware address of the neighbor. Stale neighbors are returned as is and solicited again in the
+// background.
+func (cache *NeighborCache) Resolve(ip net.IP) (net.HardwareAddr, error) {
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("ip %s not support", ip)
+	}
+
+	return cache.resolve(ip, cache.solicit)
+}
+
+// Close closes the neighbor cache.
+func (cache *NeighborCache) Close() error {
+	cache.isClosed = true
+
+	return cache.conn.Close()
+}
+
+func (cache *NeighborCache) solicit(ip net.IP) (net.HardwareAddr, error) {
+	return cache.wait(ip, func() error {
+		data, err := CreateNeighborSolicitationPacket(cache.conn.LocalDev(), cache.srcIP, ip)
+		if err != nil {
+			return fmt.Errorf("create neighbor solicitation: %w", err)
+		}
+
+		_, err = cache.conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (cache *NeighborCache) handle(packet gopacket.Packet) {
+	ipv6Layer := packet.Layer(layers.LayerTypeIPv6)
+	if ipv6Layer == nil {
+		return
+	}
+	srcIP := ipv6Layer.(*layers.IPv6).SrcIP
+
+	switch {
+	case packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement) != nil:
+		layer := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+
+		hardwareAddr := findLinkLayerAddrOption(layer.Options, layers.ICMPv6OptTargetAddress)
+		if hardwareAddr == nil {
+			ethernetLayer := packet.Layer(layers.LayerTypeEthernet)
+			if ethernetLayer == nil {
+				return
+			}
+			hardwareAddr = ethernetLayer.(*layers.Ethernet).SrcMAC
+		}
+
+		cache.learn(layer.TargetAddress, hardwareAddr)
+	case packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation) != nil:
+		layer := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+
+		// Solicitations in duplicate address detection do not describe the sender
+		if srcIP.IsUnspecified() {
+			return
+		}
+
+		hardwareAddr := findLinkLayerAddrOption(layer.Options, layers.ICMPv6OptSourceAddress)
+		if hardwareAddr == nil {
+			return
+		}
+
+		cache.learn(srcIP, hardwareAddr)
+	default:
+		break
+	}
+}
+
+func findLinkLayerAddrOption(options layers.ICMPv6Options, t layers.ICMPv6Opt) net.HardwareAddr {
+	for _, option := range options {
+		if option.Type == t && len(option.Data) >= 6 {
+			return net.HardwareAddr(option.Data[:6])
+		}
+	}
+
+	return nil
+}
+
+// findLinkLocalAddr returns the IPv6 link-local address of the device, or the unspecified address if the device does
+// not have one.
+func findLinkLocalAddr(dev *Device) net.IP {
+	inter, err := net.InterfaceByName(dev.Alias())
+	if err != nil {
+		return net.IPv6unspecified
+	}
+
+	addrs, err := inter.Addrs()
+	if err != nil {
+		return net.IPv6unspecified
+	}
+
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			return ipnet.IP
+		}
+	}
+
+	return net.IPv6unspecified
+}
+
+// solicitedNodeAddr returns the solicited-node multicast address of the IP.
+func solicitedNodeAddr(ip net.IP) net.IP {
+	ip = ip.To16()
+
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// multicastHardwareAddr returns the Ethernet multicast address of the IPv6 multicast address.
+func multicastHardwareAddr(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// CreateNeighborSolicitationPacket returns a neighbor solicitation packet resolving the target IP.
+func CreateNeighborSolicitationPacket(dev *Device, srcIP, targetIP net.IP) ([]byte, error) {
+	if targetIP.To4() != nil {
+		return nil, fmt.Errorf("ip %s not support", targetIP)
+	}
+
+	dstIP := solicitedNodeAddr(targetIP)
+
+	// Create neighbor solicitation layer
+	nsLayer := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: targetIP,
+	}
+	// The source link-layer address must not be included if the source address is unspecified
+	if !srcIP.IsUnspecified() {
+		nsLayer.Options = layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: dev.HardwareAddr()},
+		}
+	}
+
+	// Create ICMPv6 layer
+	icmpv6Layer := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+
+	// Create IPv6 layer
+	ipv6Layer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+
+	err := icmpv6Layer.SetNetworkLayerForChecksum(ipv6Layer)
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	// Create Ethernet layer
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       dev.HardwareAddr(),
+		DstMAC:       multicastHardwareAddr(dstIP),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+
+	data, err := Serialize(ethernetLayer, ipv6Layer, icmpv6Layer, nsLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
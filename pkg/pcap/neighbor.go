@@ -0,0 +1,133 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// neighborReachableTime is the time a learned neighbor is considered reachable, a neighbor will be solicited again
+// after it.
+const neighborReachableTime = 30 * time.Second
+
+// neighborSolicitTimeout is the time waiting for a reply after a neighbor is solicited.
+const neighborSolicitTimeout = 3 * time.Second
+
+// NeighborResolver is a resolver resolves hardware addresses of neighbors.
+type NeighborResolver interface {
+	// Resolve returns the hardware address of the neighbor.
+	Resolve(ip net.IP) (net.HardwareAddr, error)
+	// Close closes the resolver.
+	Close() error
+}
+
+type neighborIndicator struct {
+	hardwareAddr net.HardwareAddr
+	updated      time.Time
+}
+
+func (indicator *neighborIndicator) isStale() bool {
+	return time.Now().Sub(indicator.updated) > neighborReachableTime
+}
+
+// neighborTable is a table of learned neighbors shared by neighbor resolvers.
+type neighborTable struct {
+	lock        sync.RWMutex
+	neighbors   map[string]*neighborIndicator
+	waitersLock sync.Mutex
+	waiters     map[string][]chan net.HardwareAddr
+}
+
+func newNeighborTable() neighborTable {
+	return neighborTable{
+		neighbors: make(map[string]*neighborIndicator),
+		waiters:   make(map[string][]chan net.HardwareAddr),
+	}
+}
+
+// resolve returns the hardware address of the neighbor. Stale neighbors are returned as is and solicited again in the
+// background.
+func (table *neighborTable) resolve(ip net.IP, solicit func(ip net.IP) (net.HardwareAddr, error)) (net.HardwareAddr, error) {
+	table.lock.RLock()
+	neighbor, ok := table.neighbors[ip.String()]
+	table.lock.RUnlock()
+
+	if ok {
+		if neighbor.isStale() {
+			go func() {
+				_, err := solicit(ip)
+				if err != nil {
+					log.Verboseln(fmt.Errorf("solicit %s: %w", ip, err))
+				}
+			}()
+		}
+
+		return neighbor.hardwareAddr, nil
+	}
+
+	return solicit(ip)
+}
+
+// wait sends a solicitation and waits for the neighbor to be learned.
+func (table *neighborTable) wait(ip net.IP, send func() error) (net.HardwareAddr, error) {
+	c := make(chan net.HardwareAddr, 1)
+
+	table.waitersLock.Lock()
+	table.waiters[ip.String()] = append(table.waiters[ip.String()], c)
+	table.waitersLock.Unlock()
+
+	err := send()
+	if err != nil {
+		table.unwait(ip, c)
+		return nil, err
+	}
+
+	select {
+	case hardwareAddr := <-c:
+		return hardwareAddr, nil
+	case <-time.After(neighborSolicitTimeout):
+		table.unwait(ip, c)
+		return nil, errors.New("timeout")
+	}
+}
+
+func (table *neighborTable) unwait(ip net.IP, c chan net.HardwareAddr) {
+	table.waitersLock.Lock()
+	defer table.waitersLock.Unlock()
+
+	waiters := table.waiters[ip.String()]
+	for i, waiter := range waiters {
+		if waiter == c {
+			table.waiters[ip.String()] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(table.waiters[ip.String()]) <= 0 {
+		delete(table.waiters, ip.String())
+	}
+}
+
+func (table *neighborTable) learn(ip net.IP, hardwareAddr net.HardwareAddr) {
+	table.lock.Lock()
+	neighbor, ok := table.neighbors[ip.String()]
+	if ok && neighbor.hardwareAddr.String() != hardwareAddr.String() {
+		log.Verbosef("Neighbor %s changed to %s\n", ip, hardwareAddr)
+	}
+	table.neighbors[ip.String()] = &neighborIndicator{
+		hardwareAddr: hardwareAddr,
+		updated:      time.Now(),
+	}
+	table.lock.Unlock()
+
+	table.waitersLock.Lock()
+	waiters := table.waiters[ip.String()]
+	delete(table.waiters, ip.String())
+	table.waitersLock.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- hardwareAddr
+	}
+}
@@ -0,0 +1,558 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"ikago/internal/hook"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/stat"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// options describes options of connections and listeners.
+type options struct {
+	srcDev       *Device
+	dstDev       *Device
+	reselect     func() (*Device, *Device, error)
+	srcPort      uint16
+	crypt        crypto.Crypt
+	mtu          int
+	fragment     int
+	isNoFragment bool
+	defragConfig *config.DefragConfig
+	scheduler    Scheduler
+	congestion   CongestionControlFactory
+	dscp         uint8
+	isCopyTOS    bool
+	ttl          uint8
+	chaff        int
+	probe        time.Duration
+	feedback     time.Duration
+	rekey        time.Duration
+	adaptive     []float64
+	isBlackhole  bool
+	session      uint64
+	impairment   *Impairment
+	verifier     *crypto.ProofVerifier
+	cookie       *crypto.Cookie
+	preamble     Preamble
+	wireVersion  int
+	tls          *TLSMimicry
+	isTyped      bool
+	isPrefixed   bool
+	users        *Users
+	keyring      *Keyring
+	bans         *Bans
+	drain        *Drain
+	access       *Access
+	admission    *Admission
+	tolerance    int
+	timeout      time.Duration
+	kcpConfig    *config.KCPConfig
+	queueSize    int
+	ctx          context.Context
+	extraFilter  string
+	pcapConfig   *config.PcapConfig
+	backend      string
+	validation   Validation
+	sflow        *SFlow
+	traceFilter  *TraceFilter
+	isTraceHex   bool
+	hook         *hook.Hook
+	fragMonitor  *stat.FragmentMonitor
+	latMonitor   *stat.LatencyMonitor
+	delMonitor   *stat.DeliveryMonitor
+	queMonitor   *stat.QueueMonitor
+	malMonitor   *stat.MalformedMonitor
+	filters      *filterCache
+}
+
+// Option is an option of connections and listeners.
+type Option func(o *options)
+
+// WithDevices sets the device captured and the device of the next hop. Devices are found automatically by default.
+func WithDevices(srcDev, dstDev *Device) Option {
+	return func(o *options) {
+		o.srcDev = srcDev
+		o.dstDev = dstDev
+	}
+}
+
+// WithReselect sets the function selecting devices again, it is called when the device captured fails and cannot be
+// reopened, such as it vanishes or is renamed, and connections move to devices it returns. Devices found automatically
+// are found again automatically by default.
+func WithReselect(reselect func() (srcDev, dstDev *Device, err error)) Option {
+	return func(o *options) {
+		o.reselect = reselect
+	}
+}
+
+// WithSrcPort sets the local port of connections. A random port is used by default.
+func WithSrcPort(port uint16) Option {
+	return func(o *options) {
+		o.srcPort = port
+	}
+}
+
+// WithCrypt sets the crypt. Data is in plain by default.
+func WithCrypt(crypt crypto.Crypt) Option {
+	return func(o *options) {
+		o.crypt = crypt
+	}
+}
+
+// WithMTU sets the MTU. MaxMTU is used by default.
+func WithMTU(mtu int) Option {
+	return func(o *options) {
+		o.mtu = mtu
+	}
+}
+
+// WithFragment sets the size of fragments. MaxMTU is used by default.
+func WithFragment(size int) Option {
+	return func(o *options) {
+		o.fragment = size
+	}
+}
+
+// WithNoFragment sets if packets are never fragmented, so packets are marked don't fragment and writes which cannot be
+// carried in a fragment are rejected rather than fragmented, for paths where fragments are always dropped. Packets are
+// fragmented by default.
+func WithNoFragment(isNoFragment bool) Option {
+	return func(o *options) {
+		o.isNoFragment = isNoFragment
+	}
+}
+
+// WithDefrag sets the config of defragmentation.
+func WithDefrag(config *config.DefragConfig) Option {
+	return func(o *options) {
+		o.defragConfig = config
+	}
+}
+
+// WithScheduler sets the scheduler of writes. Packets are written immediately by default.
+func WithScheduler(scheduler Scheduler) Option {
+	return func(o *options) {
+		o.scheduler = scheduler
+	}
+}
+
+// WithCongestionControl sets the congestion control writes to each peer are paced by, whose rates are sampled by
+// delivery reports of peers and rounds are measured by latency probes. Writes are not paced by default.
+func WithCongestionControl(factory CongestionControlFactory) Option {
+	return func(o *options) {
+		o.congestion = factory
+	}
+}
+
+// WithDSCP sets the DSCP value of packets, so routers with QoS may prioritize them. Packets are not marked by default.
+func WithDSCP(dscp uint8) Option {
+	return func(o *options) {
+		o.dscp = dscp
+	}
+}
+
+// WithCopyTOS sets if DSCP and ECN of packets tunneled are copied to packets of connections, and congestion experienced
+// is passed back to packets tunneled when they are received. TOS is not copied by default.
+func WithCopyTOS(enabled bool) Option {
+	return func(o *options) {
+		o.isCopyTOS = enabled
+	}
+}
+
+// WithChaff sets the max bandwidth of chaff in bytes per second. No chaff is sent by default.
+func WithChaff(rate int) Option {
+	return func(o *options) {
+		o.chaff = rate
+	}
+}
+
+// WithProbe sets the interval of latency probes sent to peers, whose RTTs are recorded by the latency monitor. No probe is
+// sent by default.
+func WithProbe(interval time.Duration) Option {
+	return func(o *options) {
+		o.probe = interval
+	}
+}
+
+// WithFeedback sets the interval of delivery reports sent to peers, which carry counts of packets sent and received so
+// one-way losses in both directions are measured and recorded by the delivery monitor. No report is sent by default.
+func WithFeedback(interval time.Duration) Option {
+	return func(o *options) {
+		o.feedback = interval
+	}
+}
+
+// WithRekey sets the interval the client asks the server for a new key in band, which is derived from the key of the
+// handshake and a random salt, so no key encrypts too much data. Listeners change keys as requested without any option.
+// Rekeys must be in typed framing and in crypt supporting rekeys. Keys are never changed by default.
+func WithRekey(interval time.Duration) Option {
+	return func(o *options) {
+		o.rekey = interval
+	}
+}
+
+// WithAdaptive sets the thresholds of loss in percent in ascending order, packets are written in one more copy when the
+// loss measured by delivery reports, or by latency probes if there are no reports, reaches each threshold. Latency
+// probes or delivery reports must be set. Packets are not duplicated by default.
+func WithAdaptive(thresholds []float64) Option {
+	return func(o *options) {
+		o.adaptive = thresholds
+	}
+}
+
+// WithBlackhole sets if MTU blackholes are detected by large latency probes, packets are written in smaller fragments
+// to peers whose large probes are lost while small probes are replied. Latency probes must be set. MTU blackholes are
+// not detected by default.
+func WithBlackhole(isBlackhole bool) Option {
+	return func(o *options) {
+		o.isBlackhole = isBlackhole
+	}
+}
+
+// WithSession sets the session announced to the server, so the server keeps NAT of the client across connections on
+// different local ports announcing the same session. No session is announced by default.
+func WithSession(session uint64) Option {
+	return func(o *options) {
+		o.session = session
+	}
+}
+
+// WithImpairment sets the impairment simulating an impaired network, which packets of connections are written through
+// after handshaking. Packets are not impaired by default.
+func WithImpairment(impairment *Impairment) Option {
+	return func(o *options) {
+		o.impairment = impairment
+	}
+}
+
+// WithVerifier sets the verifier of proofs, listeners with a verifier never respond to clients without a valid proof.
+func WithVerifier(verifier *crypto.ProofVerifier) Option {
+	return func(o *options) {
+		o.verifier = verifier
+	}
+}
+
+// WithCookie sets the cookie. Connections lead TCP SYNs with cookies, and listeners reset TCP SYNs without valid
+// cookies as a closed port, or drop them silently in stealth mode.
+func WithCookie(cookie *crypto.Cookie) Option {
+	return func(o *options) {
+		o.cookie = cookie
+	}
+}
+
+// WithPreamble sets the preamble of handshakes. Connections without a preamble never carry anything in TCP SYN, so
+// they cannot connect to listeners requiring proofs or cookies. Preambles are tagged by default.
+func WithPreamble(preamble Preamble) Option {
+	return func(o *options) {
+		o.preamble = preamble
+	}
+}
+
+// WithWireVersion sets the version of the wire format connections write in, so clients can connect to servers of an
+// older version in rolling upgrades. Listeners read all versions supported regardless of it, and regard clients without
+// a preamble in it if they are without a preamble too, or in WireVersion0 otherwise. Versions are WireVersion by
+// default.
+func WithWireVersion(version int) Option {
+	return func(o *options) {
+		o.wireVersion = version
+	}
+}
+
+// WithTTL sets the TTL packets are written in, so packets look like from the system the peer is mimicking. TTLs are
+// 128 in data and 64 in responses to TCP SYN by default.
+func WithTTL(ttl uint8) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithTLS sets the TLS mimicry. Connections forge a TLS handshake after the FakeTCP handshake, and frame data as TLS
+// application data. Data is not framed by default.
+func WithTLS(tls *TLSMimicry) Option {
+	return func(o *options) {
+		o.tls = tls
+	}
+}
+
+// WithTyped sets if packets are framed with a byte of type under the encryption in versions of the wire format before
+// WireVersion3, which are always typed. Messages in band, segments and heartbeats are only written in typed framing,
+// and peers are closed gracefully. The peer must be typed as well. Packets are typed by the version by default.
+func WithTyped(isTyped bool) Option {
+	return func(o *options) {
+		o.isTyped = isTyped
+	}
+}
+
+// WithLengthPrefix sets if datagrams are prefixed with their lengths, so datagrams coalesced or segmented again by
+// middleboxes proxying TCP are recovered. The peer must be prefixed as well. Datagrams received partially are dropped
+// if a packet is lost or out of order. Datagrams framed as TLS records are never prefixed as records carry their
+// lengths. Datagrams are not prefixed by default.
+func WithLengthPrefix(isPrefixed bool) Option {
+	return func(o *options) {
+		o.isPrefixed = isPrefixed
+	}
+}
+
+// WithUsers sets users, listeners with users identify clients by their proofs instead of the verifier, and never respond
+// to clients of unknown users.
+func WithUsers(users *Users) Option {
+	return func(o *options) {
+		o.users = users
+	}
+}
+
+// WithKeyring sets the keyring, listeners with the keyring identify the key of clients by their proofs instead of the
+// verifier, so keys are rotated without dropping sessions.
+func WithKeyring(keyring *Keyring) Option {
+	return func(o *options) {
+		o.keyring = keyring
+	}
+}
+
+// WithBans sets the list of bans, listeners with bans never respond to clients banned.
+func WithBans(bans *Bans) Option {
+	return func(o *options) {
+		o.bans = bans
+	}
+}
+
+// WithAccess sets the access, listeners with access never respond to clients out of their schedules.
+func WithAccess(access *Access) Option {
+	return func(o *options) {
+		o.access = access
+	}
+}
+
+// WithDrain sets the drain, listeners draining never respond to new clients.
+func WithDrain(drain *Drain) Option {
+	return func(o *options) {
+		o.drain = drain
+	}
+}
+
+// WithAdmission sets the admission, listeners with an admission refuse clients over its max.
+func WithAdmission(admission *Admission) Option {
+	return func(o *options) {
+		o.admission = admission
+	}
+}
+
+// WithTolerance sets the count of packets failed to parse or decrypt in a row tolerated in reads. Such packets are
+// counted and skipped rather than returned as errors, and only failures over the tolerance in a row, or failures of the
+// connection, are returned. Each failure is returned by default.
+func WithTolerance(tolerance int) Option {
+	return func(o *options) {
+		o.tolerance = tolerance
+	}
+}
+
+// WithTimeout sets the time waiting for the handshake. 3 seconds is used by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithKCP sets the config of KCP for connections and listeners with KCP support.
+func WithKCP(config *config.KCPConfig) Option {
+	return func(o *options) {
+		o.kcpConfig = config
+	}
+}
+
+// WithQueueSize sets the max count of packets queued before they are read in connections over several ports. 1000 is
+// used by default.
+func WithQueueSize(size int) Option {
+	return func(o *options) {
+		o.queueSize = size
+	}
+}
+
+// WithContext sets the context, connections are closed when it is done.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithExtraFilter sets the BPF filter appended to filters generated for captures, so packets are captured only if they
+// match both. The filter is compiled against the link type of each device when it is opened, and filters failing to be
+// set are shown in full in the error. Nothing is appended by default.
+func WithExtraFilter(filter string) Option {
+	return func(o *options) {
+		o.extraFilter = filter
+	}
+}
+
+// WithPcapConfig sets tuning of capture handles, which are the buffer size, the snap length, immediate mode and the
+// read timeout. Handles are in defaults of the library by default.
+func WithPcapConfig(cfg *config.PcapConfig) Option {
+	return func(o *options) {
+		o.pcapConfig = cfg
+	}
+}
+
+// WithBackend sets the backend capturing packets, which is BackendPcap or BackendPFRing. BackendPcap is used by
+// default.
+func WithBackend(backend string) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithValidation sets how malformed packets captured are treated. ValidationNormal is used by default.
+func WithValidation(v Validation) Option {
+	return func(o *options) {
+		o.validation = v
+	}
+}
+
+// WithSFlow sets the exporter sampling frames of FakeTCP. Nothing is sampled by default.
+func WithSFlow(s *SFlow) Option {
+	return func(o *options) {
+		o.sflow = s
+	}
+}
+
+// WithTrace sets the filter of packets traced, and if contents of packets are dumped in hex. Packets are traced in
+// trace messages of logs. No packet is traced by default.
+func WithTrace(filter *TraceFilter, isHex bool) Option {
+	return func(o *options) {
+		o.traceFilter = filter
+		o.isTraceHex = isHex
+	}
+}
+
+// WithHook sets the hook events of connections, like reconnections and servers unreachable, are notified by. Events
+// are not notified by default.
+func WithHook(hook *hook.Hook) Option {
+	return func(o *options) {
+		o.hook = hook
+	}
+}
+
+// WithFragmentMonitor sets the monitor recording statistics of fragments.
+func WithFragmentMonitor(monitor *stat.FragmentMonitor) Option {
+	return func(o *options) {
+		o.fragMonitor = monitor
+	}
+}
+
+// WithLatencyMonitor sets the monitor recording RTTs and jitters of echo messages, and skews of clocks of peers.
+func WithLatencyMonitor(monitor *stat.LatencyMonitor) Option {
+	return func(o *options) {
+		o.latMonitor = monitor
+	}
+}
+
+// WithDeliveryMonitor sets the monitor recording delivery of packets measured by delivery reports.
+func WithDeliveryMonitor(monitor *stat.DeliveryMonitor) Option {
+	return func(o *options) {
+		o.delMonitor = monitor
+	}
+}
+
+// WithQueueMonitor sets the monitor recording writes finding pipelines of clients full.
+func WithQueueMonitor(monitor *stat.QueueMonitor) Option {
+	return func(o *options) {
+		o.queMonitor = monitor
+	}
+}
+
+// WithMalformedMonitor sets the monitor recording statistics of malformed packets. Sources of malformed packets are
+// quarantined in each listener.
+func WithMalformedMonitor(monitor *stat.MalformedMonitor) Option {
+	return func(o *options) {
+		o.malMonitor = monitor
+	}
+}
+
+// newOptions returns options applied in order, with defaults for those not set.
+func newOptions(opts ...Option) (*options, error) {
+	o := &options{
+		mtu:         MaxMTU,
+		fragment:    MaxMTU,
+		timeout:     establishDeadline,
+		queueSize:   defaultQueueSize,
+		wireVersion: WireVersion,
+		validation:  ValidationNormal,
+		ctx:         context.Background(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.srcDev == nil {
+		srcDev, dstDev, err := FindUpstreamDevAndGatewayDev("", nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("find devices: %w", err)
+		}
+
+		o.srcDev = srcDev
+		o.dstDev = dstDev
+
+		if o.reselect == nil {
+			o.reselect = func() (*Device, *Device, error) {
+				return FindUpstreamDevAndGatewayDev("", nil, nil)
+			}
+		}
+	}
+	if o.dstDev == nil {
+		o.dstDev = o.srcDev
+	}
+	if o.srcPort == 0 {
+		o.srcPort = uint16(49152 + rand.New(rand.NewSource(time.Now().UnixNano())).Intn(16384))
+	}
+	if o.crypt == nil {
+		o.crypt = crypto.CreatePlainCrypt()
+	}
+	if o.ctx == nil {
+		o.ctx = context.Background()
+	}
+	if o.defragConfig == nil {
+		o.defragConfig = config.NewDefragConfig()
+	}
+	if o.kcpConfig == nil {
+		o.kcpConfig = config.NewKCPConfig()
+	}
+	if o.timeout <= 0 {
+		return nil, fmt.Errorf("timeout %s out of range", o.timeout)
+	}
+	if o.tolerance < 0 {
+		return nil, fmt.Errorf("tolerance %d out of range", o.tolerance)
+	}
+	if o.queueSize <= 0 {
+		return nil, fmt.Errorf("queue size %d out of range", o.queueSize)
+	}
+	err := checkWireVersion(o.wireVersion)
+	if err != nil {
+		return nil, err
+	}
+	o.backend, err = ParseBackend(o.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// newListenOptions returns options of listeners on the port.
+func newListenOptions(srcPort uint16, opts ...Option) (*options, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: &net.TCPAddr{Port: int(srcPort)},
+			Err:    err,
+		}
+	}
+	o.srcPort = srcPort
+
+	return o, nil
+}
@@ -5,7 +5,9 @@
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"ikago/internal/addr"
+	"ikago/internal/log"
+	"ikago/pkg/addr"
+	"ikago/pkg/stat"
 	"net"
 )
 
@@ -38,6 +40,7 @@ type PacketIndicator struct {
 	packet           gopacket.Packet
 	linkLayer        gopacket.Layer
 	networkLayer     gopacket.Layer
+	fragmentLayer    *layers.IPv6Fragment
 	transportLayer   gopacket.Layer
 	icmpv4Indicator  *ICMPv4Indicator
 	applicationLayer gopacket.ApplicationLayer
@@ -92,6 +95,20 @@ func (indicator *PacketIndicator) IPv4Layer() *layers.IPv4 {
 	return nil
 }
 
+// IPv6Layer returns the IPv6 layer.
+func (indicator *PacketIndicator) IPv6Layer() *layers.IPv6 {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
+		return indicator.networkLayer.(*layers.IPv6)
+	}
+
+	return nil
+}
+
+// IPv6FragmentLayer returns the IPv6 fragment layer.
+func (indicator *PacketIndicator) IPv6FragmentLayer() *layers.IPv6Fragment {
+	return indicator.fragmentLayer
+}
+
 // ARPLayer returns the ARP layer.
 func (indicator *PacketIndicator) ARPLayer() *layers.ARP {
 	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
@@ -106,6 +123,8 @@ func (indicator *PacketIndicator) SrcIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().SrcIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().SrcIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().SourceProtAddress
 	default:
@@ -118,6 +137,8 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().DstIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().DstIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().DstProtAddress
 	default:
@@ -130,16 +151,24 @@ func (indicator *PacketIndicator) TTL() uint8 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().TTL
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().HopLimit
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
-// Id returns the Id in the network layer.
-func (indicator *PacketIndicator) NetworkId() uint16 {
+// NetworkId returns the Id in the network layer.
+func (indicator *PacketIndicator) NetworkId() uint32 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
-		return indicator.IPv4Layer().Id
+		return uint32(indicator.IPv4Layer().Id)
+	case layers.LayerTypeIPv6:
+		if indicator.fragmentLayer == nil {
+			return 0
+		}
+
+		return indicator.fragmentLayer.Identification
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -156,6 +185,20 @@ func (indicator *PacketIndicator) IsFrag() bool {
 		}
 
 		return ipv4Layer.FragOffset != 0
+	case layers.LayerTypeIPv6:
+		return indicator.fragmentLayer != nil
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
+// IsDF returns if the packet is not allowed to be fragmented.
+func (indicator *PacketIndicator) IsDF() bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return indicator.IPv4Layer().Flags&layers.IPv4DontFragment != 0
+	case layers.LayerTypeIPv6:
+		return false
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -166,6 +209,12 @@ func (indicator *PacketIndicator) FragOffset() uint16 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().FragOffset
+	case layers.LayerTypeIPv6:
+		if indicator.fragmentLayer == nil {
+			return 0
+		}
+
+		return indicator.fragmentLayer.FragmentOffset
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -176,6 +225,12 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().Flags&layers.IPv4MoreFragments != 0
+	case layers.LayerTypeIPv6:
+		if indicator.fragmentLayer == nil {
+			return false
+		}
+
+		return indicator.fragmentLayer.MoreFragments
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -190,12 +245,28 @@ func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 			panic(err)
 		}
 
+		return p
+	case layers.LayerTypeIPv6:
+		p, err := parseIPProtocol(indicator.NextHeader())
+		if err != nil {
+			panic(err)
+		}
+
 		return p
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
+// NextHeader returns the protocol of the upper layer following the IPv6 header and its extension headers.
+func (indicator *PacketIndicator) NextHeader() layers.IPProtocol {
+	if indicator.fragmentLayer != nil {
+		return indicator.fragmentLayer.NextHeader
+	}
+
+	return indicator.IPv6Layer().NextHeader
+}
+
 // TransportLayer returns the transport layer.
 func (indicator *PacketIndicator) TransportLayer() gopacket.Layer {
 	return indicator.transportLayer
@@ -435,6 +506,11 @@ func (indicator *PacketIndicator) NetworkPayload() []byte {
 		return nil
 	}
 
+	// Skip the IPv6 fragment header
+	if indicator.fragmentLayer != nil {
+		return indicator.fragmentLayer.LayerPayload()
+	}
+
 	return indicator.NetworkLayer().LayerPayload()
 }
 
@@ -449,6 +525,10 @@ func (indicator *PacketIndicator) Payload() []byte {
 
 // MTU returns the required MTU of the packet.
 func (indicator *PacketIndicator) MTU() int {
+	if indicator.fragmentLayer != nil {
+		return len(indicator.NetworkLayer().LayerContents()) + len(indicator.fragmentLayer.LayerContents()) + len(indicator.NetworkPayload())
+	}
+
 	return len(indicator.NetworkLayer().LayerContents()) + len(indicator.NetworkPayload())
 }
 
@@ -457,11 +537,75 @@ func (indicator *PacketIndicator) Size() int {
 	return len(indicator.packet.Data())
 }
 
-// ParsePacket parses a packet and returns a packet indicator.
-func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
+// errParsePanic describes a packet panics in parsing.
+var errParsePanic = errors.New("panic")
+
+// ParsePacket parses a packet and returns a packet indicator. Packets are validated in the validation, and malformed
+// packets are counted in the monitor. Packets panicking in parsing are dropped with an error, and counted by their
+// sources.
+func ParsePacket(packet gopacket.Packet, validation Validation, monitor *stat.MalformedMonitor) (*PacketIndicator, error) {
+	return parsePacket(packet, validation, newMalformedCounter(monitor))
+}
+
+// parsePacket parses a packet like ParsePacket, and malformed packets are counted in the quarantine.
+func parsePacket(packet gopacket.Packet, validation Validation, q *quarantine) (indicator *PacketIndicator, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			indicator, err = nil, fmt.Errorf("%w: %v", errParsePanic, r)
+		}
+		if errors.Is(err, errParsePanic) {
+			q.addPanic(srcIP(packet), err)
+		}
+	}()
+
+	// Validate
+	if validation != ValidationLoose {
+		err := ValidatePacket(packet)
+		if err != nil {
+			event := stat.MalformedEventParse
+			if errors.Is(err, errBadChecksum) {
+				event = stat.MalformedEventChecksum
+			}
+
+			// Only packets dropped count towards the quarantine
+			if validation == ValidationStrict {
+				q.add(srcIP(packet), event)
+				return nil, fmt.Errorf("validate: %w", err)
+			}
+			q.count(event)
+			log.Verboseln(fmt.Errorf("validate: %w", err))
+		}
+	}
+
+	indicator, err = InterpretPacket(packet)
+	if err != nil {
+		if !errors.Is(err, errParsePanic) {
+			q.add(srcIP(packet), stat.MalformedEventParse)
+		}
+		return nil, err
+	}
+
+	return indicator, nil
+}
+
+// InterpretPacket returns a packet indicator of a packet as the tunnel interprets it. Unlike ParsePacket, packets are
+// neither validated nor counted, so it is free of side effects. Malformed packets may panic in decoding layers, which
+// are recovered and returned as errors.
+func InterpretPacket(packet gopacket.Packet) (indicator *PacketIndicator, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			indicator, err = nil, fmt.Errorf("%w: %v", errParsePanic, r)
+		}
+	}()
+
+	return interpretPacket(packet)
+}
+
+func interpretPacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
 		linkLayer        gopacket.Layer
 		networkLayer     gopacket.Layer
+		fragmentLayer    *layers.IPv6Fragment
 		transportLayer   gopacket.Layer
 		icmpv4Indicator  *ICMPv4Indicator
 		applicationLayer gopacket.ApplicationLayer
@@ -528,6 +672,24 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		if err != nil {
 			return nil, err
 		}
+	case layers.LayerTypeIPv6:
+		ipv6Layer := networkLayer.(*layers.IPv6)
+		protocol := ipv6Layer.NextHeader
+
+		// Fragment
+		if protocol == layers.IPProtocolIPv6Fragment {
+			layer := packet.Layer(layers.LayerTypeIPv6Fragment)
+			if layer == nil {
+				return nil, errors.New("missing fragment layer")
+			}
+			fragmentLayer = layer.(*layers.IPv6Fragment)
+			protocol = fragmentLayer.NextHeader
+		}
+
+		_, err := parseIPProtocol(protocol)
+		if err != nil {
+			return nil, err
+		}
 	case layers.LayerTypeARP:
 		break
 	default:
@@ -561,6 +723,7 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		packet:           packet,
 		linkLayer:        linkLayer,
 		networkLayer:     networkLayer,
+		fragmentLayer:    fragmentLayer,
 		transportLayer:   transportLayer,
 		icmpv4Indicator:  icmpv4Indicator,
 		applicationLayer: applicationLayer,
@@ -568,33 +731,43 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	}, nil
 }
 
-// ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
-func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
-	// Guess network layer type
-	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
+// ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer, which
+// is validated in the validation. Malformed packets are counted in the monitor.
+func ParseEmbPacket(contents []byte, validation Validation, monitor *stat.MalformedMonitor) (*PacketIndicator, error) {
+	var t gopacket.LayerType
+
+	if len(contents) <= 0 {
 		return nil, errors.New("missing network layer")
 	}
-	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
-	}
-	switch networkLayer.(*layers.IPv4).Version {
+
+	// Guess network layer type by version
+	switch contents[0] >> 4 {
 	case 4:
-		break
+		t = layers.LayerTypeIPv4
+	case 6:
+		t = layers.LayerTypeIPv6
 	default:
 		return nil, errors.New("network layer type not support")
 	}
 
+	packet := gopacket.NewPacket(contents, t, gopacket.NoCopy)
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return nil, errors.New("missing network layer")
+	}
+	if networkLayer.LayerType() != t {
+		return nil, errors.New("network layer type not support")
+	}
+
 	// Parse packet
-	indicator, err := ParsePacket(packet)
+	indicator, err := ParsePacket(packet, validation, monitor)
 	if err != nil {
 		return nil, err
 	}
 	return indicator, nil
 }
 
-// ParseRawPacket parses an array of byte as a packet and returns a packet indicator.
+// ParseRawPacket parses an array of byte as a packet in Ethernet or loopback and returns the packet.
 func ParseRawPacket(contents []byte) (gopacket.Packet, error) {
 	// Guess link layer type, and here we regard Ethernet layer as a link layer
 	packet := gopacket.NewPacket(contents, layers.LayerTypeEthernet, gopacket.NoCopy)
@@ -673,6 +846,8 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	switch t {
 	case layers.EthernetTypeIPv4:
 		return layers.LayerTypeIPv4, nil
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, nil
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
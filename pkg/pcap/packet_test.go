@@ -0,0 +1,231 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+var (
+	testSrcIPv4 = net.IPv4(10, 0, 0, 1).To4()
+	testDstIPv4 = net.IPv4(10, 0, 0, 2).To4()
+	testSrcIPv6 = net.ParseIP("fd00::1")
+	testDstIPv6 = net.ParseIP("fd00::2")
+	testSrcMAC  = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testDstMAC  = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// packetCase is a packet in the corpus, whose network layer leads contents in embedded packets, or link layer in
+// others, and the source and the destination it is interpreted of, which are not checked if they are empty.
+type packetCase struct {
+	name       string
+	contents   []byte
+	isEmbedded bool
+	isRejected bool
+	src        string
+	dst        string
+}
+
+func mustSerialize(t *testing.T, layers ...gopacket.SerializableLayer) []byte {
+	b, err := Serialize(layers...)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	return b
+}
+
+func ipv4Packet(t *testing.T, transportLayer gopacket.TransportLayer, payload []byte) []byte {
+	ipv4Layer, err := CreateIPv4Layer(testSrcIPv4, testDstIPv4, 1, 64, transportLayer)
+	if err != nil {
+		t.Fatalf("create ipv4 layer: %v", err)
+	}
+
+	return mustSerialize(t, ipv4Layer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(payload))
+}
+
+func ipv6UDPPacket(t *testing.T, payload []byte) []byte {
+	ipv6Layer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolUDP,
+		HopLimit:   64,
+		SrcIP:      testSrcIPv6,
+		DstIP:      testDstIPv6,
+	}
+	udpLayer := CreateUDPLayer(5000, 53)
+	err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+	if err != nil {
+		t.Fatalf("set network layer for checksum: %v", err)
+	}
+
+	return mustSerialize(t, ipv6Layer, udpLayer, gopacket.Payload(payload))
+}
+
+// ipv6FragmentPacket returns the first fragment of a UDP datagram in IPv6, whose fragment header is written by hand.
+func ipv6FragmentPacket(t *testing.T) []byte {
+	b := ipv6UDPPacket(t, []byte("fragmented"))
+	header, transport := b[:40], b[40:]
+
+	fragment := []byte{byte(layers.IPProtocolUDP), 0, 0x00, 0x01, 0x12, 0x34, 0x56, 0x78}
+	header[6] = byte(layers.IPProtocolIPv6Fragment)
+	length := len(fragment) + len(transport)
+	header[4], header[5] = byte(length>>8), byte(length)
+
+	return append(append(append([]byte{}, header...), fragment...), transport...)
+}
+
+func corpus(t *testing.T) []packetCase {
+	tcpLayer := CreateTCPLayer(40000, 443, 1, 1)
+	tcp := ipv4Packet(t, tcpLayer, []byte("hello"))
+	udp := ipv4Packet(t, CreateUDPLayer(5000, 53), []byte("hello"))
+
+	icmpLayer := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+	ipv4Layer, err := CreateIPv4Layer(testSrcIPv4, testDstIPv4, 1, 64, tcpLayer)
+	if err != nil {
+		t.Fatalf("create ipv4 layer: %v", err)
+	}
+	ipv4Layer.Protocol = layers.IPProtocolICMPv4
+	icmp := mustSerialize(t, ipv4Layer, icmpLayer, gopacket.Payload([]byte("ping")))
+
+	gre := append([]byte{}, udp...)
+	gre[9] = byte(layers.IPProtocolGRE)
+
+	ethernetLayer, err := CreateEthernetLayer(testSrcMAC, testDstMAC, ipv4Layer)
+	if err != nil {
+		t.Fatalf("create ethernet layer: %v", err)
+	}
+	ethernet := mustSerialize(t, ethernetLayer, gopacket.Payload(tcp))
+
+	arp := mustSerialize(t, &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   testSrcMAC,
+			SourceProtAddress: testSrcIPv4,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    testDstIPv4,
+		})
+
+	ipv6 := ipv6UDPPacket(t, []byte("hello"))
+
+	return []packetCase{
+		{name: "ipv4 tcp", contents: tcp, isEmbedded: true, src: "10.0.0.1:40000", dst: "10.0.0.2:443"},
+		{name: "ipv4 udp", contents: udp, isEmbedded: true, src: "10.0.0.1:5000", dst: "10.0.0.2:53"},
+		{name: "ipv4 icmp", contents: icmp, isEmbedded: true, src: "10.0.0.1@1", dst: "10.0.0.2@1"},
+		{name: "ipv6 udp", contents: ipv6, isEmbedded: true, src: "[fd00::1]:5000", dst: "[fd00::2]:53"},
+		{name: "ipv6 fragment", contents: ipv6FragmentPacket(t), isEmbedded: true},
+		{name: "ipv4 gre", contents: gre, isEmbedded: true, isRejected: true},
+		{name: "truncated ipv4", contents: tcp[:12], isEmbedded: true, isRejected: true},
+		{name: "version 5", contents: append([]byte{0x50}, tcp[1:]...), isEmbedded: true, isRejected: true},
+		{name: "empty", contents: nil, isEmbedded: true, isRejected: true},
+		{name: "ethernet ipv4 tcp", contents: ethernet, src: "10.0.0.1:40000", dst: "10.0.0.2:443"},
+		{name: "ethernet arp", contents: arp},
+	}
+}
+
+// parseCase parses the packet as the tunnel does, and returns its indicator.
+func parseCase(c packetCase, interpret bool) (*PacketIndicator, error) {
+	if c.isEmbedded {
+		return ParseEmbPacket(c.contents, ValidationNormal, nil)
+	}
+
+	packet := gopacket.NewPacket(c.contents, layers.LayerTypeEthernet, gopacket.NoCopy)
+	if interpret {
+		return InterpretPacket(packet)
+	}
+
+	return ParsePacket(packet, ValidationNormal, nil)
+}
+
+// touch reads everything of the indicator the tunnel reads of packets of its type, so accessors panicking on packets
+// accepted are found.
+func touch(indicator *PacketIndicator) {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+		_ = indicator.ARPLayer()
+		return
+	}
+
+	_ = indicator.SrcIP()
+	_ = indicator.DstIP()
+	_ = indicator.TTL()
+	_ = indicator.IsFrag()
+	_ = indicator.FragOffset()
+	_ = indicator.NetworkPayload()
+	_ = indicator.Payload()
+	_ = indicator.MTU()
+	_ = indicator.Size()
+	_ = indicator.Src()
+	_ = indicator.Dst()
+	if indicator.TransportLayer() != nil {
+		_ = indicator.NATSrc()
+		_ = indicator.NATDst()
+		_ = indicator.NATProtocol()
+	}
+}
+
+func TestParseCorpus(t *testing.T) {
+	for _, c := range corpus(t) {
+		for _, interpret := range []bool{false, true} {
+			indicator, err := parseCase(c, interpret)
+			if c.isRejected {
+				if err == nil {
+					t.Errorf("%s: expect error, got none", c.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+				continue
+			}
+
+			touch(indicator)
+			if c.dst == "" {
+				continue
+			}
+			if src := indicator.Src().String(); src != c.src {
+				t.Errorf("%s: expect source %s, got %s", c.name, c.src, src)
+			}
+			if dst := indicator.Dst().String(); dst != c.dst {
+				t.Errorf("%s: expect destination %s, got %s", c.name, c.dst, dst)
+			}
+		}
+	}
+}
+
+// TestParseMutations parses every prefix of packets in the corpus, and packets of every byte flipped, which are
+// either rejected or interpreted, but never panic.
+func TestParseMutations(t *testing.T) {
+	for _, c := range corpus(t) {
+		mutations := make([][]byte, 0)
+		for i := range c.contents {
+			mutations = append(mutations, c.contents[:i])
+
+			b := append([]byte{}, c.contents...)
+			b[i] ^= 0xff
+			mutations = append(mutations, b)
+		}
+
+		for i, b := range mutations {
+			m := c
+			m.contents = b
+			for _, interpret := range []bool{false, true} {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s: mutation %d panics: %v", c.name, i, r)
+						}
+					}()
+
+					indicator, err := parseCase(m, interpret)
+					if err == nil {
+						touch(indicator)
+					}
+				}()
+			}
+		}
+	}
+}
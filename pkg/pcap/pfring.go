@@ -0,0 +1,47 @@
+// +build linux,pfring
+
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pfring"
+)
+
+const isPFRingSupported = true
+
+// pfringHandle is a handle of PF_RING, which captures Ethernet frames only.
+type pfringHandle struct {
+	*pfring.Ring
+}
+
+func (h *pfringHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func openPFRing(dev string, snapLen int) (captureHandle, error) {
+	ring, err := pfring.NewRing(dev, uint32(snapLen), pfring.FlagPromisc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ring.SetSocketMode(pfring.WriteAndRead)
+	if err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("set socket mode: %w", err)
+	}
+
+	err = ring.SetApplicationName("ikago")
+	if err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("set application name: %w", err)
+	}
+
+	err = ring.Enable()
+	if err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("enable: %w", err)
+	}
+
+	return &pfringHandle{Ring: ring}, nil
+}
@@ -0,0 +1,11 @@
+// +build !linux !pfring
+
+package pcap
+
+import "errors"
+
+const isPFRingSupported = false
+
+func openPFRing(dev string, snapLen int) (captureHandle, error) {
+	return nil, errors.New("pfring not support")
+}
@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"ikago/pkg/stat"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pipelineQueueSize is the max count of writes queued to each client before they are encrypted.
+	pipelineQueueSize = 64
+	// pipelineIdle is the time the pipeline of a client waits for writes before it stops.
+	pipelineIdle = 30 * time.Second
+)
+
+const (
+	writePending int32 = iota
+	writeTaken
+	writeCancelled
+)
+
+// pendingWrite is a write queued in the pipeline of a client, whose result is sent to the channel. Each write sends
+// exactly one result, by the pipeline if it is taken, or by the cancellation if it is cancelled before.
+type pendingWrite struct {
+	p       []byte
+	dstIP   net.IP
+	dstPort uint16
+	isChaff bool
+	result  chan<- error
+	state   int32
+}
+
+// take marks the write taken by the pipeline, and returns false if it is cancelled.
+func (w *pendingWrite) take() bool {
+	return atomic.CompareAndSwapInt32(&w.state, writePending, writeTaken)
+}
+
+// cancel cancels the write with ErrTimeout if it is not taken by the pipeline yet.
+func (w *pendingWrite) cancel() {
+	if atomic.CompareAndSwapInt32(&w.state, writePending, writeCancelled) {
+		w.result <- ErrTimeout
+	}
+}
+
+// isCancelled returns if the write is cancelled.
+func (w *pendingWrite) isCancelled() bool {
+	return atomic.LoadInt32(&w.state) == writeCancelled
+}
+
+// queueWrites queues writes in the pipeline of the client in order, and starts the pipeline if it is not started. Writes
+// are blocked while the queue is full.
+func (c *FakeTCPConn) queueWrites(client *clientIndicator, ws ...*pendingWrite) error {
+	c.lock.Lock()
+	if client.writes == nil {
+		writes := make(chan *pendingWrite, pipelineQueueSize)
+		client.writes = writes
+		c.spawn(func() {
+			c.runPipeline(client, writes)
+		})
+	}
+	writes := client.writes
+	// The pipeline never stops while writes are queuing
+	client.queuing++
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		client.queuing--
+		c.lock.Unlock()
+	}()
+
+	for _, w := range ws {
+		if c.queMonitor != nil && len(writes) >= cap(writes) {
+			c.queMonitor.Add((&net.TCPAddr{IP: w.dstIP, Port: int(w.dstPort)}).String(), stat.QueueSendFull)
+		}
+
+		select {
+		case <-c.closed:
+			return ErrClosed
+		case writes <- w:
+		}
+	}
+
+	return nil
+}
+
+// runPipeline writes writes queued to the client in order, until the connection is closed or no write is queued in a
+// while. Pipelines run until the connection is closed rather than its context is done, so peers are closed gracefully.
+func (c *FakeTCPConn) runPipeline(client *clientIndicator, writes chan *pendingWrite) {
+	timer := time.NewTimer(pipelineIdle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case w := <-writes:
+			// Writes cancelled are dropped
+			if w.isCancelled() {
+				continue
+			}
+
+			// Writes are paced by the congestion control of the client, and may be cancelled in pacing
+			isPaced := c.pace(client, len(w.p))
+			if !w.take() {
+				continue
+			}
+			if !isPaced {
+				w.result <- ErrClosed
+				return
+			}
+			w.result <- c.write(client, w)
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(pipelineIdle)
+		case <-timer.C:
+			c.lock.Lock()
+			if client.queuing <= 0 && len(writes) <= 0 {
+				client.writes = nil
+				c.lock.Unlock()
+				return
+			}
+			c.lock.Unlock()
+
+			timer.Reset(pipelineIdle)
+		}
+	}
+}
+
+// Queued returns the count of writes queued in the pipeline of the remote client.
+func (c *FakeTCPConn) Queued() int {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(client.writes)
+}
@@ -0,0 +1,61 @@
+package pcap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Preamble describes what identifies handshakes of FakeTCP.
+type Preamble int
+
+const (
+	// PreambleTagged describes TCP SYN carrying the method tag, the proof and the cookie, with TCP sequences starting
+	// from 0.
+	PreambleTagged Preamble = iota
+	// PreambleNone describes TCP SYN carrying nothing, with TCP sequences starting randomly, so handshakes look like
+	// any other TCP.
+	PreambleNone
+)
+
+func (p Preamble) String() string {
+	switch p {
+	case PreambleTagged:
+		return "tagged"
+	case PreambleNone:
+		return "none"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+// ParsePreamble returns the preamble by given name.
+func ParsePreamble(s string) (Preamble, error) {
+	switch strings.ToLower(s) {
+	case "", "tagged":
+		return PreambleTagged, nil
+	case "none":
+		return PreambleNone, nil
+	default:
+		return 0, fmt.Errorf("preamble %s not support", s)
+	}
+}
+
+// initialSeq returns the TCP sequence connections start from.
+func (p Preamble) initialSeq() uint32 {
+	if p == PreambleNone {
+		return randUint32()
+	}
+
+	return 0
+}
+
+// untaggedVersion returns the version of the wire format of clients whose TCP SYN carry nothing, which is the version
+// given without a preamble, or WireVersion0 before method tags otherwise.
+func (p Preamble) untaggedVersion(version int) int {
+	if p == PreambleNone {
+		return version
+	}
+
+	return WireVersion0
+}
@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"sync"
+)
+
+// priorityQueueLimit is the max count of writes queued in the bulk queue of a priority scheduler, scheduling more
+// writes blocks until the queue is drained.
+const priorityQueueLimit = 4096
+
+// Prioritizer is implemented by schedulers which prioritize writes by the data written.
+type Prioritizer interface {
+	// SchedulePriority schedules a write of size bytes which writes the data tunneled, or a fragment of it. Writes of
+	// the same priority are performed in the order they are scheduled.
+	SchedulePriority(write func() error, data []byte, size int)
+}
+
+// PriorityScheduler is a scheduler lets writes of small packets jump ahead of queued writes of large packets, so the
+// latency added to small packets like game state updates is bounded by the write of one fragment when a bulk transfer
+// shares the tunnel.
+type PriorityScheduler struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	threshold int
+	small     []func() error
+	large     []func() error
+	wg        sync.WaitGroup
+	isClosed  bool
+}
+
+// NewPriorityScheduler returns a new priority scheduler. Packets no larger than the threshold are written first.
+func NewPriorityScheduler(threshold int) (*PriorityScheduler, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("threshold %d out of range", threshold)
+	}
+
+	scheduler := &PriorityScheduler{
+		threshold: threshold,
+		small:     make([]func() error, 0),
+		large:     make([]func() error, 0),
+	}
+	scheduler.cond = sync.NewCond(&scheduler.lock)
+
+	scheduler.wg.Add(1)
+	go func() {
+		defer scheduler.wg.Done()
+		scheduler.run()
+	}()
+
+	return scheduler, nil
+}
+
+// Schedule schedules a write of unknown size, which is treated as a write of a large packet.
+func (scheduler *PriorityScheduler) Schedule(write func() error) {
+	scheduler.schedule(write, false)
+}
+
+func (scheduler *PriorityScheduler) SchedulePriority(write func() error, data []byte, size int) {
+	scheduler.schedule(write, len(data) <= scheduler.threshold)
+}
+
+func (scheduler *PriorityScheduler) schedule(write func() error, isSmall bool) {
+	scheduler.lock.Lock()
+
+	// Wait for the bulk queue to be drained
+	for !isSmall && !scheduler.isClosed && len(scheduler.large) >= priorityQueueLimit {
+		scheduler.cond.Wait()
+	}
+
+	if scheduler.isClosed {
+		scheduler.lock.Unlock()
+		perform(write)
+		return
+	}
+
+	if isSmall {
+		scheduler.small = append(scheduler.small, write)
+	} else {
+		scheduler.large = append(scheduler.large, write)
+	}
+	scheduler.cond.Broadcast()
+
+	scheduler.lock.Unlock()
+}
+
+func (scheduler *PriorityScheduler) run() {
+	for {
+		scheduler.lock.Lock()
+		for !scheduler.isClosed && len(scheduler.small) <= 0 && len(scheduler.large) <= 0 {
+			scheduler.cond.Wait()
+		}
+
+		var write func() error
+		if len(scheduler.small) > 0 {
+			write = scheduler.small[0]
+			scheduler.small = scheduler.small[1:]
+		} else if len(scheduler.large) > 0 {
+			write = scheduler.large[0]
+			scheduler.large = scheduler.large[1:]
+			scheduler.cond.Broadcast()
+		} else {
+			// Closed and drained
+			scheduler.lock.Unlock()
+			return
+		}
+		scheduler.lock.Unlock()
+
+		perform(write)
+	}
+}
+
+func (scheduler *PriorityScheduler) Close() error {
+	scheduler.lock.Lock()
+	scheduler.isClosed = true
+	scheduler.cond.Broadcast()
+	scheduler.lock.Unlock()
+
+	// Writes queued are performed before the scheduler exits
+	scheduler.wg.Wait()
+
+	return nil
+}
+
+func perform(write func() error) {
+	err := write()
+	if err != nil {
+		log.Errorln(fmt.Errorf("write: %w", err))
+	}
+}
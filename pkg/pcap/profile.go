@@ -0,0 +1,122 @@
+package pcap
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Profile describes the shape of traffic of a cover application.
+type Profile struct {
+	// Sizes are sizes packets are padded to.
+	Sizes []int
+	// Interval is the interval between batches of packets, 0 means packets are not paced.
+	Interval time.Duration
+	// Jitter is the random delay of each batch of packets.
+	Jitter time.Duration
+}
+
+var (
+	profilesLock sync.RWMutex
+	profiles     = map[string]*Profile{
+		// Video calls send frames in a steady clock with medium and large packets
+		"video-call": {
+			Sizes:    []int{240, 480, 960, 1200},
+			Interval: 20 * time.Millisecond,
+			Jitter:   5 * time.Millisecond,
+		},
+		// HTTPS browsing sends requests in small packets and responses in bursts of full-sized packets
+		"https": {
+			Sizes:  []int{120, 600, MaxMTU},
+			Jitter: 10 * time.Millisecond,
+		},
+	}
+)
+
+// RegisterProfile registers a profile, an existing one will be replaced.
+func RegisterProfile(name string, profile *Profile) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	profiles[name] = profile
+}
+
+// FindProfile returns the profile by its name.
+func FindProfile(name string) (*Profile, error) {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not support", name)
+	}
+
+	return profile, nil
+}
+
+// ProfileScheduler is a scheduler shapes packet sizes and pacing of traffic by a profile.
+type ProfileScheduler struct {
+	*JitterScheduler
+	lock    sync.Mutex
+	sizes   []int
+	padRand *rand.Rand
+}
+
+// NewProfileScheduler returns a new profile scheduler. Packets are padded only if pad is set.
+func NewProfileScheduler(profile *Profile, pad bool) (*ProfileScheduler, error) {
+	if profile.Jitter < 0 {
+		return nil, fmt.Errorf("jitter %s out of range", profile.Jitter)
+	}
+	if profile.Interval < 0 {
+		return nil, fmt.Errorf("interval %s out of range", profile.Interval)
+	}
+
+	scheduler := &ProfileScheduler{
+		JitterScheduler: &JitterScheduler{
+			budget:   profile.Jitter,
+			interval: profile.Interval,
+			rand:     rand.New(rand.NewSource(int64(randUint32()))),
+			batch:    make([]func() error, 0),
+		},
+		padRand: rand.New(rand.NewSource(int64(randUint32()))),
+	}
+
+	if pad {
+		scheduler.sizes = append(scheduler.sizes, profile.Sizes...)
+		sort.Ints(scheduler.sizes)
+	}
+
+	return scheduler, nil
+}
+
+// Pad pads the data with random bytes to the smallest size of the profile which fits it. The padding follows the
+// embedded packet, and will be ignored by the peer since the packet describes its own length.
+func (scheduler *ProfileScheduler) Pad(b []byte, max int) []byte {
+	for _, size := range scheduler.sizes {
+		if size > max {
+			break
+		}
+		if size < len(b) {
+			continue
+		}
+		if size == len(b) {
+			return b
+		}
+
+		padding := make([]byte, size-len(b))
+
+		scheduler.lock.Lock()
+		scheduler.padRand.Read(padding)
+		scheduler.lock.Unlock()
+
+		result := make([]byte, 0, size)
+		result = append(result, b...)
+		result = append(result, padding...)
+
+		return result
+	}
+
+	return b
+}
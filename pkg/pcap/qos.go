@@ -0,0 +1,453 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/pkg/config"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Class describes the traffic class of packets.
+type Class int
+
+const (
+	// ClassRealtime describes packets sensitive to latency, like voice chat and game traffic.
+	ClassRealtime Class = iota
+	// ClassNormal describes packets not matched by any rule.
+	ClassNormal
+	// ClassBulk describes packets of background transfers, like downloads.
+	ClassBulk
+)
+
+// classes are all classes in the order they are matched.
+var classes = []Class{ClassRealtime, ClassNormal, ClassBulk}
+
+func (c Class) String() string {
+	switch c {
+	case ClassRealtime:
+		return "realtime"
+	case ClassNormal:
+		return "normal"
+	case ClassBulk:
+		return "bulk"
+	default:
+		return strconv.Itoa(int(c))
+	}
+}
+
+// ClassRule describes packets of a class by their protocol and ports.
+type ClassRule struct {
+	// Protocol is the IP protocol number, 0 matches both TCP and UDP.
+	Protocol uint8
+	// MinPort and MaxPort are the range of ports, which is matched against both the source and the destination port.
+	// Ports are not matched if both are 0.
+	MinPort uint16
+	MaxPort uint16
+}
+
+// ParseClassRule returns the rule in the form of protocol, port, range of ports or protocol/port, e.g. udp, 27015,
+// 3478-3481 and udp/27015. Protocol can be tcp, udp or icmp.
+func ParseClassRule(s string) (*ClassRule, error) {
+	rule := &ClassRule{}
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return nil, errors.New("empty rule")
+	}
+	ports := s
+
+	i := strings.Index(s, "/")
+	if i >= 0 || (len(s) > 0 && (s[0] < '0' || s[0] > '9')) {
+		protocol := s
+		ports = ""
+		if i >= 0 {
+			protocol = s[:i]
+			ports = s[i+1:]
+		}
+
+		switch protocol {
+		case "tcp":
+			rule.Protocol = 6
+		case "udp":
+			rule.Protocol = 17
+		case "icmp":
+			if ports != "" {
+				return nil, fmt.Errorf("icmp with port %s", ports)
+			}
+			rule.Protocol = 1
+		default:
+			return nil, fmt.Errorf("protocol %s not support", protocol)
+		}
+	}
+
+	if ports == "" {
+		return rule, nil
+	}
+
+	min, max := ports, ports
+	if j := strings.Index(ports, "-"); j >= 0 {
+		min, max = ports[:j], ports[j+1:]
+	}
+
+	minPort, err := strconv.ParseUint(min, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port %s: %w", min, err)
+	}
+	maxPort, err := strconv.ParseUint(max, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port %s: %w", max, err)
+	}
+	if minPort <= 0 || minPort > maxPort {
+		return nil, fmt.Errorf("ports %s out of range", ports)
+	}
+
+	rule.MinPort = uint16(minPort)
+	rule.MaxPort = uint16(maxPort)
+
+	return rule, nil
+}
+
+func (rule *ClassRule) matchPort(port uint16) bool {
+	return port >= rule.MinPort && port <= rule.MaxPort
+}
+
+// BPFFilter returns the BPF filter of packets matched.
+func (rule *ClassRule) BPFFilter() string {
+	var protocol string
+	switch rule.Protocol {
+	case 1:
+		return "icmp"
+	case 6:
+		protocol = "tcp"
+	case 17:
+		protocol = "udp"
+	default:
+		protocol = "(tcp || udp)"
+	}
+
+	if rule.MinPort == 0 && rule.MaxPort == 0 {
+		return protocol
+	}
+	if rule.MinPort == rule.MaxPort {
+		return fmt.Sprintf("(%s && port %d)", protocol, rule.MinPort)
+	}
+
+	return fmt.Sprintf("(%s && portrange %d-%d)", protocol, rule.MinPort, rule.MaxPort)
+}
+
+// match returns if the packet in protocol between ports is matched. Ports are 0 if they are unknown.
+func (rule *ClassRule) match(protocol uint8, srcPort, dstPort uint16) bool {
+	if rule.Protocol != 0 {
+		if rule.Protocol != protocol {
+			return false
+		}
+	} else if rule.MinPort != 0 && protocol != 6 && protocol != 17 {
+		return false
+	}
+
+	if rule.MinPort == 0 && rule.MaxPort == 0 {
+		return true
+	}
+
+	return rule.matchPort(srcPort) || rule.matchPort(dstPort)
+}
+
+// qosQuantum is the bytes a class of weight 1 may write in each round.
+const qosQuantum = MaxMTU
+
+type qosWrite struct {
+	write func() error
+	size  int
+}
+
+type qosQueue struct {
+	weight     int
+	rate       int
+	rules      []*ClassRule
+	writes     []qosWrite
+	deficit    int
+	tokens     float64
+	lastRefill time.Time
+}
+
+// refill refills tokens of the queue, no more than the rate can be saved.
+func (queue *qosQueue) refill(now time.Time) {
+	if queue.rate <= 0 {
+		return
+	}
+
+	queue.tokens = queue.tokens + now.Sub(queue.lastRefill).Seconds()*float64(queue.rate)
+	if queue.tokens > float64(queue.rate) {
+		queue.tokens = float64(queue.rate)
+	}
+	queue.lastRefill = now
+}
+
+// wait returns the time before the queue may write again.
+func (queue *qosQueue) wait() time.Duration {
+	if queue.rate <= 0 || queue.tokens > 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(-queue.tokens / float64(queue.rate) * float64(time.Second)))
+}
+
+// QoSScheduler is a scheduler classifies packets by their protocols and ports, and shares the bandwidth among classes
+// by their weights in deficit round robin, so traffic like voice chat and games is not degraded by a background
+// download through the same tunnel. Classes with a rate are capped to it.
+type QoSScheduler struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queues   []*qosQueue
+	turn     int
+	credited bool
+	timer    *time.Timer
+	wg       sync.WaitGroup
+	isClosed bool
+}
+
+// NewQoSScheduler returns a new QoS scheduler by the config. Packets not matched by any rule are in the normal class.
+func NewQoSScheduler(qos *config.QoSConfig) (*QoSScheduler, error) {
+	scheduler := &QoSScheduler{
+		queues: make([]*qosQueue, 0),
+	}
+	scheduler.cond = sync.NewCond(&scheduler.lock)
+
+	now := time.Now()
+	for i, classConfig := range []*config.QoSClassConfig{&qos.Realtime, &qos.Normal, &qos.Bulk} {
+		if classConfig.Weight <= 0 {
+			return nil, fmt.Errorf("weight %d of class %s out of range", classConfig.Weight, classes[i])
+		}
+		if classConfig.Rate < 0 {
+			return nil, fmt.Errorf("rate %d of class %s out of range", classConfig.Rate, classes[i])
+		}
+
+		rules := make([]*ClassRule, 0)
+		for _, s := range classConfig.Match {
+			rule, err := ParseClassRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse rule %s of class %s: %w", s, classes[i], err)
+			}
+			rules = append(rules, rule)
+		}
+
+		scheduler.queues = append(scheduler.queues, &qosQueue{
+			weight:     classConfig.Weight,
+			rate:       classConfig.Rate,
+			rules:      rules,
+			writes:     make([]qosWrite, 0),
+			tokens:     float64(classConfig.Rate),
+			lastRefill: now,
+		})
+	}
+
+	scheduler.wg.Add(1)
+	go func() {
+		defer scheduler.wg.Done()
+		scheduler.run()
+	}()
+
+	return scheduler, nil
+}
+
+// Classify returns the class of the packet tunneled.
+func (scheduler *QoSScheduler) Classify(data []byte) Class {
+	protocol, srcPort, dstPort := parseProtocolAndPorts(data)
+
+	for i, queue := range scheduler.queues {
+		for _, rule := range queue.rules {
+			if rule.match(protocol, srcPort, dstPort) {
+				return classes[i]
+			}
+		}
+	}
+
+	return ClassNormal
+}
+
+// parseProtocolAndPorts returns the protocol and ports of the IP packet. Ports are 0 if the packet is not TCP or UDP, or
+// is a non-first fragment. ICMPv6 is returned as ICMP.
+func parseProtocolAndPorts(data []byte) (uint8, uint16, uint16) {
+	var (
+		protocol uint8
+		offset   int
+	)
+
+	if len(data) < 1 {
+		return 0, 0, 0
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return 0, 0, 0
+		}
+		protocol = data[9]
+		offset = int(data[0]&0x0f) * 4
+
+		// Non-first fragments carry no ports
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return protocol, 0, 0
+		}
+	case 6:
+		if len(data) < 40 {
+			return 0, 0, 0
+		}
+		protocol = data[6]
+		offset = 40
+
+		if protocol == 58 {
+			protocol = 1
+		}
+	default:
+		return 0, 0, 0
+	}
+
+	if protocol != 6 && protocol != 17 {
+		return protocol, 0, 0
+	}
+	if len(data) < offset+4 {
+		return protocol, 0, 0
+	}
+
+	return protocol, binary.BigEndian.Uint16(data[offset : offset+2]), binary.BigEndian.Uint16(data[offset+2 : offset+4])
+}
+
+// Schedule schedules a write of unknown size, which is in the normal class.
+func (scheduler *QoSScheduler) Schedule(write func() error) {
+	scheduler.schedule(ClassNormal, write, 0)
+}
+
+func (scheduler *QoSScheduler) SchedulePriority(write func() error, data []byte, size int) {
+	scheduler.schedule(scheduler.Classify(data), write, size)
+}
+
+func (scheduler *QoSScheduler) schedule(c Class, write func() error, size int) {
+	scheduler.lock.Lock()
+
+	queue := scheduler.queues[c]
+
+	// Wait for the queue to be drained
+	for !scheduler.isClosed && len(queue.writes) >= priorityQueueLimit {
+		scheduler.cond.Wait()
+	}
+
+	if scheduler.isClosed {
+		scheduler.lock.Unlock()
+		perform(write)
+		return
+	}
+
+	queue.writes = append(queue.writes, qosWrite{write: write, size: size})
+	scheduler.cond.Broadcast()
+
+	scheduler.lock.Unlock()
+}
+
+// next returns the next write in deficit round robin, or the time to wait if all classes with writes are capped.
+func (scheduler *QoSScheduler) next() (func() error, time.Duration) {
+	now := time.Now()
+	for _, queue := range scheduler.queues {
+		queue.refill(now)
+	}
+
+	var wait time.Duration
+	for i := 0; i < 2*len(scheduler.queues)+1; i++ {
+		queue := scheduler.queues[scheduler.turn]
+
+		if len(queue.writes) > 0 {
+			d := queue.wait()
+			if d <= 0 || scheduler.isClosed {
+				if !scheduler.credited {
+					queue.deficit = queue.deficit + queue.weight*qosQuantum
+					scheduler.credited = true
+				}
+
+				w := queue.writes[0]
+				if w.size <= queue.deficit {
+					queue.writes = queue.writes[1:]
+					queue.deficit = queue.deficit - w.size
+					queue.tokens = queue.tokens - float64(w.size)
+					scheduler.cond.Broadcast()
+
+					return w.write, 0
+				}
+			} else if wait <= 0 || d < wait {
+				wait = d
+			}
+		} else {
+			// Idle classes do not save their deficits
+			queue.deficit = 0
+		}
+
+		scheduler.turn = (scheduler.turn + 1) % len(scheduler.queues)
+		scheduler.credited = false
+	}
+
+	return nil, wait
+}
+
+func (scheduler *QoSScheduler) run() {
+	for {
+		scheduler.lock.Lock()
+
+		var write func() error
+		for write == nil {
+			isEmpty := true
+			for _, queue := range scheduler.queues {
+				if len(queue.writes) > 0 {
+					isEmpty = false
+					break
+				}
+			}
+			if isEmpty {
+				if scheduler.isClosed {
+					scheduler.lock.Unlock()
+					return
+				}
+
+				scheduler.cond.Wait()
+				continue
+			}
+
+			var wait time.Duration
+			write, wait = scheduler.next()
+			if write == nil && wait > 0 {
+				// All classes with writes are capped, wait for their tokens
+				if scheduler.timer == nil {
+					scheduler.timer = time.AfterFunc(wait, func() {
+						scheduler.lock.Lock()
+						scheduler.timer = nil
+						scheduler.cond.Broadcast()
+						scheduler.lock.Unlock()
+					})
+				}
+				scheduler.cond.Wait()
+			}
+		}
+
+		scheduler.lock.Unlock()
+
+		perform(write)
+	}
+}
+
+func (scheduler *QoSScheduler) Close() error {
+	scheduler.lock.Lock()
+	scheduler.isClosed = true
+	if scheduler.timer != nil {
+		scheduler.timer.Stop()
+	}
+	scheduler.cond.Broadcast()
+	scheduler.lock.Unlock()
+
+	// Writes queued are performed before the scheduler exits
+	scheduler.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"ikago/internal/log"
+	"ikago/pkg/stat"
+	"net"
+	"sync"
+	"time"
+)
+
+// quarantineThreshold is the count of malformed packets from a source in quarantineWindow after which the source is
+// quarantined.
+const quarantineThreshold = 100
+
+// quarantineWindow is the window malformed packets are counted in.
+const quarantineWindow = 10 * time.Second
+
+// quarantineDuration is the duration packets from a quarantined source are dropped without being processed.
+const quarantineDuration = 1 * time.Minute
+
+type sourceIndicator struct {
+	count int
+	start time.Time
+	until time.Time
+}
+
+// quarantine counts malformed packets in statistics, and quarantines sources sending too many malformed packets if it
+// tracks sources.
+type quarantine struct {
+	monitor     *stat.MalformedMonitor
+	sourcesLock sync.RWMutex
+	sources     map[string]*sourceIndicator
+	lastPurge   time.Time
+}
+
+// newQuarantine returns a quarantine of sources of malformed packets, which are counted in the monitor.
+func newQuarantine(monitor *stat.MalformedMonitor) *quarantine {
+	return &quarantine{
+		monitor:   monitor,
+		sources:   make(map[string]*sourceIndicator),
+		lastPurge: time.Now(),
+	}
+}
+
+// newMalformedCounter returns a quarantine which only counts malformed packets in the monitor, and never quarantines
+// their sources.
+func newMalformedCounter(monitor *stat.MalformedMonitor) *quarantine {
+	return &quarantine{monitor: monitor}
+}
+
+// count records a malformed packet in statistics only.
+func (q *quarantine) count(event stat.MalformedEvent) {
+	if q.monitor != nil {
+		q.monitor.Add(event)
+	}
+}
+
+// add records a malformed packet from the IP which is dropped, and quarantines the IP if too many malformed packets
+// are from it and sources are tracked.
+func (q *quarantine) add(ip net.IP, event stat.MalformedEvent) {
+	q.count(event)
+
+	if ip == nil || q.sources == nil {
+		return
+	}
+
+	now := time.Now()
+
+	q.sourcesLock.Lock()
+	defer q.sourcesLock.Unlock()
+
+	// Purge sources out of the window and the quarantine
+	if now.Sub(q.lastPurge) > quarantineWindow {
+		for s, indicator := range q.sources {
+			if now.Sub(indicator.start) > quarantineWindow && now.After(indicator.until) {
+				delete(q.sources, s)
+			}
+		}
+		q.lastPurge = now
+	}
+
+	key := string(ip.To16())
+	indicator, ok := q.sources[key]
+	if !ok {
+		indicator = &sourceIndicator{start: now}
+		q.sources[key] = indicator
+	}
+	if now.Sub(indicator.start) > quarantineWindow {
+		indicator.count = 0
+		indicator.start = now
+	}
+	indicator.count++
+
+	if indicator.count < quarantineThreshold || now.Before(indicator.until) {
+		return
+	}
+	indicator.until = now.Add(quarantineDuration)
+
+	q.count(stat.MalformedEventQuarantined)
+
+	log.Errorf("Quarantine %s for %s because of %d malformed packets in %s\n", ip, quarantineDuration, indicator.count, quarantineWindow)
+}
+
+// addPanic records a packet from the IP which panics in parsing and is dropped. Such packets count towards the
+// quarantine as other malformed packets.
+func (q *quarantine) addPanic(ip net.IP, err error) {
+	if q.monitor != nil && ip != nil {
+		q.monitor.AddPanicSource(ip.String())
+	}
+
+	q.add(ip, stat.MalformedEventPanic)
+
+	log.Errorln(fmt.Errorf("drop packet from %s: %w", ip, err))
+}
+
+// isQuarantined returns if the source of the packet is quarantined.
+func (q *quarantine) isQuarantined(packet gopacket.Packet) bool {
+	if q.sources == nil {
+		return false
+	}
+
+	ip := srcIP(packet)
+	if ip == nil {
+		return false
+	}
+
+	q.sourcesLock.RLock()
+	defer q.sourcesLock.RUnlock()
+
+	indicator, ok := q.sources[string(ip.To16())]
+	if !ok {
+		return false
+	}
+
+	return time.Now().Before(indicator.until)
+}
+
+// srcIP returns the source IP of the packet, or nil if the packet does not have a network layer.
+func srcIP(packet gopacket.Packet) net.IP {
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return nil
+	}
+
+	return networkLayer.NetworkFlow().Src().Raw()
+}
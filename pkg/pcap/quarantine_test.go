@@ -0,0 +1,40 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/pkg/stat"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	tests := []struct {
+		name          string
+		q             *quarantine
+		isQuarantined bool
+	}{
+		{name: "listener", q: newQuarantine(stat.NewMalformedMonitor()), isQuarantined: true},
+		{name: "peer", q: newMalformedCounter(stat.NewMalformedMonitor())},
+	}
+
+	b := ipv4Packet(t, &layers.UDP{SrcPort: 1, DstPort: 2}, []byte{0})
+	packet := gopacket.NewPacket(b, layers.LayerTypeIPv4, gopacket.Default)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < quarantineThreshold; i++ {
+				tt.q.add(srcIP(packet), stat.MalformedEventParse)
+			}
+
+			if got := tt.q.isQuarantined(packet); got != tt.isQuarantined {
+				t.Errorf("quarantined: want %t, got %t", tt.isQuarantined, got)
+			}
+			if got := tt.q.monitor.Parse(); got != quarantineThreshold {
+				t.Errorf("parse: want %d, got %d", quarantineThreshold, got)
+			}
+			if got := tt.q.monitor.Quarantined() > 0; got != tt.isQuarantined {
+				t.Errorf("quarantined in monitor: want %t, got %t", tt.isQuarantined, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,616 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"sync"
+	"time"
+)
+
+type timeoutError struct {
+	Err string
+}
+
+func (err *timeoutError) Error() string {
+	return err.Err
+}
+
+func (err *timeoutError) Timeout() bool {
+	return true
+}
+
+// MaxMTU is the max transmission and receive unit in pcap raw conn of standard Ethernet.
+const MaxMTU = 1500
+
+// MaxJumboMTU is the max transmission and receive unit in pcap raw conn of jumbo frames.
+const MaxJumboMTU = 9000
+
+// IPv4MaxSize is the max size of an IPv4 packet.
+const IPv4MaxSize = 65535
+
+// snapLenOverhead is the size reserved for link layer headers in each packet in pcap raw conn.
+const snapLenOverhead = 100
+
+// snapLen returns the max size of each packet in pcap raw conn in the device.
+func snapLen(dev *Device, cfg *config.PcapConfig) int {
+	if cfg != nil && cfg.SnapLen > 0 {
+		return cfg.SnapLen
+	}
+
+	mtu := MaxMTU
+	if dev != nil && dev.MTU() > mtu {
+		mtu = dev.MTU()
+	}
+
+	return mtu + snapLenOverhead
+}
+
+// maxRecoverInterval is the max interval between attempts of recovering a raw conn.
+const maxRecoverInterval = 30 * time.Second
+
+// maxWriteFailures is the count of consecutive write failures after which a raw conn is recovered.
+const maxWriteFailures = 3
+
+// RawConn is a raw network connection.
+type RawConn struct {
+	lock        sync.RWMutex
+	recoverLock sync.Mutex
+	srcDev      *Device
+	dstDev      *Device
+	filter      string
+	snapLen     int
+	options     *options
+	handle      captureHandle
+	failures    int
+	recovered   func(dev *Device)
+	quarantine  *quarantine
+	isClosed    bool
+}
+
+// LibVersion returns the version of the library of pcap, which is libpcap, Npcap or WinPcap.
+func LibVersion() string {
+	return pcap.Version()
+}
+
+// fullFilter returns the filter with the extra filter appended.
+func fullFilter(filter, extraFilter string) string {
+	if extraFilter == "" {
+		return filter
+	}
+
+	return fmt.Sprintf("(%s) && (%s)", filter, extraFilter)
+}
+
+// filterKey is the key of compiled filters.
+type filterKey struct {
+	linkType layers.LinkType
+	snapLen  int
+	filter   string
+}
+
+// filterCache caches compiled BPF filters, so raw conns opened with the same filter are not compiled again.
+type filterCache struct {
+	lock     sync.Mutex
+	programs map[filterKey][]pcap.BPFInstruction
+}
+
+func newFilterCache() *filterCache {
+	return &filterCache{programs: make(map[filterKey][]pcap.BPFInstruction)}
+}
+
+// setFilter sets the filter of the handle, the filter is compiled directly if the cache is nil or the handle is not of
+// pcap.
+func (cache *filterCache) setFilter(h captureHandle, snapLen int, filter string) error {
+	handle, ok := h.(*pcap.Handle)
+	if !ok {
+		return h.SetBPFFilter(filter)
+	}
+	if cache == nil {
+		return handle.SetBPFFilter(filter)
+	}
+
+	key := filterKey{linkType: handle.LinkType(), snapLen: snapLen, filter: filter}
+
+	cache.lock.Lock()
+	program, ok := cache.programs[key]
+	cache.lock.Unlock()
+	if !ok {
+		var err error
+
+		program, err = pcap.CompileBPFFilter(key.linkType, snapLen, filter)
+		if err != nil {
+			return err
+		}
+
+		cache.lock.Lock()
+		cache.programs[key] = program
+		cache.lock.Unlock()
+	}
+
+	return handle.SetBPFInstructionFilter(program)
+}
+
+// openLive opens the device in the backend and the tuning of options, and sets the filter with the extra filter of
+// options appended.
+func openLive(dev string, snapLen int, filter string, o *options) (captureHandle, error) {
+	var (
+		handle captureHandle
+		err    error
+	)
+
+	switch {
+	case isMemoryDev(dev):
+		handle, err = openMemory(dev)
+	case o.backend == BackendPFRing:
+		handle, err = openPFRing(dev, snapLen)
+	default:
+		handle, err = openPcap(dev, snapLen, o.pcapConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames in 802.11 of Wi-Fi adapters in monitor mode cannot be sent or parsed
+	switch t := handle.LinkType(); t {
+	case layers.LinkTypeEthernet, layers.LinkTypeNull, layers.LinkTypeLoop:
+		break
+	default:
+		handle.Close()
+		return nil, fmt.Errorf("link type %s not support", t)
+	}
+
+	// Filters are compiled against the link type of each device
+	filter = fullFilter(filter, o.extraFilter)
+	err = o.filters.setFilter(handle, snapLen, filter)
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("set filter %s: %w", filter, err)
+	}
+
+	return handle, nil
+}
+
+func openPcap(dev string, snapLen int, cfg *config.PcapConfig) (*pcap.Handle, error) {
+	if cfg == nil {
+		cfg = &config.PcapConfig{}
+	}
+
+	handle, err := openPcapPromisc(dev, snapLen, true, cfg)
+	if err == nil {
+		return handle, nil
+	}
+
+	// Some Wi-Fi adapters refuse promiscuous mode, especially in Npcap, so they are opened again without it
+	handle, e := openPcapPromisc(dev, snapLen, false, cfg)
+	if e != nil {
+		return nil, err
+	}
+	log.Verbosef("Capture in device %s without promiscuous mode: %s\n", dev, err)
+
+	return handle, nil
+}
+
+func openPcapPromisc(dev string, snapLen int, promisc bool, cfg *config.PcapConfig) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	err = inactive.SetSnapLen(snapLen)
+	if err != nil {
+		return nil, fmt.Errorf("set snaplen %d: %w", snapLen, err)
+	}
+
+	err = inactive.SetPromisc(promisc)
+	if err != nil {
+		return nil, fmt.Errorf("set promisc: %w", err)
+	}
+
+	timeout := pcap.BlockForever
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	err = inactive.SetTimeout(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("set timeout: %w", err)
+	}
+
+	if cfg.Buffer > 0 {
+		err = inactive.SetBufferSize(cfg.Buffer * 1024)
+		if err != nil {
+			return nil, fmt.Errorf("set buffer size %d KB: %w", cfg.Buffer, err)
+		}
+	}
+
+	// Packets are delivered as soon as they arrive in immediate mode instead of in batches
+	if cfg.Immediate {
+		err = inactive.SetImmediateMode(true)
+		if err != nil {
+			return nil, fmt.Errorf("set immediate mode: %w", err)
+		}
+	}
+
+	return inactive.Activate()
+}
+
+func createPureRawConn(dev string, snapLen int, filter string, o *options) (*RawConn, error) {
+	handle, err := openLive(dev, snapLen, filter, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawConn{
+		filter:  filter,
+		snapLen: snapLen,
+		options: o,
+		handle:  handle,
+	}, nil
+}
+
+// CreateRawConn creates a raw connection between devices with BPF filter. Options other than those of captures, which
+// are WithExtraFilter, WithPcapConfig and WithBackend, are ignored.
+func CreateRawConn(srcDev, dstDev *Device, filter string, opts ...Option) (*RawConn, error) {
+	o, err := newCaptureOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return createRawConn(srcDev, dstDev, filter, o)
+}
+
+// newCaptureOptions returns options of captures applied in order.
+func newCaptureOptions(opts ...Option) (*options, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var err error
+	o.backend, err = ParseBackend(o.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func createRawConn(srcDev, dstDev *Device, filter string, o *options) (*RawConn, error) {
+	conn, err := createPureRawConn(srcDev.Name(), snapLen(srcDev, o.pcapConfig), filter, o)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.srcDev = srcDev
+	conn.dstDev = dstDev
+
+	return conn, nil
+}
+
+func (c *RawConn) Read(b []byte) (n int, err error) {
+	for {
+		handle := c.currentHandle()
+
+		d, _, err := handle.ReadPacketData()
+		if err == nil {
+			copy(b, d)
+
+			return len(d), nil
+		}
+		if c.closed() {
+			return 0, err
+		}
+
+		// Reads time out with timeout set and nothing captured
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+
+		// The device may be down or unplugged, recover and resume reading
+		err = c.recover(handle, fmt.Errorf("read: %w", err))
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// ReadPacket reads packet from the connection.
+func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
+	for {
+		c.lock.RLock()
+		b := make([]byte, c.snapLen)
+		c.lock.RUnlock()
+
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		packet := gopacket.NewPacket(b[:n], c.currentHandle().LinkType(), gopacket.NoCopy)
+
+		// Drop packets from sources quarantined by the listener
+		if c.quarantine != nil && c.quarantine.isQuarantined(packet) {
+			continue
+		}
+
+		return packet, nil
+	}
+}
+
+func (c *RawConn) Write(b []byte) (n int, err error) {
+	handle := c.currentHandle()
+
+	err = handle.WritePacketData(b)
+	if err != nil {
+		// Writes failed persistently are recovered in background, writes in recovering fail
+		if c.fail() {
+			go c.recover(handle, fmt.Errorf("write: %w", err))
+		}
+
+		return 0, err
+	}
+
+	c.lock.Lock()
+	c.failures = 0
+	c.lock.Unlock()
+
+	return len(b), nil
+}
+
+// fail counts a write failure, and returns true if failures reach the max.
+func (c *RawConn) fail() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.failures++
+
+	return c.failures == maxWriteFailures
+}
+
+func (c *RawConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.isClosed = true
+	c.handle.Close()
+
+	return nil
+}
+
+// closed returns if the connection is closed.
+func (c *RawConn) closed() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.isClosed
+}
+
+func (c *RawConn) currentHandle() captureHandle {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.handle
+}
+
+// SetFilter replaces the BPF filter of the connection.
+func (c *RawConn) SetFilter(filter string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	full := fullFilter(filter, c.options.extraFilter)
+	err := c.options.filters.setFilter(c.handle, c.snapLen, full)
+	if err != nil {
+		return fmt.Errorf("set filter %s: %w", full, err)
+	}
+
+	c.filter = filter
+
+	return nil
+}
+
+// Reopen reopens the device of the connection with the same filter.
+func (c *RawConn) Reopen() error {
+	return c.reopen(c.LocalDev(), c.RemoteDev())
+}
+
+// reopen opens the device with the same filter, and moves the connection to the device and the device of the next hop.
+func (c *RawConn) reopen(srcDev, dstDev *Device) error {
+	snapLen := snapLen(srcDev, c.options.pcapConfig)
+
+	c.lock.RLock()
+	filter := c.filter
+	c.lock.RUnlock()
+
+	handle, err := openLive(srcDev.Name(), snapLen, filter, c.options)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed {
+		handle.Close()
+		return ErrClosed
+	}
+
+	c.handle.Close()
+	c.handle = handle
+	c.srcDev = srcDev
+	c.dstDev = dstDev
+	c.snapLen = snapLen
+	c.failures = 0
+
+	return nil
+}
+
+// reselect selects devices again and opens the device selected.
+func (c *RawConn) reselect() error {
+	srcDev, dstDev, err := c.options.reselect()
+	if err != nil {
+		return err
+	}
+	if srcDev == nil {
+		return errors.New("cannot determine device")
+	}
+	if dstDev == nil {
+		dstDev = srcDev
+	}
+
+	return c.reopen(srcDev, dstDev)
+}
+
+// setRecovered sets the function called with the device failed after the connection is recovered.
+func (c *RawConn) setRecovered(recovered func(dev *Device)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.recovered = recovered
+}
+
+// recover reopens the device whose handle failed until succeeded or the connection is closed. Devices are selected
+// again if the device cannot be reopened and the function of reselection is set. Failures of the same handle are
+// recovered only once, and the recovery is logged once.
+func (c *RawConn) recover(failed captureHandle, reason error) error {
+	c.recoverLock.Lock()
+	defer c.recoverLock.Unlock()
+
+	// Recovered by others
+	if c.currentHandle() != failed {
+		return nil
+	}
+
+	dev := c.LocalDev()
+	log.Errorln(fmt.Errorf("device %s failed, reopen: %w", dev.Alias(), reason))
+
+	start := time.Now()
+	interval := time.Second
+	attempts := 0
+
+	for {
+		time.Sleep(interval)
+
+		if c.closed() {
+			return ErrClosed
+		}
+
+		attempts++
+
+		err := c.Reopen()
+		if err != nil && c.options.reselect != nil {
+			// The device may vanish or be renamed
+			log.Verboseln(fmt.Errorf("reopen device %s: %w", dev.Alias(), err))
+
+			err = c.reselect()
+			if err != nil {
+				err = fmt.Errorf("reselect: %w", err)
+			}
+		}
+		if err == nil {
+			if newDev := c.LocalDev(); newDev.Name() != dev.Name() {
+				log.Infof("Device %s failed over to %s in %s after %d attempts\n", dev.Alias(), newDev.Alias(),
+					time.Now().Sub(start).Round(time.Second), attempts)
+			} else {
+				log.Infof("Device %s recovered in %s after %d attempts\n", dev.Alias(),
+					time.Now().Sub(start).Round(time.Second), attempts)
+			}
+
+			c.lock.RLock()
+			recovered := c.recovered
+			c.lock.RUnlock()
+
+			if recovered != nil {
+				recovered(dev)
+			}
+
+			return nil
+		}
+		log.Verboseln(fmt.Errorf("recover device %s: %w", dev.Alias(), err))
+
+		// Back off
+		interval = interval * 2
+		if interval > maxRecoverInterval {
+			interval = maxRecoverInterval
+		}
+	}
+}
+
+// LocalDev returns the local device.
+func (c *RawConn) LocalDev() *Device {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.srcDev
+}
+
+// RemoteDev returns the remote device.
+func (c *RawConn) RemoteDev() *Device {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.dstDev
+}
+
+// IsLoop returns if frames of the connection are in loopback headers instead of Ethernet. It is decided by the link
+// type of the device, since loopback devices are in Ethernet in Linux, while the Npcap loopback adapter in Windows and
+// loopback devices in macOS are in null.
+func (c *RawConn) IsLoop() bool {
+	switch c.currentHandle().LinkType() {
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reader is a reader reads packets from a pcap file.
+type Reader struct {
+	handle *pcap.Handle
+	ps     *gopacket.PacketSource
+}
+
+// CreateReader creates a reader reading a pcap file.
+func CreateReader(file string) (*Reader, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	return &Reader{
+		handle: handle,
+		ps:     ps,
+	}, nil
+}
+
+func (r *Reader) Read(b []byte) (n int, err error) {
+	packet, err := r.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+
+	copy(b, packet.Data())
+
+	return len(packet.Data()), nil
+}
+
+func (r *Reader) ReadPacket() (gopacket.Packet, error) {
+	packet, err := r.ps.NextPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+func (r *Reader) Close() error {
+	r.handle.Close()
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package pcap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/crypto"
+	"net"
+	"time"
+)
+
+// rekeySaltSize is the size of salts keys are derived from in rekeys.
+const rekeySaltSize = 16
+
+// rekeySize is the size of rekey frames, each is a byte of type, a byte of kind, the salt of the key requested and the
+// salt of the key the peer writes in, which is zeros for the key of handshakes.
+const rekeySize = 2 + 2*rekeySaltSize
+
+const (
+	rekeyRequest byte = 0
+	rekeyAck     byte = 1
+)
+
+// rekeyState describes keys of a client derived in rekeys. Keys are always derived from the key of handshakes, so peers
+// agree on keys by salts only. The previous key is kept until the next rekey so datagrams in flight are still
+// decrypted, and a key requested is pending until a datagram in it is received.
+type rekeyState struct {
+	base        crypto.Crypt
+	salt        []byte
+	prev        crypto.Crypt
+	prevSalt    []byte
+	pending     crypto.Crypt
+	pendingSalt []byte
+}
+
+func newRekeyState(base crypto.Crypt) *rekeyState {
+	return &rekeyState{
+		base: base,
+		salt: make([]byte, rekeySaltSize),
+	}
+}
+
+// baseCrypt returns the crypt the client handshakes in.
+func (client *clientIndicator) baseCrypt() crypto.Crypt {
+	if client.rekey != nil {
+		return client.rekey.base
+	}
+
+	return client.crypt
+}
+
+// checkRekey returns an error if the crypt cannot be rekeyed.
+func checkRekey(crypt crypto.Crypt) error {
+	_, err := crypto.Rekey(crypt, make([]byte, rekeySaltSize))
+
+	return err
+}
+
+// createRekey returns a rekey frame.
+func createRekey(kind byte, salt, current []byte) []byte {
+	b := make([]byte, rekeySize)
+
+	b[0] = frameRekey
+	b[1] = kind
+	copy(b[2:2+rekeySaltSize], salt)
+	copy(b[2+rekeySaltSize:], current)
+
+	return b
+}
+
+// sendRekeys asks the server for a new key every interval until the connection is closed.
+func (c *FakeTCPConn) sendRekeys(interval time.Duration) {
+	for c.sleep(interval) {
+		err := c.requestRekey(c.dstAddr)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("request rekey to %s: %w", c.dstAddr, err))
+		}
+	}
+}
+
+// requestRekey asks the address for a new key. A request not acknowledged yet is sent again in the same salt, so the
+// key requested never changes until it is in use.
+func (c *FakeTCPConn) requestRekey(addr net.Addr) error {
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok || !c.isTypedTo(client) {
+		return nil
+	}
+
+	c.lock.Lock()
+	if client.rekey == nil {
+		client.rekey = newRekeyState(client.crypt)
+	}
+	state := client.rekey
+	if state.pending == nil {
+		salt := make([]byte, rekeySaltSize)
+		_, err := rand.Read(salt)
+		if err != nil {
+			c.lock.Unlock()
+			return fmt.Errorf("read: %w", err)
+		}
+
+		crypt, err := crypto.Rekey(state.base, salt)
+		if err != nil {
+			c.lock.Unlock()
+			return err
+		}
+
+		state.pending, state.pendingSalt = crypt, salt
+	}
+	request := createRekey(rekeyRequest, state.pendingSalt, state.salt)
+	c.lock.Unlock()
+
+	// Requests are not counted as writes so chaff is still sent in idle
+	_, err := c.writeMessage(request, addr, true)
+
+	return err
+}
+
+// handleRekey changes the key of the address as requested and acknowledges it in the new key, or changes the key to
+// the one acknowledged.
+func (c *FakeTCPConn) handleRekey(contents []byte, addr net.Addr) error {
+	if len(contents) < rekeySize {
+		return fmt.Errorf("rekey size %d out of range", len(contents))
+	}
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unrecognized", addr.String())
+	}
+
+	salt := contents[2 : 2+rekeySaltSize]
+	current := contents[2+rekeySaltSize : rekeySize]
+
+	switch contents[1] {
+	case rekeyRequest:
+		err := c.rekey(client, salt, current)
+		if err != nil {
+			return err
+		}
+
+		// Acks are written in the new key, acks are not counted as writes either
+		_, err = c.writeMessage(createRekey(rekeyAck, salt, salt), addr, true)
+		if err != nil {
+			return fmt.Errorf("ack: %w", err)
+		}
+	case rekeyAck:
+		c.promoteRekey(client, salt, addr)
+	default:
+		return fmt.Errorf("rekey kind %d not support", contents[1])
+	}
+
+	return nil
+}
+
+// rekey changes the key of the client to the one derived from the salt, and keeps the key the client writes in as the
+// previous key. Requests repeated are acknowledged again only.
+func (c *FakeTCPConn) rekey(client *clientIndicator, salt, current []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client.rekey == nil {
+		client.rekey = newRekeyState(client.crypt)
+	}
+	state := client.rekey
+	if bytes.Equal(salt, state.salt) {
+		return nil
+	}
+
+	var writing crypto.Crypt
+	switch {
+	case bytes.Equal(current, state.salt):
+		writing = client.crypt
+	case state.prevSalt != nil && bytes.Equal(current, state.prevSalt):
+		writing = state.prev
+	default:
+		return errors.New("rekey from unknown key")
+	}
+
+	crypt, err := crypto.Rekey(state.base, salt)
+	if err != nil {
+		return err
+	}
+
+	state.prev, state.prevSalt = writing, append([]byte{}, current...)
+	client.crypt, state.salt = crypt, append([]byte{}, salt...)
+
+	return nil
+}
+
+// promoteRekey changes the key of the client to the key pending if it is of the salt, once the peer writes in it.
+func (c *FakeTCPConn) promoteRekey(client *clientIndicator, salt []byte, addr net.Addr) {
+	c.lock.Lock()
+	state := client.rekey
+	if state == nil || state.pending == nil || !bytes.Equal(salt, state.pendingSalt) {
+		c.lock.Unlock()
+		return
+	}
+	state.prev, state.prevSalt = client.crypt, state.salt
+	client.crypt, state.salt = state.pending, state.pendingSalt
+	state.pending, state.pendingSalt = nil, nil
+	c.lock.Unlock()
+
+	log.Verbosef("Rekey with %s\n", addr)
+}
+
+// decrypt decrypts the datagram from the client in its key, or in keys of rekeys pending or in flight.
+func (c *FakeTCPConn) decrypt(client *clientIndicator, payload []byte, addr net.Addr) ([]byte, error) {
+	c.lock.Lock()
+	crypt, state := client.crypt, client.rekey
+	var prev, pending crypto.Crypt
+	var pendingSalt []byte
+	if state != nil {
+		prev, pending, pendingSalt = state.prev, state.pending, state.pendingSalt
+	}
+	c.lock.Unlock()
+
+	contents, err := crypt.Decrypt(payload)
+	if err == nil || state == nil {
+		return contents, err
+	}
+
+	if pending != nil {
+		contents, pendingErr := pending.Decrypt(payload)
+		if pendingErr == nil {
+			c.promoteRekey(client, pendingSalt, addr)
+			return contents, nil
+		}
+	}
+	if prev != nil {
+		contents, prevErr := prev.Decrypt(payload)
+		if prevErr == nil {
+			return contents, nil
+		}
+	}
+
+	return nil, err
+}
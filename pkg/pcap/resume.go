@@ -0,0 +1,147 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+// resumeSeqGap is the gap TCP sequences skip when a connection is resumed, so datagrams written after the state is
+// saved are not taken as duplicates by the server.
+const resumeSeqGap = 1 << 24
+
+// ResumeFakeTCP returns the connection to the server in the state of a connection dialed before, so a client restarted
+// keeps its place in the server without handshaking. The local port and the session of the state override options.
+// The connection handshakes again if the server does not respond in time, as if it is dialed. Keys are not in the
+// state, including keys changed in rekeys, so the connection encrypts in the crypt of options, and states of
+// connections rekeyed cannot be resumed.
+func ResumeFakeTCP(state *ClientState, opts ...Option) (*FakeTCPConn, error) {
+	dstAddr, err := net.ResolveTCPAddr("tcp", state.Addr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:  "resume",
+			Net: "pcap",
+			Err: fmt.Errorf("parse address %s: %w", state.Addr, err),
+		}
+	}
+
+	opts = append(append(make([]Option, 0), opts...), WithSrcPort(state.Port), WithSession(state.Session))
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "resume",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   o.srcDev.IPAddr().IP,
+		Port: int(o.srcPort),
+	}
+
+	var conn *FakeTCPConn
+	err = func() error {
+		if state.Dev != o.srcDev.Alias() {
+			return fmt.Errorf("device %s mismatch", state.Dev)
+		}
+
+		// States before versioning are of the first version
+		version := state.Version
+		if version == 0 {
+			version = WireVersion1
+		}
+		err := checkWireVersion(version)
+		if err != nil {
+			return err
+		}
+
+		conn, err = dialFakeTCPPassive(dstAddr, o)
+		if err != nil {
+			return err
+		}
+
+		client := &clientIndicator{
+			crypt:     conn.crypt,
+			version:   version,
+			seq:       state.Seq + resumeSeqGap,
+			ack:       state.Ack,
+			id:        state.Id,
+			lastWrite: time.Now(),
+			probes:    newLossMeter(),
+			seen:      newSeqWindow(),
+		}
+
+		// Map client
+		conn.clientsLock.Lock()
+		conn.clients[dstAddr.String()] = client
+		conn.clientsLock.Unlock()
+
+		return nil
+	}()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "resume",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Resume session %016x to server %s\n", state.Session, dstAddr.String())
+
+	conn.appear = time.Now()
+	conn.lastReconnect = conn.appear
+	conn.isConnected = true
+	close(conn.established)
+	conn.resumeOnRecovery()
+
+	conn.spawn(conn.confirmResume)
+
+	return conn, nil
+}
+
+// confirmResume asks the server for an echo, and handshakes again if nothing is received from the server in time,
+// which is the case the server forgets the client.
+func (c *FakeTCPConn) confirmResume() {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	received := client.received
+	c.lock.Unlock()
+
+	if c.session != 0 {
+		c.announceSession()
+	}
+	_, err := c.writeMessage(createEcho(echoRequest, 0, time.Now()), c.RemoteAddr(), true)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("send probe to %s: %w", c.RemoteAddr(), err))
+	}
+	c.sendClockRequest(c.RemoteAddr())
+
+	if !c.sleep(c.timeout) {
+		return
+	}
+
+	c.lock.Lock()
+	isResumed := client.received != received
+	c.lock.Unlock()
+	if isResumed || c.isReconnected {
+		return
+	}
+
+	log.Infof("Server %s does not resume the session, connect again\n", c.RemoteAddr().String())
+
+	err = c.Reconnect()
+	if err != nil {
+		log.Errorln(fmt.Errorf("reconnect to %s: %w", c.RemoteAddr(), err))
+	}
+}
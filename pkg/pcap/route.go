@@ -0,0 +1,137 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RouteRule describes packets routed through a server by their destination.
+type RouteRule struct {
+	// Net is the network of the destination, nil matches any destination.
+	Net *net.IPNet
+	// Ports is the rule of the protocol and the destination port, nil matches any packet.
+	Ports *ClassRule
+}
+
+// ParseRouteRule returns the rule in the form of a CIDR or an IP, a rule of ports, or both separated by a space, e.g.
+// 203.0.113.0/24, udp/27015 and 203.0.113.0/24 udp/27015. Rules of ports are in the same form as ParseClassRule, and are
+// matched against the destination port.
+func ParseRouteRule(s string) (*RouteRule, error) {
+	rule := &RouteRule{}
+
+	fields := strings.Fields(s)
+	if len(fields) <= 0 {
+		return nil, errors.New("empty rule")
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("rule %s not support", s)
+	}
+
+	for _, field := range fields {
+		// Destinations are told apart from ports by their dots
+		if strings.Contains(field, ".") || strings.Contains(field, ":") {
+			if rule.Net != nil {
+				return nil, fmt.Errorf("duplicate destination %s", field)
+			}
+
+			if !strings.Contains(field, "/") {
+				ip := net.ParseIP(field)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid destination %s", field)
+				}
+				if ip.To4() != nil {
+					field = field + "/32"
+				} else {
+					field = field + "/128"
+				}
+			}
+
+			_, ipNet, err := net.ParseCIDR(field)
+			if err != nil {
+				return nil, fmt.Errorf("parse destination %s: %w", field, err)
+			}
+			rule.Net = ipNet
+
+			continue
+		}
+
+		if rule.Ports != nil {
+			return nil, fmt.Errorf("duplicate ports %s", field)
+		}
+
+		ports, err := ParseClassRule(field)
+		if err != nil {
+			return nil, fmt.Errorf("parse ports %s: %w", field, err)
+		}
+		rule.Ports = ports
+	}
+
+	return rule, nil
+}
+
+// BPFFilter returns the BPF filter of packets matched.
+func (rule *RouteRule) BPFFilter() string {
+	fs := make([]string, 0)
+	if rule.Net != nil {
+		fs = append(fs, fmt.Sprintf("dst net %s", rule.Net))
+	}
+
+	if rule.Ports != nil {
+		var protocol string
+		switch rule.Ports.Protocol {
+		case 1:
+			protocol = "icmp"
+		case 6:
+			protocol = "tcp"
+		case 17:
+			protocol = "udp"
+		default:
+			protocol = "(tcp || udp)"
+		}
+		fs = append(fs, protocol)
+
+		switch {
+		case rule.Ports.MinPort == 0 && rule.Ports.MaxPort == 0:
+			break
+		case rule.Ports.MinPort == rule.Ports.MaxPort:
+			fs = append(fs, fmt.Sprintf("dst port %d", rule.Ports.MinPort))
+		default:
+			fs = append(fs, fmt.Sprintf("dst portrange %d-%d", rule.Ports.MinPort, rule.Ports.MaxPort))
+		}
+	}
+
+	if len(fs) <= 0 {
+		return "ip"
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(fs, " && "))
+}
+
+// Match returns if the IP packet is matched.
+func (rule *RouteRule) Match(data []byte) bool {
+	if rule.Net != nil {
+		var dstIP net.IP
+		switch {
+		case len(data) >= 20 && data[0]>>4 == 4:
+			dstIP = net.IP(data[16:20])
+		case len(data) >= 40 && data[0]>>4 == 6:
+			dstIP = net.IP(data[24:40])
+		default:
+			return false
+		}
+
+		if !rule.Net.Contains(dstIP) {
+			return false
+		}
+	}
+
+	if rule.Ports != nil {
+		protocol, _, dstPort := parseProtocolAndPorts(data)
+
+		return rule.Ports.match(protocol, 0, dstPort)
+	}
+
+	return true
+}
@@ -0,0 +1,108 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Scheduler is a scheduler decides when packets are written.
+type Scheduler interface {
+	// Schedule schedules a write. Writes are performed in the order they are scheduled.
+	Schedule(write func() error)
+	// Close closes the scheduler, writes scheduled will be performed immediately.
+	Close() error
+}
+
+// Padder is implemented by schedulers which also pad packets before they are written.
+type Padder interface {
+	// Pad returns the data padded to a size no larger than max.
+	Pad(b []byte, max int) []byte
+}
+
+// JitterScheduler is a scheduler delays writes randomly and flushes them in batches, so the timing of packets does not
+// follow the timing of the traffic tunneled. Each write is delayed no longer than the latency budget.
+type JitterScheduler struct {
+	lock      sync.Mutex
+	budget    time.Duration
+	interval  time.Duration
+	rand      *rand.Rand
+	batch     []func() error
+	timer     *time.Timer
+	lastFlush time.Time
+	isClosed  bool
+}
+
+// NewJitterScheduler returns a new jitter scheduler with the latency budget.
+func NewJitterScheduler(budget time.Duration) (*JitterScheduler, error) {
+	if budget <= 0 {
+		return nil, fmt.Errorf("budget %s out of range", budget)
+	}
+
+	return &JitterScheduler{
+		budget: budget,
+		rand:   rand.New(rand.NewSource(int64(randUint32()))),
+		batch:  make([]func() error, 0),
+	}, nil
+}
+
+func (scheduler *JitterScheduler) Schedule(write func() error) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if scheduler.isClosed {
+		scheduler.perform([]func() error{write})
+		return
+	}
+
+	scheduler.batch = append(scheduler.batch, write)
+
+	// The first write of a batch decides when the batch is flushed, so no write waits longer than the budget
+	if scheduler.timer == nil {
+		delay := time.Duration(scheduler.rand.Int63n(int64(scheduler.budget) + 1))
+
+		// Paced batches are flushed at the next tick after the interval
+		if scheduler.interval > 0 {
+			wait := scheduler.lastFlush.Add(scheduler.interval).Sub(time.Now())
+			if wait > 0 {
+				delay = delay + wait
+			}
+		}
+
+		scheduler.timer = time.AfterFunc(delay, scheduler.flush)
+	}
+}
+
+func (scheduler *JitterScheduler) Close() error {
+	scheduler.lock.Lock()
+	scheduler.isClosed = true
+	if scheduler.timer != nil {
+		scheduler.timer.Stop()
+	}
+	scheduler.lock.Unlock()
+
+	scheduler.flush()
+
+	return nil
+}
+
+func (scheduler *JitterScheduler) flush() {
+	scheduler.lock.Lock()
+	batch := scheduler.batch
+	scheduler.batch = make([]func() error, 0)
+	scheduler.timer = nil
+	scheduler.lastFlush = time.Now()
+	scheduler.perform(batch)
+	scheduler.lock.Unlock()
+}
+
+func (scheduler *JitterScheduler) perform(batch []func() error) {
+	for _, write := range batch {
+		err := write()
+		if err != nil {
+			log.Errorln(fmt.Errorf("write: %w", err))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// segmentHeaderSize is the size of headers of segments, each is a byte of type, 4 bytes of the id of the datagram, 2
+// bytes of the index of the segment and 2 bytes of the count of segments.
+const segmentHeaderSize = 9
+
+const (
+	// segmentMaxCount is the max count of segments of a datagram.
+	segmentMaxCount = 256
+	// segmentMaxPending is the max count of datagrams reassembling from a peer, the oldest is dropped if it is
+	// exceeded.
+	segmentMaxPending = 4
+	// segmentTimeout is the time waiting for segments of a datagram.
+	segmentTimeout = 3 * time.Second
+)
+
+// createSegment returns the segment of the datagram in the id.
+func createSegment(id uint32, index, count uint16, data []byte) []byte {
+	b := make([]byte, segmentHeaderSize+len(data))
+
+	b[0] = segmentData
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint16(b[5:7], index)
+	binary.BigEndian.PutUint16(b[7:9], count)
+	copy(b[segmentHeaderSize:], data)
+
+	return b
+}
+
+// isSegment returns if the frame is a segment.
+func isSegment(contents []byte) bool {
+	return len(contents) > 0 && contents[0] == segmentData
+}
+
+// maxDatagram returns the max size of datagrams to the client in the IP which can be carried by IP fragmentation.
+func (c *FakeTCPConn) maxDatagram(client *clientIndicator, dstIP net.IP) int {
+	return IPv4MaxSize - headerSize(dstIP) - client.crypt.Cost() - c.recordCost()
+}
+
+// writeSegments writes the datagram too large to be carried by IP fragmentation in segments, which are messages in band
+// reassembled in the peer, so the datagram is read as it is written. Readers must read in buffers large enough for such
+// datagrams. Each segment is written as a TCP segment of its own, and advances the sequence by its size.
+func (c *FakeTCPConn) writeSegments(p []byte, addr net.Addr, max int) (int, error) {
+	segments, err := c.createSegments(p, max)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    err,
+		}
+	}
+
+	for _, segment := range segments {
+		_, err := c.writeTo(segment, addr, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// createSegments splits the datagram in segments carrying at most the size with their headers.
+func (c *FakeTCPConn) createSegments(p []byte, max int) ([][]byte, error) {
+	size := max - segmentHeaderSize
+	count := (len(p) + size - 1) / size
+	if count > segmentMaxCount {
+		return nil, fmt.Errorf("%w: size %d out of range", ErrMTUExceeded, len(p))
+	}
+
+	id := atomic.AddUint32(&c.segment, 1)
+	segments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(p) {
+			end = len(p)
+		}
+
+		segments = append(segments, createSegment(id, uint16(i), uint16(count), p[i*size:end]))
+	}
+
+	return segments, nil
+}
+
+// segmentedDatagram is a datagram reassembling from its segments.
+type segmentedDatagram struct {
+	segments [][]byte
+	received int
+	appear   time.Time
+}
+
+// segmentReassembler reassembles datagrams from segments of a peer.
+type segmentReassembler struct {
+	datagrams map[uint32]*segmentedDatagram
+}
+
+func newSegmentReassembler() *segmentReassembler {
+	return &segmentReassembler{datagrams: make(map[uint32]*segmentedDatagram)}
+}
+
+// push appends the segment and returns the datagram once all its segments are received. Datagrams whose segments are
+// not all received in time are dropped.
+func (r *segmentReassembler) push(contents []byte) ([]byte, error) {
+	if len(contents) < segmentHeaderSize {
+		return nil, errors.New("segment too short")
+	}
+
+	id := binary.BigEndian.Uint32(contents[1:5])
+	index := int(binary.BigEndian.Uint16(contents[5:7]))
+	count := int(binary.BigEndian.Uint16(contents[7:9]))
+	if count <= 0 || count > segmentMaxCount {
+		return nil, fmt.Errorf("count %d out of range", count)
+	}
+	if index >= count {
+		return nil, fmt.Errorf("index %d out of range", index)
+	}
+
+	// Drop datagrams expired
+	t := time.Now()
+	for k, d := range r.datagrams {
+		if t.Sub(d.appear) > segmentTimeout {
+			delete(r.datagrams, k)
+		}
+	}
+
+	d, ok := r.datagrams[id]
+	if !ok {
+		// Drop the oldest datagram in case of too many datagrams reassembling
+		if len(r.datagrams) >= segmentMaxPending {
+			var (
+				oldest uint32
+				appear time.Time
+			)
+			for k, d := range r.datagrams {
+				if appear.IsZero() || d.appear.Before(appear) {
+					oldest, appear = k, d.appear
+				}
+			}
+			delete(r.datagrams, oldest)
+		}
+
+		d = &segmentedDatagram{segments: make([][]byte, count), appear: t}
+		r.datagrams[id] = d
+	}
+	if len(d.segments) != count {
+		delete(r.datagrams, id)
+		return nil, fmt.Errorf("count %d mismatch", count)
+	}
+
+	// Segments duplicated
+	if d.segments[index] != nil {
+		return nil, nil
+	}
+
+	segment := make([]byte, len(contents)-segmentHeaderSize)
+	copy(segment, contents[segmentHeaderSize:])
+	d.segments[index] = segment
+	d.received++
+	if d.received < count {
+		return nil, nil
+	}
+
+	delete(r.datagrams, id)
+
+	size := 0
+	for _, segment := range d.segments {
+		size = size + len(segment)
+	}
+	datagram := make([]byte, 0, size)
+	for _, segment := range d.segments {
+		datagram = append(datagram, segment...)
+	}
+
+	return datagram, nil
+}
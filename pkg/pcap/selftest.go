@@ -0,0 +1,183 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	// selfTestPort is the port of the server in self-tests.
+	selfTestPort = 443
+	// selfTestFragment is the size of fragments in self-tests, so large packets are always fragmented.
+	selfTestFragment = 576
+	// selfTestTimeout is the time waiting for each packet echoed.
+	selfTestTimeout = 1 * time.Second
+	// selfTestHeaderSize is the size of headers of packets in self-tests, which is a byte looking like IPv4 so they
+	// are neither chaff nor messages, and 4 bytes of sequence.
+	selfTestHeaderSize = 5
+	// selfTestMaxSize is the max size of packets in self-tests, so packets too large to be carried by IP fragmentation
+	// are written in segments.
+	selfTestMaxSize = 1 << 20
+)
+
+var (
+	selfTestClientIP = net.IPv4(10, 255, 0, 1).To4()
+	selfTestServerIP = net.IPv4(10, 255, 0, 2).To4()
+)
+
+// SelfTestResult describes the result of a self-test.
+type SelfTestResult struct {
+	Sent      int           `json:"sent"`
+	Received  int           `json:"received"`
+	Corrupted int           `json:"corrupted"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// IsPassed returns if all packets are echoed intact.
+func (result *SelfTestResult) IsPassed() bool {
+	return result.Sent > 0 && result.Received == result.Sent && result.Corrupted <= 0
+}
+
+// SelfTest starts a FakeTCP server and a client in a pair of devices in memory, and pushes count packets of each size
+// from the client to the server which echoes them back, through the whole path of handshakes, encryption,
+// fragmentation, defragmentation and segmentation. Packets are fragmented in 576 Bytes. Options are applied to both the
+// client and the server, while devices, ports and the size of fragments are overridden.
+func SelfTest(ctx context.Context, sizes []int, count int, opts ...Option) (*SelfTestResult, error) {
+	for _, size := range sizes {
+		if size < selfTestHeaderSize || size > selfTestMaxSize {
+			return nil, fmt.Errorf("size %d out of range", size)
+		}
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("count %d out of range", count)
+	}
+
+	clientDev, serverDev, err := NewMemoryDevs(selfTestClientIP, selfTestServerIP)
+	if err != nil {
+		return nil, fmt.Errorf("create devices: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Server
+	serverOpts := append(append(make([]Option, 0), opts...), WithDevices(serverDev, clientDev), WithSrcPort(selfTestPort),
+		WithFragment(selfTestFragment), WithContext(ctx))
+	o, err := newOptions(serverOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	server, err := listenFakeTCPMulticast(o)
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	defer server.Close()
+
+	go func() {
+		b := make([]byte, selfTestMaxSize)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if n <= 0 {
+				continue
+			}
+
+			_, _ = server.WriteTo(b[:n], addr)
+		}
+	}()
+
+	// Client
+	clientOpts := append(append(make([]Option, 0), opts...), WithDevices(clientDev, serverDev), WithFragment(selfTestFragment),
+		WithContext(ctx))
+	client, err := DialFakeTCP(&net.TCPAddr{IP: selfTestServerIP, Port: selfTestPort}, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	defer client.Close()
+
+	// Handshakes are handled in reads
+	replies := make(chan []byte, memoryQueueSize)
+	go func() {
+		b := make([]byte, selfTestMaxSize)
+		for {
+			n, _, err := client.ReadFrom(b)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if n <= 0 {
+				continue
+			}
+
+			reply := make([]byte, n)
+			copy(reply, b[:n])
+			replies <- reply
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-client.Established():
+	case <-time.After(o.timeout):
+		return nil, errors.New("handshake timeout")
+	}
+
+	// Echo
+	result := &SelfTestResult{}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	start := time.Now()
+	for _, size := range sizes {
+		for i := 0; i < count; i++ {
+			data := make([]byte, size)
+			r.Read(data)
+			data[0] = 0x45
+			binary.BigEndian.PutUint32(data[1:5], uint32(result.Sent))
+
+			_, err := client.Write(data)
+			if err != nil {
+				return nil, fmt.Errorf("write: %w", err)
+			}
+			result.Sent++
+
+			timer := time.NewTimer(selfTestTimeout)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case reply := <-replies:
+					if len(reply) < selfTestHeaderSize || binary.BigEndian.Uint32(reply[1:5]) != uint32(result.Sent-1) {
+						continue
+					}
+					timer.Stop()
+
+					result.Received++
+					if !bytes.Equal(reply, data) {
+						result.Corrupted++
+					}
+					break wait
+				case <-timer.C:
+					break wait
+				}
+			}
+		}
+	}
+	result.Duration = time.Now().Sub(start)
+
+	return result, nil
+}
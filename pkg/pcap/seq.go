@@ -0,0 +1,23 @@
+package pcap
+
+import "github.com/google/gopacket/layers"
+
+// seqSpace returns the sequence space the TCP segment takes, which is its payload and one more for SYN and FIN each,
+// so peers and stateful middleboxes always see sequences following each other on wire.
+func seqSpace(tcpLayer *layers.TCP, payload []byte) uint32 {
+	space := uint32(len(payload))
+	if tcpLayer.SYN {
+		space++
+	}
+	if tcpLayer.FIN {
+		space++
+	}
+
+	return space
+}
+
+// seqAfter returns if the sequence a is after the sequence b in the serial arithmetic of RFC 1982, where sequences
+// wrap around.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
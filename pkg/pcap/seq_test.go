@@ -0,0 +1,145 @@
+package pcap
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+// wireSegment is a TCP segment in the wire, reassembled from its IP fragments.
+type wireSegment struct {
+	tcp  *layers.TCP
+	size int
+}
+
+// captureSegments returns TCP segments to the port captured in the device, in the order they are written, until the
+// context is done.
+func captureSegments(ctx context.Context, t *testing.T, srcDev, dstDev *Device, port uint16) <-chan []wireSegment {
+	conn, err := CreateRawConn(srcDev, dstDev, "tcp")
+	if err != nil {
+		t.Fatalf("create raw connection: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	ch := make(chan []wireSegment, 1)
+	go func() {
+		var (
+			segments []wireSegment
+			pending  = make(map[uint16]*wireSegment)
+		)
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				ch <- segments
+				return
+			}
+
+			ipv4Layer, ok := packet.NetworkLayer().(*layers.IPv4)
+			if !ok {
+				continue
+			}
+
+			// The TCP header is carried by the first fragment only
+			segment, ok := pending[ipv4Layer.Id]
+			if ipv4Layer.FragOffset == 0 {
+				transport := gopacket.NewPacket(ipv4Layer.Payload, layers.LayerTypeTCP, gopacket.Default)
+				tcpLayer, ok := transport.TransportLayer().(*layers.TCP)
+				if !ok || uint16(tcpLayer.DstPort) != port {
+					continue
+				}
+				segment = &wireSegment{tcp: tcpLayer, size: -int(tcpLayer.DataOffset) * 4}
+				pending[ipv4Layer.Id] = segment
+			} else if !ok {
+				continue
+			}
+			segment.size = segment.size + len(ipv4Layer.Payload)
+
+			if ipv4Layer.Flags&layers.IPv4MoreFragments == 0 {
+				segments = append(segments, *segment)
+				delete(pending, ipv4Layer.Id)
+			}
+		}
+	}()
+
+	return ch
+}
+
+// TestWriteSeq asserts sequences in the wire are consistent, where each segment starts from where the last ends, for
+// datagrams written in a segment, in IP fragments and in segments of the tunnel.
+func TestWriteSeq(t *testing.T) {
+	const port = 443
+
+	clientDev, serverDev, err := NewMemoryDevs(testSrcIPv4, testDstIPv4)
+	if err != nil {
+		t.Fatalf("create devices: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	capturing, stop := context.WithCancel(ctx)
+	segments := captureSegments(capturing, t, serverDev, clientDev, port)
+
+	listener, err := ListenFakeTCP(port, WithDevices(serverDev, clientDev), WithFragment(576), WithContext(ctx))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	defer cancel()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if conn != nil {
+				go conn.(*FakeTCPConn).drain(ctx)
+			}
+		}
+	}()
+
+	conn, err := DialFakeTCP(&net.TCPAddr{IP: testDstIPv4, Port: port}, WithDevices(clientDev, serverDev),
+		WithFragment(576), WithContext(ctx))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.drain(ctx)
+
+	select {
+	case <-conn.Established():
+	case <-ctx.Done():
+		t.Fatal("handshake timeout")
+	}
+
+	for _, size := range []int{64, 4000, 100000} {
+		_, err := conn.Write(make([]byte, size))
+		if err != nil {
+			t.Fatalf("write %d bytes: %v", size, err)
+		}
+	}
+
+	// Frames are delivered in memory as they are written
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	written := <-segments
+	if len(written) < 5 {
+		t.Fatalf("segments = %d, want at least 5", len(written))
+	}
+	for i := 1; i < len(written); i++ {
+		last, segment := written[i-1], written[i]
+		if want := last.tcp.Seq + seqSpace(last.tcp, make([]byte, last.size)); segment.tcp.Seq != want {
+			t.Errorf("segment %d: seq = %d, want %d", i, segment.tcp.Seq, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+// sessionSize is the size of session announcements, which is a byte of type and 8 bytes of session.
+const sessionSize = 9
+
+// sessionInterval is the interval of session announcements, so the session is learned even if announcements are lost.
+const sessionInterval = 10 * time.Second
+
+// createSessionAnnouncement returns a session announcement.
+func createSessionAnnouncement(session uint64) []byte {
+	b := make([]byte, sessionSize)
+
+	b[0] = sessionAnnouncement
+	binary.BigEndian.PutUint64(b[1:9], session)
+
+	return b
+}
+
+// handleSession records the session announced by the address.
+func (c *FakeTCPConn) handleSession(contents []byte, addr net.Addr) error {
+	if len(contents) < sessionSize {
+		return fmt.Errorf("session size %d out of range", len(contents))
+	}
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unrecognized", addr.String())
+	}
+
+	c.lock.Lock()
+	client.session = binary.BigEndian.Uint64(contents[1:9])
+	c.lock.Unlock()
+
+	return nil
+}
+
+// announceSession sends the session to the server.
+func (c *FakeTCPConn) announceSession() {
+	if !c.isTypedToAddr(c.RemoteAddr()) {
+		return
+	}
+
+	// Announcements are not counted as writes so chaff is still sent in idle
+	_, err := c.writeTo(createSessionAnnouncement(c.session), c.RemoteAddr(), true)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("announce session to %s: %w", c.RemoteAddr(), err))
+	}
+}
+
+// announceSessions sends the session to the server every interval until the connection is closed.
+func (c *FakeTCPConn) announceSessions() {
+	for c.sleep(sessionInterval) {
+		c.announceSession()
+	}
+}
+
+// Session returns the session announced by the remote address, and false if it has not announced any. Connections
+// announced the same session are from the same client on different ports.
+func (c *FakeTCPConn) Session() (uint64, bool) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return client.session, client.session != 0
+}
@@ -0,0 +1,177 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// SFlowSource describes the source of traffic sampled in sFlow.
+type SFlowSource uint32
+
+const (
+	// SFlowSourceTunnel describes frames of FakeTCP between the client and the server.
+	SFlowSourceTunnel SFlowSource = 1
+	// SFlowSourceInner describes IP packets tunneled.
+	SFlowSourceInner SFlowSource = 2
+)
+
+const (
+	// sflowVersion is the version of sFlow datagrams.
+	sflowVersion = 5
+	// sflowMaxHeader is the max size of headers of packets sampled.
+	sflowMaxHeader = 128
+	// sflowProtocolEthernet and sflowProtocolIPv4 are header protocols of raw packet headers.
+	sflowProtocolEthernet = 1
+	sflowProtocolIPv4     = 11
+	sflowProtocolIPv6     = 12
+)
+
+type sflowCounter struct {
+	skip uint32
+	pool uint32
+	seq  uint32
+}
+
+// SFlow exports samples of traffic to a collector in sFlow version 5, sampling 1 in every few packets of each source
+// randomly. Methods of a nil exporter sample nothing.
+type SFlow struct {
+	lock     sync.Mutex
+	rate     uint32
+	conn     net.Conn
+	agent    net.IP
+	start    time.Time
+	seq      uint32
+	counters map[SFlowSource]*sflowCounter
+}
+
+// NewSFlow returns a new sFlow exporter to the collector sampling 1 in every rate packets.
+func NewSFlow(collector string, rate int) (*SFlow, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate %d out of range", rate)
+	}
+
+	conn, err := net.Dial("udp4", collector)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", collector, err)
+	}
+
+	s := &SFlow{
+		rate:     uint32(rate),
+		conn:     conn,
+		agent:    conn.LocalAddr().(*net.UDPAddr).IP.To4(),
+		start:    time.Now(),
+		counters: make(map[SFlowSource]*sflowCounter),
+	}
+	for _, source := range []SFlowSource{SFlowSourceTunnel, SFlowSourceInner} {
+		s.counters[source] = &sflowCounter{skip: s.nextSkip()}
+	}
+
+	return s, nil
+}
+
+// nextSkip returns the count of packets skipped before the next sample, which is random around the rate.
+func (s *SFlow) nextSkip() uint32 {
+	if s.rate <= 1 {
+		return 1
+	}
+
+	return uint32(rand.Int63n(int64(2*s.rate-1))) + 1
+}
+
+// Sample samples the frame or the IP packet of the source.
+func (s *SFlow) Sample(source SFlowSource, data []byte) {
+	if s == nil || len(data) <= 0 {
+		return
+	}
+
+	s.lock.Lock()
+
+	counter := s.counters[source]
+	counter.pool++
+	counter.skip--
+	if counter.skip > 0 {
+		s.lock.Unlock()
+		return
+	}
+	counter.skip = s.nextSkip()
+	counter.seq++
+	s.seq++
+
+	b := s.datagram(source, counter, data)
+
+	s.lock.Unlock()
+
+	_, err := s.conn.Write(b)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("export sflow: %w", err))
+	}
+}
+
+// datagram returns a datagram of a flow sample of the packet.
+func (s *SFlow) datagram(source SFlowSource, counter *sflowCounter, data []byte) []byte {
+	protocol := uint32(sflowProtocolEthernet)
+	if source == SFlowSourceInner {
+		protocol = sflowProtocolIPv4
+		if data[0]>>4 == 6 {
+			protocol = sflowProtocolIPv6
+		}
+	}
+
+	header := data
+	if len(header) > sflowMaxHeader {
+		header = header[:sflowMaxHeader]
+	}
+	padded := (len(header) + 3) / 4 * 4
+
+	// Raw packet header record
+	record := make([]byte, 24+padded)
+	binary.BigEndian.PutUint32(record[0:4], 1)
+	binary.BigEndian.PutUint32(record[4:8], uint32(16+padded))
+	binary.BigEndian.PutUint32(record[8:12], protocol)
+	binary.BigEndian.PutUint32(record[12:16], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[16:20], 0)
+	binary.BigEndian.PutUint32(record[20:24], uint32(len(header)))
+	copy(record[24:], header)
+
+	// Flow sample
+	sample := make([]byte, 40+len(record))
+	binary.BigEndian.PutUint32(sample[0:4], 1)
+	binary.BigEndian.PutUint32(sample[4:8], uint32(32+len(record)))
+	binary.BigEndian.PutUint32(sample[8:12], counter.seq)
+	binary.BigEndian.PutUint32(sample[12:16], uint32(source))
+	binary.BigEndian.PutUint32(sample[16:20], s.rate)
+	binary.BigEndian.PutUint32(sample[20:24], counter.pool)
+	binary.BigEndian.PutUint32(sample[24:28], 0)
+	binary.BigEndian.PutUint32(sample[28:32], uint32(source))
+	binary.BigEndian.PutUint32(sample[32:36], uint32(source))
+	binary.BigEndian.PutUint32(sample[36:40], 1)
+	copy(sample[40:], record)
+
+	// Datagram with the agent in IPv4
+	b := make([]byte, 28+len(sample))
+	binary.BigEndian.PutUint32(b[0:4], sflowVersion)
+	binary.BigEndian.PutUint32(b[4:8], 1)
+	copy(b[8:12], s.agent)
+	binary.BigEndian.PutUint32(b[12:16], 0)
+	binary.BigEndian.PutUint32(b[16:20], s.seq)
+	binary.BigEndian.PutUint32(b[20:24], uint32(time.Now().Sub(s.start)/time.Millisecond))
+	binary.BigEndian.PutUint32(b[24:28], 1)
+	copy(b[28:], sample)
+
+	return b
+}
+
+// Close closes the exporter.
+func (s *SFlow) Close() error {
+	return s.conn.Close()
+}
+
+// String returns the address of the collector.
+func (s *SFlow) String() string {
+	return s.conn.RemoteAddr().String()
+}
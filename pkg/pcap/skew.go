@@ -0,0 +1,89 @@
+package pcap
+
+import (
+	"ikago/pkg/crypto"
+	"net"
+	"sync"
+	"time"
+)
+
+// skewDecay is the time the shift of windows of proofs and cookies of a client decays to none in since its skew of
+// clock is measured.
+const skewDecay = 10 * time.Minute
+
+type skewIndicator struct {
+	skew     time.Duration
+	measured time.Time
+}
+
+// skewTable describes skews of clocks of clients measured by a listener, by which windows of proofs and cookies of each
+// client are shifted, so only the client skewed is accepted out of the window. Shifts decay linearly, so a client
+// whose clock is synchronized later, or an address reassigned, is not accepted in the shifted window for long.
+type skewTable struct {
+	lock      sync.Mutex
+	skews     map[string]*skewIndicator
+	lastPurge time.Time
+}
+
+func newSkewTable() *skewTable {
+	return &skewTable{
+		skews:     make(map[string]*skewIndicator),
+		lastPurge: time.Now(),
+	}
+}
+
+// record records the skew of the clock of the IP from the local clock. Skews within clockWarning are not shifted for,
+// and skews beyond crypto.MaxClockSkew are shifted by crypto.MaxClockSkew.
+func (table *skewTable) record(ip net.IP, skew time.Duration) {
+	now := time.Now()
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	// Purge skews decayed
+	if now.Sub(table.lastPurge) > skewDecay {
+		for s, indicator := range table.skews {
+			if now.Sub(indicator.measured) >= skewDecay {
+				delete(table.skews, s)
+			}
+		}
+		table.lastPurge = now
+	}
+
+	key := string(ip.To16())
+	if absDuration(skew) <= clockWarning {
+		delete(table.skews, key)
+		return
+	}
+
+	switch {
+	case skew > crypto.MaxClockSkew:
+		skew = crypto.MaxClockSkew
+	case skew < -crypto.MaxClockSkew:
+		skew = -crypto.MaxClockSkew
+	}
+	table.skews[key] = &skewIndicator{skew: skew, measured: now}
+}
+
+// of returns the skew windows of proofs and cookies of the IP are shifted by, which decays linearly since the skew is
+// measured. The table may be nil, where nothing is shifted.
+func (table *skewTable) of(ip net.IP) time.Duration {
+	if table == nil {
+		return 0
+	}
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	indicator, ok := table.skews[string(ip.To16())]
+	if !ok {
+		return 0
+	}
+
+	elapsed := time.Now().Sub(indicator.measured)
+	if elapsed >= skewDecay {
+		return 0
+	}
+
+	return time.Duration(float64(indicator.skew) * float64(skewDecay-elapsed) / float64(skewDecay))
+}
@@ -0,0 +1,80 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// findDevName returns the name of the interface in pcap, which is the same as the interface.
+func findDevName(inter net.Interface, isLoop bool) (string, error) {
+	return inter.Name, nil
+}
+
+// findGatewayAddr returns the gateway of the default route with the lowest metric in the main table by netlink.
+func findGatewayAddr() (net.IP, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("dump routes: %w", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse routes: %w", err)
+	}
+
+	var (
+		result   net.IP
+		priority uint32 = math.MaxUint32
+	)
+	for _, msg := range msgs {
+		if msg.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		// Default routes in the main table only
+		rt := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		if rt.Dst_len != 0 || rt.Table != syscall.RT_TABLE_MAIN || rt.Type != syscall.RTN_UNICAST {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, fmt.Errorf("parse route attributes: %w", err)
+		}
+
+		var (
+			ip net.IP
+			p  uint32
+		)
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				ip = net.IP(append([]byte(nil), attr.Value...)).To4()
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) >= 4 {
+					p = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+				}
+			}
+		}
+		if ip == nil {
+			continue
+		}
+
+		if result == nil || p < priority {
+			result = ip
+			priority = p
+		}
+	}
+	if result == nil {
+		return nil, errors.New("missing default route")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,18 @@
+// +build !linux,!windows
+
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// findDevName returns the name of the interface in pcap, which is the same as the interface.
+func findDevName(inter net.Interface, isLoop bool) (string, error) {
+	return inter.Name, nil
+}
+
+func findGatewayAddr() (net.IP, error) {
+	return nil, fmt.Errorf("os %s not support", runtime.GOOS)
+}
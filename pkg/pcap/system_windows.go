@@ -0,0 +1,89 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// npfPrefix is the prefix of names of devices in Npcap and WinPcap, followed by GUIDs of adapters.
+const npfPrefix = "\\Device\\NPF_"
+
+var procGetBestRoute = syscall.NewLazyDLL("iphlpapi.dll").NewProc("GetBestRoute")
+
+// mibIPForwardRow is MIB_IPFORWARDROW in iphlpapi.
+type mibIPForwardRow struct {
+	Dest      uint32
+	Mask      uint32
+	Policy    uint32
+	NextHop   uint32
+	IfIndex   uint32
+	Type      uint32
+	Proto     uint32
+	Age       uint32
+	NextHopAS uint32
+	Metric1   uint32
+	Metric2   uint32
+	Metric3   uint32
+	Metric4   uint32
+	Metric5   uint32
+}
+
+// findDevName returns the name of the interface in pcap, which is made of the GUID of its adapter in iphlpapi. The
+// loopback interface is the loopback adapter of Npcap.
+func findDevName(inter net.Interface, isLoop bool) (string, error) {
+	if isLoop {
+		return npfPrefix + "Loopback", nil
+	}
+
+	b := make([]byte, 4096)
+	l := uint32(len(b))
+	err := syscall.GetAdaptersInfo((*syscall.IpAdapterInfo)(unsafe.Pointer(&b[0])), &l)
+	if err == syscall.ERROR_BUFFER_OVERFLOW {
+		b = make([]byte, l)
+		err = syscall.GetAdaptersInfo((*syscall.IpAdapterInfo)(unsafe.Pointer(&b[0])), &l)
+	}
+	if err != nil {
+		return "", fmt.Errorf("get adapters: %w", err)
+	}
+
+	for ai := (*syscall.IpAdapterInfo)(unsafe.Pointer(&b[0])); ai != nil; ai = ai.Next {
+		if ai.Index != uint32(inter.Index) {
+			continue
+		}
+
+		name := ai.AdapterName[:]
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+
+		return npfPrefix + string(name), nil
+	}
+
+	return "", errors.New("missing adapter")
+}
+
+// findGatewayAddr returns the next hop of the best route to any address by iphlpapi.
+func findGatewayAddr() (net.IP, error) {
+	var row mibIPForwardRow
+
+	r, _, _ := procGetBestRoute.Call(0, 0, uintptr(unsafe.Pointer(&row)))
+	if r != 0 {
+		return nil, fmt.Errorf("get best route: %w", syscall.Errno(r))
+	}
+
+	// Addresses are in network byte order in memory
+	if row.NextHop == 0 {
+		return nil, errors.New("missing default route")
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(ip, row.NextHop)
+
+	return ip, nil
+}
@@ -2,29 +2,55 @@
 
 import (
 	"fmt"
-	"ikago/internal/crypto"
 	"ikago/internal/log"
+	"ikago/pkg/crypto"
+	"ikago/pkg/stat"
 	"net"
 	"time"
 )
 
 type TCPConn struct {
-	conn  *net.TCPConn
-	crypt crypto.Crypt
+	conn      *net.TCPConn
+	crypt     crypto.Crypt
+	admission *Admission
+	malformed *quarantine
+	release   func()
 }
 
 // DialTCP acts like DialTCP for pcap networks.
-func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt) (*TCPConn, error) {
+func DialTCP(dstAddr *net.TCPAddr, opts ...Option) (*TCPConn, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  err,
+		}
+	}
+
+	return dialTCP(dstAddr, o)
+}
+
+func dialTCP(dstAddr *net.TCPAddr, o *options) (*TCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
+		IP:   o.srcDev.IPAddr().IP,
+		Port: int(o.srcPort),
+	}
+
+	network := "tcp4"
+	if dstAddr.IP.To4() == nil {
+		network = "tcp6"
+
+		// Let the system choose the address because the device only has IPv4 addresses
+		srcAddr = &net.TCPAddr{Port: int(o.srcPort)}
 	}
 
 	log.Infof("Connect to server %s\n", dstAddr.String())
 
 	t := time.Now()
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, err := net.DialTCP(network, srcAddr, dstAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -40,8 +66,9 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
 
 	return &TCPConn{
-		conn:  conn,
-		crypt: crypt,
+		conn:      conn,
+		crypt:     o.crypt,
+		malformed: newMalformedCounter(o.malMonitor),
 	}, nil
 }
 
@@ -52,14 +79,18 @@ func (c *TCPConn) Read(b []byte) (n int, err error) {
 		return 0, err
 	}
 
+	c.admission.Touch(c.RemoteAddr())
+
 	dp, err := c.crypt.Decrypt(p[:n])
 	if err != nil {
+		reject(c.RemoteAddr(), err)
+		c.malformed.add(addrIP(c.RemoteAddr()), stat.MalformedEventDecrypt)
 		return 0, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
 			Source: c.LocalAddr(),
 			Addr:   c.RemoteAddr(),
-			Err:    fmt.Errorf("decrypt: %w", err),
+			Err:    fmt.Errorf("%w: %v", ErrDecrypt, err),
 		}
 	}
 
@@ -85,6 +116,11 @@ func (c *TCPConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *TCPConn) Close() error {
+	c.admission.Release(c.RemoteAddr())
+	if c.release != nil {
+		c.release()
+	}
+
 	return c.conn.Close()
 }
 
@@ -109,15 +145,22 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 }
 
 type TCPListener struct {
-	listener *net.TCPListener
-	crypt    crypto.Crypt
+	listener  *net.TCPListener
+	crypt     crypto.Crypt
+	admission *Admission
+	monitor   *stat.MalformedMonitor
 }
 
-// ListenTCP acts like ListenTCP for pcap networks.
-func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
+// ListenTCP acts like ListenTCP for pcap networks. If an admission is set, clients over its max will be refused.
+func ListenTCP(srcPort uint16, opts ...Option) (*TCPListener, error) {
+	o, err := newListenOptions(srcPort, opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
+		IP:   o.srcDev.IPAddr().IP,
+		Port: int(o.srcPort),
 	}
 
 	listener, err := net.ListenTCP("tcp4", srcAddr)
@@ -131,21 +174,40 @@ func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, e
 	}
 
 	return &TCPListener{
-		listener: listener,
-		crypt:    crypt,
+		listener:  listener,
+		crypt:     o.crypt,
+		admission: o.admission,
+		monitor:   o.malMonitor,
 	}, nil
 }
 
 func (l *TCPListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.AcceptTCP()
-	if err != nil {
-		return nil, err
-	}
+	for {
+		conn, err := l.listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
 
-	return &TCPConn{
-		conn:  conn,
-		crypt: l.crypt,
-	}, nil
+		// Refuse clients over the max
+		if !l.admission.Admit(conn.RemoteAddr()) {
+			log.Verbosef("Refuse client %s because of too many clients\n", conn.RemoteAddr().String())
+
+			// Close without lingering results in a TCP RST
+			if l.admission.IsReset() {
+				_ = conn.SetLinger(0)
+			}
+			_ = conn.Close()
+
+			continue
+		}
+
+		return &TCPConn{
+			conn:      conn,
+			crypt:     l.crypt,
+			admission: l.admission,
+			malformed: newMalformedCounter(l.monitor),
+		}, nil
+	}
 }
 
 func (l *TCPListener) Close() error {
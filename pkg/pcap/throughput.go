@@ -0,0 +1,242 @@
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// testDataHeaderSize is the size of headers of test data, which is a byte of type, 4 bytes of run and 4 bytes of
+// sequence, followed by random bytes.
+const testDataHeaderSize = 9
+
+// testQuerySize is the size of test queries, which is a byte of type and 4 bytes of run.
+const testQuerySize = 5
+
+// testReportSize is the size of test reports, which is a byte of type, 4 bytes of run, 8 bytes of count of test data
+// received and 8 bytes of their size.
+const testReportSize = 21
+
+const (
+	// testSettle is the time waiting for test data in flight before querying.
+	testSettle = 1 * time.Second
+	// testQueryTimeout is the time waiting for a report of each query.
+	testQueryTimeout = 1 * time.Second
+	// testQueryRetries is the max count of queries sent.
+	testQueryRetries = 3
+)
+
+type testCounter struct {
+	run     uint32
+	packets uint64
+	bytes   uint64
+}
+
+// createTestQuery returns a test query of the run.
+func createTestQuery(run uint32) []byte {
+	b := make([]byte, testQuerySize)
+
+	b[0] = testQuery
+	binary.BigEndian.PutUint32(b[1:5], run)
+
+	return b
+}
+
+// createTestReport returns a test report of the counter.
+func createTestReport(counter *testCounter) []byte {
+	b := make([]byte, testReportSize)
+
+	b[0] = testReport
+	binary.BigEndian.PutUint32(b[1:5], counter.run)
+	binary.BigEndian.PutUint64(b[5:13], counter.packets)
+	binary.BigEndian.PutUint64(b[13:21], counter.bytes)
+
+	return b
+}
+
+// handleTest counts test data, replies test queries with reports and queues test reports.
+func (c *FakeTCPConn) handleTest(contents []byte, addr net.Addr) error {
+	switch contents[0] {
+	case testData:
+		if len(contents) < testDataHeaderSize {
+			return fmt.Errorf("test data size %d out of range", len(contents))
+		}
+		run := binary.BigEndian.Uint32(contents[1:5])
+
+		// Each client is counted in its latest run
+		c.testsLock.Lock()
+		counter, ok := c.tests[addr.String()]
+		if !ok || counter.run != run {
+			counter = &testCounter{run: run}
+			c.tests[addr.String()] = counter
+		}
+		counter.packets++
+		counter.bytes = counter.bytes + uint64(len(contents))
+		c.testsLock.Unlock()
+	case testQuery:
+		if len(contents) < testQuerySize {
+			return fmt.Errorf("test query size %d out of range", len(contents))
+		}
+		report := &testCounter{run: binary.BigEndian.Uint32(contents[1:5])}
+
+		c.testsLock.Lock()
+		counter, ok := c.tests[addr.String()]
+		if ok && counter.run == report.run {
+			*report = *counter
+		}
+		c.testsLock.Unlock()
+
+		_, err := c.writeMessage(createTestReport(report), addr, false)
+		if err != nil {
+			return fmt.Errorf("report: %w", err)
+		}
+	case testReport:
+		if len(contents) < testReportSize {
+			return fmt.Errorf("test report size %d out of range", len(contents))
+		}
+		report := &testCounter{
+			run:     binary.BigEndian.Uint32(contents[1:5]),
+			packets: binary.BigEndian.Uint64(contents[5:13]),
+			bytes:   binary.BigEndian.Uint64(contents[13:21]),
+		}
+
+		// Reports are dropped if nobody is testing
+		select {
+		case c.reports <- report:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// ThroughputResult describes the result of a throughput test. Sizes are of packets tunneled, which are before
+// encryption and fragmentation.
+type ThroughputResult struct {
+	Size          int           `json:"size"`
+	Duration      time.Duration `json:"duration"`
+	Sent          int           `json:"sent"`
+	SentBytes     int64         `json:"sent-bytes"`
+	Received      int           `json:"received"`
+	ReceivedBytes int64         `json:"received-bytes"`
+}
+
+// Throughput returns the bytes received by the server per second.
+func (result ThroughputResult) Throughput() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+
+	return float64(result.ReceivedBytes) / result.Duration.Seconds()
+}
+
+// Loss returns the ratio of packets lost.
+func (result ThroughputResult) Loss() float64 {
+	if result.Sent <= 0 {
+		return 0
+	}
+
+	return 1 - float64(result.Received)/float64(result.Sent)
+}
+
+// ThroughputTester measures throughput of a FakeTCP connection by pushing synthetic packets through it, which are
+// encrypted, fragmented and scheduled as packets tunneled. The server counts them and reports as long as it reads from
+// the connection.
+type ThroughputTester struct {
+	conn *FakeTCPConn
+	rand *rand.Rand
+}
+
+// NewThroughputTester returns a throughput tester of the connection. Nothing else should read from the connection while
+// testing.
+func NewThroughputTester(conn *FakeTCPConn) *ThroughputTester {
+	return &ThroughputTester{
+		conn: conn,
+		rand: rand.New(rand.NewSource(int64(randUint32()))),
+	}
+}
+
+// Run pushes packets of the size as fast as possible for the duration, and returns what the server received.
+func (t *ThroughputTester) Run(ctx context.Context, size int, duration time.Duration) (*ThroughputResult, error) {
+	if size < testDataHeaderSize || size > 65535-20-20-t.conn.crypt.Cost() {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("duration %s out of range", duration)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Read for test reports
+	errs := t.conn.drain(ctx)
+
+	// Random contents so compression takes no effect
+	data := make([]byte, size)
+	t.rand.Read(data)
+	data[0] = testData
+	run := t.rand.Uint32()
+	binary.BigEndian.PutUint32(data[1:5], run)
+
+	result := &ThroughputResult{Size: size}
+
+	start := time.Now()
+	for time.Now().Sub(start) < duration && ctx.Err() == nil {
+		binary.BigEndian.PutUint32(data[5:9], uint32(result.Sent))
+
+		// Test data is written as messages rather than data, but through the whole pipeline
+		_, err := t.conn.writeMessage(data, t.conn.RemoteAddr(), false)
+		if err != nil {
+			return nil, fmt.Errorf("write: %w", err)
+		}
+
+		result.Sent++
+		result.SentBytes = result.SentBytes + int64(size)
+	}
+	result.Duration = time.Now().Sub(start)
+
+	// Wait for data in flight
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(testSettle):
+	}
+
+	for i := 0; i < testQueryRetries; i++ {
+		_, err := t.conn.writeMessage(createTestQuery(run), t.conn.RemoteAddr(), false)
+		if err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+
+		timer := time.NewTimer(testQueryTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case err := <-errs:
+				timer.Stop()
+				return nil, fmt.Errorf("read: %w", err)
+			case report := <-t.conn.reports:
+				if report.run != run {
+					continue
+				}
+				timer.Stop()
+
+				result.Received = int(report.packets)
+				result.ReceivedBytes = int64(report.bytes)
+
+				return result, nil
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+
+	return nil, errors.New("no report")
+}
@@ -0,0 +1,386 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+)
+
+const (
+	tlsRecordHeaderSize        = 5
+	tlsRecordChangeCipherSpec  = 20
+	tlsRecordHandshake         = 22
+	tlsRecordApplicationData   = 23
+	tlsHandshakeClientHello    = 1
+	tlsHandshakeServerHello    = 2
+	tlsRandomSize              = 32
+	tlsSessionIDSize           = 32
+	tlsFinishedSize            = 40
+	tlsExtServerName           = 0x0000
+	tlsExtSupportedGroups      = 0x000a
+	tlsExtECPointFormats       = 0x000b
+	tlsExtSignatureAlgorithms  = 0x000d
+	tlsExtALPN                 = 0x0010
+	tlsExtExtendedMasterSecret = 0x0017
+	tlsExtSessionTicket        = 0x0023
+	tlsExtRenegotiationInfo    = 0xff01
+)
+
+// tlsCipherSuites are cipher suites offered in ClientHello, in the order of common browsers.
+var tlsCipherSuites = []uint16{0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+
+// TLSMimicry describes the TLS handshake forged after FakeTCP handshakes, so the traffic looks like a TLS session
+// resumed. Connections with a SNI send a ClientHello, and the other side replies a ServerHello mirroring the session,
+// the cipher suite and the first protocol of ALPN offered. Data is framed as TLS application data afterwards.
+type TLSMimicry struct {
+	SNI  string
+	ALPN []string
+}
+
+// NewTLSMimicry returns a new TLS mimicry presenting the SNI and the ALPN in ClientHello. Mimicry of servers has no SNI.
+func NewTLSMimicry(sni string, alpn []string) (*TLSMimicry, error) {
+	if len(sni) > 255 {
+		return nil, fmt.Errorf("sni %s too long", sni)
+	}
+	for _, proto := range alpn {
+		if proto == "" || len(proto) > 255 {
+			return nil, fmt.Errorf("alpn %s invalid", proto)
+		}
+	}
+
+	return &TLSMimicry{SNI: sni, ALPN: alpn}, nil
+}
+
+// clientHello describes values of a ClientHello mirrored in ServerHello.
+type clientHello struct {
+	sessionID    []byte
+	cipherSuites []uint16
+	alpn         []string
+	isEMS        bool
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendTLSExtension(b []byte, t uint16, data []byte) []byte {
+	b = appendUint16(b, t)
+	b = appendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
+
+// frameTLSRecord returns the data framed in a TLS record of the type.
+func frameTLSRecord(t byte, data []byte) []byte {
+	b := make([]byte, 0, tlsRecordHeaderSize+len(data))
+	b = append(b, t, 0x03, 0x03)
+	b = appendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
+
+// unframeTLSRecord returns the data in a TLS application data record.
+func unframeTLSRecord(b []byte) ([]byte, error) {
+	if len(b) < tlsRecordHeaderSize {
+		return nil, errors.New("missing tls record header")
+	}
+	if b[0] != tlsRecordApplicationData {
+		return nil, fmt.Errorf("tls record type %d not support", b[0])
+	}
+	if l := int(binary.BigEndian.Uint16(b[3:5])); l != len(b)-tlsRecordHeaderSize {
+		return nil, fmt.Errorf("tls record length %d mismatch", l)
+	}
+
+	return b[tlsRecordHeaderSize:], nil
+}
+
+// isTLSHandshake returns if the payload is a flight of TLS handshake instead of application data.
+func isTLSHandshake(b []byte) bool {
+	return len(b) >= tlsRecordHeaderSize && (b[0] == tlsRecordHandshake || b[0] == tlsRecordChangeCipherSpec)
+}
+
+func randBytes(size int) []byte {
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+
+	return b
+}
+
+// createClientHello returns a ClientHello record presenting the SNI and the ALPN, resuming a random session.
+func (m *TLSMimicry) createClientHello() []byte {
+	suites := make([]byte, 0)
+	for _, suite := range tlsCipherSuites {
+		suites = appendUint16(suites, suite)
+	}
+
+	// Extensions
+	exts := make([]byte, 0)
+	if m.SNI != "" {
+		sni := make([]byte, 0)
+		sni = appendUint16(sni, uint16(len(m.SNI)+3))
+		sni = append(sni, 0)
+		sni = appendUint16(sni, uint16(len(m.SNI)))
+		sni = append(sni, m.SNI...)
+		exts = appendTLSExtension(exts, tlsExtServerName, sni)
+	}
+	exts = appendTLSExtension(exts, tlsExtExtendedMasterSecret, nil)
+	exts = appendTLSExtension(exts, tlsExtRenegotiationInfo, []byte{0})
+	exts = appendTLSExtension(exts, tlsExtSupportedGroups, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18})
+	exts = appendTLSExtension(exts, tlsExtECPointFormats, []byte{0x01, 0x00})
+	exts = appendTLSExtension(exts, tlsExtSessionTicket, nil)
+	if len(m.ALPN) > 0 {
+		protos := make([]byte, 0)
+		for _, proto := range m.ALPN {
+			protos = append(protos, byte(len(proto)))
+			protos = append(protos, proto...)
+		}
+		alpn := appendUint16(nil, uint16(len(protos)))
+		exts = appendTLSExtension(exts, tlsExtALPN, append(alpn, protos...))
+	}
+	exts = appendTLSExtension(exts, tlsExtSignatureAlgorithms, []byte{0x00, 0x10, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01,
+		0x05, 0x03, 0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01})
+
+	body := make([]byte, 0)
+	body = append(body, 0x03, 0x03)
+	body = append(body, randBytes(tlsRandomSize)...)
+	body = append(body, tlsSessionIDSize)
+	body = append(body, randBytes(tlsSessionIDSize)...)
+	body = appendUint16(body, uint16(len(suites)))
+	body = append(body, suites...)
+	body = append(body, 0x01, 0x00)
+	body = appendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+
+	hello := append([]byte{tlsHandshakeClientHello}, appendUint24(nil, len(body))...)
+	hello = append(hello, body...)
+
+	// ClientHello is in a record of TLS 1.0 for compatibility
+	record := frameTLSRecord(tlsRecordHandshake, hello)
+	record[2] = 0x01
+
+	return record
+}
+
+// createClientFinished returns the flight of the client after ServerHello, which is ChangeCipherSpec and Finished.
+func createClientFinished() []byte {
+	b := frameTLSRecord(tlsRecordChangeCipherSpec, []byte{0x01})
+
+	return append(b, frameTLSRecord(tlsRecordHandshake, randBytes(tlsFinishedSize))...)
+}
+
+// parseClientHello returns values mirrored in ServerHello of the ClientHello record.
+func parseClientHello(b []byte) (*clientHello, error) {
+	var hello clientHello
+
+	if len(b) < tlsRecordHeaderSize+4 || b[0] != tlsRecordHandshake || b[tlsRecordHeaderSize] != tlsHandshakeClientHello {
+		return nil, errors.New("not client hello")
+	}
+	b = b[tlsRecordHeaderSize+4:]
+
+	// Version and random
+	if len(b) < 2+tlsRandomSize+1 {
+		return nil, errors.New("missing random")
+	}
+	b = b[2+tlsRandomSize:]
+
+	// Session ID
+	l := int(b[0])
+	if len(b) < 1+l+2 {
+		return nil, errors.New("missing session id")
+	}
+	hello.sessionID = b[1 : 1+l]
+	b = b[1+l:]
+
+	// Cipher suites
+	l = int(binary.BigEndian.Uint16(b))
+	if l%2 != 0 || len(b) < 2+l+1 {
+		return nil, errors.New("missing cipher suites")
+	}
+	for i := 2; i < 2+l; i = i + 2 {
+		hello.cipherSuites = append(hello.cipherSuites, binary.BigEndian.Uint16(b[i:]))
+	}
+	b = b[2+l:]
+
+	// Compression methods
+	l = int(b[0])
+	if len(b) < 1+l {
+		return nil, errors.New("missing compression methods")
+	}
+	b = b[1+l:]
+
+	// Extensions
+	if len(b) < 2 {
+		return &hello, nil
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		t, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return nil, fmt.Errorf("missing extension %d", t)
+		}
+		data := b[4 : 4+l]
+		b = b[4+l:]
+
+		switch t {
+		case tlsExtExtendedMasterSecret:
+			hello.isEMS = true
+		case tlsExtALPN:
+			if len(data) < 2 {
+				return nil, errors.New("missing alpn")
+			}
+			data = data[2:]
+			for len(data) > 0 {
+				l := int(data[0])
+				if len(data) < 1+l {
+					return nil, errors.New("missing alpn")
+				}
+				hello.alpn = append(hello.alpn, string(data[1:1+l]))
+				data = data[1+l:]
+			}
+		}
+	}
+
+	return &hello, nil
+}
+
+// createServerHello returns the flight of the server resuming the session of the ClientHello, which is ServerHello,
+// ChangeCipherSpec and Finished.
+func createServerHello(hello *clientHello) []byte {
+	// Mirror the first cipher suite offered known by browsers
+	suite := tlsCipherSuites[1]
+	for _, s := range hello.cipherSuites {
+		ok := false
+		for _, known := range tlsCipherSuites {
+			if s == known {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			suite = s
+			break
+		}
+	}
+
+	// Extensions
+	exts := make([]byte, 0)
+	exts = appendTLSExtension(exts, tlsExtRenegotiationInfo, []byte{0})
+	if hello.isEMS {
+		exts = appendTLSExtension(exts, tlsExtExtendedMasterSecret, nil)
+	}
+	if len(hello.alpn) > 0 {
+		proto := hello.alpn[0]
+		alpn := appendUint16(nil, uint16(len(proto)+1))
+		alpn = append(alpn, byte(len(proto)))
+		alpn = append(alpn, proto...)
+		exts = appendTLSExtension(exts, tlsExtALPN, alpn)
+	}
+
+	body := make([]byte, 0)
+	body = append(body, 0x03, 0x03)
+	body = append(body, randBytes(tlsRandomSize)...)
+	body = append(body, byte(len(hello.sessionID)))
+	body = append(body, hello.sessionID...)
+	body = appendUint16(body, suite)
+	body = append(body, 0x00)
+	body = appendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+
+	serverHello := append([]byte{tlsHandshakeServerHello}, appendUint24(nil, len(body))...)
+	serverHello = append(serverHello, body...)
+
+	b := frameTLSRecord(tlsRecordHandshake, serverHello)
+	b = append(b, frameTLSRecord(tlsRecordChangeCipherSpec, []byte{0x01})...)
+
+	return append(b, frameTLSRecord(tlsRecordHandshake, randBytes(tlsFinishedSize))...)
+}
+
+// sendClientHello sends a ClientHello to the address.
+func (c *FakeTCPConn) sendClientHello(addr net.Addr) error {
+	err := c.writeRaw(c.tls.createClientHello(), addr)
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("Send TLS ClientHello to %s with SNI %s\n", addr.String(), c.tls.SNI)
+
+	return nil
+}
+
+// handleTLSHandshake replies the flight of TLS handshake received, which is never delivered.
+func (c *FakeTCPConn) handleTLSHandshake(b []byte, addr net.Addr) error {
+	// ChangeCipherSpec and Finished of the client end the handshake
+	if b[0] != tlsRecordHandshake || len(b) <= tlsRecordHeaderSize {
+		return nil
+	}
+
+	switch b[tlsRecordHeaderSize] {
+	case tlsHandshakeClientHello:
+		hello, err := parseClientHello(b)
+		if err != nil {
+			return fmt.Errorf("parse client hello: %w", err)
+		}
+
+		log.Verbosef("Receive TLS ClientHello from %s\n", addr.String())
+
+		return c.writeRaw(createServerHello(hello), addr)
+	case tlsHandshakeServerHello:
+		log.Verbosef("Receive TLS ServerHello from %s\n", addr.String())
+
+		return c.writeRaw(createClientFinished(), addr)
+	default:
+		return nil
+	}
+}
+
+// writeRaw writes the payload to the address as is, bypassing the crypt and the scheduler.
+func (c *FakeTCPConn) writeRaw(payload []byte, addr net.Addr) error {
+	dstAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("type %T not support", addr)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return errors.New("client unrecognized")
+	}
+
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(dstAddr.Port), client.seq, client.ack, c.conn, dstAddr.IP, client.id, ttlOr(c.ttl, defaultTTL), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	MarkNetworkLayer(networkLayer, c.dscp)
+
+	fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(payload), c.fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	for _, frag := range fragments {
+		err := c.writeFrame(frag)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	client.seq = client.seq + uint32(len(payload))
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	return nil
+}
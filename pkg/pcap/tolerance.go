@@ -0,0 +1,66 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"sync/atomic"
+)
+
+// skippableError is an error of a single packet which fails to parse or decrypt, rather than of the connection. Such
+// errors are skipped in reads with tolerance.
+type skippableError struct {
+	err error
+}
+
+func (err *skippableError) Error() string {
+	return err.err.Error()
+}
+
+func (err *skippableError) Unwrap() error {
+	return err.err
+}
+
+// skippable marks the error as an error of a single packet.
+func skippable(err error) error {
+	return &skippableError{err: err}
+}
+
+// tolerate skips the error of a single packet in reads with tolerance, and counts it. Failures over the tolerance in a
+// row are systemic, like a wrong password or a middlebox mangling every packet, and are returned.
+func (c *FakeTCPConn) tolerate(n int, a net.Addr, err error) (int, net.Addr, error) {
+	if c.tolerance <= 0 {
+		return n, a, err
+	}
+	if err == nil {
+		atomic.StoreUint32(&c.failures, 0)
+		return n, a, nil
+	}
+
+	var e *skippableError
+	if !errors.As(err, &e) {
+		return n, a, err
+	}
+
+	atomic.AddUint64(&c.skipped, 1)
+	failures := atomic.AddUint32(&c.failures, 1)
+	if int(failures) > c.tolerance {
+		atomic.StoreUint32(&c.failures, 0)
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    fmt.Errorf("%d packets failed in a row: %w", failures, e.err),
+		}
+	}
+	log.Verboseln(fmt.Errorf("skip packet: %w", err))
+
+	return 0, a, nil
+}
+
+// Skipped returns the count of packets failed to parse or decrypt and skipped in reads with tolerance.
+func (c *FakeTCPConn) Skipped() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
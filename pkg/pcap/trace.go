@@ -0,0 +1,212 @@
+package pcap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Directions of packets traced.
+const (
+	TraceIn  = "in"
+	TraceOut = "out"
+)
+
+// Types of packets traced.
+const (
+	TraceSYN       = "syn"
+	TraceSYNACK    = "syn-ack"
+	TraceACK       = "ack"
+	TraceRST       = "rst"
+	TraceFIN       = "fin"
+	TraceData      = "data"
+	TraceHeartbeat = "heartbeat"
+	TraceRekey     = "rekey"
+	TraceStats     = "stats"
+	TraceClose     = "close"
+	TraceMessage   = "message"
+	TraceSegment   = "segment"
+)
+
+var traceTypes = []string{TraceSYN, TraceSYNACK, TraceACK, TraceRST, TraceFIN, TraceData, TraceHeartbeat, TraceRekey,
+	TraceStats, TraceClose, TraceMessage, TraceSegment}
+
+// TraceFilter describes the filter of packets traced, packets are traced only if they match all conditions set.
+type TraceFilter struct {
+	Peer      net.IP
+	Port      int
+	Direction string
+	Types     []string
+}
+
+// ParseTraceFilter returns a filter of packets traced by conditions separated by commas, which are peer=ip[:port],
+// dir=in or out, and type=types separated by vertical bars, like peer=1.2.3.4,dir=in,type=data|message. all matches all
+// packets.
+func ParseTraceFilter(s string) (*TraceFilter, error) {
+	filter := &TraceFilter{}
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "all" {
+		return filter, nil
+	}
+
+	for _, cond := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(cond), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("condition %s not support", cond)
+		}
+
+		switch k, v := kv[0], kv[1]; k {
+		case "peer":
+			host, port, err := net.SplitHostPort(v)
+			if err != nil {
+				host = v
+			} else {
+				filter.Port, err = strconv.Atoi(port)
+				if err != nil || filter.Port <= 0 || filter.Port > 65535 {
+					return nil, fmt.Errorf("port %s out of range", port)
+				}
+			}
+
+			filter.Peer = net.ParseIP(host)
+			if filter.Peer == nil {
+				return nil, fmt.Errorf("invalid peer %s", v)
+			}
+		case "dir":
+			if v != TraceIn && v != TraceOut {
+				return nil, fmt.Errorf("direction %s not support", v)
+			}
+			filter.Direction = v
+		case "type":
+			for _, t := range strings.Split(v, "|") {
+				if !containsString(traceTypes, t) {
+					return nil, fmt.Errorf("type %s not support", t)
+				}
+				filter.Types = append(filter.Types, t)
+			}
+		default:
+			return nil, fmt.Errorf("condition %s not support", k)
+		}
+	}
+
+	return filter, nil
+}
+
+// Match returns if the packet of the type in the direction from or to the address matches the filter.
+func (filter *TraceFilter) Match(direction string, addr net.Addr, t string) bool {
+	if filter.Direction != "" && filter.Direction != direction {
+		return false
+	}
+	if len(filter.Types) > 0 && !containsString(filter.Types, t) {
+		return false
+	}
+	if filter.Peer != nil {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || !tcpAddr.IP.Equal(filter.Peer) || filter.Port != 0 && tcpAddr.Port != filter.Port {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (filter *TraceFilter) String() string {
+	conds := make([]string, 0)
+	if filter.Peer != nil {
+		if filter.Port != 0 {
+			conds = append(conds, "peer="+net.JoinHostPort(filter.Peer.String(), strconv.Itoa(filter.Port)))
+		} else {
+			conds = append(conds, "peer="+filter.Peer.String())
+		}
+	}
+	if filter.Direction != "" {
+		conds = append(conds, "dir="+filter.Direction)
+	}
+	if len(filter.Types) > 0 {
+		conds = append(conds, "type="+strings.Join(filter.Types, "|"))
+	}
+	if len(conds) <= 0 {
+		return "all"
+	}
+
+	return strings.Join(conds, ",")
+}
+
+// traceTypeOf returns the type of the contents decrypted in tracing.
+func traceTypeOf(contents []byte, isTyped bool) string {
+	if !isTyped {
+		return TraceData
+	}
+
+	switch {
+	case len(contents) <= 0:
+		return TraceData
+	case isSegment(contents):
+		return TraceSegment
+	case contents[0] == frameHeartbeat:
+		return TraceHeartbeat
+	case contents[0] == frameRekey:
+		return TraceRekey
+	case contents[0] == frameStats:
+		return TraceStats
+	case contents[0] == frameClose:
+		return TraceClose
+	case isMessage(contents):
+		return TraceMessage
+	default:
+		return TraceData
+	}
+}
+
+// traceTypeOfTCP returns the type of the TCP segment by its flags in tracing, or empty if it carries data.
+func traceTypeOfTCP(tcpLayer *layers.TCP, payload []byte) string {
+	switch {
+	case tcpLayer.SYN && tcpLayer.ACK:
+		return TraceSYNACK
+	case tcpLayer.SYN:
+		return TraceSYN
+	case tcpLayer.RST:
+		return TraceRST
+	case tcpLayer.FIN:
+		return TraceFIN
+	case len(payload) <= 0:
+		return TraceACK
+	default:
+		return ""
+	}
+}
+
+// trace prints a summary of the packet of the type in the direction from or to the address if it matches the filter,
+// and its contents decrypted in hex if it is set.
+func (c *FakeTCPConn) trace(direction string, addr net.Addr, t string, seq, ack uint32, contents []byte) {
+	if c.traceFilter == nil || !log.IsTrace() || !c.traceFilter.Match(direction, addr, t) {
+		return
+	}
+
+	local := &net.TCPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
+	arrow := "->"
+	if direction == TraceIn {
+		arrow = "<-"
+	}
+	if t == TraceMessage && len(contents) > 0 {
+		t = fmt.Sprintf("%s 0x%02x", t, contents[0])
+	}
+	log.Tracef("Trace %s: %s %s %s %s seq %d ack %d size %d\n", direction, local, arrow, addr, t, seq, ack, len(contents))
+	if c.isTraceHex && len(contents) > 0 {
+		log.Trace(hex.Dump(contents))
+	}
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
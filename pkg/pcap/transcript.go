@@ -0,0 +1,63 @@
+package pcap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"ikago/pkg/crypto"
+)
+
+// transcriptSize is the size of hashes of transcripts of negotiation.
+const transcriptSize = 16
+
+// maxTranscripts is the max count of recent TCP SYN remembered, whose transcripts are accepted in TCP SYN+ACK.
+const maxTranscripts = 4
+
+// ErrNegotiationTampered describes the TCP SYN is not received by the server as it is sent, which may be stripped by
+// an on-path attacker to force a weaker mode.
+var ErrNegotiationTampered = errors.New("negotiation tampered")
+
+func hashTranscript(syn []byte) []byte {
+	h := sha256.Sum256(syn)
+
+	return h[:transcriptSize]
+}
+
+// signTranscript returns the transcript of negotiation signed by the crypt, which is the payload of the TCP SYN
+// received. Transcripts are only signed in AEAD, because signatures of other crypt can be forged.
+func signTranscript(crypt crypto.Crypt, syn []byte) ([]byte, error) {
+	if len(syn) <= 0 || !crypt.Method().IsAEAD() {
+		return nil, nil
+	}
+
+	signed, err := crypt.Encrypt(hashTranscript(syn))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+
+	return signed, nil
+}
+
+// verifyTranscript verifies the transcript signed by the server matches any of the payloads of TCP SYN sent.
+func verifyTranscript(crypt crypto.Crypt, syns [][]byte, signed []byte) error {
+	if len(syns) <= 0 || !crypt.Method().IsAEAD() {
+		return nil
+	}
+	if len(signed) <= 0 {
+		return fmt.Errorf("missing transcript: %w", ErrNegotiationTampered)
+	}
+
+	b, err := crypt.Decrypt(signed)
+	if err != nil {
+		return fmt.Errorf("decrypt transcript: %v: %w", err, ErrNegotiationTampered)
+	}
+
+	for _, syn := range syns {
+		if hmac.Equal(b, hashTranscript(syn)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("transcript mismatch: %w", ErrNegotiationTampered)
+}
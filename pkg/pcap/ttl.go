@@ -0,0 +1,57 @@
+package pcap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultTTL is the TTL packets of connections are written in, which is of Windows.
+	defaultTTL = 128
+	// defaultResponseTTL is the TTL responses to TCP SYN are written in, which is of Linux.
+	defaultResponseTTL = 64
+)
+
+// osTTLs are initial TTLs of operating systems, so packets look like from the system they are mimicking.
+var osTTLs = map[string]uint8{
+	"windows": 128,
+	"linux":   64,
+	"android": 64,
+	"macos":   64,
+	"ios":     64,
+	"freebsd": 64,
+	"solaris": 255,
+}
+
+// ParseTTL returns the TTL of the value, which is either a number in [1, 255] or an operating system whose initial TTL
+// is used. An empty value returns 0, which means TTLs are default.
+func ParseTTL(s string) (uint8, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	ttl, ok := osTTLs[strings.ToLower(s)]
+	if ok {
+		return ttl, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("ttl %s not support", s)
+	}
+	if i < 1 || i > 255 {
+		return 0, fmt.Errorf("ttl %d out of range [1, 255]", i)
+	}
+
+	return uint8(i), nil
+}
+
+// ttlOr returns the TTL set by WithTTL, or the default one if it is not set.
+func ttlOr(ttl, def uint8) uint8 {
+	if ttl == 0 {
+		return def
+	}
+
+	return ttl
+}
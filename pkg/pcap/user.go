@@ -0,0 +1,174 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/pkg/crypto"
+	"net"
+	"sync"
+	"time"
+)
+
+var errUnknownUser = errors.New("unknown user")
+
+type userIndicator struct {
+	crypt    crypto.Crypt
+	verifier *crypto.ProofVerifier
+}
+
+// Users identifies clients by proofs carried in their SYN. Each user has a crypt of its own key, so a user cannot
+// decrypt traffic of others, and the server knows which user every client is.
+type Users struct {
+	lock  sync.RWMutex
+	users map[string]*userIndicator
+}
+
+// NewUsers returns a new set of users.
+func NewUsers() *Users {
+	return &Users{
+		users: make(map[string]*userIndicator),
+	}
+}
+
+// Add adds a user with the crypt, an existing one will be replaced. Only crypt in AEAD is supported, because proofs
+// created by other crypt can be forged.
+func (users *Users) Add(name string, crypt crypto.Crypt) error {
+	if name == "" {
+		return errors.New("missing name")
+	}
+
+	verifier, err := crypto.NewProofVerifier(crypt)
+	if err != nil {
+		return fmt.Errorf("create proof verifier: %w", err)
+	}
+
+	users.lock.Lock()
+	defer users.lock.Unlock()
+
+	users.users[name] = &userIndicator{
+		crypt:    crypt,
+		verifier: verifier,
+	}
+
+	return nil
+}
+
+// Remove removes the user. Clients of the user connected are kept.
+func (users *Users) Remove(name string) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+
+	delete(users.users, name)
+}
+
+// Names returns names of all users.
+func (users *Users) Names() []string {
+	users.lock.RLock()
+	defer users.lock.RUnlock()
+
+	names := make([]string, 0, len(users.users))
+	for name := range users.users {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// find returns the crypt of the user.
+func (users *Users) find(name string) (crypto.Crypt, bool) {
+	users.lock.RLock()
+	defer users.lock.RUnlock()
+
+	user, ok := users.users[name]
+	if !ok {
+		return nil, false
+	}
+
+	return user.crypt, true
+}
+
+// identify returns the name and the crypt of the user whose key created the proof, which is also accepted in the window
+// shifted by the skew. Proofs are tried against each user, and proofs of a user expired or replayed are not tried
+// against others.
+func (users *Users) identify(proof []byte, skew time.Duration) (string, crypto.Crypt, error) {
+	users.lock.RLock()
+	defer users.lock.RUnlock()
+
+	for name, user := range users.users {
+		err := user.verifier.VerifySkewed(proof, skew)
+		if err == nil {
+			return name, user.crypt, nil
+		}
+		if errors.Is(err, crypto.ErrProofExpired) || errors.Is(err, crypto.ErrProofReplayed) {
+			return "", nil, fmt.Errorf("user %s: %w", name, err)
+		}
+	}
+
+	return "", nil, errUnknownUser
+}
+
+// identifySYN identifies the user of the proof carried in the TCP SYN. Sources failing repeatedly are backed off in the
+// same way as verifySYN.
+func identifySYN(users *Users, indicator *PacketIndicator, proof []byte, skew time.Duration) (string, crypto.Crypt, error) {
+	if isBackingOff(indicator.SrcIP()) {
+		return "", nil, errBackingOff
+	}
+
+	if len(proof) <= 0 {
+		failHandshake(indicator.SrcIP())
+		return "", nil, errMissingProof
+	}
+
+	name, crypt, err := users.identify(proof, skew)
+	if err != nil {
+		failHandshake(indicator.SrcIP())
+		return "", nil, err
+	}
+
+	succeedHandshake(indicator.SrcIP())
+
+	return name, crypt, nil
+}
+
+// identify assigns the user and its crypt to the client, which is created if not exists.
+func (c *FakeTCPConn) identify(addr net.Addr, name string, crypt crypto.Crypt) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.Lock()
+	defer c.clientsLock.Unlock()
+
+	client, ok := c.clients[addr.String()]
+	if !ok {
+		c.clients[addr.String()] = &clientIndicator{
+			crypt:     crypt,
+			version:   c.version,
+			seq:       c.preamble.initialSeq(),
+			id:        randUint16(),
+			lastWrite: time.Now(),
+			probes:    newLossMeter(),
+			seen:      newSeqWindow(),
+			user:      name,
+		}
+		return
+	}
+
+	client.crypt = crypt
+	client.rekey = nil
+	client.user = name
+}
+
+// User returns the name of the user the remote client is identified as.
+func (c *FakeTCPConn) User() (string, bool) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return client.user, client.user != ""
+}
@@ -0,0 +1,221 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Validation describes how malformed packets are treated.
+type Validation int
+
+const (
+	// ValidationLoose describes malformed packets are tolerated silently.
+	ValidationLoose Validation = iota
+	// ValidationNormal describes malformed packets are logged and handled as usual.
+	ValidationNormal
+	// ValidationStrict describes malformed packets are dropped.
+	ValidationStrict
+)
+
+func (v Validation) String() string {
+	switch v {
+	case ValidationLoose:
+		return "loose"
+	case ValidationNormal:
+		return "normal"
+	case ValidationStrict:
+		return "strict"
+	default:
+		return strconv.Itoa(int(v))
+	}
+}
+
+// ParseValidation returns the validation by given name.
+func ParseValidation(s string) (Validation, error) {
+	switch strings.ToLower(s) {
+	case "loose":
+		return ValidationLoose, nil
+	case "normal":
+		return ValidationNormal, nil
+	case "strict":
+		return ValidationStrict, nil
+	default:
+		return 0, fmt.Errorf("validation %s not support", s)
+	}
+}
+
+var errBadChecksum = errors.New("bad checksum")
+
+// ValidatePacket returns the first problem found in headers of the packet, including malformed headers, bad checksums
+// and unexpected TCP flags.
+func ValidatePacket(packet gopacket.Packet) error {
+	errorLayer := packet.ErrorLayer()
+	if errorLayer != nil {
+		return fmt.Errorf("malformed %s: %w", errorLayer.LayerType(), errorLayer.Error())
+	}
+	if packet.Metadata().Truncated {
+		return errors.New("truncated")
+	}
+
+	var (
+		srcIP, dstIP net.IP
+		isFrag       bool
+	)
+
+	switch t := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if t.IHL < 5 || int(t.Length) < int(t.IHL)*4 {
+			return errors.New("malformed ipv4 header")
+		}
+		if checksum(0, t.Contents) != 0 {
+			return fmt.Errorf("ipv4: %w", errBadChecksum)
+		}
+
+		srcIP, dstIP = t.SrcIP, t.DstIP
+		isFrag = t.Flags&layers.IPv4MoreFragments != 0 || t.FragOffset != 0
+	case *layers.IPv6:
+		srcIP, dstIP = t.SrcIP, t.DstIP
+
+		fragmentLayer := packet.Layer(layers.LayerTypeIPv6Fragment)
+		if fragmentLayer != nil {
+			fragment := fragmentLayer.(*layers.IPv6Fragment)
+			isFrag = fragment.MoreFragments || fragment.FragmentOffset != 0
+		}
+	default:
+		return nil
+	}
+
+	// Transport layers in fragments cannot be verified until they are reassembled
+	if isFrag {
+		return nil
+	}
+
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		if t.DataOffset < 5 {
+			return errors.New("malformed tcp header")
+		}
+
+		switch {
+		case t.SYN && t.FIN:
+			return errors.New("unexpected tcp flags syn and fin")
+		case t.SYN && t.RST:
+			return errors.New("unexpected tcp flags syn and rst")
+		case t.FIN && !t.ACK:
+			return errors.New("unexpected tcp flag fin without ack")
+		case !t.SYN && !t.ACK && !t.RST:
+			return errors.New("missing tcp flags")
+		}
+
+		pseudoheader := pseudoheaderChecksum(srcIP, dstIP, layers.IPProtocolTCP, len(t.Contents)+len(t.Payload))
+		if checksum(pseudoheader, t.Contents, t.Payload) != 0 {
+			return fmt.Errorf("tcp: %w", errBadChecksum)
+		}
+	case *layers.UDP:
+		if int(t.Length) != len(t.Contents)+len(t.Payload) {
+			return errors.New("malformed udp header")
+		}
+
+		// Checksum is optional in UDP over IPv4
+		pseudoheader := pseudoheaderChecksum(srcIP, dstIP, layers.IPProtocolUDP, len(t.Contents)+len(t.Payload))
+		if t.Checksum != 0 && checksum(pseudoheader, t.Contents, t.Payload) != 0 {
+			return fmt.Errorf("udp: %w", errBadChecksum)
+		}
+	default:
+		break
+	}
+
+	return nil
+}
+
+// VerifyChecksum returns an error if the IPv4 header or the transport layer of the packet has a bad checksum, so
+// packets corrupted in the tunnel are found before their checksums are recomputed. Transport layers in fragments are
+// not verified.
+func VerifyChecksum(indicator *PacketIndicator) error {
+	if t := indicator.IPv4Layer(); t != nil && checksum(0, t.Contents) != 0 {
+		return fmt.Errorf("ipv4: %w", errBadChecksum)
+	}
+
+	// Transport layers in fragments cannot be verified until they are reassembled
+	if indicator.IsFrag() || indicator.TransportLayer() == nil {
+		return nil
+	}
+
+	srcIP, dstIP := indicator.SrcIP(), indicator.DstIP()
+
+	switch t := indicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		tcpLayer := indicator.TCPLayer()
+
+		pseudoheader := pseudoheaderChecksum(srcIP, dstIP, layers.IPProtocolTCP, len(tcpLayer.Contents)+len(tcpLayer.Payload))
+		if checksum(pseudoheader, tcpLayer.Contents, tcpLayer.Payload) != 0 {
+			return fmt.Errorf("tcp: %w", errBadChecksum)
+		}
+	case layers.LayerTypeUDP:
+		udpLayer := indicator.UDPLayer()
+
+		// Checksum is optional in UDP over IPv4
+		if udpLayer.Checksum == 0 && indicator.IPv4Layer() != nil {
+			break
+		}
+		pseudoheader := pseudoheaderChecksum(srcIP, dstIP, layers.IPProtocolUDP, len(udpLayer.Contents)+len(udpLayer.Payload))
+		if checksum(pseudoheader, udpLayer.Contents, udpLayer.Payload) != 0 {
+			return fmt.Errorf("udp: %w", errBadChecksum)
+		}
+	case layers.LayerTypeICMPv4:
+		icmpv4Layer := indicator.ICMPv4Indicator().ICMPv4Layer()
+
+		if checksum(0, icmpv4Layer.Contents, icmpv4Layer.Payload) != 0 {
+			return fmt.Errorf("icmpv4: %w", errBadChecksum)
+		}
+	default:
+		break
+	}
+
+	return nil
+}
+
+// pseudoheaderChecksum returns the partial checksum of the pseudo header in TCP and UDP.
+func pseudoheaderChecksum(srcIP, dstIP net.IP, protocol layers.IPProtocol, length int) uint32 {
+	var csum uint32
+
+	if srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+
+	for i := 0; i+1 < len(srcIP); i += 2 {
+		csum += uint32(binary.BigEndian.Uint16(srcIP[i:]))
+	}
+	for i := 0; i+1 < len(dstIP); i += 2 {
+		csum += uint32(binary.BigEndian.Uint16(dstIP[i:]))
+	}
+	csum += uint32(protocol)
+	csum += uint32(length) & 0xffff
+	csum += uint32(length) >> 16
+
+	return csum
+}
+
+// checksum returns the Internet checksum of the data in sequence with the partial checksum, which is 0 if the data
+// including its checksum is intact. All data except the last must be in even length.
+func checksum(csum uint32, data ...[]byte) uint16 {
+	for _, b := range data {
+		for i := 0; i+1 < len(b); i += 2 {
+			csum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			csum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for csum > 0xffff {
+		csum = (csum >> 16) + (csum & 0xffff)
+	}
+
+	return ^uint16(csum)
+}
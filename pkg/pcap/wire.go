@@ -0,0 +1,94 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/pkg/crypto"
+	"strconv"
+)
+
+// Versions of the wire format of FakeTCP, which is everything peers write to each other after the TCP SYN.
+//
+// The version is embedded in the method tag of the TCP SYN, so the layout of handshakes never changes across versions.
+// TCP SYN carrying nothing are of WireVersion0 before method tags, unless connections are without a preamble, which
+// agree on the version set by WithWireVersion instead. Compatibility is kept in the following policy:
+//
+//  1. Connections write in WireVersion by default, or in an older version set by WithWireVersion.
+//  2. Listeners read every version from MinWireVersion to WireVersion, and write to each client in its version.
+//  3. A version is read for at least one release after it is superseded, so MinWireVersion is raised at most once a
+//     release, and never to WireVersion when it is raised.
+//
+// Servers are upgraded before clients in rolling upgrades. Clients connecting to servers of an older version should
+// pin their version by WithWireVersion until servers are upgraded.
+const (
+	// WireVersion0 is the wire format before method tags, whose TCP SYN carry nothing. Datagrams are data unless they
+	// are in typed framing set by WithTyped. It is read from clients only, and never written.
+	WireVersion0 = 0
+	// WireVersion1 is the wire format of method tags before versioning, whose method tags are of methods only.
+	// Datagrams are data unless they are in typed framing set by WithTyped.
+	WireVersion1 = 1
+	// WireVersion2 is the wire format whose method tags are of methods and versions. Datagrams are data unless they
+	// are in typed framing set by WithTyped.
+	WireVersion2 = 2
+	// WireVersion3 is the wire format whose datagrams are always in typed framing, so messages in band, segments and
+	// heartbeats are frames of their own types. Datagrams too large for IP fragmentation are written in segments.
+	WireVersion3 = 3
+)
+
+const (
+	// WireVersion is the version of the wire format written by default.
+	WireVersion = WireVersion3
+	// MinWireVersion is the oldest version of the wire format still written and read in method tags.
+	MinWireVersion = WireVersion1
+)
+
+// checkWireVersion returns an error if the version of the wire format is not supported.
+func checkWireVersion(version int) error {
+	if version < MinWireVersion || version > WireVersion {
+		return fmt.Errorf("wire version %d out of range [%d, %d]", version, MinWireVersion, WireVersion)
+	}
+
+	return nil
+}
+
+// wireTagName returns the name method tags are created of for the method in the version of the wire format. Names in
+// the first version are of methods only, so peers before versioning read them as they are.
+func wireTagName(method string, version int) string {
+	if version <= WireVersion1 {
+		return method
+	}
+
+	return method + "/" + strconv.Itoa(version)
+}
+
+// createWireTag returns the method tag of the method in the version of the wire format.
+func createWireTag(method string, version int) ([]byte, error) {
+	return crypto.CreateMethodTag(wireTagName(method, version))
+}
+
+// matchWireTag returns the version of the wire format the method tag is created in for the method, and false if it
+// matches none of the versions supported.
+func matchWireTag(tag []byte, method string) (int, bool) {
+	for v := WireVersion; v >= MinWireVersion; v-- {
+		if crypto.MatchMethodTag(tag, wireTagName(method, v)) {
+			return v, true
+		}
+	}
+
+	return 0, false
+}
+
+// parseWireTag returns the method and the version of the wire format the method tag is created in.
+func parseWireTag(tag []byte) (string, int, error) {
+	for _, method := range crypto.Methods() {
+		if v, ok := matchWireTag(tag, method); ok {
+			return method, v, nil
+		}
+	}
+
+	return "", 0, crypto.ErrUnknownMethod
+}
+
+// isFramed returns if datagrams are always in typed framing in the version of the wire format.
+func isFramed(version int) bool {
+	return version >= WireVersion3
+}
@@ -0,0 +1,115 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"ikago/pkg/crypto"
+	"testing"
+)
+
+func TestWireTags(t *testing.T) {
+	for _, method := range crypto.Methods() {
+		for v := MinWireVersion; v <= WireVersion; v++ {
+			tag, err := createWireTag(method, v)
+			if err != nil {
+				t.Fatalf("create wire tag of %s in version %d: %v", method, v, err)
+			}
+
+			name, version, err := parseWireTag(tag)
+			if err != nil {
+				t.Fatalf("parse wire tag of %s in version %d: %v", method, v, err)
+			}
+			if name != method || version != v {
+				t.Errorf("expect %s in version %d, got %s in version %d", method, v, name, version)
+			}
+		}
+	}
+}
+
+// TestWireTagsBeforeVersioning checks method tags of the first version are the ones created before versioning.
+func TestWireTagsBeforeVersioning(t *testing.T) {
+	for _, method := range crypto.Methods() {
+		tag, err := crypto.CreateMethodTag(method)
+		if err != nil {
+			t.Fatalf("create method tag of %s: %v", method, err)
+		}
+
+		v, ok := matchWireTag(tag, method)
+		if !ok || v != WireVersion1 {
+			t.Errorf("%s: expect version %d, got %d", method, WireVersion1, v)
+		}
+	}
+}
+
+func TestNegotiateSYN(t *testing.T) {
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "wire")
+	if err != nil {
+		t.Fatalf("parse crypt: %v", err)
+	}
+	method := crypto.Name(crypt)
+	other := "plain"
+	if method == other {
+		t.Fatalf("method %s is the same", other)
+	}
+	proof := []byte("proof")
+
+	tagged := func(method string, version int) []byte {
+		tag, err := createWireTag(method, version)
+		if err != nil {
+			t.Fatalf("create wire tag: %v", err)
+		}
+
+		return append(tag, proof...)
+	}
+
+	cases := []struct {
+		name     string
+		payload  []byte
+		untagged int
+		version  int
+		proof    []byte
+		isErr    bool
+		err      error
+	}{
+		{name: "baseline", payload: nil, untagged: PreambleTagged.untaggedVersion(WireVersion), version: WireVersion0},
+		{name: "no preamble", payload: nil, untagged: PreambleNone.untaggedVersion(WireVersion2), version: WireVersion2},
+		{name: "version 1", payload: tagged(method, WireVersion1), version: WireVersion1, proof: proof},
+		{name: "version 2", payload: tagged(method, WireVersion2), version: WireVersion2, proof: proof},
+		{name: "version 3", payload: tagged(method, WireVersion3), version: WireVersion3, proof: proof},
+		{name: "other method", payload: tagged(other, WireVersion), isErr: true, err: errMethodMismatch},
+		{name: "unknown version", payload: tagged(method, WireVersion+1), isErr: true, err: crypto.ErrUnknownMethod},
+		{name: "malformed", payload: []byte{0x00}, isErr: true},
+	}
+
+	for _, c := range cases {
+		version, rest, err := negotiateSYN(crypt, c.payload, c.untagged)
+		if c.isErr {
+			if err == nil {
+				t.Errorf("%s: expect error, got none", c.name)
+			} else if c.err != nil && !errors.Is(err, c.err) {
+				t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if version != c.version {
+			t.Errorf("%s: expect version %d, got %d", c.name, c.version, version)
+		}
+		if !bytes.Equal(rest, c.proof) {
+			t.Errorf("%s: expect proof %q, got %q", c.name, c.proof, rest)
+		}
+	}
+}
+
+// TestFraming checks only the latest version is always in typed framing, so clients before it are read as data.
+func TestFraming(t *testing.T) {
+	for v := WireVersion0; v <= WireVersion; v++ {
+		if expected := v >= WireVersion3; isFramed(v) != expected {
+			t.Errorf("version %d: expect framed %t, got %t", v, expected, isFramed(v))
+		}
+	}
+}
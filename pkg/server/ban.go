@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+type banSnapshot struct {
+	IPs   []string `json:"ips"`
+	Users []string `json:"users"`
+}
+
+// loadBans restores bans from the file of bans.
+func (e *engine) loadBans() error {
+	if e.banFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(e.banFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read: %w", err)
+	}
+
+	s := &banSnapshot{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for _, str := range s.IPs {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %s", str)
+		}
+		e.bans.BanIP(ip)
+	}
+	for _, user := range s.Users {
+		e.bans.BanUser(user)
+	}
+
+	return nil
+}
+
+// saveBans persists bans in the file of bans.
+func (e *engine) saveBans() error {
+	if e.banFile == "" {
+		return nil
+	}
+
+	ips, users := e.bans.List()
+	b, err := json.MarshalIndent(&banSnapshot{IPs: ips, Users: users}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	// Write to a temporary file first, so the file is never left half written
+	tmp := e.banFile + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	err = os.Rename(tmp, e.banFile)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
+
+// isBanned returns if the client is banned by its IP or its user.
+func (e *engine) isBanned(conn net.Conn) bool {
+	var name string
+	if u := e.clientUser(conn); u != nil {
+		name = u.name
+	}
+
+	return e.bans.IsBanned(conn.RemoteAddr(), name)
+}
+
+// track records the connection of the client, so it can be disconnected once banned.
+func (e *engine) track(conn net.Conn) {
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	e.conns[conn] = true
+}
+
+// untrack forgets the connection of the client.
+func (e *engine) untrack(conn net.Conn) {
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	delete(e.conns, conn)
+	e.queMonitor.Remove(conn.RemoteAddr().String())
+}
+
+// isTracked returns if the connection of the client is recorded.
+func (e *engine) isTracked(conn net.Conn) bool {
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	return e.conns[conn]
+}
+
+// kickBanned disconnects clients banned immediately.
+func (e *engine) kickBanned() {
+	e.connsLock.Lock()
+	conns := make([]net.Conn, 0)
+	for conn := range e.conns {
+		if e.isBanned(conn) {
+			conns = append(conns, conn)
+			delete(e.conns, conn)
+			e.queMonitor.Remove(conn.RemoteAddr().String())
+		}
+	}
+	e.connsLock.Unlock()
+
+	for _, conn := range conns {
+		log.Infof("Disconnect from client %s because it is banned\n", conn.RemoteAddr())
+
+		err := conn.Close()
+		if err != nil {
+			log.Errorln(fmt.Errorf("close %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// applyBans persists bans changed and disconnects clients banned.
+func (e *engine) applyBans() error {
+	e.kickBanned()
+
+	err := e.saveBans()
+	if err != nil {
+		return fmt.Errorf("save %s: %w", e.banFile, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package server implements the server of IkaGo which can be embedded in other applications.
+//
+// Server is stable. Options global to package pcap, such as validation and extra filters, are shared by all clients and
+// servers in a process.
+package server
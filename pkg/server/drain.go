@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/pcap"
+	"net"
+	"time"
+)
+
+// drainInterval is the interval clients are noticed in draining, so the notice is learned even if notices are lost.
+const drainInterval = 10 * time.Second
+
+// trackedConns returns connections of clients recorded.
+func (e *engine) trackedConns() []net.Conn {
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	conns := make([]net.Conn, 0, len(e.conns))
+	for conn := range e.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// noticeDrain notices clients in FakeTCP that the server is going away at the deadline.
+func (e *engine) noticeDrain(deadline time.Time) {
+	for _, conn := range e.trackedConns() {
+		fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+
+		err := fakeTCPConn.NoticeDrain(deadline)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("notice drain to %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// drainAll notices clients until the deadline, then finishes their connections and closes the server.
+func (e *engine) drainAll(deadline time.Time) {
+	for {
+		e.noticeDrain(deadline)
+
+		wait := drainInterval
+		if remain := deadline.Sub(time.Now()); remain < wait {
+			wait = remain
+		}
+		if wait <= 0 {
+			break
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-e.done:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+
+	for _, conn := range e.trackedConns() {
+		e.untrack(conn)
+
+		var err error
+		switch conn.(type) {
+		case *pcap.FakeTCPConn:
+			err = conn.(*pcap.FakeTCPConn).Finish()
+		default:
+			err = conn.Close()
+		}
+		if err != nil {
+			log.Errorln(fmt.Errorf("close %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+
+	log.Infoln("Drained")
+	e.closeAll(nil)
+}
@@ -0,0 +1,2294 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/xtaci/kcp-go"
+	"ikago/internal/exec"
+	"ikago/internal/hook"
+	"ikago/internal/log"
+	"ikago/internal/quota"
+	"ikago/pkg/addr"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/stat"
+	"ikago/pkg/transform"
+	"io"
+	"math"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+type quintuple struct {
+	src      string
+	dst      string
+	protocol gopacket.LayerType
+}
+
+type natIndicator struct {
+	src    net.Addr
+	embSrc net.Addr
+	conn   net.Conn
+}
+
+func (indicator *natIndicator) embSrcIP() net.IP {
+	switch t := indicator.embSrc.(type) {
+	case *net.IPAddr:
+		return indicator.embSrc.(*net.IPAddr).IP
+	case *net.TCPAddr:
+		return indicator.embSrc.(*net.TCPAddr).IP
+	case *net.UDPAddr:
+		return indicator.embSrc.(*net.UDPAddr).IP
+	case *addr.ICMPQueryAddr:
+		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
+	default:
+		panic(fmt.Errorf("type %T not support", t))
+	}
+}
+
+const keepAlive = 30 * time.Second
+
+// queueSize and lowMemoryQueueSize are the max count of packets queued before they are handled, in normal and in
+// low-memory mode.
+const (
+	queueSize          = 1000
+	lowMemoryQueueSize = 64
+)
+
+// lowMemoryGCPercent is the percentage of garbage collection in low-memory mode.
+const lowMemoryGCPercent = 50
+
+// engine is a single run of a server, it is created from a configuration and can
+// be opened only once.
+type engine struct {
+	port         uint16
+	ports        []uint16
+	listenDevs   []*pcap.Device
+	upDev        *pcap.Device
+	gatewayDev   *pcap.Device
+	mac          net.HardwareAddr
+	mode         string
+	isRule       bool
+	isLowMemory  bool
+	crypt        crypto.Crypt
+	mtu          int
+	fragment     int
+	isNoFragment bool
+	defragConfig *config.DefragConfig
+	scheduler    pcap.Scheduler
+	congestion   pcap.CongestionControlFactory
+	dscp         uint8
+	isCopyTOS    bool
+	ttl          uint8
+	chaff        int
+	probe        time.Duration
+	feedback     time.Duration
+	adaptive     []float64
+	isBlackhole  bool
+	tolerance    int
+	hop          *pcap.HopSchedule
+	impairment   *pcap.Impairment
+	cookie       *crypto.Cookie
+	validation   pcap.Validation
+	isChecksum   bool
+	isDecTTL     bool
+	preamble     pcap.Preamble
+	wireVersion  int
+	tls          *pcap.TLSMimicry
+	isTyped      bool
+	isPrefixed   bool
+	traceFilter  *pcap.TraceFilter
+	isTraceHex   bool
+	filter       string
+	pcapConfig   *config.PcapConfig
+	backend      string
+	tunnel       []*pcap.RouteRule
+	sflowConfig  *config.SFlowConfig
+	hook         *hook.Hook
+	verifier     *crypto.ProofVerifier
+	isKCP        bool
+	kcpConfig    *config.KCPConfig
+	quotaConfig  *config.QuotaConfig
+	admission    *pcap.Admission
+	userSet      *pcap.Users
+	users        map[string]*user
+	keyring      *pcap.Keyring
+	banFile      string
+	bans         *pcap.Bans
+	drain        *pcap.Drain
+	access       *pcap.Access
+	handover     string
+	mirrorConfig *config.MirrorConfig
+
+	isClosed         bool
+	closeOnce        sync.Once
+	done             chan struct{}
+	err              error
+	listeners        []net.Listener
+	listener         net.Listener
+	handoverListener net.Listener
+	connsLock        sync.Mutex
+	conns            map[net.Conn]bool
+	upConn           *pcap.RawConn
+	mirror           *pcap.Mirror
+	sflow            *pcap.SFlow
+	c                chan pcap.ConnBytes
+	snapshots        chan chan *handoverState
+	defrag           pcap.Defragmenter
+	nextTCPPort      uint16
+	tcpPortPool      []time.Time
+	nextUDPPort      uint16
+	udpPortPool      []time.Time
+	nextICMPv4Id     uint16
+	icmpv4IdPool     []time.Time
+	patMap           map[quintuple]uint16
+	natLock          sync.RWMutex
+	nat              map[pcap.NATGuide]*natIndicator
+	quotas           *quota.Quota
+	monitor          *stat.TrafficMonitor
+	fragMonitor      *stat.FragmentMonitor
+	rejMonitor       *stat.RejectionMonitor
+	malMonitor       *stat.MalformedMonitor
+	latMonitor       *stat.LatencyMonitor
+	delMonitor       *stat.DeliveryMonitor
+	queMonitor       *stat.QueueMonitor
+	arpCache         *pcap.ARPCache
+	dnsLock          sync.RWMutex
+	dns              map[string]string
+}
+
+func newEngine(cfg *config.Config) (*engine, error) {
+	var (
+		err        error
+		gateway    net.IP
+		gatewayMAC net.HardwareAddr
+		mac        net.HardwareAddr
+	)
+
+	// Defaults are filled into a copy so the configuration is left untouched
+	copied := *cfg
+	cfg = &copied
+
+	// Buffers, caches and windows are lowered in low-memory mode
+	size := queueSize
+	if cfg.LowMemory {
+		cfg.ApplyLowMemory()
+		size = lowMemoryQueueSize
+	}
+
+	e := &engine{
+		listenDevs:   make([]*pcap.Device, 0),
+		done:         make(chan struct{}),
+		listeners:    make([]net.Listener, 0),
+		c:            make(chan pcap.ConnBytes, size),
+		snapshots:    make(chan chan *handoverState),
+		tcpPortPool:  make([]time.Time, 16384),
+		udpPortPool:  make([]time.Time, 16384),
+		icmpv4IdPool: make([]time.Time, 65536),
+		patMap:       make(map[quintuple]uint16),
+		nat:          make(map[pcap.NATGuide]*natIndicator),
+		conns:        make(map[net.Conn]bool),
+		monitor:      stat.NewTrafficMonitor(),
+		fragMonitor:  stat.NewFragmentMonitor(),
+		rejMonitor:   stat.NewRejectionMonitor(),
+		malMonitor:   stat.NewMalformedMonitor(),
+		latMonitor:   stat.NewLatencyMonitor(),
+		delMonitor:   stat.NewDeliveryMonitor(),
+		queMonitor:   stat.NewQueueMonitor(),
+		dns:          make(map[string]string),
+	}
+
+	// Verify parameters
+	if cfg.Port == 0 {
+		return nil, errors.New("missing port")
+	}
+	if cfg.Gateway != "" {
+		gateway = net.ParseIP(cfg.Gateway)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %s", cfg.Gateway)
+		}
+	}
+	if cfg.GatewayMAC != "" {
+		gatewayMAC, err = net.ParseMAC(cfg.GatewayMAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway hardware address %s", cfg.GatewayMAC)
+		}
+	}
+	switch cfg.MAC {
+	case "":
+		break
+	case "random":
+		mac, err = pcap.RandomHardwareAddr()
+		if err != nil {
+			return nil, fmt.Errorf("random hardware address: %w", err)
+		}
+	default:
+		mac, err = net.ParseMAC(cfg.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware address %s", cfg.MAC)
+		}
+	}
+	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
+		return nil, fmt.Errorf("monitor port %d out of range", cfg.Monitor)
+	}
+	if cfg.MTU < 576 || cfg.MTU > pcap.MaxJumboMTU {
+		if cfg.MTU == 0 {
+			cfg.MTU = pcap.MaxMTU
+		} else {
+			return nil, fmt.Errorf("mtu %d out of range", cfg.MTU)
+		}
+	}
+	if cfg.FragmentSize < 68 || cfg.FragmentSize > cfg.MTU {
+		if cfg.FragmentSize == 0 {
+			cfg.FragmentSize = cfg.MTU
+		} else {
+			return nil, fmt.Errorf("fragment size %d out of range", cfg.FragmentSize)
+		}
+	}
+	if cfg.PcapConfig.Buffer < 0 {
+		return nil, fmt.Errorf("pcap buffer %d out of range", cfg.PcapConfig.Buffer)
+	}
+	// Packets larger than the snaplen are truncated
+	if cfg.PcapConfig.SnapLen != 0 && (cfg.PcapConfig.SnapLen < cfg.MTU+14 || cfg.PcapConfig.SnapLen > 262144) {
+		return nil, fmt.Errorf("pcap snaplen %d out of range", cfg.PcapConfig.SnapLen)
+	}
+	if cfg.PcapConfig.Timeout < 0 {
+		return nil, fmt.Errorf("pcap timeout %d out of range", cfg.PcapConfig.Timeout)
+	}
+	if cfg.DefragConfig.Deadline < 0 {
+		return nil, fmt.Errorf("defrag deadline %d out of range", cfg.DefragConfig.Deadline)
+	}
+	if cfg.DefragConfig.Limit <= 0 {
+		return nil, fmt.Errorf("defrag limit %d out of range", cfg.DefragConfig.Limit)
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1000 {
+		return nil, fmt.Errorf("jitter %d out of range", cfg.Jitter)
+	}
+	if cfg.Priority < 0 {
+		return nil, fmt.Errorf("priority %d out of range", cfg.Priority)
+	}
+	if cfg.Probe < 0 {
+		return nil, fmt.Errorf("probe %d out of range", cfg.Probe)
+	}
+	if cfg.Feedback < 0 {
+		return nil, fmt.Errorf("feedback %d out of range", cfg.Feedback)
+	}
+	if len(cfg.Adaptive) > pcap.MaxDuplicates {
+		return nil, fmt.Errorf("adaptive thresholds %d out of range", len(cfg.Adaptive))
+	}
+	for i, threshold := range cfg.Adaptive {
+		if threshold <= 0 || threshold > 100 {
+			return nil, fmt.Errorf("adaptive threshold %g out of range", threshold)
+		}
+		if i > 0 && threshold <= cfg.Adaptive[i-1] {
+			return nil, errors.New("adaptive thresholds not in ascending order")
+		}
+	}
+	if cfg.Chaff < 0 {
+		return nil, fmt.Errorf("chaff %d out of range", cfg.Chaff)
+	}
+	if cfg.QuotaConfig.Daily < 0 {
+		return nil, fmt.Errorf("daily quota %d out of range", cfg.QuotaConfig.Daily)
+	}
+	if cfg.QuotaConfig.Monthly < 0 {
+		return nil, fmt.Errorf("monthly quota %d out of range", cfg.QuotaConfig.Monthly)
+	}
+	if cfg.QuotaConfig.Throttle <= 0 {
+		return nil, fmt.Errorf("quota throttle %d out of range", cfg.QuotaConfig.Throttle)
+	}
+	if cfg.MaxClients < 0 {
+		return nil, fmt.Errorf("max clients %d out of range", cfg.MaxClients)
+	}
+	if cfg.KCPConfig.MTU > 1500 {
+		return nil, fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU)
+	}
+	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
+		return nil, fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow)
+	}
+	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
+		return nil, fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow)
+	}
+	if cfg.KCPConfig.DataShard < 0 {
+		return nil, fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard)
+	}
+	if cfg.KCPConfig.ParityShard < 0 {
+		return nil, fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard)
+	}
+	if cfg.KCPConfig.Interval < 0 {
+		return nil, fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval)
+	}
+	if cfg.KCPConfig.Resend < 0 {
+		return nil, fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend)
+	}
+	if cfg.KCPConfig.NC < 0 {
+		return nil, fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC)
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("listen port %d out of range", cfg.Port)
+	}
+	for _, port := range cfg.ListenPorts {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("listen port %d out of range", port)
+		}
+	}
+	if cfg.Hop < 0 {
+		return nil, fmt.Errorf("hop %d out of range", cfg.Hop)
+	}
+
+	// Ports
+	e.port = uint16(cfg.Port)
+	e.ports = []uint16{e.port}
+	for _, port := range cfg.ListenPorts {
+		for _, p := range e.ports {
+			if int(p) == port {
+				return nil, fmt.Errorf("duplicate listen port %d", port)
+			}
+		}
+		e.ports = append(e.ports, uint16(port))
+	}
+
+	// Mode
+	switch cfg.Mode {
+	case "faketcp":
+		e.mode = "faketcp"
+		log.Infoln("Use FakeTCP")
+	case "tcp":
+		e.mode = "tcp"
+		log.Infoln("Use standard TCP")
+	default:
+		return nil, fmt.Errorf("mode %s not support", cfg.Mode)
+	}
+
+	// Crypt
+	e.crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("parse crypt: %w", err)
+	}
+	if e.crypt.Method() != crypto.MethodPlain {
+		log.Infof("Encrypt with %s\n", crypto.Name(e.crypt))
+	}
+
+	// Transforms
+	pipeline, err := transform.NewPipeline(e.crypt, cfg.Transforms)
+	if err != nil {
+		return nil, fmt.Errorf("parse transforms: %w", err)
+	}
+	if len(cfg.Transforms) > 1 {
+		log.Infof("Transform in %s\n", pipeline)
+	}
+	e.crypt = pipeline
+
+	// Defragmentation
+	switch strings.ToLower(cfg.DefragConfig.Mode) {
+	case "easy":
+		break
+	case "strict":
+		log.Infoln("Use strict defragmentation")
+	default:
+		return nil, fmt.Errorf("defrag mode %s not support", cfg.DefragConfig.Mode)
+	}
+	e.defragConfig = &cfg.DefragConfig
+
+	// Validation
+	validation, err := pcap.ParseValidation(cfg.Validation)
+	if err != nil {
+		return nil, fmt.Errorf("parse validation: %w", err)
+	}
+	e.validation = validation
+	if validation != pcap.ValidationNormal {
+		log.Infof("Use %s validation\n", validation)
+	}
+
+	// Checksum
+	e.isChecksum = cfg.Checksum
+	if e.isChecksum {
+		log.Infoln("Verify checksums of packets in the tunnel")
+	}
+
+	// Decrement TTL
+	e.isDecTTL = cfg.DecrementTTL
+	if e.isDecTTL {
+		log.Infoln("Decrement TTL of packets tunneled")
+	}
+
+	// Preamble
+	e.preamble, err = pcap.ParsePreamble(cfg.Preamble)
+	if err != nil {
+		return nil, fmt.Errorf("parse preamble: %w", err)
+	}
+
+	// Wire version
+	e.wireVersion = cfg.WireVersion
+	if e.wireVersion == 0 {
+		e.wireVersion = pcap.WireVersion
+	}
+
+	// Filter
+	e.filter = cfg.Filter
+
+	// Pcap tuning
+	e.pcapConfig = &cfg.PcapConfig
+
+	// Backend
+	e.backend, err = pcap.ParseBackend(cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("parse backend: %w", err)
+	}
+
+	// sFlow
+	if cfg.SFlowConfig.Rate <= 0 {
+		return nil, fmt.Errorf("sflow rate %d out of range", cfg.SFlowConfig.Rate)
+	}
+	e.sflowConfig = &cfg.SFlowConfig
+
+	// Hook
+	if cfg.HookConfig.URL != "" || cfg.HookConfig.Script != "" {
+		e.hook, err = hook.New(cfg.HookConfig.URL, cfg.HookConfig.Script, cfg.HookConfig.Events)
+		if err != nil {
+			return nil, fmt.Errorf("create hook: %w", err)
+		}
+		log.Infoln("Notify events by hook")
+	}
+
+	// Traffic tunneled
+	e.tunnel, err = parseTunnel(cfg.Tunnel)
+	if err != nil {
+		return nil, fmt.Errorf("parse tunnel: %w", err)
+	}
+	if len(e.tunnel) > 0 {
+		log.Infof("Expect traffic tunneled in %s\n", strings.Join(cfg.Tunnel, ", "))
+	}
+
+	e.defrag, err = pcap.NewDefragmenter(e.defragConfig)
+	if err != nil {
+		return nil, fmt.Errorf("create defragmenter: %w", err)
+	}
+	e.defrag.SetMonitor(e.fragMonitor)
+
+	// Firewall rule
+	e.isRule = cfg.Rule
+
+	// Low-memory mode
+	e.isLowMemory = cfg.LowMemory
+
+	// Quota
+	e.quotaConfig = &cfg.QuotaConfig
+
+	// Bans
+	e.bans = pcap.NewBans()
+	e.banFile = cfg.BanFile
+	err = e.loadBans()
+	if err != nil {
+		return nil, fmt.Errorf("load bans %s: %w", e.banFile, err)
+	}
+	if e.banFile != "" {
+		log.Infof("Save bans to file %s\n", e.banFile)
+	}
+
+	// Drain
+	e.drain = pcap.NewDrain()
+
+	// Schedules
+	e.access, err = parseAccess(&cfg.ScheduleConfig, cfg.Users)
+	if err != nil {
+		return nil, fmt.Errorf("parse schedules: %w", err)
+	}
+	if e.access != nil {
+		log.Infoln("Allow clients in schedules")
+	}
+
+	// Handover
+	e.handover = cfg.Handover
+
+	// Mirror
+	if cfg.MirrorConfig.Sample <= 0 {
+		return nil, fmt.Errorf("mirror sample %d out of range", cfg.MirrorConfig.Sample)
+	}
+	e.mirrorConfig = &cfg.MirrorConfig
+
+	// Max clients
+	if cfg.MaxClients > 0 {
+		var isReset bool
+
+		switch strings.ToLower(cfg.Refuse) {
+		case "ignore":
+			break
+		case "reset":
+			isReset = true
+		default:
+			return nil, fmt.Errorf("refuse %s not support", cfg.Refuse)
+		}
+
+		e.admission, err = pcap.NewAdmission(cfg.MaxClients, isReset)
+		if err != nil {
+			return nil, fmt.Errorf("create admission: %w", err)
+		}
+		log.Infof("Limit to %d clients connected simultaneously\n", cfg.MaxClients)
+	}
+
+	// Monitor
+	for _, port := range e.ports {
+		if cfg.Monitor != 0 && cfg.Monitor == int(port) {
+			return nil, errors.New("same monitor port with listen port")
+		}
+	}
+
+	// Mode-related options
+	switch e.mode {
+	case "faketcp":
+		// MTU
+		e.mtu = cfg.MTU
+		if e.mtu != pcap.MaxMTU {
+			log.Infof("Set MTU to %d Bytes\n", e.mtu)
+		}
+
+		// Fragment size
+		e.fragment = cfg.FragmentSize
+		if e.fragment != e.mtu {
+			log.Infof("Set fragment size to %d Bytes\n", e.fragment)
+		}
+		e.isNoFragment = cfg.NoFragment
+		if e.isNoFragment {
+			log.Infof("Never fragment packets, packets larger than %d Bytes will be dropped\n", e.fragment)
+		}
+
+		// Traffic shaping
+		if cfg.Profile != "" {
+			if cfg.Jitter > 0 {
+				return nil, errors.New("jitter cannot be set with profile")
+			}
+
+			profile, err := pcap.FindProfile(cfg.Profile)
+			if err != nil {
+				return nil, fmt.Errorf("find profile: %w", err)
+			}
+
+			// KCP segments cannot be followed by padding
+			e.scheduler, err = pcap.NewProfileScheduler(profile, !cfg.KCP)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Shape traffic as %s\n", cfg.Profile)
+			if cfg.KCP {
+				log.Infoln("Packets will not be padded because KCP is enabled")
+			}
+		} else if cfg.Jitter > 0 {
+			e.scheduler, err = pcap.NewJitterScheduler(time.Duration(cfg.Jitter) * time.Millisecond)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Delay packets randomly within %d ms\n", cfg.Jitter)
+		}
+
+		// Priority
+		if cfg.Priority > 0 {
+			if e.scheduler != nil {
+				return nil, errors.New("priority cannot be set with jitter or profile")
+			}
+
+			e.scheduler, err = pcap.NewPriorityScheduler(cfg.Priority)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Prioritize packets within %d Bytes\n", cfg.Priority)
+		}
+
+		// QoS
+		qos := &cfg.QoSConfig
+		if len(qos.Realtime.Match) > 0 || len(qos.Normal.Match) > 0 || len(qos.Bulk.Match) > 0 ||
+			qos.Realtime.Rate > 0 || qos.Normal.Rate > 0 || qos.Bulk.Rate > 0 {
+			if e.scheduler != nil {
+				return nil, errors.New("qos cannot be set with jitter, profile or priority")
+			}
+
+			e.scheduler, err = pcap.NewQoSScheduler(qos)
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler: %w", err)
+			}
+			log.Infof("Schedule traffic in classes with weights %d:%d:%d\n", qos.Realtime.Weight, qos.Normal.Weight, qos.Bulk.Weight)
+		}
+
+		// DSCP
+		if cfg.DSCP != "" {
+			e.dscp, err = pcap.ParseDSCP(cfg.DSCP)
+			if err != nil {
+				return nil, fmt.Errorf("parse dscp: %w", err)
+			}
+			log.Infof("Mark packets with DSCP %d\n", e.dscp)
+		}
+		e.isCopyTOS = cfg.CopyTOS
+		if e.isCopyTOS {
+			if cfg.DSCP != "" {
+				return nil, errors.New("copy tos cannot be set with dscp")
+			}
+			log.Infoln("Copy DSCP and ECN of packets tunneled")
+		}
+
+		// TTL
+		e.ttl, err = pcap.ParseTTL(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("parse ttl: %w", err)
+		}
+		if e.ttl > 0 {
+			log.Infof("Write packets in TTL %d\n", e.ttl)
+		}
+
+		// Cover traffic
+		e.chaff = cfg.Chaff
+		if e.chaff > 0 {
+			log.Infof("Send cover traffic in idle within %d Bytes/s\n", e.chaff)
+		}
+
+		// Preamble
+		if e.preamble == pcap.PreambleNone {
+			if cfg.Cookie != "" {
+				return nil, errors.New("cookie cannot be set without preamble")
+			}
+			if cfg.Stealth {
+				return nil, errors.New("stealth mode cannot be set without preamble")
+			}
+			if len(cfg.Users) > 0 {
+				return nil, errors.New("users cannot be set without preamble")
+			}
+			log.Infoln("Handshake without preamble")
+		}
+
+		// Wire version
+		if e.wireVersion < pcap.MinWireVersion || e.wireVersion > pcap.WireVersion {
+			return nil, fmt.Errorf("wire version %d out of range", e.wireVersion)
+		}
+		if e.wireVersion < pcap.WireVersion {
+			log.Infof("Write in wire version %d\n", e.wireVersion)
+		}
+
+		// Cookie
+		if cfg.Cookie != "" {
+			e.cookie, err = crypto.NewCookie(cfg.Cookie)
+			if err != nil {
+				return nil, fmt.Errorf("cookie: %w", err)
+			}
+			log.Infoln("Refuse TCP SYN without cookies")
+		}
+
+		// TLS mimicry
+		if cfg.TLSConfig.Enabled {
+			e.tls, err = pcap.NewTLSMimicry("", nil)
+			if err != nil {
+				return nil, fmt.Errorf("tls: %w", err)
+			}
+			log.Infoln("Mimic TLS by mirroring ClientHello")
+		}
+
+		// Typed framing
+		e.isTyped = cfg.Typed
+		if e.isTyped {
+			log.Infoln("Frame packets with types")
+		}
+
+		// Length-prefixed framing, which TLS records have already
+		e.isPrefixed = cfg.LengthPrefix && e.tls == nil
+		if e.isPrefixed {
+			log.Infoln("Prefix datagrams with lengths")
+		}
+
+		// Stealth
+		if cfg.Stealth {
+			e.verifier, err = crypto.NewProofVerifier(e.crypt)
+			if err != nil {
+				return nil, fmt.Errorf("stealth: %w", err)
+			}
+			log.Infoln("Enable stealth mode")
+			if !cfg.Rule {
+				log.Infoln("Resets of the kernel may still be responded, consider adding firewall rule by -rule")
+			}
+		}
+
+		// Packet trace
+		if cfg.Trace != "" {
+			e.traceFilter, err = pcap.ParseTraceFilter(cfg.Trace)
+			if err != nil {
+				return nil, fmt.Errorf("parse trace: %w", err)
+			}
+			e.isTraceHex = cfg.TraceHex
+			log.Infof("Trace packets matching %s\n", e.traceFilter)
+		}
+
+		// Latency probes, which adaptive duplication measures loss by without delivery reports and MTU blackholes are
+		// detected by
+		if (len(cfg.Adaptive) > 0 && cfg.Feedback <= 0 || cfg.Blackhole) && cfg.Probe <= 0 {
+			cfg.Probe = 1000
+		}
+		e.probe = time.Duration(cfg.Probe) * time.Millisecond
+		if e.probe > 0 {
+			log.Infof("Probe latency every %d ms\n", cfg.Probe)
+		}
+
+		// Delivery reports
+		e.feedback = time.Duration(cfg.Feedback) * time.Millisecond
+		if e.feedback > 0 {
+			log.Infof("Report delivery every %d ms\n", cfg.Feedback)
+		}
+
+		// Congestion control, KCP has its own
+		if cfg.Congestion != "" {
+			if cfg.KCP {
+				return nil, errors.New("congestion cannot be set with kcp")
+			}
+			e.congestion, err = pcap.FindCongestionControl(cfg.Congestion)
+			if err != nil {
+				return nil, fmt.Errorf("find congestion control: %w", err)
+			}
+			log.Infof("Pace writes by congestion control %s\n", cfg.Congestion)
+		}
+
+		// Adaptive duplication
+		e.adaptive = cfg.Adaptive
+		if len(e.adaptive) > 0 {
+			thresholds := make([]string, 0)
+			for _, threshold := range e.adaptive {
+				thresholds = append(thresholds, fmt.Sprintf("%g%%", threshold))
+			}
+			log.Infof("Duplicate packets adaptively when loss reaches %s\n", strings.Join(thresholds, ", "))
+		}
+
+		// MTU blackholes
+		e.isBlackhole = cfg.Blackhole
+		if e.isBlackhole {
+			log.Infoln("Detect MTU blackholes by large probes")
+		}
+
+		// Tolerance of packets failed to parse or decrypt
+		if cfg.Tolerance < 0 {
+			return nil, fmt.Errorf("tolerance %d out of range", cfg.Tolerance)
+		}
+		e.tolerance = cfg.Tolerance
+		if e.tolerance > 0 {
+			log.Infof("Skip up to %d packets failed to parse or decrypt in a row\n", e.tolerance)
+		}
+
+		// Impairment
+		if cfg.ImpairmentConfig != *config.NewImpairmentConfig() {
+			e.impairment, err = pcap.NewImpairment(&cfg.ImpairmentConfig)
+			if err != nil {
+				return nil, fmt.Errorf("create impairment: %w", err)
+			}
+			impairment := &cfg.ImpairmentConfig
+			log.Infof("Impair packets with %g%% loss, %d±%d ms delay, %g%% duplication and %g%% reordering\n",
+				impairment.Loss, impairment.Delay, impairment.Jitter, impairment.Duplicate, impairment.Reorder)
+		}
+
+		// KCP
+		e.isKCP = cfg.KCP
+		e.kcpConfig = &cfg.KCPConfig
+		if e.isKCP {
+			log.Infoln("Enable KCP")
+
+			// KCP segments larger than the fragment size will always be fragmented
+			size := e.kcpConfig.MTU + 20 + 20 + e.crypt.Cost()
+			if size > e.fragment {
+				if e.isNoFragment {
+					return nil, fmt.Errorf("kcp mtu %d out of range in no fragment", e.kcpConfig.MTU)
+				}
+				log.Infof("KCP MTU %d Bytes results in %d Bytes packets which exceed fragment size %d Bytes, consider decreasing KCP MTU\n",
+					e.kcpConfig.MTU, size, e.fragment)
+			}
+		}
+
+		// Port hopping
+		if cfg.Hop > 0 {
+			if e.isKCP {
+				return nil, errors.New("hop cannot be set with kcp")
+			}
+			// Ports are derived from the password shared with clients
+			if cfg.Password == "" {
+				return nil, errors.New("hop requires password")
+			}
+			min, max, err := pcap.ParsePortRange(cfg.HopPorts)
+			if err != nil {
+				return nil, fmt.Errorf("parse hop ports %s: %w", cfg.HopPorts, err)
+			}
+			// Ports hopped are not routed upstream
+			if max >= 49152 {
+				return nil, fmt.Errorf("hop ports %s overlap ports of nat", cfg.HopPorts)
+			}
+			if cfg.Monitor >= int(min) && cfg.Monitor <= int(max) {
+				return nil, fmt.Errorf("hop ports %s overlap monitor port", cfg.HopPorts)
+			}
+			e.hop, err = pcap.NewHopSchedule([]byte(cfg.Password), min, max, time.Duration(cfg.Hop)*time.Second)
+			if err != nil {
+				return nil, fmt.Errorf("create hop schedule: %w", err)
+			}
+			log.Infof("Hop among ports %d-%d every %d s\n", min, max, cfg.Hop)
+		}
+
+		// Users
+		if len(cfg.Users) > 0 {
+			if e.isKCP {
+				return nil, errors.New("users cannot be set with kcp")
+			}
+			// Users are identified by proofs which only AEAD can create
+			if !e.crypt.Method().IsAEAD() {
+				return nil, fmt.Errorf("users not support in method %s", cfg.Method)
+			}
+			err = e.parseUsers(cfg.Users, cfg.Method, cfg.Transforms)
+			if err != nil {
+				return nil, fmt.Errorf("parse users: %w", err)
+			}
+			log.Infof("Identify clients as %d users\n", len(e.users))
+		}
+
+		// Keyring, so passwords are rotated without dropping sessions
+		if cfg.RotationConfig.Password != "" {
+			if e.isKCP {
+				return nil, errors.New("rotation cannot be set with kcp")
+			}
+			if len(cfg.Users) > 0 {
+				return nil, errors.New("rotation cannot be set with users")
+			}
+			if !e.crypt.Method().IsAEAD() {
+				return nil, fmt.Errorf("rotation not support in method %s", cfg.Method)
+			}
+		}
+		if !e.isKCP && len(cfg.Users) <= 0 && e.crypt.Method().IsAEAD() {
+			err = e.setKeys(cfg, e.crypt)
+			if err != nil {
+				return nil, fmt.Errorf("set keys: %w", err)
+			}
+		}
+
+		// Handover
+		if e.handover != "" && e.isKCP {
+			return nil, errors.New("handover cannot be set with kcp")
+		}
+	case "tcp":
+		if cfg.Stealth {
+			return nil, errors.New("stealth mode not support in standard TCP")
+		}
+		if cfg.Cookie != "" {
+			return nil, errors.New("cookie not support in standard TCP")
+		}
+		if e.preamble != pcap.PreambleTagged {
+			return nil, errors.New("preamble not support in standard TCP")
+		}
+		if cfg.WireVersion != 0 {
+			return nil, errors.New("wire version not support in standard TCP")
+		}
+		if cfg.TLSConfig.Enabled {
+			return nil, errors.New("tls not support in standard TCP")
+		}
+		if cfg.Tolerance > 0 {
+			return nil, errors.New("tolerance not support in standard TCP")
+		}
+		if cfg.NoFragment {
+			return nil, errors.New("no fragment not support in standard TCP")
+		}
+		if cfg.Trace != "" {
+			return nil, errors.New("trace not support in standard TCP")
+		}
+		if cfg.Typed {
+			return nil, errors.New("typed not support in standard TCP")
+		}
+		if cfg.LengthPrefix {
+			return nil, errors.New("length prefix not support in standard TCP")
+		}
+		if cfg.Feedback > 0 {
+			return nil, errors.New("feedback not support in standard TCP")
+		}
+		if cfg.Congestion != "" {
+			return nil, errors.New("congestion not support in standard TCP")
+		}
+		if cfg.TTL != "" {
+			return nil, errors.New("ttl not support in standard TCP")
+		}
+		if cfg.Hop > 0 {
+			return nil, errors.New("hop not support in standard TCP")
+		}
+		if len(cfg.Users) > 0 {
+			return nil, errors.New("users not support in standard TCP")
+		}
+		if cfg.RotationConfig.Password != "" {
+			return nil, errors.New("rotation not support in standard TCP")
+		}
+		if e.handover != "" {
+			return nil, errors.New("handover not support in standard TCP")
+		}
+	default:
+		return nil, fmt.Errorf("mode %s not support", e.mode)
+	}
+
+	ports := make([]string, 0)
+	for _, port := range e.ports {
+		ports = append(ports, fmt.Sprintf(":%d", port))
+	}
+	log.Infof("Proxy from %s\n", strings.Join(ports, ", "))
+
+	// Find devices
+	e.listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	if err != nil {
+		return nil, fmt.Errorf("find listen devices: %w", err)
+	}
+	if len(cfg.ListenDevs) <= 0 {
+		// Remove loopback devices by default
+		result := make([]*pcap.Device, 0)
+
+		for _, dev := range e.listenDevs {
+			if dev.IsLoop() {
+				continue
+			}
+			result = append(result, dev)
+		}
+
+		e.listenDevs = result
+	}
+	if len(e.listenDevs) <= 0 {
+		return nil, errors.New("cannot determine listen device")
+	}
+	if e.mode == "faketcp" {
+		for _, dev := range e.listenDevs {
+			if dev.MTU() > 0 && e.mtu > dev.MTU() {
+				return nil, fmt.Errorf("mtu %d exceeds mtu %d of listen device %s", e.mtu, dev.MTU(), dev.Alias())
+			}
+		}
+	}
+
+	e.upDev, e.gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway, gatewayMAC)
+	if err != nil {
+		return nil, fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if e.upDev == nil && e.gatewayDev == nil {
+		return nil, errors.New("cannot determine upstream device and gateway device")
+	}
+	if e.upDev == nil {
+		return nil, errors.New("cannot determine upstream device")
+	}
+	if e.gatewayDev == nil {
+		return nil, errors.New("cannot determine gateway device")
+	}
+
+	// Hardware address
+	if mac != nil {
+		if e.upDev.IsLoop() {
+			return nil, fmt.Errorf("cannot change hardware address of loopback device %s", e.upDev.Alias())
+		}
+		if e.upDev.IsPointToPoint() {
+			return nil, fmt.Errorf("cannot change hardware address of point-to-point device %s", e.upDev.Alias())
+		}
+
+		e.upDev.SetHardwareAddr(mac)
+		log.Infof("Use hardware address %s in %s\n", mac, e.upDev.Alias())
+		e.mac = mac
+	}
+
+	return e, nil
+}
+
+func (e *engine) open() error {
+	var err error
+
+	// Captures are tuned in options of each device opened
+	if e.backend != pcap.BackendPcap {
+		log.Infof("Capture with backend %s\n", e.backend)
+	}
+	if e.pcapConfig.Buffer > 0 {
+		log.Infof("Set pcap buffer to %d KB\n", e.pcapConfig.Buffer)
+	}
+	if e.pcapConfig.SnapLen > 0 {
+		log.Infof("Set pcap snaplen to %d Bytes\n", e.pcapConfig.SnapLen)
+	}
+	if e.pcapConfig.Immediate {
+		log.Infoln("Capture in immediate mode")
+	}
+	if e.pcapConfig.Timeout > 0 {
+		log.Infof("Set pcap timeout to %d ms\n", e.pcapConfig.Timeout)
+	}
+
+	// sFlow
+	if e.sflowConfig.Collector != "" {
+		e.sflow, err = pcap.NewSFlow(e.sflowConfig.Collector, e.sflowConfig.Rate)
+		if err != nil {
+			return fmt.Errorf("create sflow: %w", err)
+		}
+		log.Infof("Export sFlow samples of 1 in every %d packets to %s\n", e.sflowConfig.Rate, e.sflow)
+	}
+
+	// Rejections are counted in tables of the process, monitors of the rest are in options
+	pcap.SetRejectionMonitor(e.rejMonitor)
+
+	// Filter, which is compiled in each device opened
+	if e.filter != "" {
+		log.Infof("Capture with extra filter %s\n", e.filter)
+	}
+
+	// Garbage is collected more often so the heap is kept small
+	if e.isLowMemory {
+		debug.SetGCPercent(lowMemoryGCPercent)
+		log.Infoln("Use low-memory mode")
+	}
+
+	// Add firewall rule
+	if e.isRule {
+		err := exec.DisableIPForwarding()
+		if err != nil {
+			return fmt.Errorf("disable ip forwarding: %w", err)
+		}
+
+		log.Infoln("Disable IP forwarding")
+
+		err = exec.AddGlobalFirewallRule()
+		if err != nil {
+			return fmt.Errorf("add firewall rule: %w", err)
+		}
+
+		log.Infoln("Add firewall rule")
+	}
+
+	// Quota
+	isUserQuota := false
+	for _, u := range e.users {
+		if u.daily > 0 || u.monthly > 0 {
+			isUserQuota = true
+			break
+		}
+	}
+	if e.quotaConfig.Daily > 0 || e.quotaConfig.Monthly > 0 || isUserQuota {
+		e.quotas, err = quota.NewQuota(e.quotaConfig, e.hook)
+		if err != nil {
+			return fmt.Errorf("create quota: %w", err)
+		}
+
+		for _, u := range e.users {
+			if u.daily <= 0 && u.monthly <= 0 {
+				continue
+			}
+
+			err = e.quotas.SetLimit(userIdentity(u.name), u.daily, u.monthly)
+			if err != nil {
+				return fmt.Errorf("set quota of user %s: %w", u.name, err)
+			}
+		}
+
+		if e.quotaConfig.Daily > 0 {
+			log.Infof("Limit each client to %d MB a day\n", e.quotaConfig.Daily)
+		}
+		if e.quotaConfig.Monthly > 0 {
+			log.Infof("Limit each client to %d MB a month\n", e.quotaConfig.Monthly)
+		}
+		if e.quotaConfig.File != "" {
+			log.Infof("Save usages of quota to file %s\n", e.quotaConfig.File)
+		}
+	}
+
+	// Reply ARP requests with the hardware address so replies are addressed to it
+	if e.mac != nil {
+		e.arpCache, err = pcap.NewARPCache(e.upDev, e.captureOptions()...)
+		if err != nil {
+			return fmt.Errorf("create arp cache: %w", err)
+		}
+		for _, ip := range e.upDev.IPAddrs() {
+			err = e.arpCache.Publish(ip.IP)
+			if err != nil {
+				log.Errorln(fmt.Errorf("publish %s: %w", ip.IP, err))
+			}
+		}
+	}
+
+	// Verify
+	if e.port <= 0 || e.port > 65535 {
+		return fmt.Errorf("port %d out of range", e.port)
+	}
+	if len(e.listenDevs) <= 0 {
+		return errors.New("missing listen device")
+	}
+	if e.upDev == nil {
+		return errors.New("missing upstream device")
+	}
+	if e.gatewayDev == nil {
+		return errors.New("missing gateway")
+	}
+
+	if len(e.listenDevs) == 1 {
+		log.Infof("Listen on %s\n", e.listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range e.listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if !e.gatewayDev.IsLoop() && !e.gatewayDev.IsPointToPoint() {
+		log.Infof("Route upstream from %s to %s\n", e.upDev, e.gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", e.upDev)
+	}
+
+	for _, dev := range e.listenDevs {
+		var (
+			err      error
+			listener net.Listener
+		)
+
+		dstDev := e.gatewayDev
+		if dev.IsLoop() {
+			dstDev = dev
+		}
+
+		opts := []pcap.Option{
+			pcap.WithDevices(dev, dstDev),
+			pcap.WithCrypt(e.crypt),
+			pcap.WithMTU(e.mtu),
+			pcap.WithFragment(e.fragment),
+			pcap.WithNoFragment(e.isNoFragment),
+			pcap.WithDefrag(e.defragConfig),
+			pcap.WithScheduler(e.scheduler),
+			pcap.WithDSCP(e.dscp),
+			pcap.WithCopyTOS(e.isCopyTOS),
+			pcap.WithTTL(e.ttl),
+			pcap.WithChaff(e.chaff),
+			pcap.WithProbe(e.probe),
+			pcap.WithFeedback(e.feedback),
+			pcap.WithCongestionControl(e.congestion),
+			pcap.WithAdaptive(e.adaptive),
+			pcap.WithBlackhole(e.isBlackhole),
+			pcap.WithTolerance(e.tolerance),
+			pcap.WithImpairment(e.impairment),
+			pcap.WithVerifier(e.verifier),
+			pcap.WithCookie(e.cookie),
+			pcap.WithPreamble(e.preamble),
+			pcap.WithWireVersion(e.wireVersion),
+			pcap.WithTLS(e.tls),
+			pcap.WithTyped(e.isTyped),
+			pcap.WithLengthPrefix(e.isPrefixed),
+			pcap.WithBans(e.bans),
+			pcap.WithDrain(e.drain),
+			pcap.WithAccess(e.access),
+			pcap.WithAdmission(e.admission),
+			pcap.WithKCP(e.kcpConfig),
+			pcap.WithExtraFilter(e.filter),
+		}
+		opts = append(opts, e.captureOptions()...)
+		opts = append(opts, e.observeOptions()...)
+		if e.userSet != nil {
+			opts = append(opts, pcap.WithUsers(e.userSet))
+		}
+		if e.keyring != nil {
+			opts = append(opts, pcap.WithKeyring(e.keyring))
+		}
+
+		switch e.mode {
+		case "faketcp":
+			if e.isKCP {
+				// Sessions of KCP are bound to ports, so each port is listened separately
+				for _, port := range e.ports {
+					listener, err = pcap.ListenFakeTCPWithKCP(port, opts...)
+					if err != nil {
+						break
+					}
+					e.listeners = append(e.listeners, listener)
+				}
+			} else {
+				var l *pcap.FakeTCPListener
+				l, err = pcap.ListenFakeTCP(e.port, opts...)
+				if err == nil {
+					e.listeners = append(e.listeners, l)
+					err = l.SetPorts(e.listenPorts(time.Now()))
+				}
+			}
+		case "tcp":
+			for _, port := range e.ports {
+				listener, err = pcap.ListenTCP(port, opts...)
+				if err != nil {
+					break
+				}
+				e.listeners = append(e.listeners, listener)
+			}
+		default:
+			err = fmt.Errorf("mode %s not support", e.mode)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+	}
+
+	// Merge listeners in all devices
+	e.listener = pcap.NewMultiListener(e.listeners...)
+
+	// Handles for routing upstream, ports listened are excluded
+	ports := make([]string, 0)
+	for _, port := range e.ports {
+		ports = append(ports, fmt.Sprintf("not dst port %d", port))
+	}
+	if e.hop != nil {
+		min, max := e.hop.Range()
+		ports = append(ports, fmt.Sprintf("not dst portrange %d-%d", min, max))
+	}
+	filter := fmt.Sprintf("ip && (((tcp || udp) && %s) || icmp || (ip[6:2] & 0x1fff) != 0)", strings.Join(ports, " && "))
+	captureOpts := append(e.captureOptions(), pcap.WithExtraFilter(e.filter))
+	e.upConn, err = pcap.CreateRawConn(e.upDev, e.gatewayDev, filter, captureOpts...)
+	if err != nil {
+		return fmt.Errorf("open upstream device %s: %w", e.upDev.Alias(), err)
+	}
+
+	// Mirror
+	if e.mirrorConfig.Target != "" {
+		e.mirror, err = pcap.CreateMirror(e.mirrorConfig.Target, e.mirrorConfig.Sample, e.captureOptions()...)
+		if err != nil {
+			return fmt.Errorf("create mirror %s: %w", e.mirrorConfig.Target, err)
+		}
+		if e.mirrorConfig.Sample > 1 {
+			log.Infof("Mirror 1 in every %d packets to %s\n", e.mirrorConfig.Sample, e.mirror)
+		} else {
+			log.Infof("Mirror packets to %s\n", e.mirror)
+		}
+	}
+
+	if e.hop != nil {
+		go e.hopAll()
+	}
+
+	if e.access != nil {
+		go e.closeSchedules()
+	}
+
+	if e.keyring != nil {
+		go e.retireAll()
+	}
+
+	// Take over clients and NAT from the old process
+	if e.handover != "" {
+		state, err := e.takeOver()
+		if err != nil {
+			return fmt.Errorf("take over %s: %w", e.handover, err)
+		}
+		if state != nil {
+			e.restore(state)
+		}
+
+		err = e.listenHandover()
+		if err != nil {
+			return fmt.Errorf("listen handover: %w", err)
+		}
+		log.Infof("Hand over to new processes by %s\n", e.handover)
+	}
+
+	// Start handling
+	go func() {
+		for {
+			conn, err := e.listener.Accept()
+			if err != nil {
+				if e.isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("accept: %w", err))
+				continue
+			}
+			if conn == nil {
+				continue
+			}
+
+			// Tune
+			switch conn.(type) {
+			case *kcp.UDPSession:
+				err := pcap.TuneKCP(conn.(*kcp.UDPSession), e.kcpConfig)
+				if err != nil {
+					conn.Close()
+					log.Errorln(fmt.Errorf("tune: %w", err))
+					continue
+				}
+			default:
+				break
+			}
+
+			// Refuse clients banned, out of schedules, disconnected by quotas and new clients in draining, which are
+			// not refused in handshakes of KCP and standard TCP
+			if e.isBanned(conn) {
+				log.Verbosef("Refuse client %s because it is banned\n", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+			if !e.isAllowed(conn, time.Now()) {
+				log.Verbosef("Refuse client %s because it is out of schedule\n", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+			if e.drain.IsDraining() {
+				log.Verbosef("Refuse client %s because of draining\n", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+			if e.isExceeded(conn) {
+				log.Verbosef("Refuse client %s because it exceeds its quota\n", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			if u := e.clientUser(conn); u != nil {
+				log.Infof("Connect from client %s as user %s\n", conn.RemoteAddr().String(), u.name)
+			} else {
+				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
+			}
+			e.track(conn)
+
+			go e.serve(conn)
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case reply := <-e.snapshots:
+				reply <- e.snapshot()
+			case cab := <-e.c:
+				e.queMonitor.Dequeue(cab.Conn.RemoteAddr().String())
+				err := e.handleListen(cab.Bytes, cab.Conn)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+					log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+				}
+			case <-e.done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			packet, err := e.upConn.ReadPacket()
+			if err != nil {
+				if e.isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("read upstream in device %s: %w", e.upConn.LocalDev().Alias(), err))
+				continue
+			}
+
+			err = e.handleUpstream(packet)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle upstream in device %s: %w", e.upConn.LocalDev().Alias(), err))
+				log.Verboseln(packet)
+				continue
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listenPorts returns ports listened at the time, which are ports set and ports of slots around in hopping.
+func (e *engine) listenPorts(t time.Time) []uint16 {
+	ports := make([]uint16, len(e.ports))
+	copy(ports, e.ports)
+	if e.hop == nil {
+		return ports
+	}
+
+	for _, port := range e.hop.Ports(t) {
+		isDuplicate := false
+		for _, p := range ports {
+			if p == port {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate {
+			ports = append(ports, port)
+		}
+	}
+
+	return ports
+}
+
+// hopAll updates ports listened at the start of each slot in hopping until the engine is closed.
+func (e *engine) hopAll() {
+	for {
+		t := time.NewTimer(e.hop.Next(time.Now()).Sub(time.Now()))
+		select {
+		case <-e.done:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		ports := e.listenPorts(time.Now())
+		for _, listener := range e.listeners {
+			err := listener.(*pcap.FakeTCPListener).SetPorts(ports)
+			if err != nil {
+				log.Errorln(fmt.Errorf("hop in device %s: %w", listener.(*pcap.FakeTCPListener).Dev().Alias(), err))
+			}
+		}
+		log.Verbosef("Hop to port %d\n", e.hop.Port(time.Now()))
+	}
+}
+
+// serve reads packets from the client until it is disconnected.
+func (e *engine) serve(conn net.Conn) {
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			if e.isClosed {
+				return
+			}
+			// Clients disconnected by bans, draining or handover are forgotten already
+			if !e.isTracked(conn) {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				e.untrack(conn)
+				log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
+				return
+			}
+			log.Errorln(fmt.Errorf("read listen: %w", err))
+			continue
+		}
+
+		newB := make([]byte, n)
+		copy(newB, b[:n])
+		if len(e.c) >= cap(e.c) {
+			e.queMonitor.Add(conn.RemoteAddr().String(), stat.QueueReceiveFull)
+		}
+		e.queMonitor.Enqueue(conn.RemoteAddr().String())
+		select {
+		case e.c <- pcap.ConnBytes{Bytes: newB, Conn: conn}:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *engine) closeAll(err error) {
+	e.closeOnce.Do(func() {
+		e.isClosed = true
+		if e.listener != nil {
+			e.listener.Close()
+		} else {
+			for _, handle := range e.listeners {
+				if handle != nil {
+					handle.Close()
+				}
+			}
+		}
+		if e.handoverListener != nil {
+			e.handoverListener.Close()
+		}
+		if e.upConn != nil {
+			e.upConn.Close()
+		}
+		if e.sflow != nil {
+			e.sflow.Close()
+		}
+		if e.mirror != nil {
+			err := e.mirror.Close()
+			if err != nil {
+				log.Errorln(fmt.Errorf("close mirror: %w", err))
+			}
+		}
+		if e.arpCache != nil {
+			e.arpCache.Close()
+		}
+		if e.scheduler != nil {
+			e.scheduler.Close()
+		}
+		if e.impairment != nil {
+			e.impairment.Close()
+		}
+		if e.quotas != nil {
+			err := e.quotas.Close()
+			if err != nil {
+				log.Errorln(fmt.Errorf("save quota: %w", err))
+			}
+		}
+		e.err = err
+		close(e.done)
+	})
+}
+
+// queues returns statistics of queues of clients, whose send queues are read from their connections.
+func (e *engine) queues() *stat.QueueMonitor {
+	for _, conn := range e.trackedConns() {
+		fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+
+		e.queMonitor.SetSend(conn.RemoteAddr().String(), fakeTCPConn.Queued())
+	}
+
+	return e.queMonitor
+}
+
+func (e *engine) closed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *engine) handleListen(contents []byte, conn net.Conn) error {
+	var (
+		err               error
+		embIndicator      *pcap.PacketIndicator
+		upValue           uint16
+		newTransportLayer gopacket.Layer
+		newNetworkLayer   gopacket.NetworkLayer
+		upIP              net.IP
+		newLinkLayerType  gopacket.LayerType
+		newLinkLayer      gopacket.Layer
+		data              []byte
+		guide             pcap.NATGuide
+		ni                *natIndicator
+	)
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	// Parse embedded packet
+	embIndicator, err = pcap.ParseEmbPacket(contents, e.validation, e.malMonitor)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	// Packets corrupted in the tunnel are dropped before their checksums are recomputed in NAT
+	if e.isChecksum {
+		err := pcap.VerifyChecksum(embIndicator)
+		if err != nil {
+			e.malMonitor.Add(stat.MalformedEventCorrupted)
+			return fmt.Errorf("verify checksum: %w", err)
+		}
+	}
+
+	// The server forwards packets as a router, which replies an ICMPv4 time exceeded if the TTL expires
+	if e.isDecTTL && embIndicator.TTL() <= 1 {
+		log.Verbosef("Drop packet to %s of TTL expired\n", embIndicator.Dst().String())
+
+		// Never reply ICMPv4 errors to ICMPv4 errors
+		if isICMPv4Error(embIndicator) {
+			return nil
+		}
+
+		data, err := pcap.CreateTimeExceededPacket(e.upConn.LocalDev().IPAddr().IP, embIndicator)
+		if err != nil {
+			return fmt.Errorf("create time exceeded: %w", err)
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		return nil
+	}
+
+	// Traffic not declared to be tunneled has no NAT expected
+	if !matchRules(e.tunnel, embIndicator, contents) {
+		log.Verbosef("Drop packet to %s not expected\n", embIndicator.Dst().String())
+		return nil
+	}
+
+	// Destinations and rates of users
+	if u := e.clientUser(conn); u != nil {
+		if !u.isAllowed(embIndicator, contents) {
+			log.Verbosef("Drop packet from user %s to %s not allowed\n", u.name, embIndicator.Dst().String())
+			return nil
+		}
+		if !u.take(embIndicator.Size()) {
+			e.queMonitor.Add(conn.RemoteAddr().String(), stat.QueueRateLimited)
+			return nil
+		}
+	}
+
+	// Quota
+	if !e.allowQuota(conn, embIndicator.Size()) {
+		return nil
+	}
+
+	e.mirror.Mirror(contents)
+	e.sflow.Sample(pcap.SFlowSourceInner, contents)
+
+	// Distribute port/Id by source and client address and protocol
+	if !embIndicator.IsFrag() {
+		var ok bool
+
+		q := quintuple{
+			src:      embIndicator.NATSrc().String(),
+			dst:      clientSession(conn),
+			protocol: embIndicator.NATProtocol(),
+		}
+		upValue, ok = e.patMap[q]
+		if !ok {
+			var err error
+
+			// if ICMPv4 error is not in NAT, drop it
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+				return errors.New("missing nat")
+			}
+
+			upValue, err = e.dist(embIndicator.TransportLayer().LayerType())
+			if err != nil {
+				return fmt.Errorf("distribute: %w", err)
+			}
+
+			e.patMap[q] = upValue
+		}
+	}
+
+	// Create new transport layer
+	if embIndicator.TransportLayer() != nil {
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			tcpLayer := embIndicator.TCPLayer()
+			temp := *tcpLayer
+			newTransportLayer = &temp
+
+			newTCPLayer := newTransportLayer.(*layers.TCP)
+
+			newTCPLayer.SrcPort = layers.TCPPort(upValue)
+		case layers.LayerTypeUDP:
+			udpLayer := embIndicator.UDPLayer()
+			temp := *udpLayer
+			newTransportLayer = &temp
+
+			newUDPLayer := newTransportLayer.(*layers.UDP)
+
+			newUDPLayer.SrcPort = layers.UDPPort(upValue)
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
+				newTransportLayer = &temp
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				newICMPv4Layer.Id = upValue
+			} else {
+				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
+				newEmbIPv4Layer := &temp
+
+				newEmbIPv4Layer.DstIP = e.upConn.LocalDev().IPAddr().IP
+
+				var (
+					err                  error
+					newEmbTransportLayer gopacket.Layer
+				)
+
+				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
+				switch embTransportLayerType {
+				case layers.LayerTypeTCP:
+					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+
+					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeUDP:
+					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+
+					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeICMPv4:
+					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
+					newEmbTransportLayer = &temp
+
+					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
+						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
+
+						newEmbICMPv4Layer.Id = upValue
+					}
+				default:
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+				}
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				newICMPv4Layer.Payload = payload
+			}
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+	}
+
+	// Create new network layer
+	switch t := embIndicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
+		temp := *ipv4Layer
+		newNetworkLayer = &temp
+
+		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
+
+		newIPv4Layer.SrcIP = e.upConn.LocalDev().IPAddr().IP
+		upIP = newIPv4Layer.SrcIP
+		if e.isDecTTL {
+			newIPv4Layer.TTL--
+		}
+	default:
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Set network layer for transport layer
+	if newTransportLayer != nil {
+		switch t := newTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP:
+			tcpLayer := newTransportLayer.(*layers.TCP)
+
+			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
+		case layers.LayerTypeUDP:
+			udpLayer := newTransportLayer.(*layers.UDP)
+
+			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
+		case layers.LayerTypeICMPv4:
+			break
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
+	// Decide Loopback or Ethernet
+	if e.upConn.IsLoop() {
+		newLinkLayerType = layers.LayerTypeLoopback
+	} else {
+		newLinkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create new link layer
+	switch newLinkLayerType {
+	case layers.LayerTypeLoopback:
+		newLinkLayer = pcap.CreateLoopbackLayer()
+	case layers.LayerTypeEthernet:
+		newLinkLayer, err = pcap.CreateEthernetLayer(e.upConn.LocalDev().HardwareAddr(), e.upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
+	default:
+		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	}
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Serialize layers
+	if newTransportLayer == nil {
+		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
+			newNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(embIndicator.Payload()))
+	} else {
+		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
+			newNetworkLayer.(gopacket.SerializableLayer),
+			newTransportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(embIndicator.Payload()))
+	}
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = e.upConn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// NAT
+	if embIndicator.TransportLayer() != nil {
+		// Record the source and the source device of the packet
+		var addNAT bool
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			a := net.TCPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeUDP:
+			a := net.UDPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				guide = pcap.NATGuide{
+					Src: addr.ICMPQueryAddr{
+						IP: upIP,
+						Id: upValue,
+					}.String(),
+					Protocol: t,
+				}
+				addNAT = true
+			}
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+		if addNAT {
+			ni = &natIndicator{
+				src:    conn.RemoteAddr(),
+				embSrc: embIndicator.NATSrc(),
+				conn:   conn,
+			}
+			e.natLock.Lock()
+			e.nat[guide] = ni
+			e.natLock.Unlock()
+		}
+
+		// Keep alive
+		protocol := embIndicator.NATProtocol()
+		switch protocol {
+		case layers.LayerTypeTCP:
+			e.tcpPortPool[convertFromPort(upValue)] = time.Now()
+		case layers.LayerTypeUDP:
+			e.udpPortPool[convertFromPort(upValue)] = time.Now()
+		case layers.LayerTypeICMPv4:
+			e.icmpv4IdPool[upValue] = time.Now()
+		default:
+			return fmt.Errorf("transport layer type %s not support", protocol)
+		}
+	}
+
+	// Statistics
+	if e.monitor != nil {
+		e.monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+
+	log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+
+	return nil
+}
+
+func (e *engine) handleUpstream(packet gopacket.Packet) error {
+	var (
+		err               error
+		indicator         *pcap.PacketIndicator
+		frags             []*pcap.PacketIndicator
+		ni                *natIndicator
+		embTransportLayer gopacket.Layer
+		embNetworkLayer   gopacket.NetworkLayer
+		data              []byte
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParsePacket(packet, e.validation, e.malMonitor)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Handle fragments
+	indicator, frags, err = e.defrag.AppendOriginal(indicator)
+	if err != nil {
+		return fmt.Errorf("defrag: %w", err)
+	}
+	if indicator == nil {
+		return nil
+	}
+
+	// NAT
+	guide := pcap.NATGuide{
+		Src:      indicator.NATDst().String(),
+		Protocol: indicator.TransportLayer().LayerType(),
+	}
+	e.natLock.RLock()
+	ni, ok := e.nat[guide]
+	e.natLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// Keep alive
+	protocol := indicator.NATProtocol()
+	switch protocol {
+	case layers.LayerTypeTCP:
+		e.tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+	case layers.LayerTypeUDP:
+		e.udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+	case layers.LayerTypeICMPv4:
+		e.icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
+	default:
+		return fmt.Errorf("transport layer type %s not support", protocol)
+	}
+
+	// Clients disconnected are forgotten
+	if !e.isTracked(ni.conn) {
+		return nil
+	}
+
+	// Rates of users
+	if u := e.clientUser(ni.conn); u != nil && !u.take(indicator.Size()) {
+		e.queMonitor.Add(ni.conn.RemoteAddr().String(), stat.QueueRateLimited)
+		return nil
+	}
+
+	// Quota
+	if !e.allowQuota(ni.conn, indicator.Size()) {
+		return nil
+	}
+
+	// Reply fragmentation needed if the packet cannot pass through the tunnel
+	if len(frags) == 1 && indicator.IsDF() && !isICMPv4Error(indicator) {
+		switch ni.conn.(type) {
+		case *pcap.FakeTCPConn:
+			maxSize := ni.conn.(*pcap.FakeTCPConn).MaxPayload()
+			if indicator.MTU() > maxSize {
+				data, err := pcap.CreateFragNeededPacket(e.upConn, e.upConn.RemoteDev().HardwareAddr(), indicator, maxSize)
+				if err != nil {
+					return fmt.Errorf("create fragmentation needed: %w", err)
+				}
+
+				_, err = e.upConn.Write(data)
+				if err != nil {
+					return fmt.Errorf("write: %w", err)
+				}
+
+				log.Verbosef("Reply fragmentation needed to %s: %d Bytes exceeds %d Bytes\n", indicator.SrcIP(), indicator.MTU(), maxSize)
+
+				return nil
+			}
+		default:
+			break
+		}
+	}
+
+	for _, frag := range frags {
+		// Create embedded transport layer
+		if frag.TransportLayer() != nil {
+			switch t := frag.TransportLayer().LayerType(); t {
+			case layers.LayerTypeTCP:
+				embTCPLayer := frag.TCPLayer()
+				temp := *embTCPLayer
+				embTransportLayer = &temp
+
+				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+
+				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+			case layers.LayerTypeUDP:
+				embUDPLayer := frag.UDPLayer()
+				temp := *embUDPLayer
+				embTransportLayer = &temp
+
+				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
+
+				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+			case layers.LayerTypeICMPv4:
+				if frag.ICMPv4Indicator().IsQuery() {
+					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
+					temp := *embICMPv4Layer
+					embTransportLayer = &temp
+
+					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+				} else {
+					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+
+					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
+					newEmbEmbIPv4Layer := &temp
+
+					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+
+					var (
+						err                     error
+						newEmbEmbTransportLayer gopacket.Layer
+					)
+
+					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
+					case layers.LayerTypeTCP:
+						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+
+						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+					case layers.LayerTypeUDP:
+						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+					case layers.LayerTypeICMPv4:
+						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
+						newEmbEmbTransportLayer = &temp
+
+						if frag.ICMPv4Indicator().IsEmbQuery() {
+							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+
+							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+						}
+					default:
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+					}
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+					}
+
+					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+					}
+
+					newEmbICMPv4Layer.Payload = payload
+				}
+			default:
+				return fmt.Errorf("embedded transport layer type %s not support", t)
+			}
+		}
+
+		// Create embedded network layer
+		switch t := frag.NetworkLayer().LayerType(); t {
+		case layers.LayerTypeIPv4:
+			embIPv4Layer := frag.IPv4Layer()
+			temp := *embIPv4Layer
+			embNetworkLayer = &temp
+
+			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+
+			newEmbIPv4Layer.DstIP = ni.embSrcIP()
+			if e.isDecTTL {
+				if newEmbIPv4Layer.TTL <= 1 {
+					log.Verbosef("Drop packet from %s of TTL expired\n", frag.Src().String())
+					continue
+				}
+				newEmbIPv4Layer.TTL--
+			}
+		default:
+			return fmt.Errorf("embedded network layer type %s not support", t)
+		}
+
+		// Set network layer for transport layer
+		if embTransportLayer != nil {
+			switch t := embTransportLayer.LayerType(); t {
+			case layers.LayerTypeTCP:
+				embTCPLayer := embTransportLayer.(*layers.TCP)
+
+				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+			case layers.LayerTypeUDP:
+				embUDPLayer := embTransportLayer.(*layers.UDP)
+
+				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+			case layers.LayerTypeICMPv4:
+				break
+			default:
+				return fmt.Errorf("embedded transport layer type %s not support", t)
+			}
+			if err != nil {
+				return fmt.Errorf("set embedded network layer for checksum: %w", err)
+			}
+		}
+
+		// Serialize layers
+		if embTransportLayer == nil {
+			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(frag.Payload()))
+		} else {
+			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+				embTransportLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(frag.Payload()))
+		}
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+
+		e.mirror.Mirror(data)
+		e.sflow.Sample(pcap.SFlowSourceInner, data)
+
+		// Write packet data
+		_, err = ni.conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		// Statistics
+		size := frag.MTU()
+		if e.monitor != nil {
+			e.monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+		}
+
+		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	}
+
+	// Record DNS
+	if indicator.DNSIndicator() != nil {
+		if indicator.DNSIndicator().IsResponse() {
+			name, ips := indicator.DNSIndicator().Answers()
+			if name != "" && len(ips) > 0 {
+				e.dnsLock.Lock()
+				for _, ip := range ips {
+					e.dns[ip.String()] = name
+					log.Verbosef("Record DNS record %s = %s\n", name, ip)
+				}
+				e.dnsLock.Unlock()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *engine) dist(t gopacket.LayerType) (uint16, error) {
+	now := time.Now()
+
+	switch t {
+	case layers.LayerTypeTCP:
+		for i := 0; i < 16384; i++ {
+			s := e.nextTCPPort % 16384
+
+			// Point to next port
+			e.nextTCPPort++
+
+			// Check if the port is alive
+			last := e.tcpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeUDP:
+		for i := 0; i < 16384; i++ {
+			s := e.nextUDPPort % 16384
+
+			// Point to next port
+			e.nextUDPPort++
+
+			// Check if the port is alive
+			last := e.udpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeICMPv4:
+		for i := 0; i < 65536; i++ {
+			s := e.nextICMPv4Id
+
+			// Point to next Id
+			e.nextICMPv4Id++
+
+			// Check if the Id is alive
+			last := e.icmpv4IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	default:
+		return 0, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return 0, fmt.Errorf("%s pool empty", t)
+}
+
+func convertFromPort(port uint16) uint16 {
+	return port - 49152
+}
+
+func isICMPv4Error(indicator *pcap.PacketIndicator) bool {
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeICMPv4 {
+		return false
+	}
+
+	return !indicator.ICMPv4Indicator().IsQuery()
+}
+
+// clientSession returns the identity of the client in NAT, which is the session announced by the client so its NAT is
+// kept across ports, or the address of the client.
+func clientSession(conn net.Conn) string {
+	fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+	if ok {
+		session, ok := fakeTCPConn.Session()
+		if ok {
+			return fmt.Sprintf("session %016x", session)
+		}
+	}
+
+	return conn.RemoteAddr().String()
+}
+
+// clientIdentity returns the identity of the client in quotas, which is the user the client is identified as, or the
+// IP of the client.
+func clientIdentity(conn net.Conn) string {
+	fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+	if ok {
+		name, ok := fakeTCPConn.User()
+		if ok {
+			return userIdentity(name)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// userIdentity returns the identity of the user in quotas.
+func userIdentity(name string) string {
+	return fmt.Sprintf("user %s", name)
+}
+
+// captureOptions returns options of captures in devices, which are tuned in the backend and the config of pcap.
+func (e *engine) captureOptions() []pcap.Option {
+	return []pcap.Option{
+		pcap.WithPcapConfig(e.pcapConfig),
+		pcap.WithBackend(e.backend),
+	}
+}
+
+// observeOptions returns options of monitors, the exporter, the trace and the hook connections are observed by.
+func (e *engine) observeOptions() []pcap.Option {
+	return []pcap.Option{
+		pcap.WithValidation(e.validation),
+		pcap.WithSFlow(e.sflow),
+		pcap.WithTrace(e.traceFilter, e.isTraceHex),
+		pcap.WithHook(e.hook),
+		pcap.WithFragmentMonitor(e.fragMonitor),
+		pcap.WithLatencyMonitor(e.latMonitor),
+		pcap.WithDeliveryMonitor(e.delMonitor),
+		pcap.WithMalformedMonitor(e.malMonitor),
+		pcap.WithQueueMonitor(e.queMonitor),
+	}
+}
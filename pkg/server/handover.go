@@ -0,0 +1,301 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"ikago/pkg/addr"
+	"ikago/pkg/pcap"
+	"net"
+	"os"
+	"time"
+)
+
+// handoverTimeout is the max time the state is handed over in.
+const handoverTimeout = 10 * time.Second
+
+type natState struct {
+	Src      string             `json:"src"`
+	Protocol gopacket.LayerType `json:"protocol"`
+	Client   string             `json:"client"`
+	EmbIP    net.IP             `json:"emb-ip"`
+	EmbPort  uint16             `json:"emb-port"`
+}
+
+type patState struct {
+	Src      string             `json:"src"`
+	Dst      string             `json:"dst"`
+	Protocol gopacket.LayerType `json:"protocol"`
+	Value    uint16             `json:"value"`
+}
+
+// handoverState describes the state handed over to a new process, which is clients connected and NAT.
+type handoverState struct {
+	Clients      []*pcap.ClientState `json:"clients"`
+	NAT          []*natState         `json:"nat"`
+	PAT          []*patState         `json:"pat"`
+	NextTCPPort  uint16              `json:"next-tcp-port"`
+	NextUDPPort  uint16              `json:"next-udp-port"`
+	NextICMPv4Id uint16              `json:"next-icmpv4-id"`
+}
+
+// snapshot returns NAT of the engine. It is called in the goroutine handling packets from clients, which is the only
+// one changing ports of NAT.
+func (e *engine) snapshot() *handoverState {
+	state := &handoverState{
+		Clients:      make([]*pcap.ClientState, 0),
+		NAT:          make([]*natState, 0),
+		PAT:          make([]*patState, 0),
+		NextTCPPort:  e.nextTCPPort,
+		NextUDPPort:  e.nextUDPPort,
+		NextICMPv4Id: e.nextICMPv4Id,
+	}
+
+	for q, value := range e.patMap {
+		state.PAT = append(state.PAT, &patState{
+			Src:      q.src,
+			Dst:      q.dst,
+			Protocol: q.protocol,
+			Value:    value,
+		})
+	}
+
+	e.natLock.RLock()
+	defer e.natLock.RUnlock()
+
+	for guide, ni := range e.nat {
+		s := &natState{
+			Src:      guide.Src,
+			Protocol: guide.Protocol,
+			Client:   ni.src.String(),
+			EmbIP:    ni.embSrcIP(),
+		}
+		switch t := ni.embSrc.(type) {
+		case *net.TCPAddr:
+			s.EmbPort = uint16(t.Port)
+		case *net.UDPAddr:
+			s.EmbPort = uint16(t.Port)
+		case *addr.ICMPQueryAddr:
+			s.EmbPort = t.Id
+		default:
+			continue
+		}
+		state.NAT = append(state.NAT, s)
+	}
+
+	return state
+}
+
+// listenHandover listens on the unix socket for a new process the state is handed over to.
+func (e *engine) listenHandover() error {
+	// The socket is left by the last process
+	err := os.Remove(e.handover)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", e.handover, err)
+	}
+
+	listener, err := net.Listen("unix", e.handover)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", e.handover, err)
+	}
+	e.handoverListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if e.isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("accept handover: %w", err))
+				continue
+			}
+
+			// The socket belongs to the new process now
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+			err = e.handOver(conn)
+			conn.Close()
+			if err != nil {
+				e.closeAll(fmt.Errorf("hand over: %w", err))
+				return
+			}
+
+			log.Infoln("Hand over to the new process")
+			e.closeAll(nil)
+			return
+		}
+	}()
+
+	return nil
+}
+
+// handOver stops serving clients and sends their state and NAT to the new process.
+func (e *engine) handOver(conn net.Conn) error {
+	log.Infoln("Handing over to a new process...")
+
+	// Never accept new clients
+	err := e.listener.Close()
+	if err != nil {
+		log.Errorln(fmt.Errorf("close listener: %w", err))
+	}
+
+	// Clients are closed without TCP FIN, so they never know the process is changed
+	clients := make([]*pcap.ClientState, 0)
+	for _, c := range e.trackedConns() {
+		e.untrack(c)
+
+		fakeTCPConn, ok := c.(*pcap.FakeTCPConn)
+		if !ok {
+			c.Close()
+			continue
+		}
+
+		err := fakeTCPConn.Close()
+		if err != nil {
+			log.Errorln(fmt.Errorf("close %s: %w", c.RemoteAddr(), err))
+		}
+
+		state, err := fakeTCPConn.State()
+		if err != nil {
+			log.Errorln(fmt.Errorf("state of %s: %w", c.RemoteAddr(), err))
+			continue
+		}
+		clients = append(clients, state)
+	}
+
+	// NAT is taken from the goroutine changing it
+	reply := make(chan *handoverState, 1)
+	select {
+	case e.snapshots <- reply:
+	case <-e.done:
+		return errors.New("server closed")
+	}
+	state := <-reply
+	state.Clients = clients
+
+	err = conn.SetWriteDeadline(time.Now().Add(handoverTimeout))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	err = json.NewEncoder(conn).Encode(state)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	return nil
+}
+
+// takeOver takes the state over from the old process listening on the unix socket, and returns nil if there is no
+// old process.
+func (e *engine) takeOver() (*handoverState, error) {
+	conn, err := net.DialTimeout("unix", e.handover, handoverTimeout)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("dial %s: %w", e.handover, err))
+		return nil, nil
+	}
+	defer conn.Close()
+
+	log.Infof("Take over from the old process by %s\n", e.handover)
+
+	err = conn.SetReadDeadline(time.Now().Add(handoverTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	state := &handoverState{}
+	err = json.NewDecoder(conn).Decode(state)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	return state, nil
+}
+
+// restore restores clients and NAT in the state taken over. Clients which cannot be restored will connect again by
+// themselves.
+func (e *engine) restore(state *handoverState) {
+	conns := make(map[string]net.Conn)
+	for _, cs := range state.Clients {
+		var listener *pcap.FakeTCPListener
+		for _, l := range e.listeners {
+			fakeTCPListener, ok := l.(*pcap.FakeTCPListener)
+			if ok && fakeTCPListener.Dev().Alias() == cs.Dev {
+				listener = fakeTCPListener
+				break
+			}
+		}
+		if listener == nil {
+			log.Errorln(fmt.Errorf("restore %s: missing device %s", cs.Addr, cs.Dev))
+			continue
+		}
+
+		conn, err := listener.Restore(cs)
+		if err != nil {
+			log.Errorln(fmt.Errorf("restore %s: %w", cs.Addr, err))
+			continue
+		}
+
+		// Clients banned in the meantime are not restored
+		if e.isBanned(conn) {
+			conn.Close()
+			continue
+		}
+
+		e.track(conn)
+		go e.serve(conn)
+		conns[cs.Addr] = conn
+		log.Verbosef("Restore client %s\n", cs.Addr)
+	}
+
+	now := time.Now()
+	for _, ps := range state.PAT {
+		e.patMap[quintuple{src: ps.Src, dst: ps.Dst, protocol: ps.Protocol}] = ps.Value
+
+		// Ports of NAT are kept alive so they are not distributed again
+		switch ps.Protocol {
+		case layers.LayerTypeTCP:
+			e.tcpPortPool[convertFromPort(ps.Value)] = now
+		case layers.LayerTypeUDP:
+			e.udpPortPool[convertFromPort(ps.Value)] = now
+		case layers.LayerTypeICMPv4:
+			e.icmpv4IdPool[ps.Value] = now
+		}
+	}
+	e.nextTCPPort = state.NextTCPPort
+	e.nextUDPPort = state.NextUDPPort
+	e.nextICMPv4Id = state.NextICMPv4Id
+
+	e.natLock.Lock()
+	for _, ns := range state.NAT {
+		conn, ok := conns[ns.Client]
+		if !ok {
+			continue
+		}
+
+		var embSrc net.Addr
+		switch ns.Protocol {
+		case layers.LayerTypeTCP:
+			embSrc = &net.TCPAddr{IP: ns.EmbIP, Port: int(ns.EmbPort)}
+		case layers.LayerTypeUDP:
+			embSrc = &net.UDPAddr{IP: ns.EmbIP, Port: int(ns.EmbPort)}
+		case layers.LayerTypeICMPv4:
+			embSrc = &addr.ICMPQueryAddr{IP: ns.EmbIP, Id: ns.EmbPort}
+		default:
+			continue
+		}
+
+		e.nat[pcap.NATGuide{Src: ns.Src, Protocol: ns.Protocol}] = &natIndicator{
+			src:    conn.RemoteAddr(),
+			embSrc: embSrc,
+			conn:   conn,
+		}
+	}
+	e.natLock.Unlock()
+
+	log.Infof("Restore %d clients and %d flows in NAT\n", len(conns), len(state.PAT))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/stat"
+	"net"
+)
+
+// allowQuota adds the size to the usage of the client in quotas and returns if the traffic may pass. Clients exceeding
+// their quotas in the action of disconnect are disconnected.
+func (e *engine) allowQuota(conn net.Conn, size int) bool {
+	if e.quotas == nil {
+		return true
+	}
+
+	identity := clientIdentity(conn)
+	if e.quotas.Allow(identity, size) {
+		return true
+	}
+
+	e.queMonitor.Add(conn.RemoteAddr().String(), stat.QueueQuotaLimited)
+
+	if e.quotas.IsDisconnected(identity) {
+		e.kickExceeded(conn)
+	}
+
+	return false
+}
+
+// isExceeded returns if the client exceeds its quota and is disconnected until the quota resets.
+func (e *engine) isExceeded(conn net.Conn) bool {
+	if e.quotas == nil {
+		return false
+	}
+
+	return e.quotas.IsDisconnected(clientIdentity(conn))
+}
+
+// kickExceeded disconnects the client exceeding its quota, clients disconnected already are ignored.
+func (e *engine) kickExceeded(conn net.Conn) {
+	e.connsLock.Lock()
+	ok := e.conns[conn]
+	delete(e.conns, conn)
+	e.connsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	e.queMonitor.Remove(conn.RemoteAddr().String())
+
+	log.Infof("Disconnect from client %s because it exceeds its quota\n", conn.RemoteAddr())
+
+	err := conn.Close()
+	if err != nil {
+		log.Errorln(fmt.Errorf("close %s: %w", conn.RemoteAddr(), err))
+	}
+}
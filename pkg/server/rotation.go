@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/transform"
+	"reflect"
+	"time"
+)
+
+// setKeys sets keys of the server, which are the password in the crypt and the old password in rotation. Keys of
+// passwords in the keyring keep their crypts, so clients in them are kept.
+func (e *engine) setKeys(cfg *config.Config, crypt crypto.Crypt) error {
+	if cfg.RotationConfig.Grace < 0 {
+		return fmt.Errorf("grace %d out of range", cfg.RotationConfig.Grace)
+	}
+
+	keys := []*pcap.Key{{ID: cfg.Password, Crypt: crypt}}
+	if cfg.RotationConfig.Password != "" && cfg.RotationConfig.Password != cfg.Password {
+		old, err := crypto.ParseCrypt(cfg.Method, cfg.RotationConfig.Password)
+		if err != nil {
+			return fmt.Errorf("parse crypt of old password: %w", err)
+		}
+		pipeline, err := transform.NewPipeline(old, cfg.Transforms)
+		if err != nil {
+			return fmt.Errorf("parse transforms of old password: %w", err)
+		}
+
+		key := &pcap.Key{ID: cfg.RotationConfig.Password, Crypt: pipeline}
+		if cfg.RotationConfig.Grace > 0 {
+			key.Retire = time.Now().Add(time.Duration(cfg.RotationConfig.Grace) * time.Second)
+			log.Infof("Accept old password until %s\n", key.Retire.Format(time.RFC3339))
+		} else {
+			log.Infoln("Accept old password")
+		}
+		keys = append(keys, key)
+	}
+
+	if e.keyring == nil {
+		keyring, err := pcap.NewKeyring(keys)
+		if err != nil {
+			return err
+		}
+		e.keyring = keyring
+		return nil
+	}
+
+	return e.keyring.Set(keys)
+}
+
+// isRotation returns if the configuration differs from the old one in passwords only, which are rotated in place.
+func isRotation(old, cfg *config.Config) bool {
+	a, b := *old, *cfg
+	a.Password, b.Password = "", ""
+	a.RotationConfig, b.RotationConfig = config.RotationConfig{}, config.RotationConfig{}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// rotate rotates passwords of the server in the configuration. Clients keep passwords they handshake in, and clients
+// of passwords removed or retired are disconnected.
+func (e *engine) rotate(cfg *config.Config) error {
+	crypt, err := crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("parse crypt: %w", err)
+	}
+	pipeline, err := transform.NewPipeline(crypt, cfg.Transforms)
+	if err != nil {
+		return fmt.Errorf("parse transforms: %w", err)
+	}
+
+	err = e.setKeys(cfg, pipeline)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Rotate password")
+
+	e.retireKeys(time.Now())
+
+	return nil
+}
+
+// retireKeys notices clients of passwords retiring that the server is going away for them at the time the password
+// retires, and disconnects clients of passwords retired.
+func (e *engine) retireKeys(now time.Time) {
+	for _, conn := range e.trackedConns() {
+		fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+		crypt, ok := fakeTCPConn.Crypt()
+		if !ok {
+			continue
+		}
+		retire, ok := e.keyring.Retire(crypt)
+		if !ok {
+			continue
+		}
+
+		if now.Before(retire) {
+			err := fakeTCPConn.NoticeDrain(retire)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("notice drain to %s: %w", conn.RemoteAddr(), err))
+			}
+			continue
+		}
+
+		log.Infof("Disconnect from client %s because its password is retired\n", conn.RemoteAddr())
+
+		e.untrack(conn)
+		err := fakeTCPConn.Finish()
+		if err != nil {
+			log.Errorln(fmt.Errorf("close %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// retireAll retires passwords every interval until the engine is closed.
+func (e *engine) retireAll() {
+	t := time.NewTicker(drainInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-t.C:
+			e.retireKeys(time.Now())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"ikago/pkg/config"
+	"ikago/pkg/pcap"
+	"net"
+	"time"
+)
+
+// scheduleGrace is the time clients are noticed before they are disconnected once their schedules close, so they may
+// finish transfers in time.
+const scheduleGrace = 1 * time.Minute
+
+// parseAccess parses the schedule of the server and schedules of users, and returns nil if there is no schedule.
+func parseAccess(cfg *config.ScheduleConfig, users map[string]config.UserConfig) (*pcap.Access, error) {
+	server, err := pcap.ParseAccessSchedule(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := make(map[string]*pcap.AccessSchedule)
+	for name, u := range users {
+		schedule, err := pcap.ParseAccessSchedule(u.Schedule.Allow, u.Schedule.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("parse schedule of user %s: %w", name, err)
+		}
+		if schedule != nil {
+			schedules[name] = schedule
+		}
+	}
+
+	if server == nil && len(schedules) <= 0 {
+		return nil, nil
+	}
+
+	return pcap.NewAccess(server, schedules), nil
+}
+
+// isAllowed returns if the client is allowed at the time by the schedule of the server and of its user.
+func (e *engine) isAllowed(conn net.Conn, t time.Time) bool {
+	var name string
+	if u := e.clientUser(conn); u != nil {
+		name = u.name
+	}
+
+	return e.access.IsAllowed(name, t)
+}
+
+// closeSchedules notices clients out of their schedules every interval, and disconnects them if their schedules are
+// still closed after the grace until the engine is closed.
+func (e *engine) closeSchedules() {
+	deadlines := make(map[net.Conn]time.Time)
+
+	t := time.NewTicker(drainInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		conns := make(map[net.Conn]bool)
+		for _, conn := range e.trackedConns() {
+			conns[conn] = true
+
+			// Clients whose schedules open again are forgotten
+			if e.isAllowed(conn, now) {
+				delete(deadlines, conn)
+				continue
+			}
+
+			deadline, ok := deadlines[conn]
+			if !ok {
+				deadline = now.Add(scheduleGrace)
+				deadlines[conn] = deadline
+				log.Infof("Drain client %s because it is out of schedule\n", conn.RemoteAddr())
+			}
+
+			if now.Before(deadline) {
+				fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+				if !ok {
+					continue
+				}
+
+				err := fakeTCPConn.NoticeDrain(deadline)
+				if err != nil {
+					log.Verboseln(fmt.Errorf("notice drain to %s: %w", conn.RemoteAddr(), err))
+				}
+				continue
+			}
+
+			log.Infof("Disconnect from client %s because it is out of schedule\n", conn.RemoteAddr())
+
+			e.untrack(conn)
+			delete(deadlines, conn)
+
+			var err error
+			switch conn.(type) {
+			case *pcap.FakeTCPConn:
+				err = conn.(*pcap.FakeTCPConn).Finish()
+			default:
+				err = conn.Close()
+			}
+			if err != nil {
+				log.Errorln(fmt.Errorf("close %s: %w", conn.RemoteAddr(), err))
+			}
+		}
+
+		// Clients disconnected otherwise are forgotten
+		for conn := range deadlines {
+			if !conns[conn] {
+				delete(deadlines, conn)
+			}
+		}
+	}
+}
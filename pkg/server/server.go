@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/hook"
+	"ikago/internal/log"
+	"ikago/internal/quota"
+	"ikago/pkg/config"
+	"ikago/pkg/stat"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stats describes statistics of a server.
+type Stats struct {
+	Monitor    *stat.TrafficMonitor   `json:"monitor"`
+	Fragments  *stat.FragmentMonitor  `json:"fragments"`
+	Rejections *stat.RejectionMonitor `json:"rejections"`
+	Malformed  *stat.MalformedMonitor `json:"malformed"`
+	Latency    *stat.LatencyMonitor   `json:"latency"`
+	Delivery   *stat.DeliveryMonitor  `json:"delivery"`
+	Queues     *stat.QueueMonitor     `json:"queues"`
+	Errors     *log.ErrorAggregator   `json:"errors"`
+	Quota      *quota.Quota           `json:"quota"`
+}
+
+// Server is a server of IkaGo which accepts clients and routes their packets upstream.
+type Server struct {
+	lock     sync.Mutex
+	cfg      config.Config
+	engine   *engine
+	isOpened bool
+}
+
+// New returns a server with the given configuration. Devices are selected here but nothing is opened until Start.
+func New(cfg *config.Config) (*Server, error) {
+	e, err := newEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{cfg: *cfg, engine: e}, nil
+}
+
+// Start opens devices and listens for clients, and handles packets in background.
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.start()
+}
+
+func (s *Server) start() error {
+	if s.isOpened {
+		if !s.engine.closed() {
+			return errors.New("server is running")
+		}
+
+		// An engine can only be opened once
+		e, err := newEngine(&s.cfg)
+		if err != nil {
+			return err
+		}
+		e.bans = s.engine.bans
+		s.engine = e
+	}
+
+	s.isOpened = true
+	err := s.engine.open()
+	if err != nil {
+		s.engine.closeAll(err)
+		return err
+	}
+
+	return nil
+}
+
+// Stop closes devices and connections of clients. Usages of quota are saved, and firewall rules added by the server
+// are left untouched.
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.isOpened {
+		return errors.New("server is not running")
+	}
+
+	s.engine.closeAll(nil)
+
+	return nil
+}
+
+// Wait blocks until the server is stopped and returns the error which stopped it, if any. Wait keeps blocking
+// across reloads.
+func (s *Server) Wait() error {
+	for {
+		s.lock.Lock()
+		e := s.engine
+		s.lock.Unlock()
+
+		<-e.done
+
+		s.lock.Lock()
+		reloaded := s.engine != e
+		s.lock.Unlock()
+		if !reloaded {
+			return e.err
+		}
+	}
+}
+
+// Stats returns statistics of the server. Statistics restart after reloading.
+func (s *Server) Stats() *Stats {
+	s.lock.Lock()
+	e := s.engine
+	s.lock.Unlock()
+
+	return &Stats{
+		Monitor:    e.monitor,
+		Fragments:  e.fragMonitor,
+		Rejections: e.rejMonitor,
+		Malformed:  e.malMonitor,
+		Latency:    e.latMonitor,
+		Delivery:   e.delMonitor,
+		Queues:     e.queues(),
+		Errors:     log.Aggregation(),
+		Quota:      e.quotas,
+	}
+}
+
+// Names returns names of addresses recorded from DNS responses.
+func (s *Server) Names() map[string]string {
+	s.lock.Lock()
+	e := s.engine
+	s.lock.Unlock()
+
+	names := make(map[string]string)
+
+	e.dnsLock.RLock()
+	for ip, name := range e.dns {
+		names[ip] = name
+	}
+	e.dnsLock.RUnlock()
+
+	return names
+}
+
+// Reload applies the configuration to the server. The configuration is verified before the server is stopped, and
+// the server is started again if it was running. Configurations changing passwords only are applied in place without
+// building another engine, so clients are kept in passwords they handshake in.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	isRunning := s.isOpened && !s.engine.closed()
+
+	// Passwords are rotated in place without dropping sessions, so no engine is built
+	if isRunning && s.engine.keyring != nil && isRotation(&s.cfg, cfg) {
+		err := s.engine.rotate(cfg)
+		if err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+		s.cfg = *cfg
+		return nil
+	}
+
+	e, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.engine.closeAll(nil)
+
+	// Bans made at runtime are kept across reloads
+	if cfg.BanFile == s.cfg.BanFile {
+		e.bans = s.engine.bans
+	}
+
+	s.cfg = *cfg
+	s.engine = e
+	s.isOpened = false
+
+	if isRunning {
+		return s.start()
+	}
+
+	return nil
+}
+
+// Drain stops accepting new clients, notices clients connected that the server is going away after the duration,
+// and closes their connections with TCP FIN and stops the server once the duration passes.
+func (s *Server) Drain(after time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.isOpened || s.engine.closed() {
+		return errors.New("server is not running")
+	}
+
+	deadline := time.Now().Add(after)
+	if !s.engine.drain.Start(deadline) {
+		return errors.New("server is draining")
+	}
+	log.Infof("Drain until %s\n", deadline.Format(time.RFC3339))
+
+	go s.engine.drainAll(deadline)
+
+	return nil
+}
+
+// BanIP bans the IP at runtime. Clients from the IP are disconnected immediately, and their handshakes are never
+// responded until the IP is unbanned. Bans are persisted in the file of bans if set.
+func (s *Server) BanIP(ip net.IP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.engine.bans.BanIP(ip) {
+		return fmt.Errorf("ip %s has been banned", ip)
+	}
+	log.Infof("Ban IP %s\n", ip)
+	s.engine.hook.Notifyf(hook.EventBanned, "IP %s is banned", ip)
+
+	return s.engine.applyBans()
+}
+
+// UnbanIP unbans the IP at runtime.
+func (s *Server) UnbanIP(ip net.IP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.engine.bans.UnbanIP(ip) {
+		return fmt.Errorf("ip %s has not been banned", ip)
+	}
+	log.Infof("Unban IP %s\n", ip)
+
+	return s.engine.applyBans()
+}
+
+// BanUser bans the user at runtime in the same way as BanIP.
+func (s *Server) BanUser(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.engine.bans.BanUser(name) {
+		return fmt.Errorf("user %s has been banned", name)
+	}
+	log.Infof("Ban user %s\n", name)
+	s.engine.hook.Notifyf(hook.EventBanned, "User %s is banned", name)
+
+	return s.engine.applyBans()
+}
+
+// UnbanUser unbans the user at runtime.
+func (s *Server) UnbanUser(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.engine.bans.UnbanUser(name) {
+		return fmt.Errorf("user %s has not been banned", name)
+	}
+	log.Infof("Unban user %s\n", name)
+
+	return s.engine.applyBans()
+}
+
+// Bans returns IPs and users banned.
+func (s *Server) Bans() ([]string, []string) {
+	s.lock.Lock()
+	e := s.engine
+	s.lock.Unlock()
+
+	return e.bans.List()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"ikago/pkg/pcap"
+)
+
+// parseTunnel parses rules of traffic tunneled, which are NAT expectations of the server.
+func parseTunnel(strs []string) ([]*pcap.RouteRule, error) {
+	rules := make([]*pcap.RouteRule, 0, len(strs))
+	for _, s := range strs {
+		rule, err := pcap.ParseRouteRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse rule %s: %w", s, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// matchRules returns if the IP packet is matched by any of rules, or rules are empty. Non-first fragments carry no
+// ports, so they are judged by their first fragments.
+func matchRules(rules []*pcap.RouteRule, indicator *pcap.PacketIndicator, data []byte) bool {
+	if len(rules) <= 0 || indicator.FragOffset() != 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.Match(data) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"ikago/pkg/config"
+	"ikago/pkg/crypto"
+	"ikago/pkg/pcap"
+	"ikago/pkg/transform"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// user is a user of the server with its own password, destinations allowed and limits.
+type user struct {
+	name       string
+	allow      []*pcap.RouteRule
+	daily      int
+	monthly    int
+	rate       int
+	lock       sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+}
+
+// parseUsers parses users, whose crypts are in the method and the transforms of the server.
+func (e *engine) parseUsers(cfgs map[string]config.UserConfig, method string, transforms []string) error {
+	e.userSet = pcap.NewUsers()
+	e.users = make(map[string]*user)
+
+	// Users are parsed in order so errors are stable
+	names := make([]string, 0, len(cfgs))
+	for name := range cfgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := cfgs[name]
+
+		if cfg.Password == "" {
+			return fmt.Errorf("missing password of user %s", name)
+		}
+		if cfg.Daily < 0 {
+			return fmt.Errorf("daily quota %d of user %s out of range", cfg.Daily, name)
+		}
+		if cfg.Monthly < 0 {
+			return fmt.Errorf("monthly quota %d of user %s out of range", cfg.Monthly, name)
+		}
+		if cfg.Rate < 0 {
+			return fmt.Errorf("rate %d of user %s out of range", cfg.Rate, name)
+		}
+
+		crypt, err := crypto.ParseCrypt(method, cfg.Password)
+		if err != nil {
+			return fmt.Errorf("parse crypt of user %s: %w", name, err)
+		}
+		pipeline, err := transform.NewPipeline(crypt, transforms)
+		if err != nil {
+			return fmt.Errorf("parse transforms of user %s: %w", name, err)
+		}
+
+		err = e.userSet.Add(name, pipeline)
+		if err != nil {
+			return fmt.Errorf("add user %s: %w", name, err)
+		}
+
+		u := &user{
+			name:       name,
+			allow:      make([]*pcap.RouteRule, 0),
+			daily:      cfg.Daily,
+			monthly:    cfg.Monthly,
+			rate:       cfg.Rate,
+			tokens:     float64(cfg.Rate),
+			lastRefill: time.Now(),
+		}
+		for _, s := range cfg.Allow {
+			rule, err := pcap.ParseRouteRule(s)
+			if err != nil {
+				return fmt.Errorf("parse allow %s of user %s: %w", s, name, err)
+			}
+			u.allow = append(u.allow, rule)
+		}
+
+		e.users[name] = u
+	}
+
+	return nil
+}
+
+// clientUser returns the user the client is identified as, or nil if the client is of no user.
+func (e *engine) clientUser(conn net.Conn) *user {
+	if e.users == nil {
+		return nil
+	}
+
+	fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	name, ok := fakeTCPConn.User()
+	if !ok {
+		return nil
+	}
+
+	return e.users[name]
+}
+
+// isAllowed returns if the user may reach the destination of the IP packet. Non-first fragments carry no ports, so they
+// are judged by their first fragments.
+func (u *user) isAllowed(indicator *pcap.PacketIndicator, data []byte) bool {
+	return matchRules(u.allow, indicator, data)
+}
+
+// take returns if the traffic of the size is within the rate of the user, in a token bucket holding tokens no more
+// than a second.
+func (u *user) take(size int) bool {
+	if u.rate <= 0 {
+		return true
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	now := time.Now()
+	u.tokens = u.tokens + now.Sub(u.lastRefill).Seconds()*float64(u.rate)
+	if u.tokens > float64(u.rate) {
+		u.tokens = float64(u.rate)
+	}
+	u.lastRefill = now
+
+	if u.tokens < float64(size) {
+		return false
+	}
+	u.tokens = u.tokens - float64(size)
+
+	return true
+}
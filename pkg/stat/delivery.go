@@ -0,0 +1,76 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Delivery describes the delivery of packets between the local and a peer. Losses are in percent, and are measured
+// by counts of packets exchanged in band.
+type Delivery struct {
+	Sent         uint64  `json:"sent"`
+	Received     uint64  `json:"received"`
+	OutboundLoss float64 `json:"outbound-loss"`
+	InboundLoss  float64 `json:"inbound-loss"`
+}
+
+// DeliveryMonitor describes statistics of delivery of packets to each peer.
+type DeliveryMonitor struct {
+	lock  sync.RWMutex
+	peers map[string]Delivery
+}
+
+// NewDeliveryMonitor returns a new delivery monitor.
+func NewDeliveryMonitor() *DeliveryMonitor {
+	return &DeliveryMonitor{peers: make(map[string]Delivery)}
+}
+
+// Set records the delivery of packets between the local and the peer.
+func (monitor *DeliveryMonitor) Set(peer string, delivery Delivery) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	monitor.peers[peer] = delivery
+}
+
+// Delivery returns the delivery of packets between the local and the peer, and false if it is unknown.
+func (monitor *DeliveryMonitor) Delivery(peer string) (Delivery, bool) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	delivery, ok := monitor.peers[peer]
+
+	return delivery, ok
+}
+
+func (monitor *DeliveryMonitor) MarshalJSON() ([]byte, error) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return json.Marshal(monitor.peers)
+}
+
+func (monitor *DeliveryMonitor) String() string {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	peers := make([]string, 0, len(monitor.peers))
+	for peer := range monitor.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	sb := strings.Builder{}
+
+	sb.WriteString("Delivery statistics:\n")
+	for _, peer := range peers {
+		delivery := monitor.peers[peer]
+		sb.WriteString(fmt.Sprintf("%s: %d sent, %d received, outbound loss %.1f%%, inbound loss %.1f%%\n", peer,
+			delivery.Sent, delivery.Received, delivery.OutboundLoss, delivery.InboundLoss))
+	}
+
+	return sb.String()
+}
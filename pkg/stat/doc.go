@@ -0,0 +1,4 @@
+// Package stat implements monitors of traffic and events in IkaGo.
+//
+// Monitors may be read concurrently, and their JSON forms are stable.
+package stat
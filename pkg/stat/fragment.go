@@ -0,0 +1,174 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// FragmentEvent describes an event in fragment reassembly.
+type FragmentEvent int
+
+const (
+	// FragmentEventStarted describes a new flow of fragments is started.
+	FragmentEventStarted FragmentEvent = iota
+	// FragmentEventCompleted describes a flow of fragments is reassembled.
+	FragmentEventCompleted
+	// FragmentEventExpired describes a flow of fragments is discarded because of the deadline.
+	FragmentEventExpired
+	// FragmentEventOverLimit describes a fragment is dropped because of the limits of the defragmenter.
+	FragmentEventOverLimit
+	// FragmentEventOverlapped describes a flow of fragments is dropped because of overlapping fragments.
+	FragmentEventOverlapped
+	// FragmentEventInvalid describes a flow of fragments is dropped because of invalid fragments.
+	FragmentEventInvalid
+)
+
+func (event FragmentEvent) String() string {
+	switch event {
+	case FragmentEventStarted:
+		return "started"
+	case FragmentEventCompleted:
+		return "completed"
+	case FragmentEventExpired:
+		return "expired"
+	case FragmentEventOverLimit:
+		return "over limit"
+	case FragmentEventOverlapped:
+		return "overlapped"
+	case FragmentEventInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("%d", event)
+	}
+}
+
+// FragmentMonitor describes statistics of fragment reassembly.
+type FragmentMonitor struct {
+	lock       sync.RWMutex
+	inProgress int
+	completed  uint64
+	expired    uint64
+	overLimit  uint64
+	overlapped uint64
+	invalid    uint64
+}
+
+// NewFragmentMonitor returns a new fragment monitor.
+func NewFragmentMonitor() *FragmentMonitor {
+	return &FragmentMonitor{}
+}
+
+// Add adds an event of fragment reassembly. Events except started and over limit end a flow in progress.
+func (monitor *FragmentMonitor) Add(event FragmentEvent) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	switch event {
+	case FragmentEventStarted:
+		monitor.inProgress++
+	case FragmentEventCompleted:
+		monitor.inProgress--
+		monitor.completed++
+	case FragmentEventExpired:
+		monitor.inProgress--
+		monitor.expired++
+	case FragmentEventOverLimit:
+		monitor.overLimit++
+	case FragmentEventOverlapped:
+		monitor.inProgress--
+		monitor.overlapped++
+	case FragmentEventInvalid:
+		monitor.inProgress--
+		monitor.invalid++
+	default:
+		panic(fmt.Errorf("fragment event %d out of range", event))
+	}
+}
+
+// InProgress returns the count of flows of fragments in progress.
+func (monitor *FragmentMonitor) InProgress() int {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.inProgress
+}
+
+// Completed returns the count of reassembled flows of fragments.
+func (monitor *FragmentMonitor) Completed() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.completed
+}
+
+// Expired returns the count of expired flows of fragments.
+func (monitor *FragmentMonitor) Expired() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.expired
+}
+
+// OverLimit returns the count of fragments dropped because of the limits.
+func (monitor *FragmentMonitor) OverLimit() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.overLimit
+}
+
+// Overlapped returns the count of flows of fragments dropped because of overlapping fragments.
+func (monitor *FragmentMonitor) Overlapped() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.overlapped
+}
+
+// Invalid returns the count of flows of fragments dropped because of invalid fragments.
+func (monitor *FragmentMonitor) Invalid() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.invalid
+}
+
+func (monitor *FragmentMonitor) MarshalJSON() ([]byte, error) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return json.Marshal(&struct {
+		InProgress int    `json:"inProgress"`
+		Completed  uint64 `json:"completed"`
+		Expired    uint64 `json:"expired"`
+		OverLimit  uint64 `json:"overLimit"`
+		Overlapped uint64 `json:"overlapped"`
+		Invalid    uint64 `json:"invalid"`
+	}{
+		InProgress: monitor.inProgress,
+		Completed:  monitor.completed,
+		Expired:    monitor.expired,
+		OverLimit:  monitor.overLimit,
+		Overlapped: monitor.overlapped,
+		Invalid:    monitor.invalid,
+	})
+}
+
+func (monitor *FragmentMonitor) String() string {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	sb := strings.Builder{}
+
+	sb.WriteString("Fragment statistics:\n")
+	sb.WriteString(fmt.Sprintf("In progress: %d\n", monitor.inProgress))
+	sb.WriteString(fmt.Sprintf("Completed: %d\n", monitor.completed))
+	sb.WriteString(fmt.Sprintf("Expired: %d\n", monitor.expired))
+	sb.WriteString(fmt.Sprintf("Over limit: %d\n", monitor.overLimit))
+	sb.WriteString(fmt.Sprintf("Overlapped: %d\n", monitor.overlapped))
+	sb.WriteString(fmt.Sprintf("Invalid: %d\n", monitor.invalid))
+
+	return sb.String()
+}
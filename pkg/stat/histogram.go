@@ -0,0 +1,219 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// histogramSubBuckets is the count of buckets in each power of 2, so values are recorded within an error of 1/16.
+const histogramSubBuckets = 16
+
+// histogramMax is the max value recorded in microseconds, larger values are recorded as it.
+const histogramMax = 1<<36 - 1
+
+// histogramSize is the count of buckets covering values from 0 to histogramMax.
+const histogramSize = histogramSubBuckets + (36-4)*histogramSubBuckets
+
+// Histogram describes the distribution of durations in log-linear buckets, in the manner of HDR histograms, so tail
+// percentiles are kept with a bounded error while the memory used is fixed.
+type Histogram struct {
+	lock   sync.RWMutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram returns a new histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]uint64, histogramSize),
+	}
+}
+
+// histogramIndex returns the index of the bucket of the value in microseconds.
+func histogramIndex(v uint64) int {
+	if v > histogramMax {
+		v = histogramMax
+	}
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+
+	e := bits.Len64(v) - 5
+
+	return histogramSubBuckets + e*histogramSubBuckets + int(v>>uint(e)) - histogramSubBuckets
+}
+
+// histogramUpper returns the highest value in microseconds of the bucket.
+func histogramUpper(i int) uint64 {
+	if i < histogramSubBuckets {
+		return uint64(i)
+	}
+
+	e := uint((i - histogramSubBuckets) / histogramSubBuckets)
+	sub := uint64((i - histogramSubBuckets) % histogramSubBuckets)
+
+	return (histogramSubBuckets+sub+1)<<e - 1
+}
+
+// Add records a duration, negative durations are recorded as 0.
+func (histogram *Histogram) Add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	histogram.counts[histogramIndex(uint64(d/time.Microsecond))]++
+	if histogram.count <= 0 || d < histogram.min {
+		histogram.min = d
+	}
+	if d > histogram.max {
+		histogram.max = d
+	}
+	histogram.count++
+	histogram.sum = histogram.sum + d
+}
+
+// Count returns the count of durations recorded.
+func (histogram *Histogram) Count() uint64 {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return histogram.count
+}
+
+// Min returns the min duration recorded.
+func (histogram *Histogram) Min() time.Duration {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return histogram.min
+}
+
+// Max returns the max duration recorded.
+func (histogram *Histogram) Max() time.Duration {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return histogram.max
+}
+
+// Mean returns the mean of durations recorded.
+func (histogram *Histogram) Mean() time.Duration {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return histogram.mean()
+}
+
+func (histogram *Histogram) mean() time.Duration {
+	if histogram.count <= 0 {
+		return 0
+	}
+
+	return histogram.sum / time.Duration(histogram.count)
+}
+
+// Percentile returns the duration no less than the given percent of durations recorded, which is in the range of 0
+// to 100.
+func (histogram *Histogram) Percentile(percent float64) time.Duration {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return histogram.percentile(percent)
+}
+
+func (histogram *Histogram) percentile(percent float64) time.Duration {
+	if histogram.count <= 0 {
+		return 0
+	}
+
+	target := uint64(percent / 100 * float64(histogram.count))
+	if target < 1 {
+		target = 1
+	}
+
+	var n uint64
+	for i, count := range histogram.counts {
+		n = n + count
+		if n >= target {
+			d := time.Duration(histogramUpper(i)) * time.Microsecond
+			if d > histogram.max {
+				d = histogram.max
+			}
+			return d
+		}
+	}
+
+	return histogram.max
+}
+
+// Reset discards all durations recorded.
+func (histogram *Histogram) Reset() {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	histogram.counts = make([]uint64, histogramSize)
+	histogram.count = 0
+	histogram.sum = 0
+	histogram.min = 0
+	histogram.max = 0
+}
+
+// MarshalJSON returns the JSON form of the histogram, durations are in microseconds and buckets are only those not
+// empty, each with the highest duration in it.
+func (histogram *Histogram) MarshalJSON() ([]byte, error) {
+	type bucket struct {
+		LE    int64  `json:"le"`
+		Count uint64 `json:"count"`
+	}
+
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	buckets := make([]bucket, 0)
+	for i, count := range histogram.counts {
+		if count <= 0 {
+			continue
+		}
+		buckets = append(buckets, bucket{LE: int64(histogramUpper(i)), Count: count})
+	}
+
+	return json.Marshal(&struct {
+		Count   uint64   `json:"count"`
+		Min     int64    `json:"min"`
+		Max     int64    `json:"max"`
+		Mean    int64    `json:"mean"`
+		P50     int64    `json:"p50"`
+		P90     int64    `json:"p90"`
+		P99     int64    `json:"p99"`
+		P999    int64    `json:"p999"`
+		Buckets []bucket `json:"buckets"`
+	}{
+		Count:   histogram.count,
+		Min:     histogram.min.Microseconds(),
+		Max:     histogram.max.Microseconds(),
+		Mean:    histogram.mean().Microseconds(),
+		P50:     histogram.percentile(50).Microseconds(),
+		P90:     histogram.percentile(90).Microseconds(),
+		P99:     histogram.percentile(99).Microseconds(),
+		P999:    histogram.percentile(99.9).Microseconds(),
+		Buckets: buckets,
+	})
+}
+
+func (histogram *Histogram) String() string {
+	histogram.lock.RLock()
+	defer histogram.lock.RUnlock()
+
+	return fmt.Sprintf("count %d, min %s, mean %s, p50 %s, p90 %s, p99 %s, p99.9 %s, max %s", histogram.count,
+		histogram.min, histogram.mean(), histogram.percentile(50), histogram.percentile(90), histogram.percentile(99),
+		histogram.percentile(99.9), histogram.max)
+}
@@ -0,0 +1,85 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LatencyMonitor describes statistics of latency of the tunnel.
+type LatencyMonitor struct {
+	rtt    *Histogram
+	jitter *Histogram
+	skew   *Histogram
+}
+
+// NewLatencyMonitor returns a new latency monitor.
+func NewLatencyMonitor() *LatencyMonitor {
+	return &LatencyMonitor{
+		rtt:    NewHistogram(),
+		jitter: NewHistogram(),
+		skew:   NewHistogram(),
+	}
+}
+
+// AddRTT records an RTT.
+func (monitor *LatencyMonitor) AddRTT(d time.Duration) {
+	monitor.rtt.Add(d)
+}
+
+// AddJitter records a jitter, which is the difference between consecutive RTTs to the same peer.
+func (monitor *LatencyMonitor) AddJitter(d time.Duration) {
+	if d < 0 {
+		d = -d
+	}
+
+	monitor.jitter.Add(d)
+}
+
+// AddSkew records a skew of the clock of a peer from the local clock measured in band.
+func (monitor *LatencyMonitor) AddSkew(d time.Duration) {
+	if d < 0 {
+		d = -d
+	}
+
+	monitor.skew.Add(d)
+}
+
+// RTT returns the histogram of RTTs.
+func (monitor *LatencyMonitor) RTT() *Histogram {
+	return monitor.rtt
+}
+
+// Jitter returns the histogram of jitters.
+func (monitor *LatencyMonitor) Jitter() *Histogram {
+	return monitor.jitter
+}
+
+// Skew returns the histogram of skews of clocks.
+func (monitor *LatencyMonitor) Skew() *Histogram {
+	return monitor.skew
+}
+
+func (monitor *LatencyMonitor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		RTT    *Histogram `json:"rtt"`
+		Jitter *Histogram `json:"jitter"`
+		Skew   *Histogram `json:"skew"`
+	}{
+		RTT:    monitor.rtt,
+		Jitter: monitor.jitter,
+		Skew:   monitor.skew,
+	})
+}
+
+func (monitor *LatencyMonitor) String() string {
+	sb := strings.Builder{}
+
+	sb.WriteString("Latency statistics:\n")
+	sb.WriteString(fmt.Sprintf("RTT: %s\n", monitor.rtt))
+	sb.WriteString(fmt.Sprintf("Jitter: %s\n", monitor.jitter))
+	sb.WriteString(fmt.Sprintf("Skew: %s\n", monitor.skew))
+
+	return sb.String()
+}
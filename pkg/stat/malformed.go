@@ -0,0 +1,201 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MalformedEvent describes an event of a malformed packet.
+type MalformedEvent int
+
+const (
+	// MalformedEventParse describes a packet cannot be parsed.
+	MalformedEventParse MalformedEvent = iota
+	// MalformedEventChecksum describes a packet has a bad checksum.
+	MalformedEventChecksum
+	// MalformedEventDecrypt describes a packet cannot be decrypted.
+	MalformedEventDecrypt
+	// MalformedEventQuarantined describes a source is quarantined because of malformed packets.
+	MalformedEventQuarantined
+	// MalformedEventPanic describes a packet panics in parsing.
+	MalformedEventPanic
+	// MalformedEventCorrupted describes a packet in the tunnel has a bad checksum.
+	MalformedEventCorrupted
+)
+
+// malformedMaxPanicSources is the max count of sources whose packets panicking in parsing are counted separately.
+const malformedMaxPanicSources = 1024
+
+func (event MalformedEvent) String() string {
+	switch event {
+	case MalformedEventParse:
+		return "parse"
+	case MalformedEventChecksum:
+		return "checksum"
+	case MalformedEventDecrypt:
+		return "decrypt"
+	case MalformedEventQuarantined:
+		return "quarantined"
+	case MalformedEventPanic:
+		return "panic"
+	case MalformedEventCorrupted:
+		return "corrupted"
+	default:
+		return fmt.Sprintf("%d", event)
+	}
+}
+
+// MalformedMonitor describes statistics of malformed packets.
+type MalformedMonitor struct {
+	lock         sync.RWMutex
+	parse        uint64
+	checksum     uint64
+	decrypt      uint64
+	quarantined  uint64
+	panic        uint64
+	panicSources map[string]uint64
+	corrupted    uint64
+}
+
+// NewMalformedMonitor returns a new malformed monitor.
+func NewMalformedMonitor() *MalformedMonitor {
+	return &MalformedMonitor{panicSources: make(map[string]uint64)}
+}
+
+// Add adds an event of a malformed packet.
+func (monitor *MalformedMonitor) Add(event MalformedEvent) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	switch event {
+	case MalformedEventParse:
+		monitor.parse++
+	case MalformedEventChecksum:
+		monitor.checksum++
+	case MalformedEventDecrypt:
+		monitor.decrypt++
+	case MalformedEventQuarantined:
+		monitor.quarantined++
+	case MalformedEventPanic:
+		monitor.panic++
+	case MalformedEventCorrupted:
+		monitor.corrupted++
+	default:
+		panic(fmt.Errorf("malformed event %d out of range", event))
+	}
+}
+
+// Parse returns the count of packets which cannot be parsed.
+func (monitor *MalformedMonitor) Parse() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.parse
+}
+
+// Checksum returns the count of packets with bad checksums.
+func (monitor *MalformedMonitor) Checksum() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.checksum
+}
+
+// Decrypt returns the count of packets which cannot be decrypted.
+func (monitor *MalformedMonitor) Decrypt() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.decrypt
+}
+
+// Quarantined returns the count of sources quarantined.
+func (monitor *MalformedMonitor) Quarantined() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.quarantined
+}
+
+// AddPanicSource adds a packet panicking in parsing to its source. Sources over 1024 are not counted separately.
+func (monitor *MalformedMonitor) AddPanicSource(source string) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	_, ok := monitor.panicSources[source]
+	if !ok && len(monitor.panicSources) >= malformedMaxPanicSources {
+		return
+	}
+	monitor.panicSources[source]++
+}
+
+// Panic returns the count of packets which panic in parsing.
+func (monitor *MalformedMonitor) Panic() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.panic
+}
+
+// PanicSources returns counts of packets which panic in parsing of each source.
+func (monitor *MalformedMonitor) PanicSources() map[string]uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	sources := make(map[string]uint64, len(monitor.panicSources))
+	for source, count := range monitor.panicSources {
+		sources[source] = count
+	}
+
+	return sources
+}
+
+// Corrupted returns the count of packets in the tunnel with bad checksums.
+func (monitor *MalformedMonitor) Corrupted() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.corrupted
+}
+
+func (monitor *MalformedMonitor) MarshalJSON() ([]byte, error) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return json.Marshal(&struct {
+		Parse        uint64            `json:"parse"`
+		Checksum     uint64            `json:"checksum"`
+		Decrypt      uint64            `json:"decrypt"`
+		Quarantined  uint64            `json:"quarantined"`
+		Panic        uint64            `json:"panic"`
+		PanicSources map[string]uint64 `json:"panic-sources"`
+		Corrupted    uint64            `json:"corrupted"`
+	}{
+		Parse:        monitor.parse,
+		Checksum:     monitor.checksum,
+		Decrypt:      monitor.decrypt,
+		Quarantined:  monitor.quarantined,
+		Panic:        monitor.panic,
+		PanicSources: monitor.panicSources,
+		Corrupted:    monitor.corrupted,
+	})
+}
+
+func (monitor *MalformedMonitor) String() string {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	sb := strings.Builder{}
+
+	sb.WriteString("Malformed statistics:\n")
+	sb.WriteString(fmt.Sprintf("Parse: %d\n", monitor.parse))
+	sb.WriteString(fmt.Sprintf("Checksum: %d\n", monitor.checksum))
+	sb.WriteString(fmt.Sprintf("Decrypt: %d\n", monitor.decrypt))
+	sb.WriteString(fmt.Sprintf("Quarantined: %d\n", monitor.quarantined))
+	sb.WriteString(fmt.Sprintf("Panic: %d\n", monitor.panic))
+	sb.WriteString(fmt.Sprintf("Corrupted: %d\n", monitor.corrupted))
+
+	return sb.String()
+}
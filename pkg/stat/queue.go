@@ -0,0 +1,169 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// QueueEvent describes an event of a packet in queues of a peer.
+type QueueEvent int
+
+const (
+	// QueueSendFull describes a packet to the peer finds its send queue full and waits for it.
+	QueueSendFull QueueEvent = iota
+	// QueueReceiveFull describes a packet from the peer finds the receive queue full and waits for it.
+	QueueReceiveFull
+	// QueueRateLimited describes a packet of the peer is dropped by the rate of its user.
+	QueueRateLimited
+	// QueueQuotaLimited describes a packet of the peer is dropped by its quota.
+	QueueQuotaLimited
+)
+
+func (event QueueEvent) String() string {
+	switch event {
+	case QueueSendFull:
+		return "send-full"
+	case QueueReceiveFull:
+		return "receive-full"
+	case QueueRateLimited:
+		return "rate-limited"
+	case QueueQuotaLimited:
+		return "quota-limited"
+	default:
+		return fmt.Sprintf("%d", event)
+	}
+}
+
+// Queue describes queues of packets between the local and a peer. Send and Receive are counts of packets queued when
+// the statistics are read. Queues are never dropped but hold back reads and writes once they are full, so packets
+// finding queues full are dropped by the capture handle rather than the relay once its buffer overflows in turn.
+type Queue struct {
+	Send         int    `json:"send"`
+	Receive      int    `json:"receive"`
+	SendFull     uint64 `json:"send-full"`
+	ReceiveFull  uint64 `json:"receive-full"`
+	RateLimited  uint64 `json:"rate-limited"`
+	QuotaLimited uint64 `json:"quota-limited"`
+}
+
+// QueueMonitor describes statistics of queues of packets to and from each peer.
+type QueueMonitor struct {
+	lock  sync.RWMutex
+	peers map[string]*Queue
+}
+
+// NewQueueMonitor returns a new queue monitor.
+func NewQueueMonitor() *QueueMonitor {
+	return &QueueMonitor{peers: make(map[string]*Queue)}
+}
+
+func (monitor *QueueMonitor) queue(peer string) *Queue {
+	queue, ok := monitor.peers[peer]
+	if !ok {
+		queue = &Queue{}
+		monitor.peers[peer] = queue
+	}
+
+	return queue
+}
+
+// Add adds an event of a packet of the peer.
+func (monitor *QueueMonitor) Add(peer string, event QueueEvent) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	queue := monitor.queue(peer)
+	switch event {
+	case QueueSendFull:
+		queue.SendFull++
+	case QueueReceiveFull:
+		queue.ReceiveFull++
+	case QueueRateLimited:
+		queue.RateLimited++
+	case QueueQuotaLimited:
+		queue.QuotaLimited++
+	default:
+		panic(fmt.Errorf("queue event %d out of range", event))
+	}
+}
+
+// Enqueue records a packet from the peer is queued in the receive queue.
+func (monitor *QueueMonitor) Enqueue(peer string) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	monitor.queue(peer).Receive++
+}
+
+// Dequeue records a packet from the peer is taken from the receive queue. Peers removed are not recorded again.
+func (monitor *QueueMonitor) Dequeue(peer string) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	queue, ok := monitor.peers[peer]
+	if !ok || queue.Receive <= 0 {
+		return
+	}
+	queue.Receive--
+}
+
+// SetSend sets the count of packets queued in the send queue of the peer.
+func (monitor *QueueMonitor) SetSend(peer string, n int) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	monitor.queue(peer).Send = n
+}
+
+// Remove removes statistics of the peer, which is disconnected.
+func (monitor *QueueMonitor) Remove(peer string) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	delete(monitor.peers, peer)
+}
+
+// Queue returns statistics of queues of the peer, and false if it is unknown.
+func (monitor *QueueMonitor) Queue(peer string) (Queue, bool) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	queue, ok := monitor.peers[peer]
+	if !ok {
+		return Queue{}, false
+	}
+
+	return *queue, true
+}
+
+func (monitor *QueueMonitor) MarshalJSON() ([]byte, error) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return json.Marshal(monitor.peers)
+}
+
+func (monitor *QueueMonitor) String() string {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	peers := make([]string, 0, len(monitor.peers))
+	for peer := range monitor.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	sb := strings.Builder{}
+
+	sb.WriteString("Queue statistics:\n")
+	for _, peer := range peers {
+		queue := monitor.peers[peer]
+		sb.WriteString(fmt.Sprintf("%s: %d sending, %d receiving, %d send full, %d receive full, %d rate limited, %d quota limited\n",
+			peer, queue.Send, queue.Receive, queue.SendFull, queue.ReceiveFull, queue.RateLimited, queue.QuotaLimited))
+	}
+
+	return sb.String()
+}
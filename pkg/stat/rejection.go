@@ -0,0 +1,118 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RejectionReason describes the reason a packet is rejected.
+type RejectionReason int
+
+const (
+	// RejectionReplayed describes a packet is rejected by the anti-replay window.
+	RejectionReplayed RejectionReason = iota
+	// RejectionForged describes a packet is rejected because it cannot be authenticated.
+	RejectionForged
+)
+
+func (reason RejectionReason) String() string {
+	switch reason {
+	case RejectionReplayed:
+		return "replayed"
+	case RejectionForged:
+		return "forged"
+	default:
+		return fmt.Sprintf("%d", reason)
+	}
+}
+
+// RejectionMonitor describes statistics of packets rejected in authentication.
+type RejectionMonitor struct {
+	lock     sync.RWMutex
+	replayed uint64
+	forged   uint64
+	alerts   uint64
+}
+
+// NewRejectionMonitor returns a new rejection monitor.
+func NewRejectionMonitor() *RejectionMonitor {
+	return &RejectionMonitor{}
+}
+
+// Add adds a rejected packet.
+func (monitor *RejectionMonitor) Add(reason RejectionReason) {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	switch reason {
+	case RejectionReplayed:
+		monitor.replayed++
+	case RejectionForged:
+		monitor.forged++
+	default:
+		panic(fmt.Errorf("rejection reason %d out of range", reason))
+	}
+}
+
+// AddAlert adds an alert raised by rejected packets.
+func (monitor *RejectionMonitor) AddAlert() {
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	monitor.alerts++
+}
+
+// Replayed returns the count of packets rejected by the anti-replay window.
+func (monitor *RejectionMonitor) Replayed() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.replayed
+}
+
+// Forged returns the count of packets rejected because they cannot be authenticated.
+func (monitor *RejectionMonitor) Forged() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.forged
+}
+
+// Alerts returns the count of alerts raised.
+func (monitor *RejectionMonitor) Alerts() uint64 {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return monitor.alerts
+}
+
+func (monitor *RejectionMonitor) MarshalJSON() ([]byte, error) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	return json.Marshal(&struct {
+		Replayed uint64 `json:"replayed"`
+		Forged   uint64 `json:"forged"`
+		Alerts   uint64 `json:"alerts"`
+	}{
+		Replayed: monitor.replayed,
+		Forged:   monitor.forged,
+		Alerts:   monitor.alerts,
+	})
+}
+
+func (monitor *RejectionMonitor) String() string {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	sb := strings.Builder{}
+
+	sb.WriteString("Rejection statistics:\n")
+	sb.WriteString(fmt.Sprintf("Replayed: %d\n", monitor.replayed))
+	sb.WriteString(fmt.Sprintf("Forged: %d\n", monitor.forged))
+	sb.WriteString(fmt.Sprintf("Alerts: %d\n", monitor.alerts))
+
+	return sb.String()
+}
@@ -0,0 +1,70 @@
+package transform
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	compressRaw byte = iota
+	compressFlate
+)
+
+// CompressTransform is a transform compresses data in DEFLATE. Data which cannot be compressed smaller is kept as is,
+// so the size added is always a byte of header.
+type CompressTransform struct{}
+
+func (t *CompressTransform) Forward(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	buffer.WriteByte(compressFlate)
+
+	w, err := flate.NewWriter(&buffer, flate.BestSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("new writer: %w", err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+
+	if buffer.Len() > len(data) {
+		return append([]byte{compressRaw}, data...), nil
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (t *CompressTransform) Backward(data []byte) ([]byte, error) {
+	if len(data) <= 0 {
+		return nil, errors.New("missing header")
+	}
+
+	switch data[0] {
+	case compressRaw:
+		return data[1:], nil
+	case compressFlate:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+
+		result, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		return result, nil
+	default:
+		return nil, fmt.Errorf("compression %d not support", data[0])
+	}
+}
+
+func (t *CompressTransform) Cost() int {
+	return 1
+}
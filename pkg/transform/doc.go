@@ -0,0 +1,5 @@
+// Package transform implements pipelines of transforms applied to data transmitted in the tunnel of IkaGo.
+//
+// Transform and Pipeline are stable, and data transformed by a transform can always be transformed back by the same
+// transform in later versions.
+package transform
@@ -0,0 +1,55 @@
+package transform
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxPadding is the max size of padding.
+const maxPadding = 32
+
+// PadTransform is a transform pads data with random bytes of random size, followed by a byte of the size of padding.
+type PadTransform struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewPadTransform returns a new pad transform.
+func NewPadTransform() *PadTransform {
+	return &PadTransform{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (t *PadTransform) Forward(data []byte) ([]byte, error) {
+	t.lock.Lock()
+	size := t.rand.Intn(maxPadding + 1)
+	padding := make([]byte, size+1)
+	t.rand.Read(padding[:size])
+	t.lock.Unlock()
+
+	padding[size] = byte(size)
+
+	result := make([]byte, 0, len(data)+len(padding))
+	result = append(result, data...)
+	result = append(result, padding...)
+
+	return result, nil
+}
+
+func (t *PadTransform) Backward(data []byte) ([]byte, error) {
+	if len(data) <= 0 {
+		return nil, errors.New("missing padding")
+	}
+
+	size := int(data[len(data)-1])
+	if size+1 > len(data) {
+		return nil, errors.New("malformed padding")
+	}
+
+	return data[:len(data)-size-1], nil
+}
+
+func (t *PadTransform) Cost() int {
+	return maxPadding + 1
+}
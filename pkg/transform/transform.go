@@ -0,0 +1,189 @@
+package transform
+
+import (
+	"fmt"
+	"ikago/pkg/crypto"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transform is a stage in a pipeline transforms data sent and received.
+type Transform interface {
+	// Forward returns the data transformed for sending.
+	Forward([]byte) ([]byte, error)
+	// Backward returns the data received transformed back.
+	Backward([]byte) ([]byte, error)
+	// Cost returns the max size added in transforming.
+	Cost() int
+}
+
+// Factory returns a transform by given crypt of the pipeline.
+type Factory func(crypt crypto.Crypt) (Transform, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{
+		"encrypt": func(crypt crypto.Crypt) (Transform, error) {
+			return &EncryptTransform{crypt: crypt}, nil
+		},
+		"compress": func(crypt crypto.Crypt) (Transform, error) {
+			return &CompressTransform{}, nil
+		},
+		"pad": func(crypt crypto.Crypt) (Transform, error) {
+			return NewPadTransform(), nil
+		},
+	}
+)
+
+// Register registers a factory of transform by its name, an existing one will be replaced. Names are case insensitive.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	factories[strings.ToLower(name)] = factory
+}
+
+// Transforms returns the names of transforms registered in order.
+func Transforms() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func findFactory(name string) (Factory, error) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	factory, ok := factories[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("transform %s not support", name)
+	}
+
+	return factory, nil
+}
+
+// Pipeline is a crypt transforms data by transforms in order when encrypting, and in reverse order when decrypting.
+type Pipeline struct {
+	crypt      crypto.Crypt
+	names      []string
+	transforms []Transform
+}
+
+// NewPipeline returns a new pipeline of transforms by given names in order. The pipeline must encrypt exactly once by
+// the crypt.
+func NewPipeline(crypt crypto.Crypt, names []string) (*Pipeline, error) {
+	pipeline := &Pipeline{
+		crypt:      crypt,
+		names:      make([]string, 0, len(names)),
+		transforms: make([]Transform, 0, len(names)),
+	}
+
+	encrypts := 0
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == "encrypt" {
+			encrypts++
+		}
+
+		factory, err := findFactory(name)
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := factory(crypt)
+		if err != nil {
+			return nil, fmt.Errorf("create transform %s: %w", name, err)
+		}
+
+		pipeline.names = append(pipeline.names, name)
+		pipeline.transforms = append(pipeline.transforms, t)
+	}
+	if encrypts != 1 {
+		return nil, fmt.Errorf("encrypt %d times", encrypts)
+	}
+
+	return pipeline, nil
+}
+
+func (p *Pipeline) Encrypt(data []byte) ([]byte, error) {
+	var err error
+
+	for i, t := range p.transforms {
+		data, err = t.Forward(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.names[i], err)
+		}
+	}
+
+	return data, nil
+}
+
+func (p *Pipeline) Decrypt(data []byte) ([]byte, error) {
+	var err error
+
+	for i := len(p.transforms) - 1; i >= 0; i-- {
+		data, err = p.transforms[i].Backward(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.names[i], err)
+		}
+	}
+
+	return data, nil
+}
+
+func (p *Pipeline) Method() crypto.Method {
+	return p.crypt.Method()
+}
+
+func (p *Pipeline) Cost() int {
+	cost := 0
+	for _, t := range p.transforms {
+		cost = cost + t.Cost()
+	}
+
+	return cost
+}
+
+// Rekey returns a new pipeline of the same transforms whose crypt is rekeyed by the salt.
+func (p *Pipeline) Rekey(salt []byte) (crypto.Crypt, error) {
+	crypt, err := crypto.Rekey(p.crypt, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPipeline(crypt, p.names)
+}
+
+// Name returns the name of the method of the crypt of the pipeline.
+func (p *Pipeline) Name() string {
+	return crypto.Name(p.crypt)
+}
+
+func (p *Pipeline) String() string {
+	return strings.Join(p.names, " -> ")
+}
+
+// EncryptTransform is a transform encrypts data by a crypt.
+type EncryptTransform struct {
+	crypt crypto.Crypt
+}
+
+func (t *EncryptTransform) Forward(data []byte) ([]byte, error) {
+	return t.crypt.Encrypt(data)
+}
+
+func (t *EncryptTransform) Backward(data []byte) ([]byte, error) {
+	return t.crypt.Decrypt(data)
+}
+
+func (t *EncryptTransform) Cost() int {
+	return t.crypt.Cost()
+}